@@ -1,11 +1,19 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
 )
 
 // WorkerPool: everything required to orchestrate running the command against remote hosts
@@ -15,91 +23,870 @@ type WorkerPool struct {
 	cmd        string
 	sshConfig  ssh.ClientConfig
 	wg         sync.WaitGroup
-	do         func()
+	jump       *jumpChain
+	chainsMu   sync.Mutex
+	chains     map[string]*jumpChain
+	timeout    time.Duration
+	// stopSignal is sent to a command on timeout or cancellation, stopGrace before closing its session, see
+	// WithStopSignal
+	stopSignal ssh.Signal
+	stopGrace  time.Duration
+	log        Logger
+	metrics    *Metrics
+	env        map[string]string
+	stdin      []byte
+	tap        OutputTap
+	sink       OutputSink
+	action     Action
+	exec       Executor
+	limiter    *rate.Limiter
+	shutdown   sync.Once
+	conns      *ConnectionCache
+	// sharedConns is set if conns belongs to whoever passed it with WithConnectionCache
+	sharedConns bool
+	// bufferLimit caps the output kept in each Result, see WithBufferLimit
+	bufferLimit int
+	// keepaliveInterval and keepaliveCount are set by WithKeepalive
+	keepaliveInterval time.Duration
+	keepaliveCount    int
+	// maxWorkers is the most workers the pool grows to, see WithMaxWorkers
+	maxWorkers int
+	idleAfter  time.Duration
+	scaleMu    sync.Mutex
+	workers    int
+	latency    latencyTracker
+	// idleTimeout stops a command that printed nothing for this long, see WithIdleTimeout
+	idleTimeout time.Duration
+	// maxOutput and abortOutput are set by WithMaxOutput
+	maxOutput   int64
+	abortOutput bool
+	expect      Expectation
+	okExitCodes []int
+	cleanOutput bool
+	lock        RemoteLock
+	breaker     *CircuitBreaker
+	dialJitter  time.Duration
+}
+
+// Logger: receives debug messages about scheduling and SSH handshakes as a message followed by key/value fields,
+// utils.SyncLogger satisfies it
+type Logger interface {
+	Debug(msg string, args ...interface{})
+}
+
+// nopLogger: the default Logger, discards everything
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+
+// ErrTimeout: returned in Result.Err when a job runs longer than the pool's timeout
+var ErrTimeout = errors.New("timed out")
+
+// ErrCancelled: returned by RunJob when its context is done before the job finishes.
+// The error also wraps the context's error, so errors.Is(err, context.DeadlineExceeded) works as expected.
+var ErrCancelled = errors.New("job cancelled")
+
+// cancelledError: an ErrCancelled carrying the context error that caused it
+type cancelledError struct {
+	cause error
+}
+
+func (e *cancelledError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrCancelled, e.cause)
+}
+
+func (e *cancelledError) Is(target error) bool {
+	return target == ErrCancelled
+}
+
+func (e *cancelledError) Unwrap() error {
+	return e.cause
+}
+
+// Option: configure optional WorkerPool behaviour at creation time
+type Option func(*WorkerPool)
+
+// WithTimeout: limit how long each job may take, measured from when a worker picks it up. The SSH session is closed
+// when the limit is reached, see WithStopSignal to let the command exit first. Zero or less means no limit.
+func WithTimeout(timeout time.Duration) Option {
+	return func(wp *WorkerPool) {
+		wp.timeout = timeout
+	}
+}
+
+// WithStopSignal: on timeout or cancellation, send sig to the remote command and give it grace to exit before closing
+// its SSH session, so it can clean up instead of being left running on the host once the session is gone. Output
+// written while it exits is kept. Servers that do not support signals, like OpenSSH before 7.9, ignore them and the
+// session is closed after grace. Zero grace closes the session straight away, the default.
+func WithStopSignal(sig ssh.Signal, grace time.Duration) Option {
+	return func(wp *WorkerPool) {
+		wp.stopSignal = sig
+		wp.stopGrace = grace
+	}
+}
+
+// signals: the signals a remote command can be sent, as named in RFC 4254
+var signals = []ssh.Signal{
+	ssh.SIGABRT, ssh.SIGALRM, ssh.SIGFPE, ssh.SIGHUP, ssh.SIGILL, ssh.SIGINT, ssh.SIGKILL,
+	ssh.SIGPIPE, ssh.SIGQUIT, ssh.SIGSEGV, ssh.SIGTERM, ssh.SIGUSR1, ssh.SIGUSR2,
+}
+
+// ParseSignal: the signal called name, with or without the SIG prefix and in any case, e.g. TERM or sigint.
+func ParseSignal(name string) (ssh.Signal, error) {
+	short := strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	for _, sig := range signals {
+		if string(sig) == short {
+			return sig, nil
+		}
+	}
+	return "", fmt.Errorf("unknown signal %q", name)
+}
+
+// WithLogger: send debug messages about worker scheduling and SSH handshakes to logger.
+func WithLogger(logger Logger) Option {
+	return func(wp *WorkerPool) {
+		wp.log = logger
+	}
+}
+
+// WithEnv: set these environment variables in every session before running the command.
+// Servers only accept variables they allow, e.g. with OpenSSH's AcceptEnv, and fail the job otherwise.
+func WithEnv(env map[string]string) Option {
+	return func(wp *WorkerPool) {
+		wp.env = env
+	}
+}
+
+// WithConnectRate: open at most perSecond new connections a second across all workers, allowing bursts of up to
+// burst connections, so bastions and authentication backends are not overwhelmed. Time spent waiting does not count
+// towards the pool's timeout.
+func WithConnectRate(perSecond float64, burst int) Option {
+	return func(wp *WorkerPool) {
+		wp.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+	}
+}
+
+// WithDialJitter: wait a random time of up to max before each new connection, after WithConnectRate, so workers
+// starting together do not all hit bastions and authentication backends at the same moment. Time spent waiting does
+// not count towards the pool's timeout. Zero or less means no wait.
+func WithDialJitter(max time.Duration) Option {
+	return func(wp *WorkerPool) {
+		wp.dialJitter = max
+	}
+}
+
+// WithStdin: feed input to the standard input of every command, each session reads its own copy.
+func WithStdin(input []byte) Option {
+	return func(wp *WorkerPool) {
+		wp.stdin = input
+	}
+}
+
+// OutputTap: receives a command's output as it arrives, along with the host it came from and whether it was written
+// to stderr. It is called from the goroutines reading the session and must not keep data after returning.
+type OutputTap func(host string, stderr bool, data []byte)
+
+// WithOutputTap: pass each command's output to tap as it arrives, on top of collecting it in the Result, e.g. to
+// watch long running commands.
+func WithOutputTap(tap OutputTap) Option {
+	return func(wp *WorkerPool) {
+		wp.tap = tap
+	}
+}
+
+// tapWriter: hands everything written to it to an OutputTap
+type tapWriter struct {
+	tap    OutputTap
+	host   string
+	stderr bool
+}
+
+func (tw tapWriter) Write(p []byte) (int, error) {
+	tw.tap(tw.host, tw.stderr, p)
+	return len(p), nil
+}
+
+// Action: work done with a connected client instead of running the pool's command, e.g. a file transfer. Anything
+// written to out is reported in Result.Output. The connection is closed to stop the action on timeout or cancellation.
+type Action func(ctx context.Context, client *ssh.Client, target Target, out io.Writer) error
+
+// WithAction: run action on every host instead of the pool's command, which then only describes the run.
+func WithAction(action Action) Option {
+	return func(wp *WorkerPool) {
+		wp.action = action
+	}
+}
+
+// Hop: a jump host and the config used to authenticate against it
+type Hop struct {
+	Addr   string
+	Config ssh.ClientConfig
+}
+
+// WithJumpHost: tunnel every connection through the SSH server at addr, like OpenSSH's ProxyJump.
+// A single connection to the jump host is shared by all workers and re-established if it fails.
+func WithJumpHost(addr string, config ssh.ClientConfig) Option {
+	return WithJumpChain([]Hop{{Addr: addr, Config: config}})
+}
+
+// WithJumpChain: tunnel every connection through each hop in order, like a comma separated OpenSSH ProxyJump.
+// Each hop is reached through a tunnel opened on the previous one. An empty chain connects directly.
+func WithJumpChain(hops []Hop) Option {
+	return func(wp *WorkerPool) {
+		if len(hops) == 0 {
+			wp.jump = nil
+			return
+		}
+		wp.jump = &jumpChain{hops: hops}
+	}
 }
 
 // Result: the results of running a command against a specific host.
 // The struct and its fields are exported to enable live-streaming results to the caller.
 type Result struct {
-	Host   string
+	Host string
+	// Output is stdout and stderr interleaved in the order they were received
 	Output []byte
-	Err    error
+	Stdout []byte
+	Stderr []byte
+	// ExitCode is the remote command's exit status, or -1 if the command did not report one
+	ExitCode int
+	// Duration is how long the job took once a worker picked it up
+	Duration time.Duration
+	// Truncated is set when output beyond the pool's buffer or output limit was left out of Output, Stdout, or Stderr
+	Truncated bool
+	Err       error
+}
+
+// Error classes returned by Classify
+const (
+	ClassOK           = "ok"
+	ClassConnect      = "connect"
+	ClassAuth         = "auth"
+	ClassHostKey      = "hostkey"
+	ClassSession      = "session"
+	ClassExitStatus   = "exit-status"
+	ClassNoExitStatus = "no-exit-status"
+	ClassTimeout      = "timeout"
+	ClassCancelled    = "cancelled"
+	ClassChecksum     = "checksum"
+	ClassSkipped      = "skipped"
+	ClassOutputLimit  = "output-limit"
+	ClassUnexpected   = "unexpected-output"
+	ClassLocked       = "locked"
+	ClassQuarantined  = "quarantined"
+	ClassUnknown      = "unknown"
+)
+
+// ErrDial: wrapped by the error in Result.Err when the host could not be connected to
+var ErrDial = errors.New("could not dial")
+
+// ErrSession: wrapped by the error in Result.Err when a session could not be opened on the connection
+var ErrSession = errors.New("unable to create session")
+
+// ErrChecksum: wrapped by the error in Result.Err when a transferred file does not match its source
+var ErrChecksum = errors.New("checksum mismatch")
+
+// ErrSkipped: for callers to report hosts they chose not to run against, e.g. after earlier hosts failed
+var ErrSkipped = errors.New("skipped")
+
+// Classify: sort a Result.Err into one of the Class* constants so callers can tell connection, authentication, and
+// command failures apart.
+func Classify(err error) string {
+	var exitErr exitStatuser
+	var exitMissing *ssh.ExitMissingError
+	switch {
+	case err == nil:
+		return ClassOK
+	case errors.Is(err, ErrCancelled), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ClassCancelled
+	case errors.Is(err, ErrTimeout), errors.Is(err, ErrKeepalive), errors.Is(err, ErrIdle):
+		return ClassTimeout
+	case errors.As(err, &exitErr):
+		return ClassExitStatus
+	case errors.As(err, &exitMissing):
+		return ClassNoExitStatus
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return ClassAuth
+	case strings.Contains(err.Error(), "knownhosts:"), strings.Contains(err.Error(), "host key"):
+		return ClassHostKey
+	case errors.Is(err, ErrDial):
+		return ClassConnect
+	case errors.Is(err, ErrSession):
+		return ClassSession
+	case errors.Is(err, ErrChecksum):
+		return ClassChecksum
+	case errors.Is(err, ErrSkipped):
+		return ClassSkipped
+	case errors.Is(err, ErrOutputLimit):
+		return ClassOutputLimit
+	case errors.Is(err, ErrUnexpectedOutput):
+		return ClassUnexpected
+	case errors.Is(err, ErrLocked):
+		return ClassLocked
+	case errors.Is(err, ErrQuarantined):
+		return ClassQuarantined
+	default:
+		return ClassUnknown
+	}
+}
+
+// exitStatuser: an error carrying the exit status of a command that ran, e.g. *ssh.ExitError or *ExitError
+type exitStatuser interface {
+	error
+	ExitStatus() int
+}
+
+// exitCode: the remote exit status carried by err, 0 for success and -1 if there is none.
+func exitCode(err error) int {
+	var exitErr exitStatuser
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.ExitStatus()
+	default:
+		return -1
+	}
+}
+
+// Target: a host to run the command against and any per-host connection settings.
+// Fields left unset fall back to the pool's settings.
+type Target struct {
+	// Host identifies the target and is reported in Result.Host
+	Host string
+	// Addr is the host:port dialled, defaults to Host
+	Addr string
+	// Config overrides the pool's ssh.ClientConfig for this target
+	Config *ssh.ClientConfig
+	// Jump overrides the pool's jump chain for this target, an empty non-nil chain connects directly
+	Jump []Hop
+	// Env adds to the pool's environment variables for this target, winning over variables of the same name
+	Env map[string]string
+	// Executor overrides the pool's Executor for this target, e.g. to run some targets locally
+	Executor Executor
+	// Timeout overrides the pool's timeout for this target if positive, see WithTimeout. Set Config.Timeout to
+	// override how long dialling may take.
+	Timeout time.Duration
 }
 
 type JobResult struct {
-	host   string
+	ctx    context.Context
+	target Target
 	result *Result
 	done   chan struct{}
 }
 
 // CreatePool: create the worker pool
-func CreatePool(poolSize int, cmd string, config ssh.ClientConfig) *WorkerPool {
+func CreatePool(poolSize int, cmd string, config ssh.ClientConfig, opts ...Option) *WorkerPool {
 	res := &WorkerPool{
 		numWorkers: poolSize,
 		jobs:       make(chan JobResult),
 		cmd:        cmd,
 		sshConfig:  config,
+		log:        nopLogger{},
+		idleAfter:  defaultIdleAfter,
+	}
+	res.exec = sshExecutor{res}
+	for _, opt := range opts {
+		opt(res)
 	}
-	res.do = res.worker
 	return res
 }
 
 // ScheduleWorkers: add workers to the worker pool
 func (wp *WorkerPool) ScheduleWorkers() {
+	wp.log.Debug(fmt.Sprintf("scheduling %d workers", wp.numWorkers), "workers", wp.numWorkers)
+	wp.scaleMu.Lock()
+	defer wp.scaleMu.Unlock()
 	for i := 0; i < wp.numWorkers; i++ {
-		wp.wg.Add(1)
-		go wp.do()
+		wp.startWorkerLocked()
+	}
+}
+
+// Shutdown: stop the workers once the jobs already handed to them finish, then close any connections the pool keeps
+// open. RunJob and RunTarget must not be called during or after Shutdown.
+func (wp *WorkerPool) Shutdown() error {
+	wp.shutdown.Do(func() {
+		close(wp.jobs)
+	})
+	wp.wg.Wait()
+	return errors.Join(wp.Close(), wp.closeExecutor())
+}
+
+// jumpChain: the bastions that connections are tunnelled through, in order
+type jumpChain struct {
+	hops    []Hop
+	mu      sync.Mutex
+	clients []*ssh.Client
+}
+
+// connect: establish the nested tunnels through each hop, returning the client for the last hop.
+// Must be called with j.mu held.
+func (j *jumpChain) connect(ctx context.Context) (*ssh.Client, error) {
+	var client *ssh.Client
+	for i, hop := range j.hops {
+		next, err := dialVia(ctx, client, hop.Addr, hop.Config)
+		if err != nil {
+			j.closeLocked()
+			return nil, fmt.Errorf("could not dial jump host %d (%s): %v", i+1, hop.Addr, err)
+		}
+		j.clients = append(j.clients, next)
+		client = next
+	}
+	return client, nil
+}
+
+// closeLocked: tear down every hop, innermost first. Must be called with j.mu held.
+func (j *jumpChain) closeLocked() {
+	for i := len(j.clients) - 1; i >= 0; i-- {
+		_ = j.clients[i].Close()
+	}
+	j.clients = nil
+}
+
+// dial: open a connection to addr through the last hop, connecting the chain first if needed.
+func (j *jumpChain) dial(ctx context.Context, addr string) (net.Conn, error) {
+	j.mu.Lock()
+	var client *ssh.Client
+	if len(j.clients) == 0 {
+		c, err := j.connect(ctx)
+		if err != nil {
+			j.mu.Unlock()
+			return nil, err
+		}
+		client = c
+	} else {
+		client = j.clients[len(j.clients)-1]
+	}
+	j.mu.Unlock()
+
+	conn, err := client.DialContext(ctx, "tcp", addr)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		// a hop may have died, drop the chain so the next job reconnects
+		j.mu.Lock()
+		if len(j.clients) > 0 && j.clients[len(j.clients)-1] == client {
+			j.closeLocked()
+		}
+		j.mu.Unlock()
+		last := j.hops[len(j.hops)-1].Addr
+		return nil, fmt.Errorf("jump host %s could not reach %s: %v", last, addr, err)
+	}
+	return conn, nil
+}
+
+// dialVia: connect to addr directly if via is nil, otherwise through a tunnel opened on via.
+func dialVia(ctx context.Context, via *ssh.Client, addr string, config ssh.ClientConfig) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if via == nil {
+		dialer := net.Dialer{Timeout: config.Timeout}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = via.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return handshake(ctx, conn, addr, config)
+}
+
+// handshake: run the SSH handshake over conn, closing conn if ctx is done first so a host that accepts connections
+// but never answers does not hold on to the job.
+func handshake(ctx context.Context, conn net.Conn, addr string, config ssh.ClientConfig) (*ssh.Client, error) {
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &config)
+	if !stop() {
+		// conn was closed under the handshake
+		if err == nil {
+			_ = c.Close()
+		}
+		return nil, ctx.Err()
 	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
-// Connect to the remote server, execute the command, and return the output.
-func (wp *WorkerPool) executor(host string) ([]byte, error) {
-	client, err := ssh.Dial("tcp", host, &wp.sshConfig)
+// chainFor: return the jump chain to use for target, nil if it should be dialled directly.
+// Per-target chains are shared between every target using the same hops.
+func (wp *WorkerPool) chainFor(target Target) *jumpChain {
+	if target.Jump == nil {
+		return wp.jump
+	}
+	if len(target.Jump) == 0 {
+		return nil
+	}
+
+	var key strings.Builder
+	for _, hop := range target.Jump {
+		fmt.Fprintf(&key, "%s@%s,", hop.Config.User, hop.Addr)
+	}
+	wp.chainsMu.Lock()
+	defer wp.chainsMu.Unlock()
+	if wp.chains == nil {
+		wp.chains = make(map[string]*jumpChain)
+	}
+	chain, ok := wp.chains[key.String()]
+	if !ok {
+		chain = &jumpChain{hops: target.Jump}
+		wp.chains[key.String()] = chain
+	}
+	return chain
+}
+
+// dial: connect to the target, through a jump chain if one is configured, giving up once ctx is done.
+func (wp *WorkerPool) dial(ctx context.Context, target Target) (*ssh.Client, error) {
+	addr := target.Addr
+	if addr == "" {
+		addr = target.Host
+	}
+	config := wp.sshConfig
+	if target.Config != nil {
+		config = *target.Config
+	}
+	if verify := config.HostKeyCallback; verify != nil {
+		config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fingerprint := ssh.FingerprintSHA256(key)
+			wp.log.Debug(
+				fmt.Sprintf("%s (%s) presented %s host key %s", hostname, remote, key.Type(), fingerprint),
+				"host", target.Host,
+				"key_type", key.Type(),
+				"fingerprint", fingerprint,
+			)
+			return verify(hostname, remote, key)
+		}
+	}
+
+	var client *ssh.Client
+	chain := wp.chainFor(target)
+	if chain == nil {
+		wp.log.Debug(fmt.Sprintf("dialling %s", addr), "host", target.Host, "addr", addr)
+		c, err := dialVia(ctx, nil, addr, config)
+		if err != nil {
+			return nil, err
+		}
+		client = c
+	} else {
+		wp.log.Debug(
+			fmt.Sprintf("dialling %s through %d jump host(s)", addr, len(chain.hops)),
+			"host", target.Host,
+			"addr", addr,
+			"jump_hosts", len(chain.hops),
+		)
+		conn, err := chain.dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		c, err := handshake(ctx, conn, addr, config)
+		if err != nil {
+			return nil, err
+		}
+		client = c
+	}
+	wp.log.Debug(
+		fmt.Sprintf(
+			"handshake with %s complete: user %s, server version %s, client version %s, session id %x",
+			addr,
+			client.User(),
+			client.ServerVersion(),
+			client.ClientVersion(),
+			client.SessionID(),
+		),
+		"host", target.Host,
+		"user", client.User(),
+		"server_version", string(client.ServerVersion()),
+	)
+	return client, nil
+}
+
+// runSSH: connect to the remote server, execute cmd, and return the output in a Result.
+func (wp *WorkerPool) runSSH(ctx context.Context, target Target, cmd string) (res Result, err error) {
+	// the sink is opened before connecting so every target gets its writers, even if its command never runs
+	var out *commandOutput
+	if wp.action == nil {
+		if out, err = wp.openOutput(ctx, target); err != nil {
+			return res, err
+		}
+		defer func() {
+			if closeErr := out.close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}()
+	}
+	client, start, release, err := wp.client(ctx, target)
 	if err != nil {
-		return nil, fmt.Errorf("could not dial: %v", err)
+		return res, err
+	}
+	defer func() { release(err) }()
+	if wp.lock.Path != "" {
+		unlock, err := wp.acquire(ctx, client)
+		if err != nil {
+			return res, err
+		}
+		defer unlock()
+	}
+
+	var deadline <-chan time.Time
+	timeout := wp.timeoutFor(target)
+	if timeout > 0 {
+		remaining := timeout - time.Since(start)
+		if remaining <= 0 {
+			return res, fmt.Errorf("%w after %v while connecting", ErrTimeout, timeout)
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	dead, stopKeepalive := wp.keepalive(client, target.Host)
+	defer stopKeepalive()
+	if wp.action != nil {
+		return wp.runAction(ctx, client, target, timeout, deadline, dead)
 	}
 
 	sess, err := client.NewSession()
 	if err != nil {
-		return nil, fmt.Errorf("unable to create session: %v", err)
+		return res, fmt.Errorf("%w: %v", ErrSession, err)
 	}
 	defer func() { _ = sess.Close() }()
+	if err := wp.setenv(sess, target); err != nil {
+		return res, fmt.Errorf("%w: %v", ErrSession, err)
+	}
+
+	sess.Stdout, sess.Stderr = out.writers()
+	if wp.stdin != nil {
+		sess.Stdin = bytes.NewReader(wp.stdin)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Run(cmd)
+	}()
+
+	// stopping the command unblocks Run, keep whatever output arrived before giving up
+	select {
+	case err = <-done:
+	case <-deadline:
+		wp.stop(sess, target, done)
+		err = fmt.Errorf("%w after %v", ErrTimeout, timeout)
+	case <-ctx.Done():
+		wp.stop(sess, target, done)
+		err = ctx.Err()
+	case <-dead:
+		<-done
+		err = fmt.Errorf("%w for %v", ErrKeepalive, time.Duration(wp.keepaliveCount)*wp.keepaliveInterval)
+	}
+
+	out.collect(&res)
+	return res, err
+}
 
-	return sess.CombinedOutput(wp.cmd)
+// timeoutFor: how long target's job may take, its own timeout if it has one, otherwise the pool's.
+func (wp *WorkerPool) timeoutFor(target Target) time.Duration {
+	if target.Timeout > 0 {
+		return target.Timeout
+	}
+	return wp.timeout
+}
+
+// stop: stop the command running in sess, sending it the stop signal and waiting out the grace period for it to exit
+// first if the pool has one, and wait for Run to return.
+func (wp *WorkerPool) stop(sess *ssh.Session, target Target, done <-chan error) {
+	if wp.stopGrace > 0 && wp.stopSignal != "" {
+		wp.log.Debug(fmt.Sprintf("sending SIG%s to %s", wp.stopSignal, target.Host), "host", target.Host)
+		if err := sess.Signal(wp.stopSignal); err == nil {
+			timer := time.NewTimer(wp.stopGrace)
+			defer timer.Stop()
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+		}
+	}
+	_ = sess.Close()
+	<-done
+}
+
+// runAction: run the pool's action on client, closing the connection to stop it when deadline passes or ctx is done.
+func (wp *WorkerPool) runAction(
+	ctx context.Context,
+	client *ssh.Client,
+	target Target,
+	timeout time.Duration,
+	deadline <-chan time.Time,
+	dead <-chan struct{},
+) (Result, error) {
+	var out bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- wp.action(ctx, client, target, &out)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-deadline:
+		_ = client.Close()
+		<-done
+		err = fmt.Errorf("%w after %v", ErrTimeout, timeout)
+	case <-ctx.Done():
+		_ = client.Close()
+		<-done
+		err = ctx.Err()
+	case <-dead:
+		<-done
+		err = fmt.Errorf("%w for %v", ErrKeepalive, time.Duration(wp.keepaliveCount)*wp.keepaliveInterval)
+	}
+	return Result{Output: out.Bytes(), Stdout: out.Bytes()}, err
+}
+
+// setenv: set the pool's and target's environment variables in sess, in name order so failures are reproducible.
+func (wp *WorkerPool) setenv(sess *ssh.Session, target Target) error {
+	env := wp.environ(target)
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := sess.Setenv(name, env[name]); err != nil {
+			return fmt.Errorf("server refused environment variable %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// environ: the environment variables for target's command, the pool's with the target's on top.
+func (wp *WorkerPool) environ(target Target) map[string]string {
+	env := make(map[string]string, len(wp.env)+len(target.Env))
+	for name, value := range wp.env {
+		env[name] = value
+	}
+	for name, value := range target.Env {
+		env[name] = value
+	}
+	return env
 }
 
 // This is the actual worker that does the actual work. worker establishes an SSH session with the remote host and
 // runs the command on the remote host. It then waits for the result, an error if one is present, and adds a new
 // Result to the wp.results channel.
 // results will block if the channel is not made large enough or if results are not drained in a timely manner.
+// Workers above the pool's initial size exit once they go a whole idle period without a job.
 func (wp *WorkerPool) worker() {
-	for job := range wp.jobs {
-		output, err := wp.executor(job.host)
-		job.result.Host = job.host
-		job.result.Output = output
-		job.result.Err = err
-		close(job.done)
+	defer wp.wg.Done()
+	var idle <-chan time.Time
+	if wp.maxWorkers > wp.numWorkers {
+		ticker := time.NewTicker(wp.idleAfter)
+		defer ticker.Stop()
+		idle = ticker.C
 	}
+	worked := false
+	for {
+		select {
+		case job, ok := <-wp.jobs:
+			if !ok {
+				return
+			}
+			wp.work(job)
+			worked = true
+		case <-idle:
+			if !worked && wp.retire() {
+				return
+			}
+			worked = false
+		}
+	}
+}
 
-	wp.wg.Done()
+// work: run a single job and hand its result back to RunTarget.
+func (wp *WorkerPool) work(job JobResult) {
+	wp.log.Debug(fmt.Sprintf("worker picked up %s", job.target.Host), "host", job.target.Host)
+	wp.metrics.start()
+	start := time.Now()
+	var res Result
+	err := job.ctx.Err()
+	if err == nil {
+		err = wp.breaker.allow(job.target.Host)
+	}
+	if err == nil {
+		res, err = wp.executor(job.ctx, job.target)
+		wp.breaker.record(job.target.Host, err)
+	}
+	res.Host = job.target.Host
+	res.ExitCode = exitCode(err)
+	res.Duration = time.Since(start)
+	if wp.action == nil {
+		err = wp.judge(res, err)
+	}
+	res.Err = err
+	wp.metrics.finish(Classify(err), res.Duration)
+	if err == nil {
+		wp.observeLatency(res.Duration)
+	}
+	wp.log.Debug(
+		fmt.Sprintf("worker finished %s in %s, exit code %d", job.target.Host, res.Duration, res.ExitCode),
+		"host", job.target.Host,
+		"duration_seconds", res.Duration.Seconds(),
+		"exit_code", res.ExitCode,
+	)
+	*job.result = res
+	close(job.done)
 }
 
 // RunJob: run the remote command against the specified host and return the Result.
-// Return an error if the context is cancelled before the job finishes.
+// Return an ErrCancelled error if the context is cancelled before the job finishes. Cancelling the context also stops
+// the job wherever it is, whether waiting for a worker, dialling, in the SSH handshake, or running its session, so the
+// worker is free for the next job straight away.
 func (wp *WorkerPool) RunJob(ctx context.Context, host string) (Result, error) {
+	return wp.RunTarget(ctx, Target{Host: host})
+}
+
+// RunTarget: like RunJob, but with per-target connection settings.
+func (wp *WorkerPool) RunTarget(ctx context.Context, target Target) (Result, error) {
 	res := new(Result)
 	done := make(chan struct{})
 
+	job := JobResult{ctx, target, res, done}
 	select {
-	case wp.jobs <- JobResult{host, res, done}:
+	case wp.jobs <- job:
+		return wp.wait(ctx, res, done)
+	default:
+		// every worker is busy
+		wp.grow()
+	}
+
+	wp.metrics.queue(1)
+	select {
+	case wp.jobs <- job:
+		wp.metrics.queue(-1)
 	case <-ctx.Done():
-		return Result{}, nil
+		wp.metrics.queue(-1)
+		return Result{}, &cancelledError{ctx.Err()}
 	}
+	return wp.wait(ctx, res, done)
+}
 
+// wait: wait for a job handed to a worker to finish.
+func (wp *WorkerPool) wait(ctx context.Context, res *Result, done chan struct{}) (Result, error) {
 	select {
 	case <-done:
 		return *res, nil
 	case <-ctx.Done():
-		return Result{}, nil
+		// the job may have finished at the same time, prefer its result
+		select {
+		case <-done:
+			return *res, nil
+		default:
+			return Result{}, &cancelledError{ctx.Err()}
+		}
 	}
 }
@@ -1,7 +1,9 @@
 package api
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
 	cRand "crypto/rand"
 	"crypto/rsa"
@@ -11,14 +13,23 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -56,8 +67,7 @@ func TestMainFlow(t *testing.T) {
 			var good, bad float64
 			var toLog string
 			for i := 0; i < test.iterations; i++ {
-				wp := CreatePool(test.nWorkers, "noop", ssh.ClientConfig{})
-				wp.do = wp.testWorker
+				wp := CreatePool(test.nWorkers, "noop", ssh.ClientConfig{}, WithExecutor(testExecutor))
 				wp.ScheduleWorkers()
 				var wg sync.WaitGroup
 				for _, host := range test.hosts {
@@ -67,10 +77,10 @@ func TestMainFlow(t *testing.T) {
 						if err != nil {
 							t.Errorf("RunJob: %v", err)
 						}
+						got.Duration = 0
 						want := Result{
-							h,
-							[]byte("test"),
-							nil,
+							Host:   h,
+							Output: []byte("test"),
 						}
 						if diff := cmp.Diff(got, want); diff != "" {
 							mu.Lock()
@@ -91,6 +101,440 @@ func TestMainFlow(t *testing.T) {
 	}
 }
 
+func TestShutdown(t *testing.T) {
+	wp := CreatePool(4, "noop", ssh.ClientConfig{}, WithExecutor(testExecutor))
+	wp.ScheduleWorkers()
+	if _, err := wp.RunJob(context.Background(), "host"); err != nil {
+		t.Fatalf("RunJob: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- wp.Shutdown()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not wait for the workers to exit")
+	}
+	// a second call is harmless
+	if err := wp.Shutdown(); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+}
+
+func TestRunJobCancelled(t *testing.T) {
+	// no workers are scheduled so the job can never be picked up
+	wp := CreatePool(1, "noop", ssh.ClientConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	got, err := wp.RunJob(ctx, "host")
+	if !errors.Is(err, ErrCancelled) {
+		t.Errorf("RunJob returned %v, want ErrCancelled", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RunJob returned %v, want it to wrap context.DeadlineExceeded", err)
+	}
+	if diff := cmp.Diff(got, Result{}); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+}
+
+// closingExecutor: an Executor that fails with the exit status it is told to, or hangs until cancelled
+type closingExecutor struct {
+	closed bool
+}
+
+func (e *closingExecutor) Run(ctx context.Context, target Target, cmd string) (Result, error) {
+	if cmd == "hang" {
+		<-ctx.Done()
+		return Result{}, ctx.Err()
+	}
+	status, err := strconv.Atoi(cmd)
+	if err != nil {
+		return Result{}, err
+	}
+	if status != 0 {
+		return Result{Output: []byte(target.Host)}, &ExitError{Status: status}
+	}
+	return Result{Output: []byte(target.Host)}, nil
+}
+
+func (e *closingExecutor) Close() error {
+	e.closed = true
+	return nil
+}
+
+func TestWithExecutor(t *testing.T) {
+	closing := &closingExecutor{}
+	wp := CreatePool(1, "3", ssh.ClientConfig{}, WithExecutor(closing))
+	wp.ScheduleWorkers()
+	res, err := wp.RunJob(context.Background(), "host")
+	if err != nil {
+		t.Fatalf("RunJob: %v", err)
+	}
+	if res.Host != "host" || string(res.Output) != "host" {
+		t.Errorf("got host %q and output %q, want both to be %q", res.Host, res.Output, "host")
+	}
+	if res.ExitCode != 3 || Classify(res.Err) != ClassExitStatus {
+		t.Errorf("got exit code %d and class %s, want 3 and %s", res.ExitCode, Classify(res.Err), ClassExitStatus)
+	}
+	if err := wp.Shutdown(); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if !closing.closed {
+		t.Error("Shutdown did not close the executor")
+	}
+
+	wp = CreatePool(1, "hang", ssh.ClientConfig{}, WithExecutor(closing), WithTimeout(50*time.Millisecond))
+	_, err = wp.executor(context.Background(), Target{Host: "host"})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("got error %v, want ErrTimeout", err)
+	}
+}
+
+func TestExpectAndOKExitCodes(t *testing.T) {
+	// an executor printing the command, failing with exit status 2 for "fail"
+	echo := ExecutorFunc(func(ctx context.Context, target Target, cmd string) (Result, error) {
+		res := Result{Output: []byte(cmd), Stdout: []byte(cmd)}
+		if cmd == "fail" {
+			return res, &ExitError{Status: 2}
+		}
+		return res, nil
+	})
+	for _, tt := range []struct {
+		cmd    string
+		expect Expectation
+		class  string
+	}{
+		{"nginx 1.24.0\n", Expectation{Regex: regexp.MustCompile(`1\.24\.`)}, ClassOK},
+		{"nginx 1.22.1\n", Expectation{Regex: regexp.MustCompile(`1\.24\.`)}, ClassUnexpected},
+		{"  active\n", Expectation{Exact: "active"}, ClassOK},
+		{"inactive\n", Expectation{Exact: "active"}, ClassUnexpected},
+		{"fail", Expectation{Exact: "fail"}, ClassExitStatus},
+		{"anything", Expectation{}, ClassOK},
+	} {
+		wp := CreatePool(1, tt.cmd, ssh.ClientConfig{}, WithExecutor(echo), WithExpect(tt.expect))
+		wp.ScheduleWorkers()
+		res, err := wp.RunJob(context.Background(), "host")
+		if err != nil {
+			t.Fatalf("RunJob: %v", err)
+		}
+		if got := Classify(res.Err); got != tt.class {
+			t.Errorf("%q: got class %s (%v), want %s", tt.cmd, got, res.Err, tt.class)
+		}
+		if tt.class == ClassUnexpected && res.ExitCode != 0 {
+			t.Errorf("%q: got exit code %d, want 0", tt.cmd, res.ExitCode)
+		}
+		_ = wp.Shutdown()
+	}
+
+	for _, tt := range []struct {
+		cmd   string
+		codes []int
+		class string
+		exit  int
+	}{
+		{"fail", []int{0, 2}, ClassOK, 2},
+		{"fail", []int{0, 1}, ClassExitStatus, 2},
+		{"success", []int{2}, ClassExitStatus, 0},
+		{"success", nil, ClassOK, 0},
+	} {
+		wp := CreatePool(1, tt.cmd, ssh.ClientConfig{}, WithExecutor(echo), WithOKExitCodes(tt.codes))
+		wp.ScheduleWorkers()
+		res, err := wp.RunJob(context.Background(), "host")
+		if err != nil {
+			t.Fatalf("RunJob: %v", err)
+		}
+		if got := Classify(res.Err); got != tt.class || res.ExitCode != tt.exit {
+			t.Errorf("%q with %v: got %s, exit code %d, want %s, %d", tt.cmd, tt.codes, got, res.ExitCode, tt.class, tt.exit)
+		}
+		_ = wp.Shutdown()
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"/etc/nginx.conf": "/etc/nginx.conf",
+		"":                "''",
+		"a b":             "'a b'",
+		"it's":            `'it'\''s'`,
+		"$HOME":           "'$HOME'",
+	} {
+		if got := ShellQuote(in); got != want {
+			t.Errorf("ShellQuote(%q) = %s, want %s", in, got, want)
+		}
+	}
+	if got := WrapShell("bash -lc", "cd /srv && ls"); got != "bash -lc 'cd /srv && ls'" {
+		t.Errorf("WrapShell = %s", got)
+	}
+	for dir, want := range map[string]string{
+		"/srv/my app": "cd -- '/srv/my app' && ls",
+		"~/app":       `cd -- "$HOME"/app && ls`,
+		"~":           `cd -- "$HOME" && ls`,
+		"":            "ls",
+	} {
+		if got := InDir(dir, "ls"); got != want {
+			t.Errorf("InDir(%q) = %s, want %s", dir, got, want)
+		}
+	}
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	args := []string{"a b", "it's", "$HOME", "", "*"}
+	cmd := WrapShell("sh -c", ShellCommand("printf", append([]string{"%s|"}, args...)...))
+	wp := CreatePool(1, cmd, ssh.ClientConfig{}, WithExecutor(LocalExecutor{}))
+	res, err := wp.executor(context.Background(), Target{Host: "here"})
+	if want := strings.Join(args, "|") + "|"; err != nil || string(res.Output) != want {
+		t.Errorf("got output %q and error %v, want %q", res.Output, err, want)
+	}
+	dir := filepath.Join(t.TempDir(), "it's here")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	wp = CreatePool(1, InDir(dir, "pwd"), ssh.ClientConfig{}, WithExecutor(LocalExecutor{}))
+	if res, err = wp.executor(context.Background(), Target{Host: "here"}); err != nil || string(res.Stdout) != dir+"\n" {
+		t.Errorf("got output %q and error %v, want %q", res.Output, err, dir+"\n")
+	}
+	wp = CreatePool(1, InDir(filepath.Join(dir, "missing"), "pwd"), ssh.ClientConfig{}, WithExecutor(LocalExecutor{}))
+	if res, err = wp.executor(context.Background(), Target{Host: "here"}); err == nil || len(res.Stdout) != 0 {
+		t.Errorf("got output %q and error %v, want the command to fail without running", res.Output, err)
+	}
+}
+
+func TestCleanOutput(t *testing.T) {
+	for in, want := range map[string]string{
+		"\x1b[1;31merror\x1b[0m: failed\n": "error: failed\n",
+		"\x1b]0;title\x07done\r\n":         "done\r\n",
+		"\x1b(Bplain\ttext\x1b=":           "plain\ttext",
+		"bell\x07 and \x1b[12;":            "bell and ",
+		"caf\xe9 \xff\xfe ok":              "caf\uFFFD \uFFFD ok",
+		"ünïcode stays":                    "ünïcode stays",
+	} {
+		if got := string(CleanOutput([]byte(in))); got != want {
+			t.Errorf("CleanOutput(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	cmd := `printf '\033[32mok\033[0m\n'`
+	wp := CreatePool(1, cmd, ssh.ClientConfig{}, WithExecutor(LocalExecutor{}), WithCleanOutput(true))
+	res, err := wp.executor(context.Background(), Target{Host: "here"})
+	if err != nil || string(res.Stdout) != "ok\n" || string(res.Output) != "ok\n" {
+		t.Errorf("got stdout %q, output %q, and error %v, want %q", res.Stdout, res.Output, err, "ok\n")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	// an executor that cannot connect to down, and runs a failing command on up
+	unhealthy := ExecutorFunc(func(ctx context.Context, target Target, cmd string) (Result, error) {
+		mu.Lock()
+		calls[target.Host]++
+		mu.Unlock()
+		if target.Host == "down" {
+			return Result{}, fmt.Errorf("%w: connection refused", ErrDial)
+		}
+		return Result{}, &ExitError{Status: 1}
+	})
+	breaker := NewCircuitBreaker(2, 100*time.Millisecond)
+	breaker.Seed("gone", 2)
+	wp := CreatePool(1, "test", ssh.ClientConfig{}, WithExecutor(unhealthy), WithCircuitBreaker(breaker))
+	wp.ScheduleWorkers()
+	defer func() { _ = wp.Shutdown() }()
+	run := func(host string) string {
+		res, err := wp.RunJob(context.Background(), host)
+		if err != nil {
+			t.Fatalf("RunJob: %v", err)
+		}
+		return Classify(res.Err)
+	}
+
+	for i, want := range []string{ClassConnect, ClassConnect, ClassQuarantined, ClassQuarantined} {
+		if got := run("down"); got != want {
+			t.Errorf("job %d against down: got class %s, want %s", i+1, got, want)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if got := run("up"); got != ClassExitStatus {
+			t.Errorf("job %d against up: got class %s, want %s", i+1, got, ClassExitStatus)
+		}
+	}
+	if got := run("gone"); got != ClassQuarantined {
+		t.Errorf("job against gone: got class %s, want %s", got, ClassQuarantined)
+	}
+	if calls["down"] != 2 || calls["up"] != 3 || calls["gone"] != 0 {
+		t.Errorf("got calls %v, want quarantined hosts not to be connected to", calls)
+	}
+
+	// after the cooldown, one job gets through, and failing again keeps the host quarantined
+	time.Sleep(150 * time.Millisecond)
+	if got := run("down"); got != ClassConnect || calls["down"] != 3 {
+		t.Errorf("got class %s after %d calls, want the host tried again", got, calls["down"])
+	}
+	if got := run("down"); got != ClassQuarantined || breaker.Failures("down") != 3 {
+		t.Errorf("got class %s after %d failures, want the host quarantined", got, breaker.Failures("down"))
+	}
+}
+
+func TestLocalExecutor(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	wp := CreatePool(
+		1,
+		`cat; echo "$A $B" >&2; exit 3`,
+		ssh.ClientConfig{},
+		WithExecutor(LocalExecutor{}),
+		WithEnv(map[string]string{"A": "pool", "B": "pool"}),
+		WithStdin([]byte("in\n")),
+	)
+	res, err := wp.executor(context.Background(), Target{Host: "here", Env: map[string]string{"B": "target"}})
+	if exitCode(err) != 3 {
+		t.Errorf("got error %v, want exit status 3", err)
+	}
+	if string(res.Stdout) != "in\n" || string(res.Stderr) != "pool target\n" {
+		t.Errorf("got stdout %q and stderr %q, want %q and %q", res.Stdout, res.Stderr, "in\n", "pool target\n")
+	}
+
+	wp = CreatePool(1, "sleep 5", ssh.ClientConfig{}, WithExecutor(LocalExecutor{}), WithTimeout(100*time.Millisecond))
+	start := time.Now()
+	if _, err := wp.executor(context.Background(), Target{Host: "here"}); !errors.Is(err, ErrTimeout) {
+		t.Errorf("got error %v, want ErrTimeout", err)
+	}
+	if took := time.Since(start); took > 3*time.Second {
+		t.Errorf("timed out command took %v to return", took)
+	}
+
+	// a target can run locally in a pool that otherwise uses ssh
+	wp = CreatePool(1, "echo $0", ssh.ClientConfig{})
+	target := Target{Host: "here", Executor: LocalExecutor{Shell: []string{"sh", "-c"}}}
+	res, err = wp.executor(context.Background(), target)
+	if err != nil || string(res.Output) != "sh\n" {
+		t.Errorf("got output %q and error %v, want %q", res.Output, err, "sh\n")
+	}
+}
+
+func TestDockerExecutor(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	// a docker that prints the arguments it was run with and its stdin
+	cli := filepath.Join(t.TempDir(), "docker")
+	if err := ioutil.WriteFile(cli, []byte("#!/bin/sh\necho \"$@\"\ncat\n"), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	wp := CreatePool(
+		1,
+		"uptime",
+		ssh.ClientConfig{},
+		WithExecutor(DockerExecutor{CLI: cli, User: "app"}),
+		WithEnv(map[string]string{"A": "1"}),
+		WithStdin([]byte("in\n")),
+	)
+	res, err := wp.executor(context.Background(), Target{Host: "web", Addr: "web-1", Env: map[string]string{"B": "2"}})
+	if err != nil {
+		t.Fatalf("executor failed: %v", err)
+	}
+	if got, want := string(res.Output), "exec -i --user app --env A=1 --env B=2 web-1 sh -c uptime\nin\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestKubectlExecutor(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	// a kubectl that prints the arguments it was run with and its stdin
+	cli := filepath.Join(t.TempDir(), "kubectl")
+	if err := ioutil.WriteFile(cli, []byte("#!/bin/sh\necho \"$@\"\ncat\n"), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	kubectl := KubectlExecutor{CLI: cli, Context: "prod", Namespace: "default", Container: "app"}
+	wp := CreatePool(1, "uptime", ssh.ClientConfig{}, WithExecutor(kubectl), WithStdin([]byte("in\n")))
+	res, err := wp.executor(context.Background(), Target{Host: "web", Addr: "shop/web-0", Env: map[string]string{"B": "2"}})
+	if err != nil {
+		t.Fatalf("executor failed: %v", err)
+	}
+	want := "exec -i --context prod --namespace shop web-0 --container app -- env B=2 sh -c uptime\nin\n"
+	if got := string(res.Output); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+
+	// without environment variables or a namespace in the address the command runs directly in the default namespace
+	res, err = KubectlExecutor{CLI: cli, Namespace: "default"}.Run(context.Background(), Target{Host: "web-1"}, "uptime")
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got, want := string(res.Output), "exec -i --namespace default web-1 -- sh -c uptime\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestSSMExecutor(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	// an aws that logs the arguments it was run with and reports the command in progress once, then failed
+	dir := t.TempDir()
+	cli := filepath.Join(dir, "aws")
+	script := `#!/bin/sh
+printf "%s\n" "$*" >> "$(dirname "$0")/log"
+case "$2" in
+send-command) echo '{"Command": {"CommandId": "c1"}}' ;;
+get-command-invocation)
+	if [ ! -e "$(dirname "$0")/polled" ]; then
+		touch "$(dirname "$0")/polled"
+		echo '{"Status": "InProgress"}'
+	else
+		printf '%s\n' '{"Status": "Failed", "ResponseCode": 3,
+			"StandardOutputContent": "out\n", "StandardErrorContent": "err\n"}'
+	fi ;;
+esac
+`
+	if err := ioutil.WriteFile(cli, []byte(script), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	ssmExec := SSMExecutor{CLI: cli, Region: "us-west-2", PollInterval: time.Millisecond}
+	wp := CreatePool(1, "uptime", ssh.ClientConfig{}, WithExecutor(ssmExec), WithEnv(map[string]string{"A": "it's"}))
+	res, err := wp.executor(context.Background(), Target{Host: "web", Addr: "i-0abc"})
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Status != 3 {
+		t.Fatalf("executor returned %v, want exit status 3", err)
+	}
+	if got, want := string(res.Stdout), "out\n"; got != want {
+		t.Errorf("got stdout %q, want %q", got, want)
+	}
+	if got, want := string(res.Stderr), "err\n"; got != want {
+		t.Errorf("got stderr %q, want %q", got, want)
+	}
+
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	wantLog := `ssm send-command --instance-ids i-0abc --document-name AWS-RunShellScript ` +
+		`--parameters {"commands":["export A='it'\\''s'\nuptime"]} --comment remote-executor --output json --region us-west-2
+ssm get-command-invocation --command-id c1 --instance-id i-0abc --output json --region us-west-2
+ssm get-command-invocation --command-id c1 --instance-id i-0abc --output json --region us-west-2
+`
+	if diff := cmp.Diff(wantLog, string(log)); diff != "" {
+		t.Errorf("aws arguments mismatch (-want +got):\n%s", diff)
+	}
+
+	wp = CreatePool(1, "uptime", ssh.ClientConfig{}, WithExecutor(ssmExec), WithStdin([]byte("in")))
+	if _, err := wp.executor(context.Background(), Target{Host: "i-0abc"}); err == nil {
+		t.Error("executor accepted stdin over ssm")
+	}
+}
+
 func TestExecutor(t *testing.T) {
 	b := make([]byte, 32)
 	_, err := cRand.Read(b)
@@ -104,36 +548,1593 @@ func TestExecutor(t *testing.T) {
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 
-	done := make(chan struct{})
-	ready := make(chan struct{})
+	server := newSSHServer(t, b)
+	wp1 := CreatePool(10, "test", clientConf)
+	res, err := wp1.executor(context.Background(), Target{Host: server.addr})
+	if err != nil {
+		t.Fatalf("executor failed: %v", err)
+	}
+	if got, want := string(res.Output), "success!"; got != want {
+		t.Fatalf("executor returned %v, want %v", got, want)
+	}
+
+	wp2 := CreatePool(10, "fail", clientConf)
+	res, err = wp2.executor(context.Background(), Target{Host: server.addr})
+	if err != nil && err.Error() != "Process exited with status 1" {
+		t.Fatalf("executor failed: %v", err)
+	}
+	if got, want := string(res.Output), "failed!"; got != want {
+		t.Fatalf("executor returned %v, want %v", got, want)
+	}
+}
+
+// debugLog: a Logger that records debug messages
+type debugLog struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *debugLog) Debug(msg string, _ ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+}
+
+func TestExecutorDebugLog(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	server := newSSHServer(t, b)
+	logger := &debugLog{}
+	wp := CreatePool(1, "test", clientConf, WithLogger(logger))
+	if _, err := wp.executor(context.Background(), Target{Host: server.addr}); err != nil {
+		t.Fatalf("executor failed: %v", err)
+	}
+
+	want := []string{"dialling ", "presented ssh-rsa host key SHA256:", "handshake with "}
+	if len(logger.msgs) != len(want) {
+		t.Fatalf("got %d debug messages, want %d: %q", len(logger.msgs), len(want), logger.msgs)
+	}
+	for i, msg := range logger.msgs {
+		if !strings.Contains(msg, want[i]) {
+			t.Errorf("debug message %d = %q, want it to contain %q", i, msg, want[i])
+		}
+	}
+}
+
+func TestExecutorEnv(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	server := newSSHServer(t, b)
+	wp := CreatePool(1, "env", clientConf, WithEnv(map[string]string{"B": "pool", "A": "pool"}))
+	target := Target{Host: server.addr, Env: map[string]string{"B": "target", "C": "x y"}}
+	res, err := wp.executor(context.Background(), target)
+	if err != nil {
+		t.Fatalf("executor failed: %v", err)
+	}
+	if diff := cmp.Diff("A=pool\nB=target\nC=x y", string(res.Output)); diff != "" {
+		t.Errorf("environment mismatch (-want +got):\n%s", diff)
+	}
+
+	target.Env = map[string]string{"REFUSED": "1"}
+	_, err = wp.executor(context.Background(), target)
+	if !errors.Is(err, ErrSession) || !strings.Contains(err.Error(), "REFUSED") {
+		t.Errorf("got error %v, want an ErrSession naming the refused variable", err)
+	}
+}
+
+func TestExecutorStdin(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	server := newSSHServer(t, b)
+	wp := CreatePool(1, "cat", clientConf, WithStdin([]byte("line 1\nline 2\n")))
+	// every job gets the whole input, not what is left of it
+	for i := 0; i < 2; i++ {
+		res, err := wp.executor(context.Background(), Target{Host: server.addr})
+		if err != nil {
+			t.Fatalf("executor failed: %v", err)
+		}
+		if diff := cmp.Diff("line 1\nline 2\n", string(res.Output)); diff != "" {
+			t.Errorf("run %d output mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestUpload(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	src := filepath.Join(t.TempDir(), "conf")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeFile := func(name, data string, mode os.FileMode) {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("a.conf", "hello", 0640)
+	writeFile("sub/b.conf", "world!", 0600)
+	writeFile("sub/c.tmp", "scratch", 0644)
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatalf("user.Current: %v", err)
+	}
+
+	tests := map[string]struct {
+		src  string
+		dest func(dir string) string
+		opts UploadOptions
+		want map[string]string
+	}{
+		"tree into a directory": {
+			src:  src,
+			dest: func(dir string) string { return dir },
+			want: map[string]string{
+				"conf/a.conf":     "-rw-r----- hello",
+				"conf/sub/b.conf": "-rw------- world!",
+				"conf/sub/c.tmp":  "-rw-r--r-- scratch",
+			},
+		},
+		"tree to a new path": {
+			src:  src,
+			dest: func(dir string) string { return filepath.Join(dir, "etc") },
+			opts: UploadOptions{Owner: strconv.Itoa(os.Getuid())},
+			want: map[string]string{
+				"etc/a.conf":     "-rw-r----- hello",
+				"etc/sub/b.conf": "-rw------- world!",
+				"etc/sub/c.tmp":  "-rw-r--r-- scratch",
+			},
+		},
+		"file with a numeric owner and group": {
+			src:  filepath.Join(src, "a.conf"),
+			dest: func(dir string) string { return dir },
+			opts: UploadOptions{Owner: fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())},
+			want: map[string]string{"a.conf": "-rw-r----- hello"},
+		},
+		"file with an owner looked up by name": {
+			src:  filepath.Join(src, "a.conf"),
+			dest: func(dir string) string { return dir },
+			opts: UploadOptions{Owner: currentUser.Username},
+			want: map[string]string{"a.conf": "-rw-r----- hello"},
+		},
+		"excluded files": {
+			src:  src,
+			dest: func(dir string) string { return dir },
+			opts: UploadOptions{Filter: Filter{Exclude: []string{"*.tmp"}}},
+			want: map[string]string{"conf/a.conf": "-rw-r----- hello", "conf/sub/b.conf": "-rw------- world!"},
+		},
+		"verified tree": {
+			src:  src,
+			dest: func(dir string) string { return dir },
+			opts: UploadOptions{Verify: true, Filter: Filter{Exclude: []string{"c.tmp"}}},
+			want: map[string]string{"conf/a.conf": "-rw-r----- hello", "conf/sub/b.conf": "-rw------- world!"},
+		},
+		"verified file": {
+			src:  filepath.Join(src, "sub", "b.conf"),
+			dest: func(dir string) string { return dir },
+			opts: UploadOptions{Verify: true},
+			want: map[string]string{"b.conf": "-rw------- world!"},
+		},
+		"included files": {
+			src:  src,
+			dest: func(dir string) string { return dir },
+			opts: UploadOptions{Filter: Filter{Include: []string{"*.conf"}, Exclude: []string{"sub"}}},
+			want: map[string]string{"conf/a.conf": "-rw-r----- hello"},
+		},
+		"file with a mode": {
+			src:  filepath.Join(src, "a.conf"),
+			dest: func(dir string) string { return filepath.Join(dir, "it's.conf") },
+			opts: UploadOptions{Mode: 0604},
+			want: map[string]string{"it's.conf": "-rw----r-- hello"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			action, err := Upload(tc.src, tc.dest(dir), tc.opts)
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			wp := CreatePool(1, "copy", clientConf, WithAction(action))
+			res, err := wp.executor(context.Background(), Target{Host: server.addr})
+			if err != nil {
+				t.Fatalf("executor failed: %v, output: %s", err, res.Output)
+			}
+
+			got := make(map[string]string)
+			err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				data, err := ioutil.ReadFile(path)
+				rel, _ := filepath.Rel(dir, path)
+				got[filepath.ToSlash(rel)] = info.Mode().String() + " " + string(data)
+				if !info.ModTime().Equal(mtime) {
+					t.Errorf("%s has mtime %v, want %v", rel, info.ModTime(), mtime)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("uploaded files mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		dest string
+		opts UploadOptions
+		want string
+	}{
+		{dest: "/nonexistent/dir/file", want: "file does not exist"},
+		{
+			dest: t.TempDir(),
+			opts: UploadOptions{Owner: "no-such-user-here"},
+			want: `unable to look up user "no-such-user-here"`,
+		},
+	} {
+		action, err := Upload(src, tc.dest, tc.opts)
+		if err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		wp := CreatePool(1, "copy", clientConf, WithAction(action))
+		if _, err := wp.executor(context.Background(), Target{Host: server.addr}); err == nil ||
+			!strings.Contains(err.Error(), tc.want) {
+			t.Errorf("uploading to %s: got error %v, want %q", tc.dest, err, tc.want)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp is not installed")
+	}
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	// the test server runs scp locally, so the remote files are local too
+	remote := filepath.Join(t.TempDir(), "log")
+	if err := os.MkdirAll(filepath.Join(remote, "app"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(remote, "app", "app.log"), []byte("started\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(remote, "app", "app.log"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	local := t.TempDir()
+	dest := func(target Target) string { return filepath.Join(local, "web1", remote) }
+	if err := ioutil.WriteFile(filepath.Join(remote, "app", "app.tmp"), []byte("skipped"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	download, err := Download(remote, dest, Filter{Exclude: []string{"app/*.tmp"}})
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	wp := CreatePool(1, "fetch", clientConf, WithAction(download))
+	res, err := wp.executor(context.Background(), Target{Host: server.addr})
+	if err != nil {
+		t.Fatalf("executor failed: %v", err)
+	}
+	if diff := cmp.Diff("fetched 1 files, 8 bytes to "+dest(Target{})+"\n", string(res.Output)); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+
+	path := filepath.Join(dest(Target{}), "app", "app.log")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("fetched file is missing: %v", err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("fetched file has mode %v and mtime %v, want %v and %v", info.Mode(), info.ModTime(), 0640, mtime)
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || info.Mode().Perm() != 0750 {
+		t.Errorf("fetched directory has mode %v, %v, want %v", info.Mode(), err, 0750)
+	}
+
+	if _, err := os.Stat(filepath.Join(dest(Target{}), "app", "app.tmp")); !os.IsNotExist(err) {
+		t.Errorf("excluded file was fetched: %v", err)
+	}
+
+	download, err = Download(filepath.Join(remote, "missing"), dest, Filter{})
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	wp = CreatePool(1, "fetch", clientConf, WithAction(download))
+	_, err = wp.executor(context.Background(), Target{Host: server.addr})
+	if exitCode(err) != 1 || !strings.Contains(err.Error(), "No such file") {
+		t.Errorf("got error %v, want the exit status and message of the failed scp", err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar is not installed")
+	}
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	// the test server runs tar locally, so the remote files are local too
+	remote := filepath.Join(t.TempDir(), "log")
+	if err := os.MkdirAll(filepath.Join(remote, "app"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(remote, "app", "app.log"), []byte("started\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "web1.tar.gz")
+	collect, err := Collect([]string{remote}, func(Target) string { return dest })
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	wp := CreatePool(1, "collect", clientConf, WithAction(collect))
+	res, err := wp.executor(context.Background(), Target{Host: server.addr})
+	if err != nil || !strings.HasPrefix(string(res.Output), "collected ") {
+		t.Fatalf("got output %q and error %v", res.Output, err)
+	}
+
+	f, err := os.Open(dest)
+	if err != nil {
+		t.Fatalf("archive is missing: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("archive is not gzipped: %v", err)
+	}
+	archive := tar.NewReader(gz)
+	var got string
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading the archive: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			content, _ := ioutil.ReadAll(archive)
+			got = hdr.Name + ": " + string(content)
+		}
+	}
+	if want := "." + remote + "/app/app.log: started\n"; got != want {
+		t.Errorf("got archived file %q, want %q", got, want)
+	}
+
+	collect, err = Collect([]string{filepath.Join(remote, "missing")}, func(Target) string { return dest })
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	wp = CreatePool(1, "collect", clientConf, WithAction(collect))
+	if _, err = wp.executor(context.Background(), Target{Host: server.addr}); Classify(err) != ClassExitStatus {
+		t.Errorf("got error %v, want the exit status of the failed tar", err)
+	}
+	if _, err := Collect(nil, nil); err == nil {
+		t.Error("Collect with no paths did not fail")
+	}
+}
+
+func TestRemoteLock(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	// the test server runs the lock scripts locally, so the lock is local too
+	lock := RemoteLock{Path: filepath.Join(t.TempDir(), "run.lock"), Owner: "alice@laptop", TTL: time.Hour}
+	wp := CreatePool(1, "test", clientConf, WithRemoteLock(lock))
+	res, err := wp.executor(context.Background(), Target{Host: server.addr})
+	if err != nil || string(res.Output) != "success!" {
+		t.Fatalf("got output %q and error %v", res.Output, err)
+	}
+	if _, err := os.Stat(lock.Path); !os.IsNotExist(err) {
+		t.Errorf("the lock was not released: %v", err)
+	}
+
+	// a lock held by another run
+	held := filepath.Join(t.TempDir(), "held.lock")
+	if err := os.Mkdir(held, 0700); err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour).Unix()
+	_ = ioutil.WriteFile(filepath.Join(held, "owner"), []byte("bob@desktop\n"), 0600)
+	_ = ioutil.WriteFile(filepath.Join(held, "expires"), []byte(fmt.Sprintln(expires)), 0600)
+	wp = CreatePool(1, "test", clientConf, WithRemoteLock(RemoteLock{Path: held, Owner: "alice", TTL: time.Hour}))
+	res, err = wp.executor(context.Background(), Target{Host: server.addr})
+	if Classify(err) != ClassLocked || !strings.Contains(err.Error(), "bob@desktop") || len(res.Output) != 0 {
+		t.Errorf("got output %q and error %v, want the command not to run as bob@desktop holds the lock", res.Output, err)
+	}
+	if owner, _ := ioutil.ReadFile(filepath.Join(held, "owner")); string(owner) != "bob@desktop\n" {
+		t.Errorf("the held lock was changed to %q", owner)
+	}
+
+	// once it expires, the lock is taken over
+	_ = ioutil.WriteFile(filepath.Join(held, "expires"), []byte(fmt.Sprintln(time.Now().Add(-time.Minute).Unix())), 0600)
+	if res, err = wp.executor(context.Background(), Target{Host: server.addr}); err != nil {
+		t.Errorf("got output %q and error %v, want the expired lock to be taken over", res.Output, err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	filter := Filter{Include: []string{"*.conf", "bin/*"}, Exclude: []string{"cache", "*.bak.conf"}}
+	tests := map[string]struct {
+		rel  string
+		dir  bool
+		want bool
+	}{
+		"top of the tree":       {"", true, false},
+		"included by base name": {"nginx/nginx.conf", false, false},
+		"included by path":      {"bin/run", false, false},
+		"not included":          {"README", false, true},
+		"directories searched":  {"nginx", true, false},
+		"excluded directory":    {"nginx/cache", true, true},
+		"exclude wins":          {"old.bak.conf", false, true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := filter.skip(tc.rel, tc.dir); got != tc.want {
+				t.Errorf("skip(%q, %v) = %v, want %v", tc.rel, tc.dir, got, tc.want)
+			}
+		})
+	}
+	if err := (Filter{Exclude: []string{"[a-"}}).Validate(); err == nil {
+		t.Error("Validate accepted a bad pattern")
+	}
+}
+
+func TestCheckSums(t *testing.T) {
+	sums := map[string]string{"a.conf": "aaaa", "sub/b.conf": "bbbb", "new\nline": "cccc"}
+	tests := map[string]struct {
+		sums   map[string]string
+		output string
+		want   string
+	}{
+		"match":       {sums, "aaaa  a.conf\nbbbb  sub/b.conf\n\\cccc  new\\nline\n", ""},
+		"mismatch":    {sums, "aaaa  a.conf\nbbbc  sub/b.conf\n\\cccc  new\\nline\n", "checksum mismatch: sub/b.conf"},
+		"missing":     {sums, "aaaa  a.conf\n", "checksum mismatch: new\nline, sub/b.conf"},
+		"single file": {map[string]string{"": "aaaa"}, "aaaa  /etc/a.conf\n", ""},
+		"single mismatch": {
+			map[string]string{"": "aaaa"}, "bbbb  /etc/a.conf\n", "checksum mismatch: file",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := checkSums(tc.sums, []byte(tc.output))
+			got := ""
+			if err != nil {
+				got = err.Error()
+				if Classify(err) != ClassChecksum {
+					t.Errorf("Classify(%v) = %s, want %s", err, Classify(err), ClassChecksum)
+				}
+			}
+			if got != tc.want {
+				t.Errorf("checkSums = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseScpEntry(t *testing.T) {
+	tests := map[string]struct {
+		line    string
+		wantErr bool
+	}{
+		"file":        {"C0644 12 app.log", false},
+		"dir":         {"D0755 0 conf", false},
+		"dot dot":     {"D0755 0 ..", true},
+		"slash":       {"C0644 12 ../../etc/passwd", true},
+		"bad mode":    {"C0999 12 app.log", true},
+		"bad size":    {"C0644 -1 app.log", true},
+		"no name":     {"C0644 12", true},
+		"spaced name": {"C0644 12 my app.log", false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, _, _, err := parseScpEntry(tc.line); (err != nil) != tc.wantErr {
+				t.Errorf("parseScpEntry(%q) = %v, want error: %v", tc.line, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestConnectRate(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	wp := CreatePool(4, "test", clientConf, WithConnectRate(20, 1))
+	wp.ScheduleWorkers()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := wp.RunJob(context.Background(), server.addr); err != nil {
+				t.Errorf("RunJob: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	// the first connection is free, the other three wait 50ms each
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("4 connections at 20 a second took %v, want at least 150ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := wp.executor(ctx, Target{Host: server.addr}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v waiting for a connection with a cancelled context, want context.Canceled", err)
+	}
+}
+
+func TestDialJitter(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	wp := CreatePool(4, "test", clientConf, WithDialJitter(50*time.Millisecond))
+	wp.ScheduleWorkers()
+	for i := 0; i < 4; i++ {
+		if _, err := wp.RunJob(context.Background(), server.addr); err != nil {
+			t.Errorf("RunJob: %v", err)
+		}
+	}
+
+	wp = CreatePool(1, "test", clientConf, WithDialJitter(time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := wp.executor(ctx, Target{Host: server.addr}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v waiting to connect with a context timing out, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waiting to connect took %v after the context was done", elapsed)
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	wp := CreatePool(1, "test", clientConf, WithConnectionReuse())
+	for i := 0; i < 3; i++ {
+		res, err := wp.executor(context.Background(), Target{Host: server.addr})
+		if err != nil {
+			t.Fatalf("executor run %d: %v", i+1, err)
+		}
+		if diff := cmp.Diff("success!", string(res.Stdout)); diff != "" {
+			t.Errorf("unexpected output on run %d (-want +got):\n%s", i+1, diff)
+		}
+	}
+	if got := server.connections(); got != 1 {
+		t.Errorf("3 jobs opened %d connections, want 1", got)
+	}
+
+	// a failed session drops the connection, the next job connects again
+	wp.cmd = "hang"
+	wp.timeout = 100 * time.Millisecond
+	if _, err := wp.executor(context.Background(), Target{Host: server.addr}); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("executor returned %v, want ErrTimeout", err)
+	}
+	wp.cmd = "test"
+	wp.timeout = 0
+	if _, err := wp.executor(context.Background(), Target{Host: server.addr}); err != nil {
+		t.Fatalf("executor after a timeout: %v", err)
+	}
+	if got := server.connections(); got != 2 {
+		t.Errorf("got %d connections after a timeout, want 2", got)
+	}
+
+	// a connection that went away while kept is replaced
+	_ = wp.conns.get(wp.cacheKey(Target{Host: server.addr})).Close()
+	if _, err := wp.executor(context.Background(), Target{Host: server.addr}); err != nil {
+		t.Fatalf("executor after the connection closed: %v", err)
+	}
+	if got := server.connections(); got != 3 {
+		t.Errorf("got %d connections after the connection closed, want 3", got)
+	}
+
+	if err := wp.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := wp.executor(context.Background(), Target{Host: server.addr}); err != nil {
+		t.Fatalf("executor after Close: %v", err)
+	}
+	if got := server.connections(); got != 4 {
+		t.Errorf("got %d connections after Close, want 4", got)
+	}
+}
+
+func TestConnectionCache(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	// a pool per command, like serve jobs, sharing one cache
+	cache := NewConnectionCache()
+	first := CreatePool(1, "test", clientConf, WithConnectionCache(cache))
+	if _, err := first.executor(context.Background(), Target{Host: server.addr}); err != nil {
+		t.Fatalf("first command: %v", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	second := CreatePool(1, "mixed", clientConf, WithConnectionCache(cache))
+	res, err := second.executor(context.Background(), Target{Host: server.addr})
+	if err != nil {
+		t.Fatalf("second command: %v", err)
+	}
+	if diff := cmp.Diff("out\n", string(res.Stdout)); diff != "" {
+		t.Errorf("unexpected output of the second command (-want +got):\n%s", diff)
+	}
+	if got := server.connections(); got != 1 {
+		t.Errorf("a second command to the same host opened %d connections, want 1 reused by both", got)
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatalf("closing the cache: %v", err)
+	}
+	if _, err := second.executor(context.Background(), Target{Host: server.addr}); err != nil {
+		t.Fatalf("command after closing the cache: %v", err)
+	}
+	if got := server.connections(); got != 2 {
+		t.Errorf("got %d connections after closing the cache, want 2", got)
+	}
+	_ = cache.Close()
+}
+
+func TestKeepalive(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	// answered keepalives do not get in the way
+	wp := CreatePool(1, "test", clientConf, WithKeepalive(10*time.Millisecond, 2))
+	if _, err := wp.executor(context.Background(), Target{Host: server.addr}); err != nil {
+		t.Fatalf("executor: %v", err)
+	}
+
+	// a proxy that stops passing traffic on, like a NAT that forgot the connection
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	frozen := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		upstream, err := net.Dial("tcp", server.addr)
+		if err != nil {
+			return
+		}
+		defer func() { _ = upstream.Close() }()
+		relay := func(dst, src net.Conn) {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := src.Read(buf)
+				if err != nil {
+					return
+				}
+				select {
+				case <-frozen:
+					continue
+				default:
+				}
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+		}
+		go relay(upstream, conn)
+		relay(conn, upstream)
+	}()
+
+	wp = CreatePool(1, "hang", clientConf, WithKeepalive(50*time.Millisecond, 2))
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		close(frozen)
+	}()
+	start := time.Now()
+	_, err = wp.executor(context.Background(), Target{Host: listener.Addr().String()})
+	if !errors.Is(err, ErrKeepalive) {
+		t.Fatalf("executor returned %v, want ErrKeepalive", err)
+	}
+	if got := Classify(err); got != ClassTimeout {
+		t.Errorf("Classify(%v) = %q, want %q", err, got, ClassTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("executor took %v to notice the host stopped answering", elapsed)
+	}
+}
+
+func TestMaxWorkers(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	action := func(ctx context.Context, client *ssh.Client, target Target, out io.Writer) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+	wp := CreatePool(1, "action", clientConf, WithAction(action), WithMaxWorkers(3))
+	wp.idleAfter = 50 * time.Millisecond
+	wp.ScheduleWorkers()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := wp.RunJob(context.Background(), server.addr); err != nil {
+				t.Errorf("RunJob: %v", err)
+			}
+		}()
+	}
+	// three jobs run at once, the fourth waits for a worker
+	for i := 0; i < 3; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d jobs started, want 3", i)
+		}
+	}
+	select {
+	case <-started:
+		t.Fatal("a fourth job started, want at most 3 workers")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	<-started
+	wg.Wait()
+
+	// the added workers exit once idle
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		wp.scaleMu.Lock()
+		workers := wp.workers
+		wp.scaleMu.Unlock()
+		if workers == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool still has %d workers after idling, want 1", workers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLatencyTracker(t *testing.T) {
+	tests := map[string]struct {
+		durations []time.Duration
+		want      bool
+	}{
+		"too few samples": {
+			durations: []time.Duration{time.Second, 10 * time.Second, 10 * time.Second},
+			want:      false,
+		},
+		"steady": {
+			durations: []time.Duration{time.Second, time.Second, time.Second, time.Second, time.Second, 2 * time.Second},
+			want:      false,
+		},
+		"slowing down": {
+			durations: []time.Duration{
+				time.Second, time.Second, time.Second, time.Second, time.Second,
+				10 * time.Second, 10 * time.Second, 10 * time.Second,
+			},
+			want: true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var l latencyTracker
+			for _, d := range test.durations {
+				l.observe(d)
+			}
+			if got := l.slowing(); got != test.want {
+				t.Errorf("slowing() = %v after %v, want %v", got, test.durations, test.want)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	server := newSSHServer(t, b)
+	metrics := NewMetrics()
+	wp := CreatePool(1, "test", clientConf, WithMetrics(metrics))
+	wp.ScheduleWorkers()
+	if _, err := wp.RunJob(context.Background(), server.addr); err != nil {
+		t.Fatalf("RunJob failed: %v", err)
+	}
+	if _, err := wp.RunJob(context.Background(), "127.0.0.1:1"); err != nil {
+		t.Fatalf("RunJob failed: %v", err)
+	}
+
+	var buf strings.Builder
+	metrics.Export(&buf)
+	for _, want := range []string{
+		"remote_executor_jobs_started_total 2\n",
+		"remote_executor_jobs_succeeded_total 1\n",
+		"remote_executor_jobs_failed_total{class=\"connect\"} 1\n",
+		"remote_executor_jobs_running 0\n",
+		"remote_executor_queue_depth 0\n",
+		"remote_executor_dial_duration_seconds_count 2\n",
+		"remote_executor_exec_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics are missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	badAuth := clientConf
+	badAuth.Auth = []ssh.AuthMethod{ssh.Password("wrong")}
+
+	server := newSSHServer(t, b)
+	for name, test := range map[string]struct {
+		cmd      string
+		conf     ssh.ClientConfig
+		host     string
+		class    string
+		exitCode int
+	}{
+		"success":     {"test", clientConf, server.addr, ClassOK, 0},
+		"exit status": {"fail", clientConf, server.addr, ClassExitStatus, 1},
+		"bad auth":    {"test", badAuth, server.addr, ClassAuth, -1},
+		"unreachable": {"test", clientConf, "localhost:1", ClassConnect, -1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := CreatePool(1, test.cmd, test.conf).executor(context.Background(), Target{Host: test.host})
+			if got := Classify(err); got != test.class {
+				t.Errorf("Classify(%v) = %v, want %v", err, got, test.class)
+			}
+			if got := exitCode(err); got != test.exitCode {
+				t.Errorf("exitCode(%v) = %v, want %v", err, got, test.exitCode)
+			}
+		})
+	}
+
+	if got := Classify(fmt.Errorf("%w after 1s", ErrTimeout)); got != ClassTimeout {
+		t.Errorf("Classify(timeout) = %v, want %v", got, ClassTimeout)
+	}
+	if got := Classify(&cancelledError{context.Canceled}); got != ClassCancelled {
+		t.Errorf("Classify(cancelled) = %v, want %v", got, ClassCancelled)
+	}
+	if got := Classify(fmt.Errorf("%w: batch 1 failed", ErrSkipped)); got != ClassSkipped {
+		t.Errorf("Classify(skipped) = %v, want %v", got, ClassSkipped)
+	}
+}
+
+func TestExecutorStderr(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	server := newSSHServer(t, b)
+	wp := CreatePool(10, "mixed", clientConf)
+	res, err := wp.executor(context.Background(), Target{Host: server.addr})
+	if err != nil {
+		t.Fatalf("executor failed: %v", err)
+	}
+	if got, want := string(res.Stdout), "out\n"; got != want {
+		t.Errorf("executor stdout %q, want %q", got, want)
+	}
+	if got, want := string(res.Stderr), "err\n"; got != want {
+		t.Errorf("executor stderr %q, want %q", got, want)
+	}
+	// the order stdout and stderr arrive in is not guaranteed
+	if got := string(res.Output); got != "out\nerr\n" && got != "err\nout\n" {
+		t.Errorf("executor output %q, want both streams", got)
+	}
+}
+
+func TestExecutorOutputTap(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	var mu sync.Mutex
+	tapped := make(map[string]string)
+	wp := CreatePool(1, "mixed", clientConf, WithOutputTap(func(host string, stderr bool, data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		tapped[fmt.Sprintf("%s stderr=%v", host, stderr)] += string(data)
+	}))
+	if _, err := wp.executor(context.Background(), Target{Host: server.addr}); err != nil {
+		t.Fatalf("executor failed: %v", err)
+	}
+	want := map[string]string{
+		server.addr + " stderr=false": "out\n",
+		server.addr + " stderr=true":  "err\n",
+	}
+	if diff := cmp.Diff(want, tapped); diff != "" {
+		t.Errorf("unexpected tapped output (-want +got):\n%s", diff)
+	}
+
+	// output reaches the tap while the command is still running
+	arrived := make(chan struct{})
+	var once sync.Once
+	wp = CreatePool(1, "hang", clientConf, WithOutputTap(func(string, bool, []byte) {
+		once.Do(func() { close(arrived) })
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := wp.executor(ctx, Target{Host: server.addr})
+		done <- err
+	}()
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no output tapped from a running command")
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("executor returned %v, want context.Canceled", err)
+	}
+}
+
+// closeBuffer: a bytes.Buffer that records being closed, for output sinks
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestExecutorOutputSink(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	server := newSSHServer(t, b)
+
+	stdout, stderr := &closeBuffer{}, &closeBuffer{}
+	sink := func(target Target) (io.WriteCloser, io.WriteCloser, error) {
+		if target.Host != server.addr {
+			t.Errorf("sink opened for %q, want %q", target.Host, server.addr)
+		}
+		return stdout, stderr, nil
+	}
+	wp := CreatePool(1, "mixed", clientConf, WithOutputSink(sink))
+	res, err := wp.executor(context.Background(), Target{Host: server.addr})
+	if err != nil {
+		t.Fatalf("executor failed: %v", err)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("sink got stdout %q and stderr %q, want %q and %q", stdout.String(), stderr.String(), "out\n", "err\n")
+	}
+	if !stdout.closed || !stderr.closed {
+		t.Error("sink writers were not closed")
+	}
+	if res.Truncated {
+		t.Error("result truncated without a buffer limit")
+	}
+
+	// only the buffered copy is cut short
+	stdout, stderr = &closeBuffer{}, &closeBuffer{}
+	wp = CreatePool(1, "test", clientConf, WithOutputSink(sink), WithBufferLimit(4))
+	res, err = wp.executor(context.Background(), Target{Host: server.addr})
+	if err != nil {
+		t.Fatalf("executor failed: %v", err)
+	}
+	if got, want := string(res.Stdout), "succ"; got != want || !res.Truncated {
+		t.Errorf("buffered stdout %q, truncated %v, want %q, truncated", got, res.Truncated, want)
+	}
+	if got, want := stdout.String(), "success!"; got != want {
+		t.Errorf("sink got %q, want %q", got, want)
+	}
+
+	wp = CreatePool(1, "test", clientConf, WithOutputSink(func(Target) (io.WriteCloser, io.WriteCloser, error) {
+		return nil, nil, errors.New("disk full")
+	}))
+	if _, err := wp.executor(context.Background(), Target{Host: server.addr}); err == nil {
+		t.Error("executor succeeded although the sink could not be opened")
+	}
+}
+
+func TestExecutorJumpHost(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	bastion := newSSHServer(t, b)
+	target := newSSHServer(t, b)
+	wp := CreatePool(10, "test", clientConf, WithJumpHost(bastion.addr, clientConf))
+	for i := 0; i < 3; i++ {
+		res, err := wp.executor(context.Background(), Target{Host: target.addr})
+		if err != nil {
+			t.Fatalf("executor failed: %v", err)
+		}
+		if got, want := string(res.Output), "success!"; got != want {
+			t.Fatalf("executor returned %v, want %v", got, want)
+		}
+	}
+	if got, want := bastion.forwarded(), 3; got != want {
+		t.Errorf("bastion forwarded %d connections, want %d", got, want)
+	}
+
+	unreachable := CreatePool(10, "test", clientConf, WithJumpHost("localhost:1", clientConf))
+	if _, err := unreachable.executor(context.Background(), Target{Host: target.addr}); err == nil {
+		t.Errorf("executor should fail when the jump host is unreachable")
+	}
+}
+
+func TestExecutorJumpChain(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	first := newSSHServer(t, b)
+	second := newSSHServer(t, b)
+	target := newSSHServer(t, b)
+	hops := []Hop{{first.addr, clientConf}, {second.addr, clientConf}}
+	wp := CreatePool(10, "test", clientConf, WithJumpChain(hops))
+	for i := 0; i < 2; i++ {
+		res, err := wp.executor(context.Background(), Target{Host: target.addr})
+		if err != nil {
+			t.Fatalf("executor failed: %v", err)
+		}
+		if got, want := string(res.Output), "success!"; got != want {
+			t.Fatalf("executor returned %v, want %v", got, want)
+		}
+	}
+	// the first hop only tunnels to the second, which tunnels to the target for each job
+	if got, want := first.forwarded(), 1; got != want {
+		t.Errorf("first hop forwarded %d connections, want %d", got, want)
+	}
+	if got, want := second.forwarded(), 2; got != want {
+		t.Errorf("second hop forwarded %d connections, want %d", got, want)
+	}
+}
+
+func TestExecutorTimeout(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	server := newSSHServer(t, b)
+	wp := CreatePool(10, "hang", clientConf, WithTimeout(200*time.Millisecond))
+	start := time.Now()
+	res, err := wp.executor(context.Background(), Target{Host: server.addr})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("executor returned %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("executor took %v to time out", elapsed)
+	}
+	if got, want := string(res.Output), "hanging"; got != want {
+		t.Errorf("executor returned %v, want %v", got, want)
+	}
+
+	fast := CreatePool(10, "test", clientConf, WithTimeout(5*time.Second))
+	if _, err := fast.executor(context.Background(), Target{Host: server.addr}); err != nil {
+		t.Errorf("executor failed: %v", err)
+	}
+
+	// a target's own timeout wins over the pool's
+	slow := CreatePool(10, "hang", clientConf, WithTimeout(time.Hour))
+	start = time.Now()
+	_, err = slow.executor(context.Background(), Target{Host: server.addr, Timeout: 200 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) || !strings.Contains(err.Error(), "200ms") {
+		t.Errorf("executor returned %v, want ErrTimeout after 200ms", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("executor took %v to time out", elapsed)
+	}
+	local := CreatePool(1, "sleep 10", ssh.ClientConfig{}, WithExecutor(LocalExecutor{}), WithTimeout(time.Hour))
+	_, err = local.executor(context.Background(), Target{Host: "local", Timeout: 200 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("local executor returned %v, want ErrTimeout", err)
+	}
+}
+
+func TestExecutorCancel(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	server := newSSHServer(t, b)
+	wp := CreatePool(10, "hang", clientConf)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := wp.executor(ctx, Target{Host: server.addr}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("executor returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestExecutorStopSignal(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	server := newSSHServer(t, b)
+	tests := []struct {
+		cmd     string
+		opts    []Option
+		want    string
+		elapsed time.Duration
+	}{
+		// exits once it gets the signal, well within the grace period
+		{"sleep", []Option{WithStopSignal(ssh.SIGTERM, 5*time.Second)}, "sleeping, terminated", 0},
+		// ignores the signal, so the session is closed after the grace period
+		{"hang", []Option{WithStopSignal(ssh.SIGTERM, 300*time.Millisecond)}, "hanging", 300 * time.Millisecond},
+		// no signal without a grace period
+		{"sleep", nil, "sleeping", 0},
+	}
+	for _, tt := range tests {
+		wp := CreatePool(1, tt.cmd, clientConf, append(tt.opts, WithTimeout(200*time.Millisecond))...)
+		start := time.Now()
+		res, err := wp.executor(context.Background(), Target{Host: server.addr})
+		elapsed := time.Since(start) - 200*time.Millisecond
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("%s: executor returned %v, want ErrTimeout", tt.cmd, err)
+		}
+		if got := string(res.Output); got != tt.want {
+			t.Errorf("%s: got output %q, want %q", tt.cmd, got, tt.want)
+		}
+		if elapsed < tt.elapsed || elapsed > tt.elapsed+4*time.Second {
+			t.Errorf("%s: stopping took %v, want about %v", tt.cmd, elapsed, tt.elapsed)
+		}
+	}
+
+	for name, want := range map[string]ssh.Signal{"TERM": ssh.SIGTERM, "sigint": ssh.SIGINT, "SIGKILL": ssh.SIGKILL} {
+		if got, err := ParseSignal(name); err != nil || got != want {
+			t.Errorf("ParseSignal(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseSignal("STOP"); err == nil {
+		t.Error("ParseSignal accepted STOP")
+	}
+}
+
+func TestExecutorIdleTimeout(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	server := newSSHServer(t, b)
+	wp := CreatePool(1, "hang", clientConf, WithIdleTimeout(200*time.Millisecond), WithTimeout(time.Minute))
+	res, err := wp.executor(context.Background(), Target{Host: server.addr})
+	if !errors.Is(err, ErrIdle) || Classify(err) != ClassTimeout {
+		t.Errorf("executor returned %v, want ErrIdle", err)
+	}
+	if string(res.Output) != "hanging" {
+		t.Errorf("got output %q, want %q", res.Output, "hanging")
+	}
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	// printing resets the clock, so a command can run longer than the idle timeout
+	wp = CreatePool(
+		1,
+		"echo a; sleep 0.2; echo b; sleep 0.2; echo c",
+		ssh.ClientConfig{},
+		WithExecutor(LocalExecutor{}),
+		WithIdleTimeout(time.Second),
+	)
+	res, err = wp.executor(context.Background(), Target{Host: "here"})
+	if err != nil || string(res.Output) != "a\nb\nc\n" {
+		t.Errorf("got output %q and error %v, want %q", res.Output, err, "a\nb\nc\n")
+	}
+	wp = CreatePool(
+		1,
+		"echo a; sleep 5",
+		ssh.ClientConfig{},
+		WithExecutor(LocalExecutor{}),
+		WithIdleTimeout(300*time.Millisecond),
+	)
+	start := time.Now()
+	if _, err := wp.executor(context.Background(), Target{Host: "here"}); !errors.Is(err, ErrIdle) {
+		t.Errorf("got error %v, want ErrIdle", err)
+	}
+	if took := time.Since(start); took > 3*time.Second {
+		t.Errorf("idle command took %v to return", took)
+	}
+}
+
+func TestExecutorMaxOutput(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
+	if err != nil {
+		t.Fatalf("crypto/rand.Read: %v", err)
+	}
+
+	clientConf := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	server := newSSHServer(t, b)
+	wp := CreatePool(1, "hang", clientConf, WithMaxOutput(4, true), WithTimeout(time.Minute))
+	res, err := wp.executor(context.Background(), Target{Host: server.addr})
+	if !errors.Is(err, ErrOutputLimit) || Classify(err) != ClassOutputLimit {
+		t.Errorf("executor returned %v, want ErrOutputLimit", err)
+	}
+	if string(res.Output) != "hang" || !res.Truncated {
+		t.Errorf("got output %q, truncated %v, want %q truncated", res.Output, res.Truncated, "hang")
+	}
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	local := WithExecutor(LocalExecutor{})
+	wp = CreatePool(1, "echo 0123456789abcdef", ssh.ClientConfig{}, local, WithMaxOutput(10, false))
+	res, err = wp.executor(context.Background(), Target{Host: "here"})
+	want := "0123456789\n[output truncated after 10 bytes]\n"
+	if err != nil || string(res.Stdout) != want || !res.Truncated {
+		t.Errorf("got stdout %q, truncated %v, and error %v, want %q truncated", res.Stdout, res.Truncated, err, want)
+	}
+	wp = CreatePool(1, "while true; do echo y; done", ssh.ClientConfig{}, local, WithMaxOutput(100, true))
+	res, err = wp.executor(context.Background(), Target{Host: "here"})
+	if !errors.Is(err, ErrOutputLimit) || len(res.Output) != 100 {
+		t.Errorf("got %d bytes of output and error %v, want 100 bytes and ErrOutputLimit", len(res.Output), err)
+	}
+}
+
+func TestExecutorCancelDial(t *testing.T) {
+	// a host that accepts connections but never starts the SSH handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+	var mu sync.Mutex
+	var conns []net.Conn
 	go func() {
-		if err := newSSHServer(b, done, ready); err != nil {
-			t.Fatalf("issue running SSH server: %v", err)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
 		}
 	}()
-	<-ready
-	wp1 := CreatePool(10, "test", clientConf)
-	output, err := wp1.executor("localhost:2022")
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	clientConf := ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	wp := CreatePool(1, "test", clientConf)
+	wp.ScheduleWorkers()
+	defer func() { _ = wp.Shutdown() }()
+	for _, target := range []Target{
+		{Host: listener.Addr().String()},
+		{Host: "alias", Addr: "unused:22", Jump: []Hop{{listener.Addr().String(), clientConf}}},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		start := time.Now()
+		_, err := wp.executor(ctx, target)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("executor for %s returned %v, want context.DeadlineExceeded", target.Host, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("executor for %s took %v to give up", target.Host, elapsed)
+		}
+	}
+
+	// a job cancelled before a worker picks it up is not started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res := new(Result)
+	done := make(chan struct{})
+	wp.work(JobResult{ctx, Target{Host: listener.Addr().String()}, res, done})
+	<-done
+	if !errors.Is(res.Err, context.Canceled) {
+		t.Errorf("cancelled job returned %v, want context.Canceled", res.Err)
+	}
+}
+
+func TestExecutorTargetOverrides(t *testing.T) {
+	b := make([]byte, 32)
+	_, err := cRand.Read(b)
 	if err != nil {
-		t.Fatalf("executor failed: %v", err)
+		t.Fatalf("crypto/rand.Read: %v", err)
 	}
-	if got, want := string(output), "success!"; got != want {
-		t.Fatalf("executor returned %v, want %v", got, want)
+
+	good := ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password(string(b))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
+	bad := good
+	bad.User = "nobody"
 
-	wp2 := CreatePool(10, "fail", clientConf)
-	output, err = wp2.executor("localhost:2022")
-	if err != nil && err.Error() != "Process exited with status 1" {
+	bastion := newSSHServer(t, b)
+	target := newSSHServer(t, b)
+	wp := CreatePool(10, "test", bad)
+
+	if _, err := wp.executor(context.Background(), Target{Host: target.addr}); err == nil {
+		t.Errorf("executor should fail with the pool's config")
+	}
+	res, err := wp.executor(context.Background(), Target{
+		Host:   "alias",
+		Addr:   target.addr,
+		Config: &good,
+		Jump:   []Hop{{bastion.addr, good}},
+	})
+	if err != nil {
 		t.Fatalf("executor failed: %v", err)
 	}
-	if got, want := string(output), "failed!"; got != want {
+	if got, want := string(res.Output), "success!"; got != want {
 		t.Fatalf("executor returned %v, want %v", got, want)
 	}
-	close(done)
+	if got, want := bastion.forwarded(), 1; got != want {
+		t.Errorf("bastion forwarded %d connections, want %d", got, want)
+	}
+}
+
+// testServer: a minimal SSH server that answers exec and sftp subsystem requests and forwards direct-tcpip channels.
+// Running "test" prints "success!" and exits 0, "mixed" prints "out" to stdout and "err" to stderr, "hang" prints
+// "hanging" and never exits, "sleep" prints "sleeping" and exits 143 once sent SIGTERM, and any other command prints
+// "failed!" and exits 1.
+type testServer struct {
+	addr     string
+	config   *ssh.ServerConfig
+	listener net.Listener
+
+	mu       sync.Mutex
+	nForward int
+	nConn    int
 }
 
-//func newSSHServer(serverPass []byte, done <- chan struct{}) (*ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
-func newSSHServer(serverPass []byte, done <-chan struct{}, ready chan<- struct{}) error {
+// newSSHServer: start a testServer on a random local port, it is shut down when the test finishes.
+func newSSHServer(t *testing.T, serverPass []byte) *testServer {
 	serverConfig := &ssh.ServerConfig{
 		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
 			if c.User() == "test" && subtle.ConstantTimeCompare(serverPass, pass) == 1 {
@@ -152,74 +2153,235 @@ func newSSHServer(serverPass []byte, done <-chan struct{}, ready chan<- struct{}
 	}
 	private, err := ssh.ParsePrivateKey(pem.EncodeToMemory(&privateKeyPEM))
 	if err != nil {
-		return fmt.Errorf("ParsePrivateKey: %v", err)
+		t.Fatalf("ParsePrivateKey: %v", err)
 	}
 	serverConfig.AddHostKey(private)
 
-	listener, err := net.Listen("tcp", "localhost:2022")
+	listener, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
-		return fmt.Errorf("net.Listen: %v", err)
+		t.Fatalf("net.Listen: %v", err)
 	}
-	close(ready)
+	t.Cleanup(func() { _ = listener.Close() })
 
+	server := &testServer{
+		addr:     listener.Addr().String(),
+		config:   serverConfig,
+		listener: listener,
+	}
+	go server.serve()
+	return server
+}
+
+func (s *testServer) forwarded() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nForward
+}
+
+func (s *testServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nConn
+}
+
+func (s *testServer) serve() {
 	for {
-		// blocks waiting for connection
-		nConn, err := listener.Accept()
+		// blocks waiting for connection, fails once the listener is closed
+		nConn, err := s.listener.Accept()
 		if err != nil {
-			return fmt.Errorf("listener.Accept: %v", err)
+			return
 		}
+		go s.handleConn(nConn)
+	}
+}
 
-		conn, chans, reqs, err := ssh.NewServerConn(nConn, serverConfig)
-		if err != nil {
-			return fmt.Errorf("NewServerConn: %v", err)
-		}
+func (s *testServer) handleConn(nConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.config)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.nConn++
+	s.mu.Unlock()
+	defer func() { _ = conn.Close() }()
+	go ssh.DiscardRequests(reqs)
 
-		go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				log.Printf("could not accept channel: %v", err)
+				return
+			}
+			go s.handleSession(channel, requests)
+		case "direct-tcpip":
+			s.handleForward(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
 
-		select {
-		case newChannel := <-chans:
-			if newChannel.ChannelType() != "session" {
-				newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-				continue
+func (s *testServer) handleSession(channel ssh.Channel, in <-chan *ssh.Request) {
+	defer channel.Close()
+	var env []string
+	for req := range in {
+		switch req.Type {
+		case "env":
+			var payload struct{ Name, Value string }
+			ok := ssh.Unmarshal(req.Payload, &payload) == nil && !strings.HasPrefix(payload.Name, "REFUSED")
+			if ok {
+				env = append(env, payload.Name+"="+payload.Value)
 			}
-			channel, requests, err := newChannel.Accept()
+			if req.WantReply {
+				_ = req.Reply(ok, nil)
+			}
+		case "subsystem":
+			var payload struct{ Name string }
+			ok := ssh.Unmarshal(req.Payload, &payload) == nil && payload.Name == "sftp"
+			if req.WantReply {
+				_ = req.Reply(ok, nil)
+			}
+			if !ok {
+				return
+			}
+			// uploads go to the local filesystem, like the commands run locally
+			server, err := sftp.NewServer(channel)
 			if err != nil {
-				return fmt.Errorf("could not accept channel: %v", err)
-			}
-
-			go func(in <-chan *ssh.Request) {
-				defer channel.Close()
-				for req := range in {
-					switch req.Type {
-					case "exec":
-						cmd := req.Payload[4:]
-						var output, exitStatus []byte
-						if string(cmd) == "test" {
-							output = []byte("success!")
-							exitStatus = []byte{0, 0, 0, 0}
-						} else {
-							output = []byte("failed!")
-							exitStatus = []byte{0, 0, 0, 1}
-						}
-						if err := req.Reply(true, nil); err != nil {
-							log.Fatalf("could not reply to request: %v", err)
-						}
+				log.Printf("could not start sftp server: %v", err)
+				return
+			}
+			_ = server.Serve()
+			return
+		case "exec":
+			cmd := req.Payload[4:]
+			if err := req.Reply(true, nil); err != nil {
+				log.Printf("could not reply to request: %v", err)
+				return
+			}
 
-						if _, err := io.Copy(channel, bytes.NewReader(output)); err != nil {
-							log.Fatalf("io.Copy: %v", err)
-						}
+			status := s.run(string(cmd), env, channel, in)
+			if status < 0 {
+				return
+			}
+			exitStatus := ssh.Marshal(struct{ Status uint32 }{uint32(status)})
+			if ok, err := channel.SendRequest("exit-status", false, exitStatus); err != nil {
+				log.Printf("could not send request to channel: %v, ok: %v", err, ok)
+			}
+			return
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
 
-						if ok, err := channel.SendRequest("exit-status", false, exitStatus); err != nil {
-							log.Fatalf("could not send request to channel: %v, ok: %v", err, ok)
-						}
-						return
-					}
-				}
-			}(requests)
-		case <-done:
-			return conn.Close()
+// run: fake running cmd with env set, writing its output to channel and returning its exit status, or -1 if it never
+// exits.
+func (s *testServer) run(cmd string, env []string, channel ssh.Channel, in <-chan *ssh.Request) int {
+	switch cmd {
+	case "env":
+		_, _ = channel.Write([]byte(strings.Join(env, "\n")))
+		return 0
+	case "cat":
+		_, _ = io.Copy(channel, channel)
+		return 0
+	case "test":
+		_, _ = channel.Write([]byte("success!"))
+		return 0
+	case "mixed":
+		_, _ = channel.Write([]byte("out\n"))
+		_, _ = channel.Stderr().Write([]byte("err\n"))
+		return 0
+	case "hang":
+		// never exit, just wait for the client to give up
+		_, _ = channel.Write([]byte("hanging"))
+		_, _ = io.Copy(ioutil.Discard, channel)
+		for range in {
+			// the request channel is closed along with the session
+		}
+		return -1
+	case "sleep":
+		_, _ = channel.Write([]byte("sleeping"))
+		for req := range in {
+			var sig struct{ Signal string }
+			if req.Type == "signal" && ssh.Unmarshal(req.Payload, &sig) == nil && sig.Signal == "TERM" {
+				_, _ = channel.Write([]byte(", terminated"))
+				return 143
+			}
+		}
+		return -1
+	default:
+		if strings.Contains(cmd, "scp -") || strings.Contains(cmd, "sha256sum ") || strings.HasPrefix(cmd, "tar ") ||
+			strings.HasPrefix(cmd, ": remote-executor") || strings.HasPrefix(cmd, "id -u ") {
+			// file transfers and locks run the real scp, sha256sum, tar, or sh, the command also runs it on the remote side
+			return runShell(cmd, channel)
+		}
+		_, _ = channel.Write([]byte("failed!"))
+		return 1
+	}
+}
+
+// runShell: run cmd with sh, connected to channel, and return its exit status.
+func runShell(cmd string, channel ssh.Channel) int {
+	c := exec.Command("sh", "-c", cmd)
+	c.Stdout, c.Stderr = channel, channel.Stderr()
+	// like sshd, do not wait for the client to close stdin once the command exits
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return 127
+	}
+	go func() {
+		_, _ = io.Copy(stdin, channel)
+		_ = stdin.Close()
+	}()
+	if err := c.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
 		}
+		return 127
 	}
+	return 0
+}
+
+func (s *testServer) handleForward(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "bad payload")
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	s.mu.Lock()
+	s.nForward++
+	s.mu.Unlock()
+
+	go func() {
+		_, _ = io.Copy(channel, target)
+		_ = channel.CloseWrite()
+	}()
+	go func() {
+		_, _ = io.Copy(target, channel)
+		_ = target.Close()
+	}()
 }
 
 func randHosts(n int) []string {
@@ -230,12 +2392,7 @@ func randHosts(n int) []string {
 	return hosts
 }
 
-func (wp *WorkerPool) testWorker() {
-	for job := range wp.jobs {
-		job.result.Host = job.host
-		job.result.Output = []byte("test")
-		job.result.Err = nil
-		job.done <- struct{}{}
-	}
-	wp.wg.Done()
-}
+// testExecutor: an Executor that succeeds immediately without connecting anywhere
+var testExecutor = ExecutorFunc(func(context.Context, Target, string) (Result, error) {
+	return Result{Output: []byte("test")}, nil
+})
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrQuarantined: wrapped by the error in Result.Err when a job was not run because its host tripped the pool's
+// CircuitBreaker
+var ErrQuarantined = errors.New("host is quarantined")
+
+// CircuitBreaker: counts each host's consecutive failures to connect or get a command to run on it, and once a host
+// reaches the limit quarantines it, failing its jobs straight away instead of connecting to it again. A quarantined
+// host gets one job again once the cooldown is over, and stays quarantined if that fails too. Failures of the command
+// itself, like an exit status, show the host is healthy.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	limit    int
+	cooldown time.Duration
+	hosts    map[string]*hostHealth
+}
+
+// hostHealth: a host's consecutive failures, and when it was last quarantined
+type hostHealth struct {
+	failures    int
+	quarantined time.Time
+}
+
+// NewCircuitBreaker: create a breaker quarantining hosts after limit consecutive failures, for cooldown, or for
+// good if cooldown is zero or less, to pass to WithCircuitBreaker.
+func NewCircuitBreaker(limit int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{limit: limit, cooldown: cooldown, hosts: make(map[string]*hostHealth)}
+}
+
+// WithCircuitBreaker: stop connecting to hosts b has quarantined, failing their jobs with ErrQuarantined.
+func WithCircuitBreaker(b *CircuitBreaker) Option {
+	return func(wp *WorkerPool) {
+		wp.breaker = b
+	}
+}
+
+// Seed: start host off with failures carried over from earlier runs, quarantining it from now if they reach the
+// limit.
+func (b *CircuitBreaker) Seed(host string, failures int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	health := b.health(host)
+	health.failures = failures
+	if failures >= b.limit {
+		health.quarantined = time.Now()
+	}
+}
+
+// Failures: how many times in a row host failed, to carry over to later runs with Seed.
+func (b *CircuitBreaker) Failures(host string) int {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if health, ok := b.hosts[host]; ok {
+		return health.failures
+	}
+	return 0
+}
+
+// allow: nil if a job may run against host, the ErrQuarantined error it fails with if not.
+func (b *CircuitBreaker) allow(host string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	health, ok := b.hosts[host]
+	if !ok || health.failures < b.limit {
+		return nil
+	}
+	if b.cooldown > 0 && time.Since(health.quarantined) >= b.cooldown {
+		// let this job through, whoever comes next waits for its outcome to be recorded
+		health.quarantined = time.Now()
+		return nil
+	}
+	return fmt.Errorf("%w after %d failures in a row", ErrQuarantined, health.failures)
+}
+
+// record: count the outcome of a job that ran against host.
+func (b *CircuitBreaker) record(host string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	health := b.health(host)
+	switch Classify(err) {
+	case ClassConnect, ClassAuth, ClassHostKey, ClassSession, ClassTimeout, ClassNoExitStatus:
+		if health.failures++; health.failures == b.limit {
+			health.quarantined = time.Now()
+		}
+	case ClassCancelled, ClassSkipped, ClassQuarantined:
+		// says nothing about the host
+	default:
+		health.failures = 0
+	}
+}
+
+// health: host's entry, added if it has none yet. Must be called with b.mu held.
+func (b *CircuitBreaker) health(host string) *hostHealth {
+	health, ok := b.hosts[host]
+	if !ok {
+		health = &hostHealth{}
+		b.hosts[host] = health
+	}
+	return health
+}
@@ -0,0 +1,64 @@
+package api
+
+import "bytes"
+
+// WithCleanOutput: strip terminal escape sequences, like colors and cursor movement, and other control characters
+// from the output collected in each Result, and replace bytes that are not valid UTF-8, so reports are not polluted by
+// tools that assume a terminal. The tap and sink still get the output as it was printed.
+func WithCleanOutput(clean bool) Option {
+	return func(wp *WorkerPool) {
+		wp.cleanOutput = clean
+	}
+}
+
+// CleanOutput: data without ANSI escape sequences or control characters other than newlines, tabs, and carriage
+// returns, and with every run of bytes that is not valid UTF-8 replaced by U+FFFD.
+func CleanOutput(data []byte) []byte {
+	data = bytes.ToValidUTF8(data, []byte("\uFFFD"))
+	cleaned := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == 0x1b:
+			i = escapeEnd(data, i)
+		case c < 0x20 && c != '\n' && c != '\t' && c != '\r', c == 0x7f:
+		default:
+			cleaned = append(cleaned, c)
+		}
+	}
+	return cleaned
+}
+
+// escapeEnd: the index of the last byte of the escape sequence starting at data[i].
+func escapeEnd(data []byte, i int) int {
+	if i+1 == len(data) {
+		return i
+	}
+	switch data[i+1] {
+	case '[':
+		// CSI, e.g. colors: parameters up to a final byte from @ to ~
+		for j := i + 2; j < len(data); j++ {
+			if data[j] >= 0x40 && data[j] <= 0x7e {
+				return j
+			}
+		}
+	case ']', 'P', '_', '^':
+		// OSC and the like, e.g. window titles: a string up to BEL or ESC \
+		for j := i + 2; j < len(data); j++ {
+			if data[j] == 0x07 {
+				return j
+			}
+			if data[j] == 0x1b && j+1 < len(data) && data[j+1] == '\\' {
+				return j + 1
+			}
+		}
+	default:
+		// anything else, e.g. character set selection: intermediate bytes and a final byte
+		j := i + 1
+		for j < len(data)-1 && data[j] >= 0x20 && data[j] <= 0x2f {
+			j++
+		}
+		return j
+	}
+	// an unterminated sequence runs to the end of the output
+	return len(data) - 1
+}
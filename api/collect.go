@@ -0,0 +1,81 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Collect: an Action archiving the remote files and directory trees at paths on each host with tar and gzip, and
+// streaming the archive to the local file dest returns for the host, e.g. to grab logs and cores from many hosts
+// during an incident. Relative paths are relative to the remote user's home directory. If tar fails part way, e.g.
+// because a path is missing, what it archived is kept and the error is returned.
+func Collect(paths []string, dest func(target Target) string) (Action, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("nothing to collect")
+	}
+	// names are rooted at ./ so none is taken for an option, absolute ones come after -C /
+	var relative, absolute []string
+	for _, p := range paths {
+		if path.IsAbs(p) {
+			absolute = append(absolute, ShellQuote("."+path.Clean(p)))
+		} else {
+			relative = append(relative, ShellQuote("./"+path.Clean(p)))
+		}
+	}
+	cmd := "tar -czf -"
+	if len(relative) > 0 {
+		cmd += " " + strings.Join(relative, " ")
+	}
+	if len(absolute) > 0 {
+		cmd += " -C / " + strings.Join(absolute, " ")
+	}
+	return func(ctx context.Context, client *ssh.Client, target Target, out io.Writer) error {
+		local := dest(target)
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		sess, err := client.NewSession()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrSession, err)
+		}
+		defer func() { _ = sess.Close() }()
+		archive := &countingWriter{w: f}
+		var stderr bytes.Buffer
+		sess.Stdout, sess.Stderr = archive, &stderr
+		if err := sess.Run(cmd); err != nil {
+			err = remoteError(err, stderr.Bytes())
+			return fmt.Errorf("%w; the %d bytes collected to %s may be incomplete", err, archive.n, local)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(out, "collected %d bytes to %s\n", archive.n, local)
+		return nil
+	}, nil
+}
+
+// countingWriter: counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// WithConnectionReuse: keep each host's connection open after a job and run later jobs against the same host as new
+// sessions on it, instead of dialling and authenticating again. Call Close once the pool is no longer needed.
+func WithConnectionReuse() Option {
+	return func(wp *WorkerPool) {
+		wp.conns = NewConnectionCache()
+		wp.sharedConns = false
+	}
+}
+
+// WithConnectionCache: like WithConnectionReuse, but keep the connections in cache, so pools given the same cache,
+// e.g. one per serve job, reuse each other's connections. The pool's Close leaves them open, close the cache once no
+// pool needs it anymore.
+func WithConnectionCache(cache *ConnectionCache) Option {
+	return func(wp *WorkerPool) {
+		wp.conns = cache
+		wp.sharedConns = cache != nil
+	}
+}
+
+// ConnectionCache: open connections by user and address, shared by every worker of the pools using it
+type ConnectionCache struct {
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+}
+
+// NewConnectionCache: an empty cache for WithConnectionCache.
+func NewConnectionCache() *ConnectionCache {
+	return &ConnectionCache{clients: make(map[string]*ssh.Client)}
+}
+
+// cacheKey: connections are only shared between targets dialled at the same address as the same user.
+func (wp *WorkerPool) cacheKey(target Target) string {
+	addr := target.Addr
+	if addr == "" {
+		addr = target.Host
+	}
+	config := wp.sshConfig
+	if target.Config != nil {
+		config = *target.Config
+	}
+	return config.User + "@" + addr
+}
+
+// get: the open connection for key, nil if there is none.
+func (c *ConnectionCache) get(key string) *ssh.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clients[key]
+}
+
+// put: keep client for later jobs, unless another worker connected to the same host first. Returns whether client
+// was kept, the caller closes it otherwise.
+func (c *ConnectionCache) put(key string, client *ssh.Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.clients[key]; ok {
+		return false
+	}
+	c.clients[key] = client
+	return true
+}
+
+// evict: forget and close client if it is still the connection kept for key.
+func (c *ConnectionCache) evict(key string, client *ssh.Client) {
+	c.mu.Lock()
+	if c.clients[key] == client {
+		delete(c.clients, key)
+	}
+	c.mu.Unlock()
+	_ = client.Close()
+}
+
+// Close: close every kept connection, pools using the cache connect again for their next jobs.
+func (c *ConnectionCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for key, client := range c.clients {
+		if err := client.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", key, err))
+		}
+		delete(c.clients, key)
+	}
+	return errors.Join(errs...)
+}
+
+// client: a connection to target, reusing a kept one if there is one, along with when connecting started for the
+// timeout to count from. release must be called with the job's error once the job is done with the connection.
+func (wp *WorkerPool) client(ctx context.Context, target Target) (*ssh.Client, time.Time, func(error), error) {
+	var key string
+	if wp.conns != nil {
+		key = wp.cacheKey(target)
+		if client := wp.conns.get(key); client != nil {
+			// the host may have dropped the connection since, try a session before trusting it
+			sess, err := client.NewSession()
+			if err == nil {
+				_ = sess.Close()
+				wp.log.Debug(fmt.Sprintf("reusing the connection to %s", key), "host", target.Host)
+				return client, time.Now(), wp.conns.release(key, client), nil
+			}
+			wp.log.Debug(fmt.Sprintf("dropping the connection to %s: %v", key, err), "host", target.Host)
+			wp.conns.evict(key, client)
+		}
+	}
+
+	if wp.limiter != nil {
+		if err := wp.limiter.Wait(ctx); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, time.Time{}, nil, ctxErr
+			}
+			return nil, time.Time{}, nil, fmt.Errorf("%w: %v", ErrDial, err)
+		}
+	}
+	if err := wp.jitter(ctx); err != nil {
+		return nil, time.Time{}, nil, err
+	}
+	start := time.Now()
+	client, err := wp.dial(ctx, target)
+	wp.metrics.dialled(time.Since(start))
+	if err != nil && ctx.Err() != nil {
+		return nil, start, nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, start, nil, fmt.Errorf("%w: %v", ErrDial, err)
+	}
+	if wp.conns != nil && wp.conns.put(key, client) {
+		return client, start, wp.conns.release(key, client), nil
+	}
+	return client, start, func(error) { _ = client.Close() }, nil
+}
+
+// jitter: wait a random time of up to the pool's dial jitter, or until ctx is done, returning its error.
+func (wp *WorkerPool) jitter(ctx context.Context) error {
+	if wp.dialJitter <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(wp.dialJitter) + 1)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release: keep client for the next job unless the job's error leaves the connection in doubt.
+func (c *ConnectionCache) release(key string, client *ssh.Client) func(error) {
+	return func(err error) {
+		switch Classify(err) {
+		case ClassOK, ClassExitStatus, ClassChecksum:
+		default:
+			c.evict(key, client)
+		}
+	}
+}
+
+// Close: close the connections kept open by WithConnectionReuse and any jump host connections. Jobs run afterwards
+// connect again. Connections in a WithConnectionCache cache are left to its owner.
+func (wp *WorkerPool) Close() error {
+	var errs []error
+	if wp.conns != nil && !wp.sharedConns {
+		errs = append(errs, wp.conns.Close())
+	}
+	chains := []*jumpChain{wp.jump}
+	wp.chainsMu.Lock()
+	for _, chain := range wp.chains {
+		chains = append(chains, chain)
+	}
+	wp.chainsMu.Unlock()
+	for _, chain := range chains {
+		if chain == nil {
+			continue
+		}
+		chain.mu.Lock()
+		chain.closeLocked()
+		chain.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"os/exec"
+)
+
+// DockerExecutor: runs commands inside containers with docker exec, or a CLI that takes the same arguments like
+// nerdctl for containerd or podman. The container is the target's Addr, or its Host if that is empty.
+type DockerExecutor struct {
+	// CLI is the program run, docker if empty
+	CLI string
+	// User runs the command as this user in the container instead of the container's default
+	User string
+}
+
+func (e DockerExecutor) Run(ctx context.Context, target Target, cmd string) (Result, error) {
+	return runProcess(ctx, e.command(ctx, target, cmd, target.Env), &commandOutput{}, nil)
+}
+
+func (e DockerExecutor) runIn(ctx context.Context, wp *WorkerPool, target Target, cmd string) (Result, error) {
+	return wp.runProcess(ctx, target, e.command(ctx, target, cmd, wp.environ(target)))
+}
+
+// command: the docker exec process running cmd with sh -c in target's container with env set, killed once ctx is
+// done. Only env is passed to the container, not this process's environment.
+func (e DockerExecutor) command(ctx context.Context, target Target, cmd string, env map[string]string) *exec.Cmd {
+	cli := e.CLI
+	if cli == "" {
+		cli = "docker"
+	}
+	container := target.Addr
+	if container == "" {
+		container = target.Host
+	}
+	// -i keeps stdin open for the pool's input, without any it reads nothing
+	args := []string{"exec", "-i"}
+	if e.User != "" {
+		args = append(args, "--user", e.User)
+	}
+	for _, entry := range envList(env) {
+		args = append(args, "--env", entry)
+	}
+	args = append(args, container, "sh", "-c", cmd)
+	return exec.CommandContext(ctx, cli, args...)
+}
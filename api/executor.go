@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Executor: the transport a pool's workers run the command against a target with, SSH unless WithExecutor is used.
+// Run may be called from many workers at once. The pool fills in the Result's Host, ExitCode, Duration, and Err, so
+// Run only needs to return the output. A command that ran but failed should return an error with an ExitStatus() int
+// method, e.g. an *ExitError, for its exit code to be reported.
+type Executor interface {
+	Run(ctx context.Context, target Target, cmd string) (Result, error)
+}
+
+// ExecutorFunc: adapts a function to an Executor
+type ExecutorFunc func(ctx context.Context, target Target, cmd string) (Result, error)
+
+func (f ExecutorFunc) Run(ctx context.Context, target Target, cmd string) (Result, error) {
+	return f(ctx, target, cmd)
+}
+
+// WithExecutor: run commands with exec instead of over SSH. The pool's timeout cancels the context passed to Run.
+// Actions only run over SSH. WithEnv, WithStdin, WithOutputTap, WithOutputSink, and WithBufferLimit are left to exec,
+// apart from the Executors in this package, which follow them. If exec is an io.Closer it is closed by Shutdown.
+func WithExecutor(exec Executor) Option {
+	return func(wp *WorkerPool) {
+		wp.exec = exec
+	}
+}
+
+// ExitError: a command that ran to completion with a non-zero exit status, for Executors to return
+type ExitError struct {
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %d", e.Status)
+}
+
+func (e *ExitError) ExitStatus() int {
+	return e.Status
+}
+
+// sshExecutor: the default Executor, runs commands over the pool's SSH connections
+type sshExecutor struct {
+	wp *WorkerPool
+}
+
+func (e sshExecutor) Run(ctx context.Context, target Target, cmd string) (Result, error) {
+	return e.wp.runSSH(ctx, target, cmd)
+}
+
+// poolExecutor: an Executor that takes the pool's environment variables, stdin, and output settings into account when
+// a pool runs it
+type poolExecutor interface {
+	Executor
+	runIn(ctx context.Context, wp *WorkerPool, target Target, cmd string) (Result, error)
+}
+
+// stopKey: the context key a job's function to stop it early is kept under, for openOutput to find
+type stopKey struct{}
+
+// jobStop: the function stopping the job run with ctx early with the error it should fail with, nil if it cannot be.
+func jobStop(ctx context.Context) context.CancelCauseFunc {
+	stop, _ := ctx.Value(stopKey{}).(context.CancelCauseFunc)
+	return stop
+}
+
+// executor: run the pool's command against target, stopping it early if it goes idle or prints too much.
+func (wp *WorkerPool) executor(ctx context.Context, target Target) (Result, error) {
+	if wp.action != nil || (wp.idleTimeout <= 0 && (wp.maxOutput <= 0 || !wp.abortOutput)) {
+		return wp.execute(ctx, target)
+	}
+	jobCtx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+	res, err := wp.execute(context.WithValue(jobCtx, stopKey{}, stop), target)
+	// only the job's own stops cancel jobCtx with a cause while ctx is still running
+	if cause := context.Cause(jobCtx); err != nil && ctx.Err() == nil && cause != nil {
+		err = cause
+	}
+	return res, err
+}
+
+// execute: run the pool's command against target with the target's Executor, or else the pool's, applying the
+// target's or pool's timeout to Executors that do not handle it themselves.
+func (wp *WorkerPool) execute(ctx context.Context, target Target) (Result, error) {
+	exec := wp.exec
+	if target.Executor != nil {
+		exec = target.Executor
+	}
+	if _, ok := exec.(sshExecutor); ok {
+		return exec.Run(ctx, target, wp.cmd)
+	}
+	if wp.action != nil {
+		return Result{}, errors.New("actions only run over ssh")
+	}
+	run := exec.Run
+	if pe, ok := exec.(poolExecutor); ok {
+		run = func(ctx context.Context, target Target, cmd string) (Result, error) {
+			return pe.runIn(ctx, wp, target, cmd)
+		}
+	}
+	timeout := wp.timeoutFor(target)
+	if timeout <= 0 {
+		return run(ctx, target, wp.cmd)
+	}
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res, err := run(runCtx, target, wp.cmd)
+	if err != nil && ctx.Err() == nil && runCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%w after %v", ErrTimeout, timeout)
+	}
+	return res, err
+}
+
+// closeExecutor: close the pool's Executor if it holds anything open.
+func (wp *WorkerPool) closeExecutor() error {
+	if closer, ok := wp.exec.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
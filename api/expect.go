@@ -0,0 +1,77 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ErrUnexpectedOutput: wrapped by the error in Result.Err when a command succeeded but its stdout did not meet the
+// pool's Expectation
+var ErrUnexpectedOutput = errors.New("unexpected output")
+
+// Expectation: what a command's stdout must look like for its job to succeed, on top of exiting 0
+type Expectation struct {
+	// Regex, if set, must match somewhere in stdout
+	Regex *regexp.Regexp
+	// Exact, if not empty, must be the whole of stdout, leading and trailing whitespace aside
+	Exact string
+}
+
+// WithExpect: fail every job whose command exits 0 but whose stdout does not meet expect, with ErrUnexpectedOutput,
+// e.g. to check the same version is installed everywhere. Actions are not checked.
+func WithExpect(expect Expectation) Option {
+	return func(wp *WorkerPool) {
+		wp.expect = expect
+	}
+}
+
+// WithOKExitCodes: count the commands exiting with any of codes as successful, and every other exit status as a
+// failure, e.g. 0 and 1 for grep, where 1 only means nothing matched. Result.ExitCode still holds the actual status.
+// Empty means only 0 is successful. Actions are not affected.
+func WithOKExitCodes(codes []int) Option {
+	return func(wp *WorkerPool) {
+		wp.okExitCodes = codes
+	}
+}
+
+// judge: the error a command's job fails with, given the error it ended with and its result, after the pool's ok
+// exit codes and expectation. Result.ExitCode is left as it was.
+func (wp *WorkerPool) judge(res Result, err error) error {
+	var exitErr exitStatuser
+	switch {
+	case err == nil && !wp.exitOK(0):
+		return &ExitError{Status: 0}
+	case errors.As(err, &exitErr) && wp.exitOK(res.ExitCode):
+		err = nil
+	}
+	if err == nil {
+		return wp.expect.check(res)
+	}
+	return err
+}
+
+// exitOK: whether a command that exited with code counts as successful.
+func (wp *WorkerPool) exitOK(code int) bool {
+	if len(wp.okExitCodes) == 0 {
+		return code == 0
+	}
+	for _, ok := range wp.okExitCodes {
+		if code == ok {
+			return true
+		}
+	}
+	return false
+}
+
+// check: the error res fails with for not meeting the expectation, nil if it does.
+func (e Expectation) check(res Result) error {
+	if e.Regex != nil && !e.Regex.Match(res.Stdout) {
+		return fmt.Errorf("%w: stdout does not match %q", ErrUnexpectedOutput, e.Regex)
+	}
+	if e.Exact != "" && !bytes.Equal(bytes.TrimSpace(res.Stdout), bytes.TrimSpace([]byte(e.Exact))) {
+		return fmt.Errorf("%w: stdout is not %q", ErrUnexpectedOutput, e.Exact)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrIdle: wrapped by the error in Result.Err when a command printed nothing for longer than the pool's idle timeout
+var ErrIdle = errors.New("no output")
+
+// WithIdleTimeout: stop a job once its command has gone idle long without printing anything, to catch commands that
+// hang without ever exiting, separately from the pool's timeout. The command is stopped like on timeout, see
+// WithStopSignal, and the job fails with ErrIdle. The clock starts when the command does, so connecting does not count.
+// Executors that only report output once the command is over, like SSMExecutor, are never stopped. Zero or less
+// means no limit.
+func WithIdleTimeout(idle time.Duration) Option {
+	return func(wp *WorkerPool) {
+		wp.idleTimeout = idle
+	}
+}
+
+// idleWatch: stops a job once its command has printed nothing for timeout. Every write resets the clock.
+type idleWatch struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	timer   *time.Timer
+	stop    context.CancelCauseFunc
+	stopped bool
+}
+
+func newIdleWatch(timeout time.Duration, stop context.CancelCauseFunc) *idleWatch {
+	return &idleWatch{timeout: timeout, stop: stop}
+}
+
+// start: start the clock, once the command is about to run.
+func (w *idleWatch) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer == nil && !w.stopped {
+		w.timer = time.AfterFunc(w.timeout, func() { w.stop(fmt.Errorf("%w for %v", ErrIdle, w.timeout)) })
+	}
+}
+
+// touch: reset the clock, the command just printed something.
+func (w *idleWatch) touch() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil && !w.stopped {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// close: stop the clock once the command is over.
+func (w *idleWatch) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
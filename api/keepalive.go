@@ -0,0 +1,77 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrKeepalive: wrapped by the error in Result.Err when the host stopped answering keepalives mid-job
+var ErrKeepalive = errors.New("host stopped answering keepalives")
+
+// WithKeepalive: ask the host for a reply every interval while a job runs, and fail the job with ErrKeepalive once
+// count replies in a row are missing, like OpenSSH's ServerAliveInterval and ServerAliveCountMax. Without it a
+// connection silently dropped by a NAT or firewall hangs the job until the pool's timeout, if there is one.
+func WithKeepalive(interval time.Duration, count int) Option {
+	return func(wp *WorkerPool) {
+		if count < 1 {
+			count = 1
+		}
+		wp.keepaliveInterval = interval
+		wp.keepaliveCount = count
+	}
+}
+
+// keepalive: ping the host behind client until stop is called. The returned channel is closed, and the connection
+// with it, once the host misses too many replies. Both are nil if keepalives are off.
+func (wp *WorkerPool) keepalive(client *ssh.Client, host string) (<-chan struct{}, func()) {
+	if wp.keepaliveInterval <= 0 {
+		return nil, func() {}
+	}
+	dead := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(wp.keepaliveInterval)
+		defer ticker.Stop()
+		missed := 0
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			reply := make(chan error, 1)
+			go func() {
+				// any reply will do, most servers answer the OpenSSH request with a failure
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+			timer := time.NewTimer(wp.keepaliveInterval)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case err := <-reply:
+				if err != nil {
+					// the connection is already gone
+					missed = wp.keepaliveCount
+				} else {
+					missed = 0
+				}
+			case <-timer.C:
+				missed++
+			}
+			timer.Stop()
+
+			if missed >= wp.keepaliveCount {
+				wp.log.Debug("host stopped answering keepalives", "host", host, "missed", missed)
+				close(dead)
+				_ = client.Close()
+				return
+			}
+		}
+	}()
+	return dead, func() { close(stop) }
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+)
+
+// KubectlExecutor: runs commands inside Kubernetes pods with kubectl exec, through the API server's exec subresource.
+// The pod is the target's Addr, or its Host if that is empty, in namespace/pod form to pick its namespace.
+type KubectlExecutor struct {
+	// CLI is the program run, kubectl if empty
+	CLI string
+	// Context is the kubeconfig context to use instead of the current one
+	Context string
+	// Namespace is used for pods not given in namespace/pod form, the context's namespace if empty
+	Namespace string
+	// Container runs the command in this container of the pod instead of its default one
+	Container string
+}
+
+func (e KubectlExecutor) Run(ctx context.Context, target Target, cmd string) (Result, error) {
+	return runProcess(ctx, e.command(ctx, target, cmd, target.Env), &commandOutput{}, nil)
+}
+
+func (e KubectlExecutor) runIn(ctx context.Context, wp *WorkerPool, target Target, cmd string) (Result, error) {
+	return wp.runProcess(ctx, target, e.command(ctx, target, cmd, wp.environ(target)))
+}
+
+// command: the kubectl exec process running cmd with sh -c in target's pod with env set, killed once ctx is done.
+// kubectl exec cannot set environment variables, so they are set with env inside the pod.
+func (e KubectlExecutor) command(ctx context.Context, target Target, cmd string, env map[string]string) *exec.Cmd {
+	cli := e.CLI
+	if cli == "" {
+		cli = "kubectl"
+	}
+	pod := target.Addr
+	if pod == "" {
+		pod = target.Host
+	}
+	namespace := e.Namespace
+	if ns, name, ok := strings.Cut(pod, "/"); ok {
+		namespace, pod = ns, name
+	}
+	// -i keeps stdin open for the pool's input, without any it reads nothing
+	args := []string{"exec", "-i"}
+	if e.Context != "" {
+		args = append(args, "--context", e.Context)
+	}
+	if namespace != "" {
+		args = append(args, "--namespace", namespace)
+	}
+	args = append(args, pod)
+	if e.Container != "" {
+		args = append(args, "--container", e.Container)
+	}
+	args = append(args, "--")
+	if entries := envList(env); len(entries) > 0 {
+		args = append(append(args, "env"), entries...)
+	}
+	args = append(args, "sh", "-c", cmd)
+	return exec.CommandContext(ctx, cli, args...)
+}
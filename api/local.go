@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+)
+
+// localWaitDelay: how long a local command's output is still read after it exits or is killed, in case it left
+// processes behind that hold on to its stdout or stderr
+const localWaitDelay = time.Second
+
+// LocalExecutor: runs commands on this machine with os/exec instead of connecting anywhere, for dry runs, smoke tests,
+// and the steps of a run that belong on the operator's machine. The target's Host only names it in the Result.
+type LocalExecutor struct {
+	// Shell is the program and arguments the command is passed to as the last argument, sh -c if empty
+	Shell []string
+}
+
+func (e LocalExecutor) Run(ctx context.Context, target Target, cmd string) (Result, error) {
+	return runProcess(ctx, e.command(ctx, cmd, target.Env), &commandOutput{}, nil)
+}
+
+func (e LocalExecutor) runIn(ctx context.Context, wp *WorkerPool, target Target, cmd string) (Result, error) {
+	return wp.runProcess(ctx, target, e.command(ctx, cmd, wp.environ(target)))
+}
+
+// command: the process running cmd with env added to this process's environment, killed once ctx is done.
+func (e LocalExecutor) command(ctx context.Context, cmd string, env map[string]string) *exec.Cmd {
+	shell := e.Shell
+	if len(shell) == 0 {
+		shell = []string{"sh", "-c"}
+	}
+	c := exec.CommandContext(ctx, shell[0], append(append([]string{}, shell[1:]...), cmd)...)
+	c.Env = append(os.Environ(), envList(env)...)
+	return c
+}
+
+// envList: env as NAME=value entries, sorted by name.
+func envList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for name, value := range env {
+		list = append(list, name+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// runProcess: run c, started with ctx, for target with the pool's stdin and output settings.
+func (wp *WorkerPool) runProcess(ctx context.Context, target Target, c *exec.Cmd) (res Result, err error) {
+	out, err := wp.openOutput(ctx, target)
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		if closeErr := out.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	return runProcess(ctx, c, out, wp.stdin)
+}
+
+// runProcess: run c, started with ctx, to completion, feeding it stdin and collecting its output with out. A non-zero
+// exit status is returned as an *ExitError, and ctx's error if c was killed because ctx is done.
+func runProcess(ctx context.Context, c *exec.Cmd, out *commandOutput, stdin []byte) (Result, error) {
+	var res Result
+	c.Stdout, c.Stderr = out.writers()
+	if stdin != nil {
+		c.Stdin = bytes.NewReader(stdin)
+	}
+	c.WaitDelay = localWaitDelay
+	err := c.Run()
+	out.collect(&res)
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		err = &ExitError{Status: exitErr.ExitCode()}
+	}
+	return res, err
+}
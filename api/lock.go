@@ -0,0 +1,121 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrLocked: wrapped by the error in Result.Err when another run holds the host's RemoteLock
+var ErrLocked = errors.New("host is locked")
+
+// lockedStatus: the exit status of the lock script when the lock is held by someone else
+const lockedStatus = 75
+
+// RemoteLock: a lock taken on each host before its command or action runs and released once it is over, so runs
+// from different places cannot step on each other on the same host. The lock is a directory holding who took it and
+// when it expires.
+type RemoteLock struct {
+	// Path is the directory created on each host as the lock, e.g. /tmp/remote-executor.lock
+	Path string
+	// Owner describes who holds the lock to anyone else trying to take it, e.g. alice@laptop
+	Owner string
+	// TTL is how long the lock is held at most, a lock left behind by a run that never released it is taken over
+	// once it is up
+	TTL time.Duration
+}
+
+// WithRemoteLock: take lock on each host over SSH before running anything on it, failing the job with ErrLocked
+// if another run holds it. Hosts that are not run over SSH are not locked.
+func WithRemoteLock(lock RemoteLock) Option {
+	return func(wp *WorkerPool) {
+		wp.lock = lock
+	}
+}
+
+// acquire: take the pool's lock on the host client is connected to, and return the function releasing it.
+func (wp *WorkerPool) acquire(ctx context.Context, client *ssh.Client) (func(), error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	ttl := int64(wp.lock.TTL / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	// a lock without an expiry is still being written by whoever took it, so it is held
+	script := fmt.Sprintf(`: remote-executor lock; l=%s; now=$(date +%%s)
+if ! mkdir -- "$l" 2>/dev/null; then
+	expires=$(cat -- "$l/expires" 2>/dev/null || echo $now)
+	if [ "$now" -lt "$expires" ] || [ ! -e "$l/expires" ]; then
+		printf '%%s\n%%s\n' "$expires" "$(cat -- "$l/owner" 2>/dev/null)"; exit %d
+	fi
+	rm -rf -- "$l" && mkdir -- "$l" || exit %d
+fi
+printf '%%s\n' %s >"$l/owner" && printf %%s %s >"$l/token" && echo $((now + %d)) >"$l/expires"`,
+		ShellQuote(wp.lock.Path),
+		lockedStatus,
+		lockedStatus,
+		ShellQuote(wp.lock.Owner),
+		hex.EncodeToString(token),
+		ttl,
+	)
+	stdout, err := runQuiet(ctx, client, script)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitStatus() == lockedStatus {
+		return nil, lockedError(stdout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to take the lock %s: %w", wp.lock.Path, err)
+	}
+	release := fmt.Sprintf(
+		`: remote-executor unlock; l=%s; [ "$(cat -- "$l/token" 2>/dev/null)" != %s ] || rm -rf -- "$l"`,
+		ShellQuote(wp.lock.Path),
+		hex.EncodeToString(token),
+	)
+	return func() {
+		// the job is over, whether or not its context is, so the lock is released anyway
+		if _, err := runQuiet(context.Background(), client, release); err != nil {
+			wp.log.Debug(fmt.Sprintf("unable to release the lock %s: %v", wp.lock.Path, err), "error", err.Error())
+		}
+	}, nil
+}
+
+// lockedError: the ErrLocked error for the expiry and owner the lock script reported for a lock held by another run.
+func lockedError(report []byte) error {
+	lines := strings.SplitN(strings.TrimSpace(string(report)), "\n", 2)
+	expires, err := strconv.ParseInt(lines[0], 10, 64)
+	if err != nil || len(lines) < 2 {
+		return ErrLocked
+	}
+	return fmt.Errorf("%w by %s until %s", ErrLocked, lines[1], time.Unix(expires, 0).Format(time.RFC3339))
+}
+
+// runQuiet: run a short script in a session of its own and return its stdout, closing the session if ctx is done
+// first. What the script wrote to stderr is part of the error.
+func runQuiet(ctx context.Context, client *ssh.Client, script string) ([]byte, error) {
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSession, err)
+	}
+	defer func() { _ = sess.Close() }()
+	var stdout, stderr bytes.Buffer
+	sess.Stdout, sess.Stderr = &stdout, &stderr
+	stop := context.AfterFunc(ctx, func() { _ = sess.Close() })
+	defer stop()
+	if err := sess.Run(script); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return stdout.Bytes(), ctxErr
+		}
+		return stdout.Bytes(), remoteError(err, stderr.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets: histogram upper bounds in seconds, from a fast LAN handshake to a long running command
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// histogram: a cumulative Prometheus histogram
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range latencyBuckets {
+		var count uint64
+		if h.counts != nil {
+			count = h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, count)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, h.count, name, h.sum, name, h.count)
+}
+
+// Metrics: counters and histograms describing a WorkerPool's jobs, served in the Prometheus text format.
+// A nil *Metrics records nothing.
+type Metrics struct {
+	mu        sync.Mutex
+	started   uint64
+	succeeded uint64
+	failed    map[string]uint64
+	queued    int64
+	running   int64
+	workers   int64
+	dial      histogram
+	exec      histogram
+}
+
+// NewMetrics: create an empty set of metrics to pass to WithMetrics.
+func NewMetrics() *Metrics {
+	return &Metrics{failed: make(map[string]uint64)}
+}
+
+// WithMetrics: record job counts, dial latency, execution time, and queue depth in m.
+func WithMetrics(m *Metrics) Option {
+	return func(wp *WorkerPool) {
+		wp.metrics = m
+	}
+}
+
+// queue: a job is waiting for a worker, or has stopped waiting if delta is negative.
+func (m *Metrics) queue(delta int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued += delta
+}
+
+// scaled: workers were added to the pool, or removed if delta is negative.
+func (m *Metrics) scaled(delta int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workers += delta
+}
+
+// start: a worker picked up a job.
+func (m *Metrics) start() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started++
+	m.running++
+}
+
+// dialled: a connection attempt finished after d.
+func (m *Metrics) dialled(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dial.observe(d)
+}
+
+// finish: a job finished after d, successfully if class is ClassOK.
+func (m *Metrics) finish(class string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running--
+	if class == ClassOK {
+		m.succeeded++
+	} else {
+		m.failed[class]++
+	}
+	m.exec.observe(d)
+}
+
+// Export: write every metric in the Prometheus text exposition format.
+func (m *Metrics) Export(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP remote_executor_jobs_started_total Jobs picked up by a worker.\n")
+	fmt.Fprintf(w, "# TYPE remote_executor_jobs_started_total counter\n")
+	fmt.Fprintf(w, "remote_executor_jobs_started_total %d\n", m.started)
+	fmt.Fprintf(w, "# HELP remote_executor_jobs_succeeded_total Jobs that ran the command with exit status 0.\n")
+	fmt.Fprintf(w, "# TYPE remote_executor_jobs_succeeded_total counter\n")
+	fmt.Fprintf(w, "remote_executor_jobs_succeeded_total %d\n", m.succeeded)
+	fmt.Fprintf(w, "# HELP remote_executor_jobs_failed_total Jobs that failed, by error class.\n")
+	fmt.Fprintf(w, "# TYPE remote_executor_jobs_failed_total counter\n")
+	classes := make([]string, 0, len(m.failed))
+	for class := range m.failed {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Fprintf(w, "remote_executor_jobs_failed_total{class=%q} %d\n", class, m.failed[class])
+	}
+	fmt.Fprintf(w, "# HELP remote_executor_jobs_running Jobs currently being run by a worker.\n")
+	fmt.Fprintf(w, "# TYPE remote_executor_jobs_running gauge\n")
+	fmt.Fprintf(w, "remote_executor_jobs_running %d\n", m.running)
+	fmt.Fprintf(w, "# HELP remote_executor_workers Workers in the pool.\n")
+	fmt.Fprintf(w, "# TYPE remote_executor_workers gauge\n")
+	fmt.Fprintf(w, "remote_executor_workers %d\n", m.workers)
+	fmt.Fprintf(w, "# HELP remote_executor_queue_depth Jobs waiting for a free worker.\n")
+	fmt.Fprintf(w, "# TYPE remote_executor_queue_depth gauge\n")
+	fmt.Fprintf(w, "remote_executor_queue_depth %d\n", m.queued)
+	m.dial.write(w, "remote_executor_dial_duration_seconds", "Time taken to connect and authenticate to a host.")
+	m.exec.write(w, "remote_executor_exec_duration_seconds", "Time taken by a job, from pickup to result.")
+}
+
+// ServeHTTP: serve the metrics for a Prometheus scrape.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Export(w)
+}
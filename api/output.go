@@ -0,0 +1,204 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// OutputSink: opens the writers a target's stdout and stderr are streamed to as they arrive, e.g. files. Both are
+// closed once the command is over. Actions are not streamed to the sink.
+type OutputSink func(target Target) (stdout, stderr io.WriteCloser, err error)
+
+// WithOutputSink: stream every command's output to the writers sink opens for its target, on top of collecting it in
+// the Result. Combined with WithBufferLimit, output of any size can be kept without holding it all in memory.
+func WithOutputSink(sink OutputSink) Option {
+	return func(wp *WorkerPool) {
+		wp.sink = sink
+	}
+}
+
+// WithBufferLimit: keep at most limit bytes of each of a command's stdout, stderr, and combined output in its Result,
+// dropping the rest and setting Result.Truncated. Zero or less keeps everything.
+func WithBufferLimit(limit int) Option {
+	return func(wp *WorkerPool) {
+		wp.bufferLimit = limit
+	}
+}
+
+// ErrOutputLimit: wrapped by the error in Result.Err when a command was stopped for printing more than the pool's
+// output limit
+var ErrOutputLimit = errors.New("too much output")
+
+// WithMaxOutput: cap the output a command may print at limit bytes of stdout and stderr together, to protect the run,
+// the tap, and the sink against a host printing far more than expected. Unlike WithBufferLimit, nothing past the
+// limit is passed on: the rest of the output is dropped after a marker line and Result.Truncated is set, or with
+// abort, the command is stopped like on timeout, see WithStopSignal, and the job fails with ErrOutputLimit. Zero or
+// less means no limit.
+func WithMaxOutput(limit int64, abort bool) Option {
+	return func(wp *WorkerPool) {
+		wp.maxOutput = limit
+		wp.abortOutput = abort
+	}
+}
+
+// cappedBuffer: a buffer that keeps the first limit bytes written to it and discards the rest
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.limit > 0 {
+		if room := b.limit - b.buf.Len(); room < len(p) {
+			b.truncated = true
+			if room > 0 {
+				b.buf.Write(p[:room])
+			}
+			return len(p), nil
+		}
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// outputWriter: one of a command's output streams, serializing writes from the stdout and stderr copiers into the
+// shared buffers and keeping the command within its output limit
+type outputWriter struct {
+	o *commandOutput
+	w io.Writer
+}
+
+func (ow outputWriter) Write(p []byte) (int, error) {
+	o := ow.o
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.idle != nil {
+		o.idle.touch()
+	}
+	if o.limit <= 0 {
+		return ow.w.Write(p)
+	}
+	if o.overLimit {
+		return len(p), nil
+	}
+	total := len(p)
+	if room := o.limit - o.written; room < int64(len(p)) {
+		o.overLimit = true
+		p = p[:room]
+	}
+	o.written += int64(len(p))
+	n, err := ow.w.Write(p)
+	if err != nil || !o.overLimit {
+		return n, err
+	}
+	if o.abort && o.stop != nil {
+		o.stop(fmt.Errorf("%w, stopped after %d bytes", ErrOutputLimit, o.limit))
+	} else if _, err = fmt.Fprintf(ow.w, "\n[output truncated after %d bytes]\n", o.limit); err != nil {
+		return n, err
+	}
+	// the copiers must not fail over output dropped on purpose
+	return total, nil
+}
+
+// commandOutput: where a command's stdout and stderr go, the buffers collected into its Result, the pool's tap, and
+// the writers the pool's sink opened for its target
+type commandOutput struct {
+	mu               sync.Mutex
+	combined         cappedBuffer
+	stdout           cappedBuffer
+	stderr           cappedBuffer
+	tap              OutputTap
+	host             string
+	clean            bool
+	sinkOut, sinkErr io.WriteCloser
+	// idle is the job's idle watch, nil without an idle timeout
+	idle *idleWatch
+	// limit is the pool's output limit, written what the command printed so far, and stop ends the job early
+	limit     int64
+	abort     bool
+	written   int64
+	overLimit bool
+	stop      context.CancelCauseFunc
+}
+
+// openOutput: set up the output of a command run against target with ctx, opening the pool's sink for it. The output
+// must be closed once the command is over.
+func (wp *WorkerPool) openOutput(ctx context.Context, target Target) (*commandOutput, error) {
+	out := &commandOutput{
+		combined: cappedBuffer{limit: wp.bufferLimit},
+		stdout:   cappedBuffer{limit: wp.bufferLimit},
+		stderr:   cappedBuffer{limit: wp.bufferLimit},
+		tap:      wp.tap,
+		host:     target.Host,
+		clean:    wp.cleanOutput,
+		limit:    wp.maxOutput,
+		abort:    wp.abortOutput,
+		stop:     jobStop(ctx),
+	}
+	if wp.idleTimeout > 0 && out.stop != nil {
+		out.idle = newIdleWatch(wp.idleTimeout, out.stop)
+	}
+	if wp.sink != nil {
+		var err error
+		if out.sinkOut, out.sinkErr, err = wp.sink(target); err != nil {
+			return nil, fmt.Errorf("unable to open the output sink: %v", err)
+		}
+	}
+	return out, nil
+}
+
+// writers: the writers to hand the command's stdout and stderr to, just before it starts.
+func (o *commandOutput) writers() (stdout, stderr io.Writer) {
+	outs := []io.Writer{&o.stdout, &o.combined}
+	errs := []io.Writer{&o.stderr, &o.combined}
+	if o.idle != nil {
+		o.idle.start()
+	}
+	if o.tap != nil {
+		outs = append(outs, tapWriter{o.tap, o.host, false})
+		errs = append(errs, tapWriter{o.tap, o.host, true})
+	}
+	if o.sinkOut != nil {
+		outs = append(outs, o.sinkOut)
+		errs = append(errs, o.sinkErr)
+	}
+	return outputWriter{o, io.MultiWriter(outs...)}, outputWriter{o, io.MultiWriter(errs...)}
+}
+
+// collect: fill in the output of res once the command is over.
+func (o *commandOutput) collect(res *Result) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	res.Output = o.combined.Bytes()
+	res.Stdout = o.stdout.Bytes()
+	res.Stderr = o.stderr.Bytes()
+	res.Truncated = o.overLimit || o.combined.truncated || o.stdout.truncated || o.stderr.truncated
+	if o.clean {
+		res.Output, res.Stdout, res.Stderr = CleanOutput(res.Output), CleanOutput(res.Stdout), CleanOutput(res.Stderr)
+	}
+}
+
+// close: stop the idle watch and close the sink's writers.
+func (o *commandOutput) close() error {
+	if o.idle != nil {
+		o.idle.close()
+	}
+	var err error
+	for _, w := range []io.WriteCloser{o.sinkOut, o.sinkErr} {
+		if w == nil {
+			continue
+		}
+		if closeErr := w.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("unable to write the output: %v", closeErr)
+		}
+	}
+	return err
+}
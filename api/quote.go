@@ -0,0 +1,51 @@
+package api
+
+import "strings"
+
+// shellSafe: the characters a word can be made of without quoting it for a POSIX shell
+const shellSafe = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-"
+
+// ShellQuote: quote s as a single word for a POSIX shell, so spaces, quotes, globs, and $ in it reach the command as
+// they are. Words that need no quoting are left alone.
+func ShellQuote(s string) string {
+	if s != "" && strings.Trim(s, shellSafe) == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ShellCommand: the command line running name with args, every one of them quoted with ShellQuote, e.g.
+// ShellCommand("grep", "-r", "max conns", "/etc") is grep -r 'max conns' /etc.
+func ShellCommand(name string, args ...string) string {
+	words := make([]string, 0, len(args)+1)
+	for _, word := range append([]string{name}, args...) {
+		words = append(words, ShellQuote(word))
+	}
+	return strings.Join(words, " ")
+}
+
+// InDir: the command line running cmd in dir, failing without running it if dir cannot be entered, e.g. because it
+// does not exist. A leading ~/ in dir is the user's home directory. An empty dir leaves cmd as it is.
+func InDir(dir, cmd string) string {
+	if dir == "" {
+		return cmd
+	}
+	quoted := ShellQuote(dir)
+	switch {
+	case dir == "~":
+		quoted = `"$HOME"`
+	case strings.HasPrefix(dir, "~/"):
+		quoted = `"$HOME"/` + ShellQuote(dir[2:])
+	}
+	return "cd -- " + quoted + " && " + cmd
+}
+
+// WrapShell: the command line passing cmd to shell as its last argument, e.g. WrapShell("bash -lc", "cd /srv && ls")
+// is bash -lc 'cd /srv && ls', to run cmd under a known shell whatever the user's login shell is. An empty shell
+// leaves cmd as it is.
+func WrapShell(shell, cmd string) string {
+	if strings.TrimSpace(shell) == "" {
+		return cmd
+	}
+	return strings.TrimSpace(shell) + " " + ShellQuote(cmd)
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultIdleAfter: how long a worker added past the pool's initial size waits for a job before exiting
+const defaultIdleAfter = 5 * time.Second
+
+// slowdownFactor: recent jobs taking this many times longer than the fastest the pool has seen means the hosts, or
+// something in front of them, are struggling and adding workers would only make it worse
+const slowdownFactor = 2
+
+// minLatencySamples: jobs that must finish before latency is trusted to hold back growth
+const minLatencySamples = 5
+
+// WithMaxWorkers: let the pool grow past its initial size, up to max workers, while jobs are waiting for a free worker
+// and recent jobs are not slowing down. Workers added this way exit again once they have been idle for a while.
+func WithMaxWorkers(max int) Option {
+	return func(wp *WorkerPool) {
+		wp.maxWorkers = max
+	}
+}
+
+// latencyTracker: an exponentially weighted moving average of how long jobs take, and the lowest it has been
+type latencyTracker struct {
+	samples int
+	average time.Duration
+	best    time.Duration
+}
+
+// observe: a job finished successfully after d.
+func (l *latencyTracker) observe(d time.Duration) {
+	l.samples++
+	if l.samples == 1 {
+		l.average = d
+	} else {
+		// weigh the latest job at a fifth so one slow host does not stop the pool growing
+		l.average += (d - l.average) / 5
+	}
+	if l.samples >= minLatencySamples && (l.best == 0 || l.average < l.best) {
+		l.best = l.average
+	}
+}
+
+// slowing: whether recent jobs take markedly longer than the pool's best.
+func (l *latencyTracker) slowing() bool {
+	return l.best > 0 && l.average > slowdownFactor*l.best
+}
+
+// grow: add a worker if jobs are waiting, the pool is below its maximum, and jobs are not slowing down.
+func (wp *WorkerPool) grow() {
+	wp.scaleMu.Lock()
+	defer wp.scaleMu.Unlock()
+	if wp.workers >= wp.maxWorkers {
+		return
+	}
+	if wp.latency.slowing() {
+		wp.log.Debug(
+			fmt.Sprintf("not adding workers, jobs are taking %s against a best of %s", wp.latency.average, wp.latency.best),
+			"workers", wp.workers,
+		)
+		return
+	}
+	wp.startWorkerLocked()
+	wp.log.Debug(fmt.Sprintf("added a worker, now %d", wp.workers), "workers", wp.workers)
+}
+
+// retire: let an idle worker exit if the pool is above its initial size.
+func (wp *WorkerPool) retire() bool {
+	wp.scaleMu.Lock()
+	defer wp.scaleMu.Unlock()
+	if wp.workers <= wp.numWorkers {
+		return false
+	}
+	wp.workers--
+	wp.metrics.scaled(-1)
+	wp.log.Debug(fmt.Sprintf("removed an idle worker, now %d", wp.workers), "workers", wp.workers)
+	return true
+}
+
+// startWorkerLocked: start one more worker. Must be called with wp.scaleMu held.
+func (wp *WorkerPool) startWorkerLocked() {
+	wp.workers++
+	wp.metrics.scaled(1)
+	wp.wg.Add(1)
+	go wp.worker()
+}
+
+// observeLatency: record how long a successful job took.
+func (wp *WorkerPool) observeLatency(d time.Duration) {
+	wp.scaleMu.Lock()
+	defer wp.scaleMu.Unlock()
+	wp.latency.observe(d)
+}
@@ -0,0 +1,626 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Filter: glob patterns choosing the files in a tree to transfer. Patterns use path.Match syntax and match either the
+// slash separated path relative to the top of the tree or the base name, e.g. *.log or cache/*. The top of the tree is
+// always transferred.
+type Filter struct {
+	// Include limits the files transferred to those matching any pattern, directories are still searched
+	Include []string
+	// Exclude skips files and whole directories matching any pattern, winning over Include
+	Exclude []string
+}
+
+// Validate: check the patterns are well formed, since path.Match only reports bad patterns when it gets that far.
+func (f Filter) Validate() error {
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// skip: whether the file or directory at rel, relative to the top of the tree, is left out.
+func (f Filter) skip(rel string, dir bool) bool {
+	if rel == "" {
+		return false
+	}
+	if matchAny(f.Exclude, rel) {
+		return true
+	}
+	return !dir && len(f.Include) > 0 && !matchAny(f.Include, rel)
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadOptions: how Upload writes files on each host
+type UploadOptions struct {
+	// Mode overrides the permissions of uploaded files, zero keeps the local permissions
+	Mode os.FileMode
+	// Owner is given to chown for everything uploaded, e.g. www-data or root:root, empty leaves the remote user's
+	Owner string
+	// Filter picks the files uploaded from a directory tree
+	Filter Filter
+	// Verify compares the SHA-256 of every uploaded file, computed with sha256sum on the host, to the local file's
+	Verify bool
+}
+
+// Upload: an Action copying the local file or directory tree at src to dest on each host over SFTP, which only needs
+// the sftp subsystem on the remote side. Like scp, an existing directory at dest receives src inside it. Modification
+// times are kept.
+func Upload(src, dest string, opts UploadOptions) (Action, error) {
+	if err := opts.Filter.Validate(); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file or directory", src)
+	}
+
+	// hash once up front rather than for every host
+	var sums map[string]string
+	if opts.Verify {
+		if sums, err = localSums(src, "", info, opts.Filter); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(ctx context.Context, client *ssh.Client, target Target, out io.Writer) error {
+		sc, err := sftp.NewClient(client)
+		if err != nil {
+			return fmt.Errorf("%w: sftp: %v", ErrSession, err)
+		}
+		defer func() { _ = sc.Close() }()
+		stop := context.AfterFunc(ctx, func() { _ = sc.Close() })
+		defer stop()
+
+		// like scp, an existing directory receives src inside it
+		remote := dest
+		if fi, err := sc.Stat(dest); err == nil && fi.IsDir() {
+			remote = path.Join(dest, filepath.Base(src))
+		}
+		up := &sftpUploader{client: sc, mode: opts.Mode, filter: opts.Filter}
+		if opts.Owner != "" {
+			if up.owner, err = lookupOwner(ctx, client, opts.Owner); err != nil {
+				return err
+			}
+		}
+		if err := up.send(src, remote, "", info); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+
+		verified := ""
+		if len(sums) > 0 {
+			// sha256sum fails on a missing file but still hashes the rest, which names it
+			output, err := runQuiet(ctx, client, sumCommand(remote, sums, info.IsDir()))
+			if sumErr := checkSums(sums, output); sumErr != nil {
+				return sumErr
+			}
+			if err != nil {
+				return err
+			}
+			verified = ", checksums match"
+		}
+		_, _ = fmt.Fprintf(out, "copied %d files, %d bytes to %s%s\n", up.files, up.bytes, dest, verified)
+		return nil
+	}, nil
+}
+
+// fileOwner: the numeric ids uploaded files are chowned to, -1 keeps a file's own user or group
+type fileOwner struct {
+	uid int
+	gid int
+}
+
+// lookupOwner: owner, a user, user:group or :group like chown takes, as numeric ids. Names are looked up on the host
+// with id and getent.
+func lookupOwner(ctx context.Context, client *ssh.Client, owner string) (*fileOwner, error) {
+	user, group, _ := strings.Cut(owner, ":")
+	if user == "" && group == "" {
+		return nil, fmt.Errorf("bad owner %q", owner)
+	}
+	ids := &fileOwner{uid: -1, gid: -1}
+	var err error
+	if user != "" {
+		if ids.uid, err = lookupID(ctx, client, user, "id -u -- "+ShellQuote(user)); err != nil {
+			return nil, fmt.Errorf("unable to look up user %q: %v", user, err)
+		}
+	}
+	if group != "" {
+		if ids.gid, err = lookupID(ctx, client, group, "getent group "+ShellQuote(group)+" | cut -d: -f3"); err != nil {
+			return nil, fmt.Errorf("unable to look up group %q: %v", group, err)
+		}
+	}
+	return ids, nil
+}
+
+// lookupID: name if it is already numeric, otherwise the id script prints for it.
+func lookupID(ctx context.Context, client *ssh.Client, name, script string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+	output, err := runQuiet(ctx, client, script)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil || id < 0 {
+		return 0, errors.New("no such name on the host")
+	}
+	return id, nil
+}
+
+// localSums: the hex SHA-256 of every file Upload will send from the tree at local, by path relative to the top of the
+// tree, or "" for a single file.
+func localSums(local, rel string, info os.FileInfo, filter Filter) (map[string]string, error) {
+	sums := make(map[string]string)
+	if !info.IsDir() {
+		f, err := os.Open(local)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = f.Close() }()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return nil, fmt.Errorf("%s: %v", local, err)
+		}
+		sums[rel] = hex.EncodeToString(h.Sum(nil))
+		return sums, nil
+	}
+
+	entries, err := ioutil.ReadDir(local)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		child, childRel := filepath.Join(local, entry.Name()), path.Join(rel, entry.Name())
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if entry, err = os.Stat(child); err != nil {
+				return nil, err
+			}
+		}
+		if filter.skip(childRel, entry.IsDir()) || !(entry.IsDir() || entry.Mode().IsRegular()) {
+			continue
+		}
+		childSums, err := localSums(child, childRel, entry, filter)
+		if err != nil {
+			return nil, err
+		}
+		for name, sum := range childSums {
+			sums[name] = sum
+		}
+	}
+	return sums, nil
+}
+
+// sumCommand: the shell command hashing the uploaded copies of the files in sums, where remote is where they were
+// uploaded to.
+func sumCommand(remote string, sums map[string]string, tree bool) string {
+	if !tree {
+		return "sha256sum -- " + ShellQuote(remote)
+	}
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, ShellQuote(name))
+	}
+	sort.Strings(names)
+	return "cd -- " + ShellQuote(remote) + " && sha256sum -- " + strings.Join(names, " ")
+}
+
+// checkSums: compare sha256sum output to the expected sums, naming every file that differs or was not hashed.
+func checkSums(sums map[string]string, output []byte) error {
+	got := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			continue
+		}
+		// sha256sum escapes names containing a backslash or line break and marks the line with a leading backslash
+		if strings.HasPrefix(sum, "\\") {
+			sum = sum[1:]
+			name = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(name)
+		}
+		got[name] = sum
+	}
+	if _, ok := sums[""]; ok {
+		// a single file is hashed by its remote path, which is not known here
+		for _, sum := range got {
+			got[""] = sum
+		}
+	}
+
+	var bad []string
+	for name, sum := range sums {
+		if got[name] != sum {
+			if name == "" {
+				name = "file"
+			}
+			bad = append(bad, name)
+		}
+	}
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return fmt.Errorf("%w: %s", ErrChecksum, strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// Download: an Action copying the remote file or directory tree at src on each host to the local path dest returns
+// for the host, keeping the permissions and modification times it has on the host. Existing files are overwritten.
+// scp cannot filter on the remote side, so files left out by filter are still sent and then discarded.
+func Download(src string, dest func(target Target) string, filter Filter) (Action, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	cmd := "scp -f -p -r -- " + ShellQuote(src)
+	return func(ctx context.Context, client *ssh.Client, target Target, out io.Writer) error {
+		sess, err := client.NewSession()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrSession, err)
+		}
+		defer func() { _ = sess.Close() }()
+		stdin, err := sess.StdinPipe()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrSession, err)
+		}
+		stdout, err := sess.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrSession, err)
+		}
+		var stderr bytes.Buffer
+		sess.Stderr = &stderr
+		if err := sess.Start(cmd); err != nil {
+			return fmt.Errorf("%w: %v", ErrSession, err)
+		}
+
+		local := dest(target)
+		receiver := &scpReceiver{w: stdin, r: bufio.NewReader(stdout), filter: filter}
+		recvErr := receiver.receive(local)
+		_ = stdin.Close()
+		if err := sess.Wait(); err != nil {
+			if recvErr != nil && len(bytes.TrimSpace(stderr.Bytes())) == 0 {
+				return fmt.Errorf("%w: %v", err, recvErr)
+			}
+			return remoteError(err, stderr.Bytes())
+		}
+		if recvErr != nil {
+			return recvErr
+		}
+		_, _ = fmt.Fprintf(out, "fetched %d files, %d bytes to %s\n", receiver.files, receiver.bytes, local)
+		return nil
+	}, nil
+}
+
+// sftpUploader: writes local files and directory trees to a host over an SFTP connection
+type sftpUploader struct {
+	client *sftp.Client
+	mode   os.FileMode
+	owner  *fileOwner
+	filter Filter
+	files  int
+	bytes  int64
+}
+
+// send: write the file or directory at local to remote, rel to the top of the tree, following symlinks as scp does.
+func (u *sftpUploader) send(local, remote, rel string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		// writable until its contents are in, its own mode is set afterwards
+		if err := u.client.Mkdir(remote); err != nil {
+			if fi, statErr := u.client.Stat(remote); statErr != nil || !fi.IsDir() {
+				return fmt.Errorf("%s: %w", remote, err)
+			}
+		}
+		if err := u.client.Chmod(remote, info.Mode().Perm()|0700); err != nil {
+			return fmt.Errorf("%s: %w", remote, err)
+		}
+		entries, err := os.ReadDir(local)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			child, childRel := filepath.Join(local, entry.Name()), path.Join(rel, entry.Name())
+			childInfo, err := os.Stat(child)
+			if err != nil {
+				return err
+			}
+			if u.filter.skip(childRel, childInfo.IsDir()) {
+				continue
+			}
+			if err := u.send(child, path.Join(remote, entry.Name()), childRel, childInfo); err != nil {
+				return err
+			}
+		}
+		return u.finish(remote, info.Mode().Perm(), info.ModTime())
+	case info.Mode().IsRegular():
+		mode := info.Mode().Perm()
+		if u.mode != 0 {
+			mode = u.mode.Perm()
+		}
+		f, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		rf, err := u.client.OpenFile(remote, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return fmt.Errorf("%s: %w", remote, err)
+		}
+		// send exactly the size stat reported even if the file changes underneath
+		n, err := rf.ReadFrom(io.LimitReader(f, info.Size()))
+		if closeErr := rf.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", remote, err)
+		}
+		u.files++
+		u.bytes += n
+		return u.finish(remote, mode, info.ModTime())
+	default:
+		return fmt.Errorf("%s is not a regular file or directory", local)
+	}
+}
+
+// finish: give the uploaded file or directory at remote its owner, mode and modification time.
+func (u *sftpUploader) finish(remote string, mode os.FileMode, mtime time.Time) error {
+	if u.owner != nil {
+		uid, gid := u.owner.uid, u.owner.gid
+		if uid < 0 || gid < 0 {
+			fi, err := u.client.Stat(remote)
+			if err != nil {
+				return fmt.Errorf("%s: %w", remote, err)
+			}
+			if st, ok := fi.Sys().(*sftp.FileStat); ok {
+				if uid < 0 {
+					uid = int(st.UID)
+				}
+				if gid < 0 {
+					gid = int(st.GID)
+				}
+			}
+		}
+		if err := u.client.Chown(remote, uid, gid); err != nil {
+			return fmt.Errorf("%s: chown: %w", remote, err)
+		}
+	}
+	if err := u.client.Chmod(remote, mode); err != nil {
+		return fmt.Errorf("%s: %w", remote, err)
+	}
+	if err := u.client.Chtimes(remote, mtime, mtime); err != nil {
+		return fmt.Errorf("%s: %w", remote, err)
+	}
+	return nil
+}
+
+// scpReceiver: the sink side of the scp protocol, reading files from a remote `scp -f` and replying to each message
+type scpReceiver struct {
+	w      io.Writer
+	r      *bufio.Reader
+	filter Filter
+	files  int
+	bytes  int64
+}
+
+// scpDir: a directory being received, its mode and times are set once it is complete so it can be written to until
+// then. The contents of a skipped directory are read and discarded.
+type scpDir struct {
+	path  string
+	rel   string
+	mode  os.FileMode
+	times []time.Time
+	skip  bool
+}
+
+// ok: tell the source to carry on.
+func (s *scpReceiver) ok() error {
+	_, err := s.w.Write([]byte{0})
+	return err
+}
+
+// receive: write the file or directory tree sent by the source to dest.
+func (s *scpReceiver) receive(dest string) error {
+	var dirs []scpDir
+	var times []time.Time
+	var remoteErrs []string
+	done := false
+	if err := s.ok(); err != nil {
+		return err
+	}
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("scp: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errors.New("scp: empty message")
+		}
+
+		switch line[0] {
+		case 1, 2:
+			// the source could not send something, e.g. a missing file, and may carry on with the rest
+			remoteErrs = append(remoteErrs, strings.TrimSpace(line[1:]))
+			continue
+		case 'T':
+			var mtime, atime int64
+			if _, err := fmt.Sscanf(line, "T%d 0 %d 0", &mtime, &atime); err != nil {
+				return fmt.Errorf("scp: bad times %q", line)
+			}
+			times = []time.Time{time.Unix(atime, 0), time.Unix(mtime, 0)}
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("scp: end of a directory that was never started")
+			}
+			dir := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if dir.skip {
+				break
+			}
+			if err := setMeta(dir.path, dir.mode, dir.times); err != nil {
+				return err
+			}
+		case 'C', 'D':
+			mode, size, name, err := parseScpEntry(line)
+			if err != nil {
+				return err
+			}
+			local, rel, skip := dest, "", false
+			if len(dirs) > 0 {
+				parent := dirs[len(dirs)-1]
+				local, rel = filepath.Join(parent.path, name), path.Join(parent.rel, name)
+				skip = parent.skip || s.filter.skip(rel, line[0] == 'D')
+			} else if done {
+				return fmt.Errorf("scp: more than one file sent for %s", dest)
+			} else {
+				done = true
+				if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+					return err
+				}
+			}
+
+			if line[0] == 'D' {
+				if !skip {
+					if err := os.MkdirAll(local, 0700); err != nil {
+						return err
+					}
+				}
+				dirs = append(dirs, scpDir{local, rel, mode, times, skip})
+				times = nil
+				break
+			}
+			if err := s.ok(); err != nil {
+				return err
+			}
+			if skip {
+				if _, err := io.CopyN(ioutil.Discard, s.r, size); err != nil {
+					return fmt.Errorf("scp: %v", err)
+				}
+			} else {
+				if err := s.receiveFile(local, mode, size); err != nil {
+					return err
+				}
+				if err := setMeta(local, mode, times); err != nil {
+					return err
+				}
+			}
+			times = nil
+			// the source follows the contents with its own status
+			if b, err := s.r.ReadByte(); err != nil {
+				return fmt.Errorf("scp: %v", err)
+			} else if b != 0 {
+				msg, _ := s.r.ReadString('\n')
+				return errors.New(strings.TrimSpace(msg))
+			}
+		default:
+			return fmt.Errorf("scp: unexpected message %q", line)
+		}
+		if err := s.ok(); err != nil {
+			return err
+		}
+	}
+
+	if len(dirs) > 0 {
+		return fmt.Errorf("scp: %s was cut short", dirs[0].path)
+	}
+	if len(remoteErrs) > 0 {
+		return errors.New(strings.Join(remoteErrs, "; "))
+	}
+	return nil
+}
+
+// receiveFile: write size bytes of file contents to path.
+func (s *scpReceiver) receiveFile(path string, mode os.FileMode, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, s.r, size); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("scp: %s: %v", path, err)
+	}
+	s.files++
+	s.bytes += size
+	return f.Close()
+}
+
+// parseScpEntry: parse a C or D message, refusing names that would escape the directory being written to.
+func parseScpEntry(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(line[1:], " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("scp: bad message %q", line)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("scp: bad mode in %q", line)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("scp: bad size in %q", line)
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return 0, 0, "", fmt.Errorf("scp: refusing file name %q", name)
+	}
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+// setMeta: apply the mode, and times if any were sent.
+func setMeta(path string, mode os.FileMode, times []time.Time) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if len(times) == 2 {
+		return os.Chtimes(path, times[0], times[1])
+	}
+	return nil
+}
+
+// remoteError: the error from a remote command, with what it wrote to stderr.
+func remoteError(err error, stderr []byte) error {
+	if msg := strings.TrimSpace(string(stderr)); msg != "" {
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+	return err
+}
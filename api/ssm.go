@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// ssmPollInterval: how often an SSM command's status is checked by default
+	ssmPollInterval = time.Second
+	// ssmCancelTimeout: how long cancelling an SSM command once the run is over may take
+	ssmCancelTimeout = 10 * time.Second
+)
+
+// SSMExecutor: runs commands on EC2 instances through AWS Systems Manager Run Command, for instances with no inbound
+// SSH, using the aws CLI and its usual credentials and config. The instance ID is the target's Addr, or its Host if
+// that is empty. Commands run with the AWS-RunShellScript document and their output arrives once they finish, cut
+// short by SSM after 24000 bytes of stdout and 8000 of stderr. Stdin is not supported.
+type SSMExecutor struct {
+	// CLI is the program run, aws if empty
+	CLI string
+	// Region is the instances' region, the CLI's default if empty
+	Region string
+	// PollInterval is how often the command's status is checked, a second if zero
+	PollInterval time.Duration
+}
+
+// ssmInvocation: the parts of `aws ssm get-command-invocation` output used to build a Result
+type ssmInvocation struct {
+	Status                string `json:"Status"`
+	StatusDetails         string `json:"StatusDetails"`
+	ResponseCode          int    `json:"ResponseCode"`
+	StandardOutputContent string `json:"StandardOutputContent"`
+	StandardErrorContent  string `json:"StandardErrorContent"`
+}
+
+func (e SSMExecutor) Run(ctx context.Context, target Target, cmd string) (Result, error) {
+	var res Result
+	out := &commandOutput{}
+	err := e.run(ctx, target, ssmScript(cmd, target.Env), out)
+	out.collect(&res)
+	return res, err
+}
+
+func (e SSMExecutor) runIn(ctx context.Context, wp *WorkerPool, target Target, cmd string) (res Result, err error) {
+	if wp.stdin != nil {
+		return res, errors.New("stdin is not supported over ssm")
+	}
+	out, err := wp.openOutput(ctx, target)
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		if closeErr := out.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	err = e.run(ctx, target, ssmScript(cmd, wp.environ(target)), out)
+	out.collect(&res)
+	return res, err
+}
+
+// run: send script to target's instance and wait for it to finish, writing its output to out. The command is
+// cancelled if ctx is done first.
+func (e SSMExecutor) run(ctx context.Context, target Target, script string, out *commandOutput) error {
+	instance := target.Addr
+	if instance == "" {
+		instance = target.Host
+	}
+	params, err := json.Marshal(map[string][]string{"commands": {script}})
+	if err != nil {
+		return err
+	}
+	sent, err := e.aws(ctx, "send-command", "--instance-ids", instance, "--document-name", "AWS-RunShellScript",
+		"--parameters", string(params), "--comment", "remote-executor")
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("unable to send the command: %v", err)
+	}
+	var command struct {
+		Command struct {
+			CommandID string `json:"CommandId"`
+		} `json:"Command"`
+	}
+	if err := json.Unmarshal(sent, &command); err != nil {
+		return fmt.Errorf("unable to parse the sent command: %v", err)
+	}
+	id := command.Command.CommandID
+
+	interval := e.PollInterval
+	if interval <= 0 {
+		interval = ssmPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// the command keeps running on the instance unless it is cancelled
+			cancelCtx, cancel := context.WithTimeout(context.Background(), ssmCancelTimeout)
+			_, _ = e.aws(cancelCtx, "cancel-command", "--command-id", id, "--instance-ids", instance)
+			cancel()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		got, err := e.aws(ctx, "get-command-invocation", "--command-id", id, "--instance-id", instance)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			continue
+		case err != nil && strings.Contains(err.Error(), "InvocationDoesNotExist"):
+			// the invocation only shows up a moment after the command is sent
+			continue
+		case err != nil:
+			return fmt.Errorf("unable to get the command's status: %v", err)
+		}
+		var inv ssmInvocation
+		if err := json.Unmarshal(got, &inv); err != nil {
+			return fmt.Errorf("unable to parse the command's status: %v", err)
+		}
+		switch inv.Status {
+		case "Pending", "InProgress", "Delayed":
+			continue
+		}
+
+		stdout, stderr := out.writers()
+		if _, err := io.WriteString(stdout, inv.StandardOutputContent); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(stderr, inv.StandardErrorContent); err != nil {
+			return err
+		}
+		switch {
+		case inv.Status == "Success":
+			return nil
+		case inv.Status == "Failed" && inv.ResponseCode > 0:
+			return &ExitError{Status: inv.ResponseCode}
+		default:
+			return fmt.Errorf("ssm command %s %s: %s", id, inv.Status, inv.StatusDetails)
+		}
+	}
+}
+
+// aws: run an aws ssm subcommand, returning its JSON output.
+func (e SSMExecutor) aws(ctx context.Context, args ...string) ([]byte, error) {
+	cli := e.CLI
+	if cli == "" {
+		cli = "aws"
+	}
+	args = append(append([]string{"ssm"}, args...), "--output", "json")
+	if e.Region != "" {
+		args = append(args, "--region", e.Region)
+	}
+	out, err := exec.CommandContext(ctx, cli, args...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return out, err
+}
+
+// ssmScript: cmd preceded by exports of env, since Run Command has no way to pass environment variables.
+func ssmScript(cmd string, env map[string]string) string {
+	var script strings.Builder
+	for _, entry := range envList(env) {
+		name, value, _ := strings.Cut(entry, "=")
+		script.WriteString("export " + name + "=" + ShellQuote(value) + "\n")
+	}
+	script.WriteString(cmd)
+	return script.String()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile: the --config file, named profiles of flag values, e.g.
+//
+//	profiles:
+//	  prod:
+//	    user: deploy
+//	    private-key: ~/.ssh/prod_ed25519
+//	    jump: bastion.prod.example.com
+//	    concurrency: 200
+//	    hosts: aws:tag:Env=prod
+//	    env:
+//	      DEPLOY_ENV: prod
+type configFile struct {
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// envPrefix: flags can also be set through environment variables named like REMOTE_EXECUTOR_CONNECT_TIMEOUT
+const envPrefix = "REMOTE_EXECUTOR_"
+
+// envName: the environment variable setting flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv: set every flag not given on the command line from its environment variable, if that is set.
+func applyEnv() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s: %v", envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// applyProfile: set the flags named in profile name of the config file at path. Flags already set on the command line
+// or through the environment win.
+// Lists are joined with commas and maps are set one KEY=VALUE at a time, for repeatable flags like --env.
+func applyProfile(path, name string) error {
+	data, err := os.ReadFile(expandHome(path))
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %v", err)
+	}
+	var conf configFile
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return fmt.Errorf("unable to parse config file %s: %v", path, err)
+	}
+	profile, ok := conf.Profiles[name]
+	if !ok {
+		var names []string
+		for name := range conf.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("no profile %q in %s, it has: %s", name, path, strings.Join(names, ", "))
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	var keys []string
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "profile" || key == "config" {
+			return fmt.Errorf("profile %q: %s cannot be set in a profile", name, key)
+		}
+		if flag.Lookup(key) == nil {
+			return fmt.Errorf("profile %q: unknown flag %q", name, key)
+		}
+		if explicit[key] {
+			continue
+		}
+		values, err := profileValues(profile[key])
+		if err != nil {
+			return fmt.Errorf("profile %q: %s: %v", name, key, err)
+		}
+		for _, value := range values {
+			if err := flag.Set(key, value); err != nil {
+				return fmt.Errorf("profile %q: %s: %v", name, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// profileValues: the flag values for a profile setting, one for scalars and lists and one per entry for maps.
+func profileValues(setting interface{}) ([]string, error) {
+	switch v := setting.(type) {
+	case nil:
+		return nil, errors.New("no value")
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		return []string{strings.Join(items, ",")}, nil
+	case map[string]interface{}:
+		var entries []string
+		for key, value := range v {
+			entries = append(entries, key+"="+fmt.Sprint(value))
+		}
+		sort.Strings(entries)
+		return entries, nil
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// expandHome: replace a leading ~ with the user's home directory, for paths in profiles that no shell expanded.
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, _ := os.LookupEnv("HOME")
+		return home + path[1:]
+	}
+	return path
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFlags: replace the command line flags with user and concurrency flags parsed from args for the rest of the test.
+func testFlags(t *testing.T, args ...string) (user *string, concurrency *int) {
+	t.Helper()
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	flag.CommandLine = flag.NewFlagSet("remote-executor", flag.ContinueOnError)
+	user = flag.String("user", "root", "")
+	concurrency = flag.Int("concurrency", 10, "")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatalf("unable to parse %v: %v", args, err)
+	}
+	return user, concurrency
+}
+
+// writeConfig: a config file with contents, returning its path.
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("unable to write config file: %v", err)
+	}
+	return path
+}
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("REMOTE_EXECUTOR_USER", "env-user")
+	t.Setenv("REMOTE_EXECUTOR_CONCURRENCY", "50")
+	user, concurrency := testFlags(t, "-user", "flag-user")
+	if err := applyEnv(); err != nil {
+		t.Fatalf("unable to apply environment: %v", err)
+	}
+	if *user != "flag-user" {
+		t.Errorf("got user %q, want the flag's %q", *user, "flag-user")
+	}
+	if *concurrency != 50 {
+		t.Errorf("got concurrency %d, want the environment's 50", *concurrency)
+	}
+}
+
+func TestApplyEnvInvalid(t *testing.T) {
+	t.Setenv("REMOTE_EXECUTOR_CONCURRENCY", "lots")
+	testFlags(t)
+	err := applyEnv()
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid REMOTE_EXECUTOR_CONCURRENCY") {
+		t.Errorf("got error %v, want one for REMOTE_EXECUTOR_CONCURRENCY", err)
+	}
+}
+
+func TestApplyProfilePrecedence(t *testing.T) {
+	path := writeConfig(t, `profiles:
+  prod:
+    user: profile-user
+    concurrency: 200
+`)
+	tests := []struct {
+		name            string
+		args            []string
+		env             map[string]string
+		wantUser        string
+		wantConcurrency int
+	}{
+		{
+			name:            "profile over defaults",
+			wantUser:        "profile-user",
+			wantConcurrency: 200,
+		},
+		{
+			name:            "environment over profile",
+			env:             map[string]string{"REMOTE_EXECUTOR_USER": "env-user"},
+			wantUser:        "env-user",
+			wantConcurrency: 200,
+		},
+		{
+			name:            "flag over environment and profile",
+			args:            []string{"-user", "flag-user"},
+			env:             map[string]string{"REMOTE_EXECUTOR_USER": "env-user", "REMOTE_EXECUTOR_CONCURRENCY": "50"},
+			wantUser:        "flag-user",
+			wantConcurrency: 50,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			user, concurrency := testFlags(t, tt.args...)
+			// the order main applies them in
+			if err := applyEnv(); err != nil {
+				t.Fatalf("unable to apply environment: %v", err)
+			}
+			if err := applyProfile(path, "prod"); err != nil {
+				t.Fatalf("unable to apply profile: %v", err)
+			}
+			if *user != tt.wantUser {
+				t.Errorf("got user %q, want %q", *user, tt.wantUser)
+			}
+			if *concurrency != tt.wantConcurrency {
+				t.Errorf("got concurrency %d, want %d", *concurrency, tt.wantConcurrency)
+			}
+		})
+	}
+}
+
+func TestApplyProfileErrors(t *testing.T) {
+	path := writeConfig(t, `profiles:
+  prod:
+    user: deploy
+  staging:
+    user: deploy
+  typo:
+    usr: deploy
+`)
+	tests := []struct {
+		name    string
+		profile string
+		wantErr string
+	}{
+		{
+			name:    "unknown profile",
+			profile: "dev",
+			wantErr: `no profile "dev" in ` + path + `, it has: prod, staging, typo`,
+		},
+		{
+			name:    "unknown flag",
+			profile: "typo",
+			wantErr: `profile "typo": unknown flag "usr"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testFlags(t)
+			if err := applyProfile(path, tt.profile); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit events, a run is logged before any host is started and again once it is over
+const (
+	auditStart  = "start"
+	auditFinish = "finish"
+)
+
+// errAudit: wrapped by the error returned when an audit entry could not be written, runs do not go ahead without one
+var errAudit = errors.New("unable to write the audit log")
+
+// auditEntry: a line of the audit log. Hash is the SHA-256 of the entry's JSON without it, which includes the
+// previous entry's hash, so changing, removing, or reordering an entry breaks every hash after it.
+type auditEntry struct {
+	Seq        int64     `json:"seq"`
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	User       string    `json:"user"`
+	Origin     string    `json:"origin"`
+	RemoteUser string    `json:"remote_user"`
+	Kind       string    `json:"kind"`
+	Job        string    `json:"job,omitempty"`
+	Command    string    `json:"command"`
+	Hosts      int       `json:"hosts"`
+	// HostsHash is the SHA-256 of the sorted host names, one per line
+	HostsHash string `json:"hosts_sha256"`
+	// Succeeded, Failed, and ExitStatus are only set on finish
+	Succeeded  *int   `json:"succeeded,omitempty"`
+	Failed     *int   `json:"failed,omitempty"`
+	ExitStatus *int   `json:"exit_status,omitempty"`
+	Prev       string `json:"prev"`
+	Hash       string `json:"hash,omitempty"`
+}
+
+// auditLog: the append-only, hash-chained log of every run at path
+type auditLog struct {
+	path string
+	// mu orders the entries of concurrent serve jobs, other processes are kept out by a lock on the file
+	mu sync.Mutex
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: expandHome(path)}
+}
+
+// hostsHash: a digest of the host set, to tell which hosts a run targeted without logging them all.
+func hostsHash(names []string) string {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAuditEntry: an entry for event on a run of command across hosts as remoteUser, by the local user on this machine.
+func newAuditEntry(event, kind, command, remoteUser string, hosts []string) auditEntry {
+	localUser, _ := os.LookupEnv("USER")
+	origin, _ := os.Hostname()
+	return auditEntry{
+		Time:       time.Now().UTC(),
+		Event:      event,
+		User:       localUser,
+		Origin:     origin,
+		RemoteUser: remoteUser,
+		Kind:       kind,
+		Command:    command,
+		Hosts:      len(hosts),
+		HostsHash:  hostsHash(hosts),
+	}
+}
+
+// finished: the entry with the outcome of the run set, for the finish event.
+func (e auditEntry) finished(succeeded, failed int) auditEntry {
+	exitStatus := runExitCode(failed, succeeded+failed)
+	e.Time = time.Now().UTC()
+	e.Event = auditFinish
+	e.Succeeded, e.Failed, e.ExitStatus = &succeeded, &failed, &exitStatus
+	return e
+}
+
+// digest: the hash of the entry with its Hash left out.
+func (e auditEntry) digest() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// append: chain e onto the last entry in the log and write it, creating the log if needed.
+func (a *auditLog) append(e auditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return fmt.Errorf("%w: %v", errAudit, err)
+	}
+	f, err := os.OpenFile(a.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errAudit, err)
+	}
+	defer func() { _ = f.Close() }()
+	unlock, err := lockFile(f)
+	if err != nil {
+		return fmt.Errorf("%w: unable to lock %s: %v", errAudit, a.path, err)
+	}
+	defer unlock()
+
+	last, err := lastLine(f)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errAudit, err)
+	}
+	if len(last) > 0 {
+		var prev auditEntry
+		if err := json.Unmarshal(last, &prev); err != nil {
+			return fmt.Errorf("%w: the last entry of %s is unreadable: %v", errAudit, a.path, err)
+		}
+		e.Seq, e.Prev = prev.Seq+1, prev.Hash
+	} else {
+		e.Seq, e.Prev = 1, ""
+	}
+	if e.Hash, err = e.digest(); err != nil {
+		return fmt.Errorf("%w: %v", errAudit, err)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errAudit, err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("%w: %v", errAudit, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("%w: %v", errAudit, err)
+	}
+	return nil
+}
+
+// lastLine: the last non-empty line of f, read backwards from the end so long logs are not read whole.
+func lastLine(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	const chunk = 4096
+	var tail []byte
+	for end := info.Size(); end > 0; {
+		start := end - chunk
+		if start < 0 {
+			start = 0
+		}
+		buf := make([]byte, end-start)
+		if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+			return nil, err
+		}
+		tail = append(buf, tail...)
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+		end = start
+	}
+	return bytes.TrimRight(tail, "\n"), nil
+}
+
+// verifyAudit: check every entry read from r follows on from the one before it and has not been changed. Returns the
+// number of entries checked. Entries removed from the end cannot be detected from the log alone, compare the count
+// or the last hash with a copy kept elsewhere.
+func verifyAudit(r io.Reader) (int64, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var prev auditEntry
+	var n int64
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		n++
+		var e auditEntry
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			return n - 1, fmt.Errorf("entry %d: unreadable: %v", n, err)
+		}
+		if e.Seq != n {
+			return n - 1, fmt.Errorf("entry %d: has sequence number %d, entries are missing or out of order", n, e.Seq)
+		}
+		if e.Prev != prev.Hash {
+			return n - 1, fmt.Errorf("entry %d: does not follow on from entry %d", n, n-1)
+		}
+		digest, err := e.digest()
+		if err != nil {
+			return n - 1, fmt.Errorf("entry %d: %v", n, err)
+		}
+		if digest != e.Hash {
+			return n - 1, fmt.Errorf("entry %d: has been modified, its hash does not match its contents", n)
+		}
+		prev = e
+	}
+	return n, scanner.Err()
+}
+
+// verifyAudit: the verify-audit subcommand, check the AuditPath log's hash chain.
+func (c *Config) verifyAudit() (int, error) {
+	if len(c.Args) > 0 {
+		return ExitSetup, fmt.Errorf("unable to parse flags: verify-audit takes no arguments, got %q", c.Args)
+	}
+	if c.AuditPath == "" {
+		return ExitSetup, errors.New("unable to parse flags: verify-audit needs -audit-log")
+	}
+	f, err := os.Open(expandHome(c.AuditPath))
+	if err != nil {
+		return ExitSetup, fmt.Errorf("unable to open the audit log: %v", err)
+	}
+	n, err := verifyAudit(f)
+	_ = f.Close()
+	if err != nil {
+		c.Logger.Error(fmt.Sprintf(
+			"audit log %s failed verification after %d good entries: %v", c.AuditPath, n, err,
+		))
+		return ExitSomeFailed, nil
+	}
+	c.Logger.Info(fmt.Sprintf("audit log %s verified: %d entries, hash chain intact", c.AuditPath, n))
+	return ExitOK, nil
+}
@@ -0,0 +1,135 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestAudit: an audit log of a started and finished run followed by another started run, returned line by line.
+func writeTestAudit(t *testing.T) [][]byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit := newAuditLog(path)
+	started := newAuditEntry(auditStart, "run", "uptime", "deploy", []string{"web1", "web2"})
+	for _, e := range []auditEntry{
+		started,
+		started.finished(1, 1),
+		newAuditEntry(auditStart, "copy", "copy a b", "deploy", []string{"web1"}),
+	} {
+		if err := audit.append(e); err != nil {
+			t.Fatalf("unable to append to the audit log: %v", err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read the audit log: %v", err)
+	}
+	return bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+}
+
+func TestVerifyAudit(t *testing.T) {
+	lines := writeTestAudit(t)
+	if len(lines) != 3 {
+		t.Fatalf("got %d audit log lines, want 3", len(lines))
+	}
+	n, err := verifyAudit(bytes.NewReader(append(bytes.Join(lines, []byte("\n")), '\n')))
+	if err != nil {
+		t.Fatalf("untouched audit log failed verification: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("verified %d entries, want 3", n)
+	}
+}
+
+func TestVerifyAuditTampered(t *testing.T) {
+	tests := []struct {
+		name string
+		// tamper changes the log's lines
+		tamper func(t *testing.T, lines [][]byte) [][]byte
+		// good is the number of entries reported as verified before the broken one
+		good    int64
+		wantErr string
+	}{
+		{
+			name: "edited record",
+			tamper: func(t *testing.T, lines [][]byte) [][]byte {
+				var e auditEntry
+				if err := json.Unmarshal(lines[1], &e); err != nil {
+					t.Fatalf("unable to decode entry 2: %v", err)
+				}
+				failed := 0
+				e.Failed = &failed
+				edited, err := json.Marshal(e)
+				if err != nil {
+					t.Fatalf("unable to encode entry 2: %v", err)
+				}
+				lines[1] = edited
+				return lines
+			},
+			good:    1,
+			wantErr: "entry 2: has been modified",
+		},
+		{
+			name: "edited record with its hash recomputed",
+			tamper: func(t *testing.T, lines [][]byte) [][]byte {
+				var e auditEntry
+				if err := json.Unmarshal(lines[0], &e); err != nil {
+					t.Fatalf("unable to decode entry 1: %v", err)
+				}
+				e.Command = "true"
+				var err error
+				if e.Hash, err = e.digest(); err != nil {
+					t.Fatalf("unable to hash entry 1: %v", err)
+				}
+				if lines[0], err = json.Marshal(e); err != nil {
+					t.Fatalf("unable to encode entry 1: %v", err)
+				}
+				return lines
+			},
+			good:    1,
+			wantErr: "entry 2: does not follow on from entry 1",
+		},
+		{
+			name: "reordered records",
+			tamper: func(t *testing.T, lines [][]byte) [][]byte {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			good:    1,
+			wantErr: "entry 2: has sequence number 3",
+		},
+		{
+			name: "removed record",
+			tamper: func(t *testing.T, lines [][]byte) [][]byte {
+				return append(lines[:1], lines[2:]...)
+			},
+			good:    1,
+			wantErr: "entry 2: has sequence number 3",
+		},
+		{
+			name: "truncated record",
+			tamper: func(t *testing.T, lines [][]byte) [][]byte {
+				lines[2] = lines[2][:len(lines[2])/2]
+				return lines
+			},
+			good:    2,
+			wantErr: "entry 3: unreadable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := tt.tamper(t, writeTestAudit(t))
+			n, err := verifyAudit(bytes.NewReader(append(bytes.Join(lines, []byte("\n")), '\n')))
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one starting with %q", err, tt.wantErr)
+			}
+			if n != tt.good {
+				t.Errorf("got %d good entries, want %d", n, tt.good)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// keyPassphrase: return the private key passphrase from the config, the environment, or an interactive prompt, in
+// that order of preference.
+func (c *Config) keyPassphrase(keyFile string) ([]byte, error) {
+	if c.Passphrase != "" {
+		return []byte(c.Passphrase), nil
+	}
+	if pass, ok := os.LookupEnv("REMOTE_EXECUTOR_PASSPHRASE"); ok {
+		return []byte(pass), nil
+	}
+	return utils.ReadSecret(fmt.Sprintf("passphrase for %s: ", keyFile))
+}
+
+// remotePassword: return the remote password from a file descriptor, a secret reference, the environment, or an
+// interactive prompt, in that order of preference.
+func (c *Config) remotePassword() (string, error) {
+	if c.PasswordFD >= 0 {
+		line, err := bufio.NewReader(os.NewFile(uintptr(c.PasswordFD), "password-fd")).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("unable to read password from fd %d: %v", c.PasswordFD, err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	if c.PasswordSecret != "" {
+		pass, err := utils.FetchSecret(c.PasswordSecret)
+		return strings.TrimRight(string(pass), "\r\n"), err
+	}
+	if pass, ok := os.LookupEnv("REMOTE_EXECUTOR_PASSWORD"); ok {
+		return pass, nil
+	}
+	pass, err := utils.ReadSecret(fmt.Sprintf("password for %s: ", c.User))
+	return string(pass), err
+}
+
+// newAuthConfig: build the auth config.
+// Without AuthOrder the order is derived from UseAgent and PasswordAuth to keep their original meaning.
+func (c *Config) newAuthConfig() (utils.AuthConfig, error) {
+	order := c.AuthOrder
+	if order == "" {
+		order = utils.AuthKey
+		if c.UseAgent {
+			order = utils.AuthAgent
+		}
+		if c.PasswordAuth {
+			order += "," + utils.AuthPassword
+		}
+	}
+	methods, err := utils.ParseAuthOrder(order)
+	if err != nil {
+		return utils.AuthConfig{}, err
+	}
+
+	var keyFiles []string
+	for _, keyFile := range c.PrivateKeys {
+		keyFiles = append(keyFiles, expandHome(keyFile))
+	}
+
+	// the password may be needed by both the password and keyboard-interactive methods, only ask for it once
+	var once sync.Once
+	var pass string
+	var passErr error
+	password := func() (string, error) {
+		once.Do(func() { pass, passErr = c.remotePassword() })
+		return pass, passErr
+	}
+
+	return utils.AuthConfig{
+		Order:      methods,
+		KeyFiles:   keyFiles,
+		Passphrase: c.keyPassphrase,
+		Password:   password,
+		Challenge:  utils.NewChallengeResponder(password, c.totpSecret(), utils.Prompt),
+	}, nil
+}
+
+// totpSecret: the TOTP secret from the config, or else the environment.
+func (c *Config) totpSecret() string {
+	if c.TOTPSecret != "" {
+		return c.TOTPSecret
+	}
+	return os.Getenv("REMOTE_EXECUTOR_TOTP_SECRET")
+}
+
+// vaultAuth: fetch the -vault-ssh credentials. A signed certificate is added to authConf, for one-time passwords the
+// Vault client is returned so each host can be given its own once it is resolved.
+func (c *Config) vaultAuth(authConf *utils.AuthConfig) (*utils.VaultClient, error) {
+	if c.VaultSSH == "" {
+		return nil, nil
+	}
+	vault, err := utils.NewVaultClient()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.Contains(c.VaultSSH, "/sign/"):
+		signer, err := vault.SignKey(context.Background(), c.VaultSSH, []string{c.User})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get a signed certificate: %v", err)
+		}
+		authConf.Signers = append(authConf.Signers, signer)
+		return nil, nil
+	case strings.Contains(c.VaultSSH, "/creds/"):
+		// the hosts' methods are replaced by their one-time password, jump hosts can still be answered interactively
+		for _, method := range authConf.Order {
+			if method == utils.AuthKeyboardInteractive {
+				return vault, nil
+			}
+		}
+		authConf.Order = append(authConf.Order, utils.AuthKeyboardInteractive)
+		return vault, nil
+	default:
+		return nil, fmt.Errorf("-vault-ssh: want <mount>/sign/<role> or <mount>/creds/<role>, got %q", c.VaultSSH)
+	}
+}
+
+// newResolver: build the SSH client config and the resolver turning hosts into targets with it, fetching any
+// credentials needed up front. Without ssh as the transport a broken SSH setup is only an error for the hosts picking
+// ssh themselves.
+func (c *Config) newResolver() (*targetResolver, ssh.ClientConfig, error) {
+	authConf, err := c.newAuthConfig()
+	if err != nil {
+		return nil, ssh.ClientConfig{}, fmt.Errorf("unable to parse flags: %v", err)
+	}
+	vault, err := c.vaultAuth(&authConf)
+	if err != nil {
+		return nil, ssh.ClientConfig{}, fmt.Errorf("unable to fetch credentials from vault: %v", err)
+	}
+	c.KnownHosts = expandHome(c.KnownHosts)
+	// loaded once here, so per-host configs only read the identity files the host adds
+	var sshConf ssh.ClientConfig
+	authConf, sshErr := authConf.Preload()
+	if sshErr == nil {
+		sshConf, sshErr = utils.NewSSHConfig(
+			c.HostKeyPolicy, c.KnownHosts, c.User, c.ConnectTimeout, authConf, c.SSHOptions...,
+		)
+	}
+	if sshErr != nil && c.Transport == TransportSSH {
+		return nil, sshConf, fmt.Errorf("unable to parse flags: %v", sshErr)
+	}
+	sshConfig, err := c.loadSSHConfig()
+	if err != nil {
+		return nil, sshConf, err
+	}
+	creds, err := c.credentials()
+	if err != nil {
+		return nil, sshConf, err
+	}
+	resolver := newTargetResolver(c, sshConfig, authConf, sshConf)
+	resolver.sshErr = sshErr
+	resolver.vault = vault
+	resolver.creds = creds
+	return resolver, sshConf, nil
+}
+
+// loadSSHConfig: read the -ssh-config file, an empty one if it is disabled.
+func (c *Config) loadSSHConfig() (*utils.SSHConfigFile, error) {
+	if c.SSHConfigPath == "" {
+		return &utils.SSHConfigFile{}, nil
+	}
+	sshConfig, err := utils.LoadSSHConfig(expandHome(c.SSHConfigPath))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load ssh config: %v", err)
+	}
+	return sshConfig, nil
+}
+
+// lockOwner: the -remote-lock, held by the local user on this machine.
+func (c *Config) lockOwner() api.RemoteLock {
+	localUser, _ := os.LookupEnv("USER")
+	origin, _ := os.Hostname()
+	return api.RemoteLock{
+		Path:  c.RemoteLock,
+		Owner: fmt.Sprintf("%s@%s (pid %d)", localUser, origin, os.Getpid()),
+		TTL:   c.LockTTL,
+	}
+}
+
+// expandHome: replace a leading ~ with the user's home directory, for paths in profiles that no shell expanded.
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, _ := os.LookupEnv("HOME")
+		return home + path[1:]
+	}
+	return path
+}
@@ -0,0 +1,28 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/basilnsage/remote-executor/api"
+)
+
+// checkAction: an action that does nothing with the connected client, so every host only goes through the dial, SSH
+// handshake, and authentication, and a description of it. Each host reports the user it logged in as and the
+// server's version.
+func (c *Config) checkAction() (string, api.Action, error) {
+	if len(c.Args) > 0 {
+		return "", nil, fmt.Errorf("unable to parse flags: %s takes no command, got %q", SubcommandCheck, c.Args)
+	}
+	if c.Script != "" || c.PipeStdin {
+		return "", nil, fmt.Errorf("unable to parse flags: -script and -stdin cannot be used with %s", SubcommandCheck)
+	}
+	action := func(ctx context.Context, client *ssh.Client, target api.Target, out io.Writer) error {
+		_, err := fmt.Fprintf(out, "logged in as %s, %s", client.User(), client.ServerVersion())
+		return err
+	}
+	return SubcommandCheck, action, nil
+}
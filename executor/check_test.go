@@ -0,0 +1,223 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+	"golang.org/x/crypto/ssh"
+)
+
+// checkServer: an SSH server letting in anyone with its key who only logs in, every channel opened is refused
+type checkServer struct {
+	addr string
+	mu   sync.Mutex
+	// logins and channels count the logins and the sessions or forwards asked for
+	logins, channels int
+}
+
+// newTestKey: a new ed25519 key written to a key file, returning the file's path and the public key.
+func newTestKey(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatalf("unable to encode key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("unable to write key: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("unable to convert key: %v", err)
+	}
+	return path, sshPub
+}
+
+// newCheckServer: a checkServer letting in key, closed at the end of the test.
+func newCheckServer(t *testing.T, key ssh.PublicKey) *checkServer {
+	t.Helper()
+	config := &ssh.ServerConfig{
+		ServerVersion: "SSH-2.0-checktest",
+		PublicKeyCallback: func(_ ssh.ConnMetadata, offered ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(offered.Marshal(), key.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("unable to use host key: %v", err)
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	s := &checkServer{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *checkServer) handle(conn net.Conn, config *ssh.ServerConfig) {
+	defer func() { _ = conn.Close() }()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.logins++
+	s.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+	for ch := range chans {
+		s.mu.Lock()
+		s.channels++
+		s.mu.Unlock()
+		_ = ch.Reject(ssh.Prohibited, "only logging in is allowed")
+	}
+}
+
+// counts: the logins and channels so far.
+func (s *checkServer) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins, s.channels
+}
+
+func TestCheck(t *testing.T) {
+	keyFile, key := newTestKey(t)
+	otherKey, _ := newTestKey(t)
+	srv := newCheckServer(t, key)
+	tests := []struct {
+		name string
+		key  string
+		// wantClass is the error class of srv's host, a host nothing listens on always fails to connect
+		wantClass  string
+		wantStdout string
+		wantLogins int
+	}{
+		{
+			name:       "logged in",
+			key:        keyFile,
+			wantClass:  api.ClassOK,
+			wantStdout: "logged in as deploy, SSH-2.0-checktest",
+			wantLogins: 1,
+		},
+		{name: "wrong key", key: otherKey, wantClass: api.ClassAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logins, _ := srv.counts()
+			var stdout bytes.Buffer
+			c := Config{
+				Subcommand:     SubcommandCheck,
+				InlineHosts:    srv.addr + ",127.0.0.1:1",
+				User:           "deploy",
+				UserSet:        true,
+				PrivateKeys:    []string{tt.key},
+				SSHConfigPath:  filepath.Join(t.TempDir(), "none"),
+				Transport:      TransportSSH,
+				Logger:         testLogger(t),
+				Stdout:         &stdout,
+				Output:         "json",
+				Workers:        2,
+				ConnectTimeout: time.Second,
+			}
+			code, err := Execute(context.Background(), &c)
+			if err != nil {
+				t.Fatalf("unable to run the check: %v", err)
+			}
+			wantCode := ExitSomeFailed
+			if tt.wantClass != api.ClassOK {
+				wantCode = ExitAllFailed
+			}
+			if code != wantCode {
+				t.Errorf("got exit status %d, want %d", code, wantCode)
+			}
+			var run jsonRun
+			if err := json.Unmarshal(stdout.Bytes(), &run); err != nil {
+				t.Fatalf("unable to decode output %q: %v", stdout.String(), err)
+			}
+			if run.Command != SubcommandCheck {
+				t.Errorf("got command %q, want %q", run.Command, SubcommandCheck)
+			}
+			classes := map[string]jsonResult{}
+			for _, res := range run.Results {
+				classes[strings.TrimSuffix(res.Host, ":22")] = res
+			}
+			if res := classes[srv.addr]; res.ErrorClass != tt.wantClass || res.Stdout != tt.wantStdout {
+				t.Errorf("got result %+v for the server, want class %s and stdout %q", res, tt.wantClass, tt.wantStdout)
+			}
+			if res := classes["127.0.0.1:1"]; res.ErrorClass != api.ClassConnect {
+				t.Errorf("got result %+v for the host nothing listens on, want class %s", res, api.ClassConnect)
+			}
+			after, channels := srv.counts()
+			if after-logins != tt.wantLogins {
+				t.Errorf("got %d logins, want %d", after-logins, tt.wantLogins)
+			}
+			if channels != 0 {
+				t.Errorf("the check opened %d channels, want none", channels)
+			}
+		})
+	}
+}
+
+func TestCheckInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       Config
+		wantErr string
+	}{
+		{name: "command", c: Config{Args: []string{"uptime"}}, wantErr: "check takes no command"},
+		{name: "script", c: Config{Script: "deploy.sh"}, wantErr: "-script and -stdin cannot be used with check"},
+		{
+			name:    "expected output",
+			c:       Config{Expect: api.Expectation{Exact: "ok"}},
+			wantErr: "-expect-regex and -expect-exact only check the output of commands",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.c
+			c.Subcommand = SubcommandCheck
+			c.InlineHosts = "127.0.0.1:1"
+			c.Transport = TransportSSH
+			c.Logger = testLogger(t)
+			code, err := Execute(context.Background(), &c)
+			if code != ExitSetup || err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got exit status %d and error %v, want %d and one containing %q", code, err, ExitSetup, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/utils"
+	"github.com/basilnsage/remote-executor/utils/inventory"
+	"golang.org/x/crypto/ssh"
+)
+
+// Subcommands, a run of a command when there is none
+const (
+	// SubcommandCopy: `remote-executor copy [options] hosts src dest` uploads files instead of running a command
+	SubcommandCopy = "copy"
+	// SubcommandFetch: `remote-executor fetch [options] hosts src dir` downloads src from every host into dir
+	SubcommandFetch = "fetch"
+	// SubcommandCollect: `remote-executor collect [options] hosts dir path...` archives paths on every host into dir
+	SubcommandCollect = "collect"
+	// SubcommandCheck: only connect to and log in on every host, to probe the fleet before a real run
+	SubcommandCheck = "check"
+	// SubcommandListHosts: print the hosts a run would target instead of running anything
+	SubcommandListHosts = "list-hosts"
+	// SubcommandServe: keep running and take jobs over HTTP instead of running a single command
+	SubcommandServe = "serve"
+	// SubcommandHistory: query the runs recorded in the history database instead of running anything
+	SubcommandHistory = "history"
+	// SubcommandVerifyAudit: check the audit log's hash chain instead of running anything
+	SubcommandVerifyAudit = "verify-audit"
+)
+
+// Subcommands: every subcommand, in the order the CLI lists them
+var Subcommands = []string{
+	SubcommandCopy, SubcommandFetch, SubcommandCollect, SubcommandCheck, SubcommandListHosts, SubcommandServe,
+	SubcommandHistory, SubcommandVerifyAudit,
+}
+
+// Process exit statuses returned by Execute, so wrapper scripts can branch on the outcome of a run
+const (
+	ExitOK         = 0
+	ExitSomeFailed = 1
+	ExitAllFailed  = 2
+	ExitSetup      = 3
+)
+
+// Transports hosts are run with, picked with Config.Transport, per host in inventories, or with a prefix like local:
+// on flat host list entries
+const (
+	TransportSSH     = "ssh"
+	TransportLocal   = "local"
+	TransportDocker  = "docker"
+	TransportKubectl = "kubectl"
+	TransportSSM     = "ssm"
+)
+
+// Sort orders for Config.SortBy, results are reported as hosts finish without one
+const (
+	SortHost      = "host"
+	SortInventory = "inventory"
+)
+
+// Config: everything a run of the CLI is set up with, one field per flag, the way the CLI's flags describe them.
+// Build one and hand it to Execute to do what the CLI would with the same flags. Zero values mean the flag's
+// default unless noted otherwise.
+type Config struct {
+	// Subcommand is one of the Subcommand constants, empty to run a command
+	Subcommand string
+	// HostList is the host list file or source like srv:_ssh._tcp.example.com, unless InlineHosts is set
+	HostList string
+	// Args are the positional arguments after the host list: the command, or the subcommand's arguments
+	Args []string
+	// Logger gets log messages and, with the text output format, each host's result
+	Logger *utils.SyncLogger
+	// Stdin, Stdout, and Stderr default to the process's own
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// host selection
+	InlineHosts     string
+	InventoryFormat string
+	Parser          *regexp.Regexp
+	Groups          []string
+	NotGroups       []string
+	Limit           []string
+	Exclude         []string
+	DefaultPort     int
+	CIDRHostsOnly   bool
+	FailedOut       string
+	RetryFailed     bool
+
+	// authentication and connecting
+	User string
+	// UserSet is true if User was picked explicitly, so it wins over the ssh config
+	UserSet        bool
+	AuthOrder      string
+	UseAgent       bool
+	PasswordAuth   bool
+	PrivateKeys    []string
+	Passphrase     string
+	PasswordFD     int
+	PasswordSecret string
+	TOTPSecret     string
+	VaultSSH       string
+	HostKeyPolicy  string
+	KnownHosts     string
+	ConnectTimeout time.Duration
+	SSHOptions     []utils.SSHOption
+	SSHConfigPath  string
+	Credentials    string
+	Jump           string
+	Transport      string
+	DockerCLI      string
+
+	// what runs on every host
+	Script    string
+	PipeStdin bool
+	Shell     string
+	Chdir     string
+	Env       map[string]string
+	// FileMode, FileOwner, and VerifyCopy are for copy, IncludeFiles and ExcludeFiles for copy and fetch
+	FileMode     string
+	FileOwner    string
+	VerifyCopy   bool
+	IncludeFiles []string
+	ExcludeFiles []string
+
+	// the worker pool
+	Workers         int
+	MaxWorkers      int
+	Timeout         time.Duration
+	MaxRuntime      time.Duration
+	Keepalive       time.Duration
+	KeepaliveCount  int
+	StopSignal      ssh.Signal
+	StopGrace       time.Duration
+	IdleTimeout     time.Duration
+	BufferLimit     int
+	MaxOutput       int64
+	AbortOutput     bool
+	CleanOutput     bool
+	Expect          api.Expectation
+	OKExitCodes     []int
+	RemoteLock      string
+	LockTTL         time.Duration
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	// ConnectRate is in connections per second, with bursts of up to ConnectBurst, zero for no limit
+	ConnectRate  float64
+	ConnectBurst int
+	DialJitter   time.Duration
+
+	// the rollout
+	Serial        string
+	SerialAbort   bool
+	Canary        string
+	CanaryAuto    bool
+	Confirm       bool
+	MaxFailures   int
+	MaxFailurePct float64
+
+	// reporting results
+	Output    string
+	Format    string
+	SortBy    string
+	OutDir    string
+	Aggregate bool
+	Diff      bool
+	Stream    bool
+	Progress  bool
+	// Color highlights hosts and errors in text output, only set it when writing to a terminal
+	Color         bool
+	Summarize     bool
+	Reports       []Report
+	MetricsListen string
+
+	// remembering runs
+	StatePath   string
+	ResumePath  string
+	SkipRecent  time.Duration
+	Force       bool
+	HistoryPath string
+	AuditPath   string
+
+	// notifications
+	NotifyURL      string
+	NotifyFailures bool
+	SlackWebhook   string
+	SlackToken     string
+	SlackChannel   string
+
+	// the history subcommand
+	HistoryRun   int64
+	HistoryHost  string
+	HistorySince time.Duration
+	HistoryLast  int
+
+	// the serve subcommand
+	Listen     string
+	GRPCListen string
+	Token      string
+	// ReuseConnections keeps each host's connection open between jobs
+	ReuseConnections bool
+}
+
+// Execute: do what the CLI does with c, returning the process exit status. The error is only set if nothing could be
+// run because c is unusable or its files, hosts, or credentials could not be loaded, the status is ExitSetup then.
+func Execute(ctx context.Context, c *Config) (int, error) {
+	if c.Logger == nil {
+		return ExitSetup, errors.New("no logger")
+	}
+	if c.Stdin == nil {
+		c.Stdin = os.Stdin
+	}
+	if c.Stdout == nil {
+		c.Stdout = os.Stdout
+	}
+	if c.Stderr == nil {
+		c.Stderr = os.Stderr
+	}
+	if c.Parser == nil {
+		c.Parser = regexp.MustCompile(`^(\S+)`)
+	}
+	if c.DefaultPort == 0 {
+		c.DefaultPort = 22
+	}
+	if _, err := c.hostTransport(inventory.Host{}); err != nil {
+		return ExitSetup, fmt.Errorf("unable to parse flags: -transport: %v", err)
+	}
+
+	switch c.Subcommand {
+	case SubcommandHistory:
+		return c.showHistory()
+	case SubcommandVerifyAudit:
+		return c.verifyAudit()
+	case SubcommandListHosts:
+		return c.listHosts()
+	case SubcommandServe:
+		return ExitSetup, c.serve()
+	default:
+		return c.run(ctx)
+	}
+}
+
+// runKind: the kind a run is recorded as, its subcommand or run.
+func (c *Config) runKind() string {
+	if c.Subcommand == "" {
+		return "run"
+	}
+	return c.Subcommand
+}
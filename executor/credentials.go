@@ -0,0 +1,118 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/basilnsage/remote-executor/utils"
+	"github.com/basilnsage/remote-executor/utils/inventory"
+	"gopkg.in/yaml.v3"
+)
+
+// credentialsFile: the Config.Credentials file, the auth to use for hosts matching host name patterns or in groups, so
+// fleets needing different users, keys, and passwords can be covered in one run, e.g.
+//
+//	credentials:
+//	  - hosts: ["switch-*", "10.20.*"]
+//	    user: admin
+//	    password: aws-sm://net/switch-password
+//	  - groups: [legacy]
+//	    user: root
+//	    key_files: [~/.ssh/legacy_rsa]
+type credentialsFile struct {
+	Credentials []credential `yaml:"credentials"`
+}
+
+// credential: one entry of a credentials file. The first entry matching a host applies to it.
+type credential struct {
+	// Hosts are path.Match patterns matched against the host name or address, without the user or port
+	Hosts []string `yaml:"hosts"`
+	// Groups match hosts in any of these inventory groups
+	Groups   []string `yaml:"groups"`
+	User     string   `yaml:"user"`
+	KeyFiles []string `yaml:"key_files"`
+	// Password is the password itself or a secret reference like aws-sm://net/switch-password
+	Password string `yaml:"password"`
+}
+
+// loadCredentials: read and check the credentials file at credsPath.
+func loadCredentials(credsPath string) ([]credential, error) {
+	data, err := os.ReadFile(expandHome(credsPath))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read credentials file: %v", err)
+	}
+	var file credentialsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse credentials file: %v", err)
+	}
+	for i, cred := range file.Credentials {
+		if len(cred.Hosts) == 0 && len(cred.Groups) == 0 {
+			return nil, fmt.Errorf("credentials entry %d matches no hosts or groups", i+1)
+		}
+		for _, pattern := range cred.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("credentials entry %d: bad host pattern %q: %v", i+1, pattern, err)
+			}
+		}
+		for j, keyFile := range cred.KeyFiles {
+			file.Credentials[i].KeyFiles[j] = expandHome(keyFile)
+		}
+	}
+	return file.Credentials, nil
+}
+
+// credentials: the entries of the Credentials file, none if it is not set.
+func (c *Config) credentials() ([]credential, error) {
+	if c.Credentials == "" {
+		return nil, nil
+	}
+	return loadCredentials(c.Credentials)
+}
+
+// credentialFor: the first of creds applying to host, known by alias, nil if none does.
+func credentialFor(creds []credential, host inventory.Host, alias string) *credential {
+	for i, cred := range creds {
+		for _, pattern := range cred.Hosts {
+			if ok, _ := path.Match(pattern, alias); ok {
+				return &creds[i]
+			}
+		}
+		for _, group := range cred.Groups {
+			for _, hostGroup := range host.Groups {
+				if group == hostGroup {
+					return &creds[i]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// credentialPassword: answer password and keyboard-interactive auth in authConf with a credentials file entry's
+// password pass, and one-time password prompts with totp, offering password auth if it is not in the auth order
+// already.
+func credentialPassword(authConf *utils.AuthConfig, pass, totp string) {
+	password := func() (string, error) { return pass, nil }
+	authConf.Password = password
+	authConf.Challenge = utils.NewChallengeResponder(password, totp, utils.Prompt)
+	for _, method := range authConf.Order {
+		if method == utils.AuthPassword {
+			return
+		}
+	}
+	authConf.Order = append(append([]string{}, authConf.Order...), utils.AuthPassword)
+}
+
+// password: the credential's password, fetched if it is a secret reference.
+func (c *credential) password() (string, error) {
+	if !utils.IsSecretRef(c.Password) {
+		return c.Password, nil
+	}
+	pass, err := utils.FetchSecret(c.Password)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(pass), "\r\n"), nil
+}
@@ -0,0 +1,123 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/basilnsage/remote-executor/utils"
+	"github.com/basilnsage/remote-executor/utils/inventory"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestResolverCredentialPassword: a credentials entry's secret is fetched once, however many users and key files the
+// hosts it covers need a client config for.
+func TestResolverCredentialPassword(t *testing.T) {
+	// an aws CLI that logs each call and answers with the password
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"$@\" >> \"$(dirname \"$0\")/log\"\n" +
+		`echo '{"Parameter": {"Value": "hunter2"}}'` + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "aws"), []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write the aws CLI: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	c := &Config{Transport: TransportSSH, DefaultPort: 22}
+	authConf := utils.AuthConfig{Order: []string{utils.AuthKey}}
+	resolver := newTargetResolver(c, &utils.SSHConfigFile{}, authConf, ssh.ClientConfig{User: "root"})
+	resolver.creds = []credential{{Hosts: []string{"switch-*"}, Password: "aws-ssm:///net/switch-password"}}
+
+	for _, host := range []inventory.Host{
+		{Name: "switch-1", User: "admin"},
+		{Name: "switch-2", User: "operator"},
+		{Name: "switch-3", User: "admin", KeyFiles: []string{"/does/not/exist"}},
+	} {
+		target, err := resolver.resolve(host)
+		if err != nil {
+			t.Fatalf("unable to resolve %s: %v", host.Name, err)
+		}
+		if target.Config == nil || target.Config.User != host.User || len(target.Config.Auth) != 1 {
+			t.Errorf("got config %+v for %s, want %s with password auth", target.Config, host.Name, host.User)
+		}
+	}
+
+	log, err := os.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatalf("unable to read the aws CLI log: %v", err)
+	}
+	if calls := strings.Count(string(log), "\n"); calls != 1 {
+		t.Errorf("the secret was fetched %d times, want once:\n%s", calls, log)
+	}
+}
+
+func TestCredentialFor(t *testing.T) {
+	creds := []credential{
+		{Hosts: []string{"switch-*", "router1"}, User: "netops"},
+		{Groups: []string{"db", "cache"}, User: "dba"},
+		{Hosts: []string{"*"}, User: "fallback"},
+	}
+	tests := []struct {
+		name  string
+		host  inventory.Host
+		alias string
+		want  string
+	}{
+		{name: "host pattern", host: inventory.Host{Name: "switch-3"}, alias: "switch-3", want: "netops"},
+		{name: "second pattern", host: inventory.Host{Name: "router1"}, alias: "router1", want: "netops"},
+		{name: "pattern on the alias", host: inventory.Host{Name: "core"}, alias: "switch-core", want: "netops"},
+		{name: "group", host: inventory.Host{Name: "pg1", Groups: []string{"web", "db"}}, alias: "pg1", want: "dba"},
+		{
+			name:  "first entry wins",
+			host:  inventory.Host{Name: "switch-db", Groups: []string{"db"}},
+			alias: "switch-db",
+			want:  "netops",
+		},
+		{name: "catch all", host: inventory.Host{Name: "web1", Groups: []string{"web"}}, alias: "web1", want: "fallback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := credentialFor(creds, tt.host, tt.alias)
+			if got == nil || got.User != tt.want {
+				t.Fatalf("got credential %+v, want the one for %s", got, tt.want)
+			}
+			if got != &creds[0] && got != &creds[1] && got != &creds[2] {
+				t.Error("got a copy of the credential, want the entry itself")
+			}
+		})
+	}
+
+	if got := credentialFor(creds[:2], inventory.Host{Name: "web1", Groups: []string{"web"}}, "web1"); got != nil {
+		t.Errorf("got credential %+v for a host no entry covers, want none", got)
+	}
+	if got := credentialFor(nil, inventory.Host{Name: "web1"}, "web1"); got != nil {
+		t.Errorf("got credential %+v without a credentials file, want none", got)
+	}
+}
+
+func TestCredentialPassword(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []string
+		want  string
+	}{
+		{name: "password added", order: []string{utils.AuthKey}, want: "key,password"},
+		{name: "password kept in place", order: []string{utils.AuthPassword, utils.AuthKey}, want: "password,key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := append([]string{}, tt.order...)
+			authConf := utils.AuthConfig{Order: order}
+			credentialPassword(&authConf, "hunter2", "")
+			if got := strings.Join(authConf.Order, ","); got != tt.want {
+				t.Errorf("got auth order %s, want %s", got, tt.want)
+			}
+			if strings.Join(order, ",") != strings.Join(tt.order, ",") {
+				t.Errorf("the shared auth order was changed to %v", order)
+			}
+			if pass, err := authConf.Password(); pass != "hunter2" || err != nil {
+				t.Errorf("got password %q and error %v, want hunter2", pass, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package executor
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+)
+
+// dashboardPage: the single page web UI, it reads everything it shows from the job API
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// serveDashboard: serve the dashboard at /. The page asks for the bearer token and sends it along with its API
+// requests.
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		httpError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed on /", r.Method))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(dashboardPage)
+}
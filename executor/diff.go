@@ -0,0 +1,158 @@
+package executor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffCells: past this many lines in one changed stretch times lines in the other, the stretches are not aligned
+// line by line but reported as removed and added whole, to keep huge outputs from using up memory
+const maxDiffCells = 1 << 20
+
+// diffLine: a line of a diff, op is ' ' for a line in both, '-' for a line only in the old text, '+' for the new
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// unifiedDiff: the changes turning a into b line by line with context unchanged lines around each, like diff -u
+// prints them, or "" if there are none.
+func unifiedDiff(aName, bName string, a, b []byte, context int) string {
+	lines := diffLines(splitLines(a), splitLines(b))
+	// aLines[i] and bLines[i] count the lines of a and b before lines[i]
+	aLines, bLines := make([]int, len(lines)+1), make([]int, len(lines)+1)
+	for i, line := range lines {
+		aLines[i+1], bLines[i+1] = aLines[i], bLines[i]
+		if line.op != '+' {
+			aLines[i+1]++
+		}
+		if line.op != '-' {
+			bLines[i+1]++
+		}
+	}
+
+	var sb strings.Builder
+	for next := 0; next < len(lines); {
+		first := next
+		for first < len(lines) && lines[first].op == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+		// a hunk runs until more unchanged lines than the context on both sides of it
+		end := first + 1
+		for i := end; i < len(lines) && i-end < 2*context; i++ {
+			if lines[i].op != ' ' {
+				end = i + 1
+			}
+		}
+		from, to := max(first-context, next), min(end+context, len(lines))
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+		}
+		fmt.Fprintf(
+			&sb,
+			"@@ -%s +%s @@\n",
+			hunkRange(aLines[from], aLines[to]-aLines[from]),
+			hunkRange(bLines[from], bLines[to]-bLines[from]),
+		)
+		for _, line := range lines[from:to] {
+			sb.WriteByte(line.op)
+			sb.WriteString(line.text)
+			sb.WriteByte('\n')
+		}
+		next = to
+	}
+	return sb.String()
+}
+
+// hunkRange: the start,count of a hunk starting after before lines, the way diff -u numbers them.
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprint(before + 1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// splitLines: the lines of data without their newlines.
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// diffLines: a shortest edit turning a into b, with the lines they have in common.
+func diffLines(a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var lines []diffLine
+	for _, text := range a[:prefix] {
+		lines = append(lines, diffLine{' ', text})
+	}
+	lines = append(lines, alignLines(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, text := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{' ', text})
+	}
+	return lines
+}
+
+// alignLines: the lines of a and b lined up along their longest common subsequence.
+func alignLines(a, b []string) []diffLine {
+	var lines []diffLine
+	if len(a)*len(b) > maxDiffCells {
+		for _, text := range a {
+			lines = append(lines, diffLine{'-', text})
+		}
+		for _, text := range b {
+			lines = append(lines, diffLine{'+', text})
+		}
+		return lines
+	}
+	// common[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case common[i+1][j] >= common[i][j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+	return lines
+}
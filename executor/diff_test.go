@@ -0,0 +1,142 @@
+package executor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+		want    string
+	}{
+		{
+			name:    "identical",
+			a:       "1\n2\n3\n",
+			b:       "1\n2\n3\n",
+			context: 3,
+			want:    "",
+		},
+		{
+			name:    "insertion",
+			a:       "1\n2\n3\n",
+			b:       "1\n2\nx\n3\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -2,2 +2,3 @@\n 2\n+x\n 3\n",
+		},
+		{
+			name:    "deletion",
+			a:       "1\n2\n3\n",
+			b:       "1\n3\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,3 +1,2 @@\n 1\n-2\n 3\n",
+		},
+		{
+			name:    "change",
+			a:       "1\n2\n3\n",
+			b:       "1\nX\n3\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,3 +1,3 @@\n 1\n-2\n+X\n 3\n",
+		},
+		{
+			name:    "changes further apart than the context make two hunks",
+			a:       "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:       "1\nX\n3\n4\n5\n6\nY\n8\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,3 +1,3 @@\n 1\n-2\n+X\n 3\n@@ -6,3 +6,3 @@\n 6\n-7\n+Y\n 8\n",
+		},
+		{
+			name:    "changes within the context make one hunk",
+			a:       "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:       "1\nX\n3\n4\n5\n6\nY\n8\n",
+			context: 3,
+			want:    "--- a\n+++ b\n@@ -1,8 +1,8 @@\n 1\n-2\n+X\n 3\n 4\n 5\n 6\n-7\n+Y\n 8\n",
+		},
+		{
+			name:    "context lines stop at the edges",
+			a:       "1\n2\n3\n4\n5\n6\n",
+			b:       "1\n2\n3\nX\n5\n6\n",
+			context: 2,
+			want:    "--- a\n+++ b\n@@ -2,5 +2,5 @@\n 2\n 3\n-4\n+X\n 5\n 6\n",
+		},
+		{
+			name:    "no context",
+			a:       "1\n2\n3\n",
+			b:       "1\n2\nx\n3\n",
+			context: 0,
+			want:    "--- a\n+++ b\n@@ -2,0 +3 @@\n+x\n",
+		},
+		{
+			name:    "from nothing",
+			a:       "",
+			b:       "x\n",
+			context: 3,
+			want:    "--- a\n+++ b\n@@ -0,0 +1 @@\n+x\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unifiedDiff("a", "b", []byte(tt.a), []byte(tt.b), tt.context); got != tt.want {
+				t.Errorf("got diff:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// diffString: lines as the op and text of each, one per line.
+func diffString(lines []diffLine) string {
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteByte(line.op)
+		sb.WriteString(line.text)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func TestAlignLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want string
+	}{
+		{name: "identical", a: []string{"a", "b"}, b: []string{"a", "b"}, want: " a\n b\n"},
+		{name: "insertion", a: []string{"a", "c"}, b: []string{"a", "b", "c"}, want: " a\n+b\n c\n"},
+		{name: "deletion", a: []string{"a", "b", "c"}, b: []string{"a", "c"}, want: " a\n-b\n c\n"},
+		{name: "change", a: []string{"a", "b", "c"}, b: []string{"a", "X", "c"}, want: " a\n-b\n+X\n c\n"},
+		{name: "swap", a: []string{"a", "b"}, b: []string{"b", "a"}, want: "-a\n b\n+a\n"},
+		{name: "from nothing", a: nil, b: []string{"a"}, want: "+a\n"},
+		{name: "to nothing", a: []string{"a"}, b: nil, want: "-a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffString(alignLines(tt.a, tt.b)); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlignLinesTooLarge(t *testing.T) {
+	// past maxDiffCells the lines are not lined up, even the ones in common
+	var a, b []string
+	for i := 0; i < 1025; i++ {
+		a = append(a, "same")
+		b = append(b, "same")
+	}
+	lines := alignLines(a, b)
+	if len(lines) != len(a)+len(b) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(a)+len(b))
+	}
+	for i, line := range lines {
+		want := byte('-')
+		if i >= len(a) {
+			want = '+'
+		}
+		if line.op != want {
+			t.Fatalf("line %d: got op %q, want %q", i, line.op, want)
+		}
+	}
+}
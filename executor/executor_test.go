@@ -0,0 +1,234 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/utils/inventory"
+)
+
+// failBad: an executor failing every host whose name starts with bad, and hanging on hosts starting with slow
+var failBad = api.ExecutorFunc(func(ctx context.Context, target api.Target, cmd string) (api.Result, error) {
+	switch {
+	case strings.HasPrefix(target.Host, "bad"):
+		return api.Result{}, &api.ExitError{Status: 1}
+	case strings.HasPrefix(target.Host, "slow"):
+		<-ctx.Done()
+		return api.Result{}, ctx.Err()
+	}
+	return api.Result{Output: []byte(cmd + " on " + target.Addr)}, nil
+})
+
+func testHosts(names ...string) []inventory.Host {
+	var hosts []inventory.Host
+	for _, name := range names {
+		hosts = append(hosts, inventory.Host{Name: name, Address: name + ":22"})
+	}
+	return hosts
+}
+
+// outcomes: each host's output, or the error it failed with
+func outcomes(summary *Summary) map[string]string {
+	got := map[string]string{}
+	for _, res := range summary.Results {
+		got[res.Host] = string(res.Output)
+		if res.Err != nil {
+			got[res.Host] = res.Err.Error()
+		}
+	}
+	return got
+}
+
+// localInventory: an inventory of hosts with each one's name in $TEST_HOST, for commands run on this machine to tell
+// them apart, returning its path.
+func localInventory(t *testing.T, names ...string) string {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("hosts:\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %s:\n    env:\n      TEST_HOST: %s\n", name, name)
+	}
+	path := filepath.Join(t.TempDir(), "inventory.yaml")
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatalf("unable to write inventory: %v", err)
+	}
+	return path
+}
+
+// runLocal: run cmd with c on this machine for every host of a localInventory the way the CLI would, returning the
+// exit status and what was written to Stdout and Stderr. Output defaults to json and Workers to 4.
+func runLocal(t *testing.T, c Config, inventoryPath, cmd string) (int, string) {
+	t.Helper()
+	var stdout bytes.Buffer
+	c.HostList = inventoryPath
+	c.Args = []string{cmd}
+	c.Transport = TransportLocal
+	c.Stdout = &stdout
+	c.Stderr = &stdout
+	if c.Logger == nil {
+		c.Logger = testLogger(t)
+	}
+	if c.Output == "" {
+		c.Output = "json"
+	}
+	if c.Workers == 0 {
+		c.Workers = 4
+	}
+	code, err := Execute(context.Background(), &c)
+	if err != nil {
+		t.Fatalf("unable to run %q: %v", cmd, err)
+	}
+	return code, stdout.String()
+}
+
+func TestRunner(t *testing.T) {
+	var mu sync.Mutex
+	var reported []string
+	r := &Runner{
+		Command: "uptime",
+		Workers: 2,
+		Options: []api.Option{api.WithExecutor(failBad)},
+		OnResult: func(res api.Result) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, res.Host)
+		},
+	}
+	summary, err := r.Run(context.Background(), testHosts("a", "bad1", "b"))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	got := outcomes(summary)
+	if got["a"] != "uptime on a:22" || got["b"] != "uptime on b:22" || !strings.Contains(got["bad1"], "status 1") {
+		t.Errorf("got results %v", got)
+	}
+	if failed := summary.Failed(); len(failed) != 1 || failed[0] != "bad1" {
+		t.Errorf("got failed hosts %v, want [bad1]", failed)
+	}
+	if len(reported) != 3 || summary.Started.IsZero() || summary.TimedOut {
+		t.Errorf("got %d results reported, started %v, timed out %v", len(reported), summary.Started, summary.TimedOut)
+	}
+
+	r.Resolve = func(host inventory.Host) (api.Target, error) {
+		if host.Name == "b" {
+			return api.Target{}, errors.New("no address")
+		}
+		return api.Target{Host: host.Name, Addr: "10.0.0.1"}, nil
+	}
+	if summary, err = r.Run(context.Background(), testHosts("a", "b")); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	got = outcomes(summary)
+	if got["a"] != "uptime on 10.0.0.1" || !strings.Contains(got["b"], "no address") {
+		t.Errorf("got results %v", got)
+	}
+
+	if _, err := (&Runner{}).Run(context.Background(), nil); err == nil {
+		t.Error("Run with no workers did not fail")
+	}
+	if _, err := (&Runner{Workers: 4, MaxWorkers: 2}).Run(context.Background(), nil); err == nil {
+		t.Error("Run with max workers below workers did not fail")
+	}
+}
+
+func TestRunnerRollOut(t *testing.T) {
+	skipped := func(summary *Summary) []string {
+		var hosts []string
+		for _, res := range summary.Results {
+			if errors.Is(res.Err, api.ErrSkipped) {
+				hosts = append(hosts, res.Host)
+			}
+		}
+		return hosts
+	}
+	tests := []struct {
+		name   string
+		runner Runner
+		hosts  []inventory.Host
+		want   string
+	}{
+		{
+			name:   "no limits",
+			runner: Runner{Workers: 1},
+			hosts:  testHosts("bad1", "bad2", "a", "b"),
+			want:   "",
+		},
+		{
+			name:   "failure limit",
+			runner: Runner{Workers: 1, MaxFailures: 2},
+			hosts:  testHosts("a", "bad1", "bad2", "b", "c"),
+			want:   "b,c",
+		},
+		{
+			name:   "stop on batch failure",
+			runner: Runner{Workers: 2, BatchSize: 2, StopOnBatchFailure: true},
+			hosts:  testHosts("a", "b", "c", "bad1", "d", "e"),
+			want:   "d,e",
+		},
+		{
+			name:   "failed canary",
+			runner: Runner{Workers: 2, Canaries: 1},
+			hosts:  testHosts("bad1", "a", "b"),
+			want:   "a,b",
+		},
+		{
+			name:   "healthy canary",
+			runner: Runner{Workers: 2, Canaries: 1},
+			hosts:  testHosts("a", "bad1", "b"),
+			want:   "",
+		},
+		{
+			name: "confirmed canary",
+			runner: Runner{
+				Workers:  2,
+				Canaries: 2,
+				ContinueAfterCanaries: func(failed, canaries, remaining int) (bool, error) {
+					return failed == 1 && canaries == 2 && remaining == 1, nil
+				},
+			},
+			hosts: testHosts("bad1", "a", "b"),
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.runner.Options = []api.Option{api.WithExecutor(failBad)}
+			summary, err := tt.runner.Run(context.Background(), tt.hosts)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if len(summary.Results) != len(tt.hosts) {
+				t.Fatalf("got %d results, want %d", len(summary.Results), len(tt.hosts))
+			}
+			if got := strings.Join(skipped(summary), ","); got != tt.want {
+				t.Errorf("got skipped hosts %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunnerMaxRuntime(t *testing.T) {
+	r := &Runner{
+		Command:    "uptime",
+		Workers:    2,
+		MaxRuntime: 50 * time.Millisecond,
+		Options:    []api.Option{api.WithExecutor(failBad)},
+	}
+	summary, err := r.Run(context.Background(), testHosts("a", "slow1"))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	got := outcomes(summary)
+	if !summary.TimedOut || got["a"] != "uptime on a:22" || got["slow1"] == "" || len(summary.Failed()) != 1 {
+		t.Errorf("got timed out %v and results %v", summary.TimedOut, got)
+	}
+}
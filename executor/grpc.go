@@ -0,0 +1,181 @@
+package executor
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/jobspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcJobs: the job API as the jobspb.Jobs gRPC service, backed by the same jobs as the HTTP API
+type grpcJobs struct {
+	jobspb.UnimplementedJobsServer
+	s *jobServer
+}
+
+func (g grpcJobs) SubmitJob(_ context.Context, req *jobspb.SubmitJobRequest) (*jobspb.Job, error) {
+	jr := jobRequest{
+		Hosts:       req.GetHosts(),
+		Command:     req.GetCommand(),
+		Concurrency: int(req.GetConcurrency()),
+		Env:         req.GetEnv(),
+	}
+	if req.GetTimeout() != nil {
+		if err := req.GetTimeout().CheckValid(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid job: bad timeout: %v", err)
+		}
+		jr.Timeout = req.GetTimeout().AsDuration().String()
+	}
+	j, err := g.s.start(jr)
+	if errors.Is(err, errAudit) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return newGRPCJob(j.status(false)), nil
+}
+
+func (g grpcJobs) StreamResults(req *jobspb.StreamResultsRequest, stream jobspb.Jobs_StreamResultsServer) error {
+	j, ok := g.s.lookup(req.GetId())
+	if !ok {
+		return status.Errorf(codes.NotFound, "no such job: %s", req.GetId())
+	}
+	seen := 0
+	for {
+		results, over, updated := j.since(seen)
+		for _, res := range results {
+			if err := stream.Send(newGRPCResult(res)); err != nil {
+				return err
+			}
+		}
+		seen += len(results)
+		if over {
+			return nil
+		}
+		select {
+		case <-updated:
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+func (g grpcJobs) CancelJob(_ context.Context, req *jobspb.CancelJobRequest) (*jobspb.Job, error) {
+	j, ok := g.s.lookup(req.GetId())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no such job: %s", req.GetId())
+	}
+	j.stop()
+	return newGRPCJob(j.status(false)), nil
+}
+
+func (g grpcJobs) ListJobs(context.Context, *jobspb.ListJobsRequest) (*jobspb.ListJobsResponse, error) {
+	resp := &jobspb.ListJobsResponse{}
+	for _, j := range g.s.all() {
+		resp.Jobs = append(resp.Jobs, newGRPCJob(j.status(false)))
+	}
+	return resp, nil
+}
+
+// grpcStates: the protobuf enum value for each job state
+var grpcStates = map[string]jobspb.JobState{
+	jobRunning:   jobspb.JobState_JOB_STATE_RUNNING,
+	jobDone:      jobspb.JobState_JOB_STATE_DONE,
+	jobCancelled: jobspb.JobState_JOB_STATE_CANCELLED,
+}
+
+func newGRPCJob(st jobStatus) *jobspb.Job {
+	j := &jobspb.Job{
+		Id:        st.ID,
+		Command:   st.Command,
+		State:     grpcStates[st.State],
+		Hosts:     int32(st.Hosts),
+		Succeeded: int32(st.Succeeded),
+		Failed:    int32(st.Failed),
+		Started:   timestamppb.New(st.Started),
+	}
+	if st.Finished != nil {
+		j.Finished = timestamppb.New(*st.Finished)
+	}
+	return j
+}
+
+func newGRPCResult(res api.Result) *jobspb.Result {
+	r := &jobspb.Result{
+		Host:       res.Host,
+		ExitCode:   int32(res.ExitCode),
+		Stdout:     res.Stdout,
+		Stderr:     res.Stderr,
+		Duration:   durationpb.New(res.Duration),
+		ErrorClass: api.Classify(res.Err),
+	}
+	if res.Err != nil {
+		r.Error = res.Err.Error()
+	}
+	return r
+}
+
+// grpcAuthorized: whether the call carries the bearer token, if there is one.
+func grpcAuthorized(ctx context.Context, token string) error {
+	if token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		got := strings.TrimPrefix(value, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or wrong bearer token")
+}
+
+// newGRPCServer: a gRPC server with the Jobs service registered on top of s.
+func newGRPCServer(s *jobServer) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(
+			ctx context.Context,
+			req interface{},
+			_ *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler,
+		) (interface{}, error) {
+			if err := grpcAuthorized(ctx, s.cfg.Token); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(
+			srv interface{},
+			stream grpc.ServerStream,
+			_ *grpc.StreamServerInfo,
+			handler grpc.StreamHandler,
+		) error {
+			if err := grpcAuthorized(stream.Context(), s.cfg.Token); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	)
+	jobspb.RegisterJobsServer(srv, grpcJobs{s: s})
+	return srv
+}
+
+// serveGRPC: serve the gRPC job API on addr until the listener fails.
+func serveGRPC(addr string, s *jobServer) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return newGRPCServer(s).Serve(lis)
+}
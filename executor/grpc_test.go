@@ -0,0 +1,231 @@
+package executor
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/basilnsage/remote-executor/jobspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// newTestGRPCClient: a client of the gRPC job API serving c's jobs in memory.
+func newTestGRPCClient(t *testing.T, c *Config) jobspb.JobsClient {
+	t.Helper()
+	lis := bufconn.Listen(1024 * 1024)
+	srv := newGRPCServer(newTestJobServer(t, c))
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.NewClient(
+		"passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return jobspb.NewJobsClient(conn)
+}
+
+// withToken: ctx with token as the call's bearer token.
+func withToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+// streamResults: every result of the job with id, once it is over.
+func streamResults(ctx context.Context, t *testing.T, client jobspb.JobsClient, id string) []*jobspb.Result {
+	t.Helper()
+	stream, err := client.StreamResults(ctx, &jobspb.StreamResultsRequest{Id: id})
+	if err != nil {
+		t.Fatalf("unable to stream results of job %s: %v", id, err)
+	}
+	var results []*jobspb.Result
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return results
+		}
+		if err != nil {
+			t.Fatalf("unable to receive a result of job %s: %v", id, err)
+		}
+		results = append(results, res)
+	}
+}
+
+func TestGRPCJobs(t *testing.T) {
+	client := newTestGRPCClient(t, &Config{Transport: TransportLocal})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	job, err := client.SubmitJob(ctx, &jobspb.SubmitJobRequest{
+		Hosts:   []string{"web1", "web2"},
+		Command: `echo "$GREETING"`,
+		Env:     map[string]string{"GREETING": "hello"},
+		Timeout: durationpb.New(10 * time.Second),
+	})
+	if err != nil {
+		t.Fatalf("unable to submit job: %v", err)
+	}
+	if job.GetId() == "" || job.GetHosts() != 2 || job.GetState() != jobspb.JobState_JOB_STATE_RUNNING {
+		t.Errorf("got submitted job %v, want a running job on 2 hosts", job)
+	}
+	results := streamResults(ctx, t, client, job.GetId())
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, res := range results {
+		if res.GetErrorClass() != "ok" || string(res.GetStdout()) != "hello\n" {
+			t.Errorf("got result %v, want hello", res)
+		}
+	}
+
+	list, err := client.ListJobs(ctx, &jobspb.ListJobsRequest{})
+	if err != nil {
+		t.Fatalf("unable to list jobs: %v", err)
+	}
+	if len(list.GetJobs()) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(list.GetJobs()))
+	}
+	got := list.GetJobs()[0]
+	if got.GetState() != jobspb.JobState_JOB_STATE_DONE || got.GetSucceeded() != 2 || got.GetFinished() == nil {
+		t.Errorf("got job %v once its results were streamed, want it done with 2 hosts succeeded", got)
+	}
+}
+
+func TestGRPCCancelJob(t *testing.T) {
+	client := newTestGRPCClient(t, &Config{Transport: TransportLocal})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	job, err := client.SubmitJob(ctx, &jobspb.SubmitJobRequest{Hosts: []string{"web1"}, Command: "sleep 30"})
+	if err != nil {
+		t.Fatalf("unable to submit job: %v", err)
+	}
+	if _, err := client.CancelJob(ctx, &jobspb.CancelJobRequest{Id: job.GetId()}); err != nil {
+		t.Fatalf("unable to cancel job: %v", err)
+	}
+	results := streamResults(ctx, t, client, job.GetId())
+	if len(results) != 1 || results[0].GetErrorClass() != "cancelled" {
+		t.Errorf("got results %v, want web1 cancelled", results)
+	}
+	list, err := client.ListJobs(ctx, &jobspb.ListJobsRequest{})
+	if err != nil {
+		t.Fatalf("unable to list jobs: %v", err)
+	}
+	if state := list.GetJobs()[0].GetState(); state != jobspb.JobState_JOB_STATE_CANCELLED {
+		t.Errorf("got state %v, want cancelled", state)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	client := newTestGRPCClient(t, &Config{Transport: TransportLocal})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{
+			name: "no command",
+			call: func() error {
+				_, err := client.SubmitJob(ctx, &jobspb.SubmitJobRequest{Hosts: []string{"web1"}})
+				return err
+			},
+			want: codes.InvalidArgument,
+		},
+		{
+			name: "bad timeout",
+			call: func() error {
+				_, err := client.SubmitJob(ctx, &jobspb.SubmitJobRequest{
+					Hosts:   []string{"web1"},
+					Command: "true",
+					Timeout: &durationpb.Duration{Seconds: 1, Nanos: -1},
+				})
+				return err
+			},
+			want: codes.InvalidArgument,
+		},
+		{
+			name: "cancel unknown job",
+			call: func() error {
+				_, err := client.CancelJob(ctx, &jobspb.CancelJobRequest{Id: "42"})
+				return err
+			},
+			want: codes.NotFound,
+		},
+		{
+			name: "stream unknown job",
+			call: func() error {
+				stream, err := client.StreamResults(ctx, &jobspb.StreamResultsRequest{Id: "42"})
+				if err != nil {
+					return err
+				}
+				_, err = stream.Recv()
+				return err
+			},
+			want: codes.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := status.Code(tt.call()); got != tt.want {
+				t.Errorf("got code %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCToken(t *testing.T) {
+	client := newTestGRPCClient(t, &Config{Transport: TransportLocal, Token: "s3cret"})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	submit := &jobspb.SubmitJobRequest{Hosts: []string{"web1"}, Command: "true"}
+
+	for name, callCtx := range map[string]context.Context{
+		"missing": ctx,
+		"wrong":   withToken(ctx, "wrong"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := client.SubmitJob(callCtx, submit); status.Code(err) != codes.Unauthenticated {
+				t.Errorf("submitting: got error %v, want %v", err, codes.Unauthenticated)
+			}
+			if _, err := client.ListJobs(callCtx, &jobspb.ListJobsRequest{}); status.Code(err) != codes.Unauthenticated {
+				t.Errorf("listing: got error %v, want %v", err, codes.Unauthenticated)
+			}
+			stream, err := client.StreamResults(callCtx, &jobspb.StreamResultsRequest{Id: "1"})
+			if err == nil {
+				_, err = stream.Recv()
+			}
+			if status.Code(err) != codes.Unauthenticated {
+				t.Errorf("streaming: got error %v, want %v", err, codes.Unauthenticated)
+			}
+		})
+	}
+
+	ctx = withToken(ctx, "s3cret")
+	job, err := client.SubmitJob(ctx, submit)
+	if err != nil {
+		t.Fatalf("unable to submit with the right token: %v", err)
+	}
+	if results := streamResults(ctx, t, client, job.GetId()); len(results) != 1 {
+		t.Errorf("got %d results, want 1", len(results))
+	}
+	list, err := client.ListJobs(ctx, &jobspb.ListJobsRequest{})
+	if err != nil {
+		t.Fatalf("unable to list jobs: %v", err)
+	}
+	if len(list.GetJobs()) != 1 || list.GetJobs()[0].GetId() != job.GetId() {
+		t.Errorf("got jobs %v, want only the job submitted with the right token", list.GetJobs())
+	}
+}
@@ -0,0 +1,406 @@
+package executor
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+)
+
+// historySchema: one row per run and one per host in it. Outputs are kept whole so a host's past runs can be
+// compared.
+const historySchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	kind TEXT NOT NULL,
+	command TEXT NOT NULL,
+	started INTEGER NOT NULL,
+	duration REAL NOT NULL,
+	hosts INTEGER NOT NULL,
+	succeeded INTEGER NOT NULL,
+	failed INTEGER NOT NULL,
+	local_user TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS runs_started ON runs (started);
+CREATE TABLE IF NOT EXISTS results (
+	run_id INTEGER NOT NULL REFERENCES runs (id) ON DELETE CASCADE,
+	host TEXT NOT NULL,
+	exit_code INTEGER NOT NULL,
+	duration REAL NOT NULL,
+	error TEXT NOT NULL,
+	error_class TEXT NOT NULL,
+	stdout BLOB NOT NULL,
+	stderr BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS results_host ON results (host, run_id);
+`
+
+// history: the SQLite database every run is recorded in
+type history struct {
+	db *sql.DB
+}
+
+// historyRun: a recorded run as the history subcommand reports it
+type historyRun struct {
+	ID        int64        `json:"id"`
+	Kind      string       `json:"kind"`
+	Command   string       `json:"command"`
+	Started   time.Time    `json:"started"`
+	Duration  float64      `json:"duration_seconds"`
+	Hosts     int          `json:"hosts"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	User      string       `json:"local_user"`
+	Results   []jsonResult `json:"results,omitempty"`
+}
+
+// openHistory: open the database at path, creating it and its directory if needed.
+func openHistory(path string) (*history, error) {
+	if !HistorySupported {
+		return nil, errors.New("this build has no SQLite support, build it with cgo to keep a history")
+	}
+	path = expandHome(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// runs finishing at the same time, e.g. serve jobs, wait for each other instead of failing
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(historySchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("unable to set up %s: %v", path, err)
+	}
+	return &history{db: db}, nil
+}
+
+func (h *history) Close() error {
+	return h.db.Close()
+}
+
+// record: store a finished run of kind, the subcommand or "run", and the results of every host in it. Returns the
+// run's id.
+func (h *history) record(kind, command string, started time.Time, results []api.Result) (int64, error) {
+	succeeded, failed := 0, 0
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+		} else {
+			succeeded++
+		}
+	}
+	localUser, _ := os.LookupEnv("USER")
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	run, err := tx.Exec(
+		`INSERT INTO runs (kind, command, started, duration, hosts, succeeded, failed, local_user)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		kind, command, started.UnixNano(), time.Since(started).Seconds(), len(results), succeeded, failed, localUser,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := run.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(
+		`INSERT INTO results (run_id, host, exit_code, duration, error, error_class, stdout, stderr)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = stmt.Close() }()
+	for _, res := range results {
+		jr := newJSONResult(res)
+		// a nil slice would be stored as NULL
+		stdout, stderr := []byte(jr.Stdout), []byte(jr.Stderr)
+		if _, err := stmt.Exec(id, jr.Host, jr.ExitCode, jr.Duration, jr.Error, jr.ErrorClass, stdout, stderr); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// runs: the latest runs started after since, only those including host if it is set, with host's results.
+func (h *history) runs(since time.Time, host string, limit int) ([]historyRun, error) {
+	query := `SELECT id, kind, command, started, duration, hosts, succeeded, failed, local_user FROM runs
+		WHERE started >= ?`
+	args := []interface{}{since.UnixNano()}
+	if host != "" {
+		query += ` AND id IN (SELECT run_id FROM results WHERE host = ?)`
+		args = append(args, host)
+	}
+	query += ` ORDER BY id DESC`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var runs []historyRun
+	for rows.Next() {
+		var run historyRun
+		var started int64
+		err := rows.Scan(
+			&run.ID, &run.Kind, &run.Command, &started, &run.Duration,
+			&run.Hosts, &run.Succeeded, &run.Failed, &run.User,
+		)
+		if err != nil {
+			return nil, err
+		}
+		run.Started = time.Unix(0, started)
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if host != "" {
+		for i := range runs {
+			if runs[i].Results, err = h.results(runs[i].ID, host); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return runs, nil
+}
+
+// run: the run with id along with the results of its hosts, only host's if it is set.
+func (h *history) run(id int64, host string) (historyRun, error) {
+	run := historyRun{ID: id}
+	var started int64
+	err := h.db.QueryRow(
+		`SELECT kind, command, started, duration, hosts, succeeded, failed, local_user FROM runs WHERE id = ?`, id,
+	).Scan(&run.Kind, &run.Command, &started, &run.Duration, &run.Hosts, &run.Succeeded, &run.Failed, &run.User)
+	if errors.Is(err, sql.ErrNoRows) {
+		return run, fmt.Errorf("no run %d in the history", id)
+	}
+	if err != nil {
+		return run, err
+	}
+	run.Started = time.Unix(0, started)
+	run.Results, err = h.results(id, host)
+	return run, err
+}
+
+// results: the recorded results of the run with id, in the order the hosts finished, only host's if it is set.
+func (h *history) results(id int64, host string) ([]jsonResult, error) {
+	query := `SELECT host, exit_code, duration, error, error_class, stdout, stderr FROM results WHERE run_id = ?`
+	args := []interface{}{id}
+	if host != "" {
+		query += ` AND host = ?`
+		args = append(args, host)
+	}
+	rows, err := h.db.Query(query+` ORDER BY rowid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var results []jsonResult
+	for rows.Next() {
+		var jr jsonResult
+		var stdout, stderr []byte
+		err := rows.Scan(&jr.Host, &jr.ExitCode, &jr.Duration, &jr.Error, &jr.ErrorClass, &stdout, &stderr)
+		if err != nil {
+			return nil, err
+		}
+		jr.Stdout, jr.Stderr = string(stdout), string(stderr)
+		results = append(results, jr)
+	}
+	return results, rows.Err()
+}
+
+// recordHistory: add a finished run to the database at path.
+func recordHistory(path, kind, command string, started time.Time, results []api.Result) (int64, error) {
+	h, err := openHistory(path)
+	if err != nil {
+		return 0, err
+	}
+	id, err := h.record(kind, command, started, results)
+	if closeErr := h.Close(); err == nil {
+		err = closeErr
+	}
+	return id, err
+}
+
+// succeededSince: the hosts that succeeded in a run of kind with the same command that started after since.
+func (h *history) succeededSince(kind, command string, since time.Time) (map[string]bool, error) {
+	rows, err := h.db.Query(
+		`SELECT DISTINCT results.host FROM results JOIN runs ON runs.id = results.run_id
+		WHERE runs.kind = ? AND runs.command = ? AND runs.started >= ? AND results.error_class = ?`,
+		kind, command, since.UnixNano(), api.ClassOK,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	succeeded := make(map[string]bool)
+	for rows.Next() {
+		var host string
+		if err := rows.Scan(&host); err != nil {
+			return nil, err
+		}
+		succeeded[host] = true
+	}
+	return succeeded, rows.Err()
+}
+
+// recentSuccesses: the hosts that succeeded in a run of kind with the same command recorded in the database at path
+// within the last window, for -skip-recent.
+func recentSuccesses(path, kind, command string, window time.Duration) (map[string]bool, error) {
+	h, err := openHistory(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = h.Close() }()
+	return h.succeededSince(kind, command, time.Now().Add(-window))
+}
+
+// showHistory: the history subcommand, write the runs picked by the History fields to Stdout.
+func (c *Config) showHistory() (int, error) {
+	if len(c.Args) > 0 {
+		return ExitSetup, fmt.Errorf("unable to parse flags: history takes no arguments, got %q", c.Args)
+	}
+	if c.HistoryPath == "" {
+		return ExitSetup, errors.New("unable to parse flags: history needs -history-db")
+	}
+	h, err := openHistory(c.HistoryPath)
+	if err != nil {
+		return ExitSetup, fmt.Errorf("unable to open the history: %v", err)
+	}
+	defer func() { _ = h.Close() }()
+	if err := c.writeHistory(c.Stdout, h); err != nil {
+		c.Logger.Error(fmt.Sprintf("unable to show the history: %v", err))
+		return ExitSetup, nil
+	}
+	return ExitOK, nil
+}
+
+// writeHistory: write the runs picked by the History fields to w in the Output format: a table of runs, or with
+// HistoryRun the results of every host in the run.
+func (c *Config) writeHistory(w io.Writer, h *history) error {
+	var runs []historyRun
+	if c.HistoryRun != 0 {
+		run, err := h.run(c.HistoryRun, c.HistoryHost)
+		if err != nil {
+			return err
+		}
+		runs = []historyRun{run}
+	} else {
+		var since time.Time
+		if c.HistorySince > 0 {
+			since = time.Now().Add(-c.HistorySince)
+		}
+		var err error
+		if runs, err = h.runs(since, c.HistoryHost, c.HistoryLast); err != nil {
+			return err
+		}
+	}
+
+	switch c.Output {
+	case "text":
+		if c.HistoryRun != 0 {
+			return writeHistoryRun(w, runs[0])
+		}
+		return writeHistoryRuns(w, runs, c.HistoryHost)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if c.HistoryRun != 0 {
+			return enc.Encode(runs[0])
+		}
+		if runs == nil {
+			runs = []historyRun{}
+		}
+		return enc.Encode(runs)
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		for _, run := range runs {
+			if err := enc.Encode(run); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown output format: %q", c.Output)
+	}
+}
+
+// writeHistoryRuns: one line per run, followed by host's exit code and error class if it is set.
+func writeHistoryRuns(w io.Writer, runs []historyRun, host string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	header := "ID\tSTARTED\tDURATION\tKIND\tOK\tFAILED\tCOMMAND"
+	if host != "" {
+		header += "\tEXIT\tCLASS"
+	}
+	fmt.Fprintln(tw, header)
+	for _, run := range runs {
+		line := fmt.Sprintf(
+			"%d\t%s\t%s\t%s\t%d\t%d\t%s",
+			run.ID,
+			run.Started.Format(time.DateTime),
+			(time.Duration(run.Duration * float64(time.Second))).Round(time.Millisecond),
+			run.Kind,
+			run.Succeeded,
+			run.Failed,
+			run.Command,
+		)
+		for _, res := range run.Results {
+			line += fmt.Sprintf("\t%d\t%s", res.ExitCode, res.ErrorClass)
+		}
+		fmt.Fprintln(tw, line)
+	}
+	return tw.Flush()
+}
+
+// writeHistoryRun: the run's details, then each host's status and output.
+func writeHistoryRun(w io.Writer, run historyRun) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "run %d: %s %q", run.ID, run.Kind, run.Command)
+	if run.User != "" {
+		fmt.Fprintf(&b, " by %s", run.User)
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(
+		&b,
+		"started %s, took %s, %d of %d hosts succeeded\n",
+		run.Started.Format(time.DateTime),
+		(time.Duration(run.Duration * float64(time.Second))).Round(time.Millisecond),
+		run.Succeeded,
+		run.Hosts,
+	)
+	for _, res := range run.Results {
+		fmt.Fprintf(&b, "\n%s: exit %d, %s", res.Host, res.ExitCode, res.ErrorClass)
+		if res.Error != "" {
+			fmt.Fprintf(&b, ": %s", res.Error)
+		}
+		b.WriteString("\n")
+		for _, out := range []string{res.Stdout, res.Stderr} {
+			if out == "" {
+				continue
+			}
+			for _, line := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
+				fmt.Fprintf(&b, "    %s\n", line)
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,362 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+)
+
+// needHistory: skip the test in builds that cannot keep a history.
+func needHistory(t *testing.T) {
+	t.Helper()
+	if !HistorySupported {
+		t.Skip("built without cgo, so without SQLite")
+	}
+}
+
+// recordTestRuns: a history with an uptime run two hours ago that failed on web2, a copy a minute ago and an uptime
+// run just now that succeeded on web2, returning its path and the three runs' ids.
+func recordTestRuns(t *testing.T) (string, []int64) {
+	t.Helper()
+	t.Setenv("USER", "deploy")
+	path := filepath.Join(t.TempDir(), "history", "runs.db")
+	now := time.Now()
+	runs := []struct {
+		kind, command string
+		started       time.Time
+		results       []api.Result
+	}{
+		{"run", "uptime", now.Add(-2 * time.Hour), []api.Result{
+			{Host: "web1", Stdout: []byte("up 3 days\n"), Duration: time.Second},
+			{Host: "web2", Err: &api.ExitError{Status: 1}, ExitCode: 1, Stderr: []byte("boom\n")},
+		}},
+		{"copy", "copy app.tar /tmp", now.Add(-time.Minute), []api.Result{
+			{Host: "web1"},
+		}},
+		{"run", "uptime", now, []api.Result{
+			{Host: "web2", Stdout: []byte("up 1 day\n")},
+		}},
+	}
+	var ids []int64
+	for _, run := range runs {
+		id, err := recordHistory(path, run.kind, run.command, run.started, run.results)
+		if err != nil {
+			t.Fatalf("unable to record %s run: %v", run.kind, err)
+		}
+		ids = append(ids, id)
+	}
+	return path, ids
+}
+
+// openTestHistory: the history at path, closed at the end of the test.
+func openTestHistory(t *testing.T, path string) *history {
+	t.Helper()
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatalf("unable to open history: %v", err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	return h
+}
+
+func TestHistoryRun(t *testing.T) {
+	needHistory(t)
+	path, ids := recordTestRuns(t)
+	h := openTestHistory(t, path)
+
+	run, err := h.run(ids[0], "")
+	if err != nil {
+		t.Fatalf("unable to read run %d: %v", ids[0], err)
+	}
+	if run.Kind != "run" || run.Command != "uptime" || run.User != "deploy" {
+		t.Errorf("got run %+v, want deploy's uptime run", run)
+	}
+	if run.Hosts != 2 || run.Succeeded != 1 || run.Failed != 1 {
+		t.Errorf("got %d hosts, %d succeeded and %d failed, want 2, 1 and 1", run.Hosts, run.Succeeded, run.Failed)
+	}
+	if run.Duration < (2 * time.Hour).Seconds() {
+		t.Errorf("got duration %vs, want at least the 2h since it started", run.Duration)
+	}
+	want := []jsonResult{
+		{Host: "web1", Stdout: "up 3 days\n", Duration: 1, ErrorClass: api.ClassOK},
+		{
+			Host:       "web2",
+			ExitCode:   1,
+			Stderr:     "boom\n",
+			Error:      "Process exited with status 1",
+			ErrorClass: api.ClassExitStatus,
+		},
+	}
+	if len(run.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(run.Results), len(want))
+	}
+	for i := range want {
+		if run.Results[i] != want[i] {
+			t.Errorf("result %d: got %+v, want %+v", i, run.Results[i], want[i])
+		}
+	}
+
+	run, err = h.run(ids[0], "web2")
+	if err != nil {
+		t.Fatalf("unable to read web2's part of run %d: %v", ids[0], err)
+	}
+	if len(run.Results) != 1 || run.Results[0] != want[1] {
+		t.Errorf("got results %+v for web2, want only %+v", run.Results, want[1])
+	}
+
+	if _, err := h.run(ids[2]+1, ""); err == nil {
+		t.Errorf("read run %d, which was never recorded", ids[2]+1)
+	}
+}
+
+func TestHistoryRuns(t *testing.T) {
+	needHistory(t)
+	path, ids := recordTestRuns(t)
+	h := openTestHistory(t, path)
+	tests := []struct {
+		name    string
+		since   time.Time
+		host    string
+		limit   int
+		wantIDs []int64
+		// wantExit is the exit code of host in each run, when host is set
+		wantExit []int
+	}{
+		{name: "all", wantIDs: []int64{ids[2], ids[1], ids[0]}},
+		{name: "since", since: time.Now().Add(-time.Hour), wantIDs: []int64{ids[2], ids[1]}},
+		{name: "limit", limit: 1, wantIDs: []int64{ids[2]}},
+		{name: "host", host: "web2", wantIDs: []int64{ids[2], ids[0]}, wantExit: []int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs, err := h.runs(tt.since, tt.host, tt.limit)
+			if err != nil {
+				t.Fatalf("unable to read runs: %v", err)
+			}
+			if len(runs) != len(tt.wantIDs) {
+				t.Fatalf("got %d runs, want %d", len(runs), len(tt.wantIDs))
+			}
+			for i, run := range runs {
+				if run.ID != tt.wantIDs[i] {
+					t.Errorf("run %d: got id %d, want %d", i, run.ID, tt.wantIDs[i])
+				}
+				if tt.host == "" {
+					if run.Results != nil {
+						t.Errorf("run %d: got results %+v without asking for a host's", i, run.Results)
+					}
+					continue
+				}
+				if len(run.Results) != 1 || run.Results[0].Host != tt.host || run.Results[0].ExitCode != tt.wantExit[i] {
+					t.Errorf("run %d: got results %+v, want only %s's exiting %d", i, run.Results, tt.host, tt.wantExit[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHistorySucceededSince(t *testing.T) {
+	needHistory(t)
+	path, _ := recordTestRuns(t)
+	h := openTestHistory(t, path)
+	tests := []struct {
+		name          string
+		kind, command string
+		since         time.Time
+		want          map[string]bool
+	}{
+		{name: "ever", kind: "run", command: "uptime", want: map[string]bool{"web1": true, "web2": true}},
+		{
+			name:    "last hour",
+			kind:    "run",
+			command: "uptime",
+			since:   time.Now().Add(-time.Hour),
+			want:    map[string]bool{"web2": true},
+		},
+		{name: "other command", kind: "run", command: "reboot", want: map[string]bool{}},
+		{name: "other kind", kind: "copy", command: "uptime", want: map[string]bool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.succeededSince(tt.kind, tt.command, tt.since)
+			if err != nil {
+				t.Fatalf("unable to look up successes: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got hosts %v, want %v", got, tt.want)
+			}
+			for host := range tt.want {
+				if !got[host] {
+					t.Errorf("got hosts %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryConcurrentRecords(t *testing.T) {
+	needHistory(t)
+	path := filepath.Join(t.TempDir(), "runs.db")
+	const runs = 8
+	errs := make(chan error, runs)
+	for i := 0; i < runs; i++ {
+		go func() {
+			_, err := recordHistory(path, "run", "uptime", time.Now(), []api.Result{{Host: "web1"}})
+			errs <- err
+		}()
+	}
+	var err error
+	for i := 0; i < runs; i++ {
+		err = errors.Join(err, <-errs)
+	}
+	if err != nil {
+		t.Fatalf("unable to record runs at the same time: %v", err)
+	}
+	recorded, err := openTestHistory(t, path).runs(time.Time{}, "", 0)
+	if err != nil {
+		t.Fatalf("unable to read runs: %v", err)
+	}
+	if len(recorded) != runs {
+		t.Errorf("got %d runs recorded, want %d", len(recorded), runs)
+	}
+}
+
+func TestHistorySubcommand(t *testing.T) {
+	needHistory(t)
+	path, ids := recordTestRuns(t)
+	tests := []struct {
+		name string
+		c    Config
+		// want are the lines expected in the output, in order, each may be part of a line
+		want      []string
+		wantLines int
+	}{
+		{
+			name: "runs",
+			c:    Config{Output: "text"},
+			want: []string{
+				"ID  STARTED",
+				fmt.Sprintf("%d   ", ids[2]),
+				fmt.Sprintf("%d   ", ids[1]),
+				fmt.Sprintf("%d   ", ids[0]),
+			},
+			wantLines: 4,
+		},
+		{
+			name: "runs of a host",
+			c:    Config{Output: "text", HistoryHost: "web2"},
+			want: []string{
+				"FAILED  COMMAND  EXIT  CLASS",
+				"uptime   0     ok",
+				"uptime   1     exit-status",
+			},
+			wantLines: 3,
+		},
+		{
+			name:      "latest runs",
+			c:         Config{Output: "ndjson", HistoryLast: 2},
+			want:      []string{fmt.Sprintf(`{"id":%d,"kind":"run"`, ids[2]), fmt.Sprintf(`{"id":%d,"kind":"copy"`, ids[1])},
+			wantLines: 2,
+		},
+		{
+			name: "run",
+			c:    Config{Output: "text", HistoryRun: ids[0]},
+			want: []string{
+				fmt.Sprintf(`run %d: run "uptime" by deploy`, ids[0]),
+				"1 of 2 hosts succeeded",
+				"",
+				"web1: exit 0, ok",
+				"    up 3 days",
+				"",
+				"web2: exit 1, exit-status: Process exited with status 1",
+				"    boom",
+			},
+			wantLines: 8,
+		},
+		{
+			name:      "run as json",
+			c:         Config{Output: "json", HistoryRun: ids[0], HistoryHost: "web2"},
+			want:      []string{"{", fmt.Sprintf(`"id": %d,`, ids[0]), `"results": [`, `"host": "web2",`, `"exit_code": 1,`},
+			wantLines: 22,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			c := tt.c
+			c.Subcommand = SubcommandHistory
+			c.HistoryPath = path
+			c.Transport = TransportSSH
+			c.Logger = testLogger(t)
+			c.Stdout = &stdout
+			code, err := Execute(context.Background(), &c)
+			if code != ExitOK || err != nil {
+				t.Fatalf("got exit code %d and error %v, want %d", code, err, ExitOK)
+			}
+			lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+			if len(lines) != tt.wantLines {
+				t.Errorf("got %d lines, want %d:\n%s", len(lines), tt.wantLines, stdout.String())
+			}
+			next := 0
+			for _, line := range lines {
+				if next < len(tt.want) && strings.Contains(line, tt.want[next]) {
+					next++
+				}
+			}
+			if next < len(tt.want) {
+				t.Errorf("got output:\n%s\nmissing %q", stdout.String(), tt.want[next])
+			}
+		})
+	}
+}
+
+func TestHistorySubcommandErrors(t *testing.T) {
+	needHistory(t)
+	path, ids := recordTestRuns(t)
+	tests := []struct {
+		name    string
+		c       Config
+		wantErr bool
+	}{
+		{name: "arguments", c: Config{HistoryPath: path, Args: []string{"uptime"}}, wantErr: true},
+		{name: "no history", wantErr: true},
+		// a run that is not there is only logged, like a run that cannot be read
+		{name: "unknown run", c: Config{HistoryPath: path, HistoryRun: ids[2] + 1}},
+		{name: "unknown output", c: Config{HistoryPath: path, Output: "yaml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			c := tt.c
+			c.Subcommand = SubcommandHistory
+			c.Transport = TransportSSH
+			c.Logger = testLogger(t)
+			c.Stdout = &stdout
+			code, err := Execute(context.Background(), &c)
+			if code != ExitSetup {
+				t.Errorf("got exit code %d, want %d", code, ExitSetup)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if stdout.Len() != 0 {
+				t.Errorf("got output %q, want none", stdout.String())
+			}
+		})
+	}
+}
+
+func TestHistoryUnsupported(t *testing.T) {
+	if HistorySupported {
+		t.Skip("built with cgo, so with SQLite")
+	}
+	if _, err := openHistory(filepath.Join(t.TempDir(), "runs.db")); err == nil || !strings.Contains(err.Error(), "cgo") {
+		t.Errorf("got error %v, want one saying the history needs cgo", err)
+	}
+}
@@ -0,0 +1,147 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/basilnsage/remote-executor/utils"
+	"github.com/basilnsage/remote-executor/utils/inventory"
+	"golang.org/x/crypto/ssh"
+)
+
+// listedHost: a host as list-hosts reports it, with the settings a run would connect with
+type listedHost struct {
+	Name           string            `json:"name"`
+	Transport      string            `json:"transport"`
+	Addr           string            `json:"addr,omitempty"`
+	User           string            `json:"user,omitempty"`
+	KeyFiles       []string          `json:"key_files,omitempty"`
+	Jump           string            `json:"jump,omitempty"`
+	Timeout        string            `json:"timeout,omitempty"`
+	ConnectTimeout string            `json:"connect_timeout,omitempty"`
+	Groups         []string          `json:"groups,omitempty"`
+	Vars           map[string]string `json:"vars,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+}
+
+// describe: the address, user, and other settings a run would use for host, after the inventory, ssh config, and
+// command line flags are applied. Key files are listed, not loaded. Hosts not run over ssh only have their transport.
+func (r *targetResolver) describe(host inventory.Host) (listedHost, error) {
+	transport, err := r.cfg.hostTransport(host)
+	if err != nil {
+		return listedHost{}, err
+	}
+	if transport != TransportSSH {
+		listed := listedHost{Name: host.Name, Transport: transport, Groups: host.Groups, Vars: host.Vars, Env: host.Env}
+		listed.Timeout = timeoutString(host.Timeout, r.cfg.Timeout)
+		switch transport {
+		case TransportDocker:
+			listed.Addr, listed.User = transportAddr(host), r.containerUser(host)
+		case TransportKubectl, TransportSSM:
+			listed.Addr = transportAddr(host)
+		}
+		return listed, nil
+	}
+	alias, port, settings, err := r.settings(host)
+	if err != nil {
+		return listedHost{}, err
+	}
+	listed := listedHost{
+		Name:      host.Name,
+		Transport: transport,
+		Addr:      r.addr(alias, port, settings),
+		User:      r.user(settings, hostUser(host, credentialFor(r.creds, host, alias))),
+		KeyFiles:  settings.IdentityFiles,
+		Jump:      r.cfg.Jump,
+		Timeout:   timeoutString(host.Timeout, r.cfg.Timeout),
+		Groups:    host.Groups,
+		Vars:      host.Vars,
+		Env:       host.Env,
+	}
+	if listed.Jump == "" {
+		listed.Jump = settings.ProxyJump
+	}
+	listed.ConnectTimeout = timeoutString(host.ConnectTimeout, r.cfg.ConnectTimeout)
+	return listed, nil
+}
+
+// timeoutString: a host's own timeout if it has one, otherwise the config's, empty if neither sets a limit.
+func timeoutString(own, config time.Duration) string {
+	if own <= 0 {
+		own = config
+	}
+	if own <= 0 {
+		return ""
+	}
+	return own.String()
+}
+
+// listHosts: the list-hosts subcommand, write the hosts a run would target to Stdout.
+func (c *Config) listHosts() (int, error) {
+	if len(c.Args) > 0 {
+		return ExitSetup, fmt.Errorf("unable to parse flags: list-hosts takes no command, got %q", c.Args)
+	}
+	hosts, err := c.selectHosts()
+	if err != nil {
+		return ExitSetup, err
+	}
+	sshConfig, err := c.loadSSHConfig()
+	if err != nil {
+		return ExitSetup, err
+	}
+	resolver := newTargetResolver(c, sshConfig, utils.AuthConfig{}, ssh.ClientConfig{User: c.User})
+	if resolver.creds, err = c.credentials(); err != nil {
+		return ExitSetup, err
+	}
+	if err := writeHosts(c.Stdout, hosts, resolver, c.Output); err != nil {
+		return ExitSetup, fmt.Errorf("unable to list hosts: %v", err)
+	}
+	return ExitOK, nil
+}
+
+// writeHosts: write the final set of hosts to w, in the text, json, or ndjson format. The text format is one host per
+// line followed by the user and address connected to, so it can be fed back in as a host list.
+func writeHosts(w io.Writer, hosts []inventory.Host, r *targetResolver, format string) error {
+	listed := make([]listedHost, 0, len(hosts))
+	for _, host := range hosts {
+		l, err := r.describe(host)
+		if err != nil {
+			return fmt.Errorf("%s: %v", host.Name, err)
+		}
+		listed = append(listed, l)
+	}
+
+	switch format {
+	case "text":
+		for _, l := range listed {
+			conn := l.User + "@" + l.Addr
+			switch {
+			case l.Transport == TransportSSH:
+			case l.Addr != "":
+				conn = l.Transport + ":" + l.Addr
+			default:
+				conn = l.Transport
+			}
+			if _, err := fmt.Fprintf(w, "%s\t%s\n", l.Name, conn); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(listed)
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		for _, l := range listed {
+			if err := enc.Encode(l); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown output format: %q", format)
+	}
+}
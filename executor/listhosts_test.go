@@ -0,0 +1,147 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const listInventory = `hosts:
+  web1:
+    address: 10.0.0.1
+    user: deploy
+    env:
+      APP_ENV: prod
+  web2:
+    address: 10.0.0.2
+    port: 2222
+    timeout: 30s
+  build:
+    transport: local
+groups:
+  web:
+    hosts: [web1, web2]
+    vars:
+      tier: frontend
+`
+
+// listHosts: run list-hosts with c over an inventory of listInventory, returning the exit status and what was written
+// to Stdout.
+func listHosts(t *testing.T, c Config) (int, string, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "inventory.yaml")
+	if err := os.WriteFile(path, []byte(listInventory), 0644); err != nil {
+		t.Fatalf("unable to write inventory: %v", err)
+	}
+	var stdout bytes.Buffer
+	c.Subcommand = SubcommandListHosts
+	c.HostList = path
+	c.Stdout = &stdout
+	c.Logger = testLogger(t)
+	c.Transport = TransportSSH
+	if c.User == "" {
+		c.User = "admin"
+	}
+	if c.Output == "" {
+		c.Output = "text"
+	}
+	code, err := Execute(context.Background(), &c)
+	return code, stdout.String(), err
+}
+
+func TestListHosts(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{
+			name: "every host",
+			want: "web1\tdeploy@10.0.0.1:22\nweb2\tadmin@10.0.0.2:2222\nbuild\tlocal\n",
+		},
+		{
+			name: "group",
+			cfg:  Config{Groups: []string{"web"}},
+			want: "web1\tdeploy@10.0.0.1:22\nweb2\tadmin@10.0.0.2:2222\n",
+		},
+		{
+			name: "limit",
+			cfg:  Config{Limit: []string{"web2"}},
+			want: "web2\tadmin@10.0.0.2:2222\n",
+		},
+		{
+			name: "the inventory user over the flag",
+			cfg:  Config{User: "root", UserSet: true, Exclude: []string{"build"}},
+			want: "web1\tdeploy@10.0.0.1:22\nweb2\troot@10.0.0.2:2222\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, got, err := listHosts(t, tt.cfg)
+			if code != ExitOK || err != nil {
+				t.Fatalf("got exit status %d and error %v, want %d", code, err, ExitOK)
+			}
+			if got != tt.want {
+				t.Errorf("got hosts %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListHostsJSON(t *testing.T) {
+	c := Config{Output: "json", Timeout: time.Minute, Jump: "bastion", Limit: []string{"web1", "web2"}}
+	code, stdout, err := listHosts(t, c)
+	if code != ExitOK || err != nil {
+		t.Fatalf("got exit status %d and error %v, want %d", code, err, ExitOK)
+	}
+	var listed []listedHost
+	if err := json.Unmarshal([]byte(stdout), &listed); err != nil {
+		t.Fatalf("unable to decode hosts %q: %v", stdout, err)
+	}
+	if len(listed) != 2 {
+		t.Fatalf("got %d hosts, want 2: %s", len(listed), stdout)
+	}
+	web1, web2 := listed[0], listed[1]
+	if web1.Name != "web1" || web1.Transport != TransportSSH || web1.User != "deploy" || web1.Jump != "bastion" {
+		t.Errorf("got web1 %+v", web1)
+	}
+	if web1.Env["APP_ENV"] != "prod" || web1.Vars["tier"] != "frontend" || web1.Timeout != "1m0s" {
+		t.Errorf("got web1 env %v, vars %v, and timeout %q", web1.Env, web1.Vars, web1.Timeout)
+	}
+	if web2.Addr != "10.0.0.2:2222" || web2.Timeout != "30s" {
+		t.Errorf("got web2 address %q and timeout %q, want 10.0.0.2:2222 and its own 30s", web2.Addr, web2.Timeout)
+	}
+
+	c.Output = "ndjson"
+	if _, stdout, err = listHosts(t, c); err != nil {
+		t.Fatalf("unable to list hosts as ndjson: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); len(lines) != 2 {
+		t.Errorf("got %d ndjson lines, want 2: %s", len(lines), stdout)
+	}
+}
+
+func TestListHostsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{name: "command", cfg: Config{Args: []string{"uptime"}}, wantErr: "list-hosts takes no command"},
+		{name: "no hosts", cfg: Config{Groups: []string{"db"}}, wantErr: "db"},
+		{name: "output", cfg: Config{Output: "yaml"}, wantErr: "unknown output format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, err := listHosts(t, tt.cfg)
+			if code != ExitSetup || err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got exit status %d and error %v, want %d and %q", code, err, ExitSetup, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+)
+
+// notifyTimeout: how long a webhook has to accept a notification before it is given up on
+const notifyTimeout = 10 * time.Second
+
+// runSummary: the outcome of a run as posted to -notify-url
+type runSummary struct {
+	Kind       string    `json:"kind"`
+	Job        string    `json:"job,omitempty"`
+	Command    string    `json:"command"`
+	Started    time.Time `json:"started"`
+	Duration   float64   `json:"duration_seconds"`
+	Hosts      int       `json:"hosts"`
+	Succeeded  int       `json:"succeeded"`
+	Failed     int       `json:"failed"`
+	ExitStatus int       `json:"exit_status"`
+	// Failures are only listed with -notify-failures
+	Failures []hostFailure `json:"failures,omitempty"`
+}
+
+// hostFailure: a failed host in a runSummary
+type hostFailure struct {
+	Host       string `json:"host"`
+	ExitCode   int    `json:"exit_code"`
+	Error      string `json:"error"`
+	ErrorClass string `json:"error_class"`
+}
+
+// newRunSummary: summarize a run of kind that started at started, listing each failed host.
+func newRunSummary(kind, command string, started time.Time, results []api.Result) runSummary {
+	summary := runSummary{
+		Kind:     kind,
+		Command:  command,
+		Started:  started,
+		Duration: time.Since(started).Seconds(),
+		Hosts:    len(results),
+	}
+	for _, res := range results {
+		if res.Err == nil {
+			summary.Succeeded++
+			continue
+		}
+		summary.Failed++
+		summary.Failures = append(summary.Failures, hostFailure{
+			Host:       res.Host,
+			ExitCode:   res.ExitCode,
+			Error:      res.Err.Error(),
+			ErrorClass: api.Classify(res.Err),
+		})
+	}
+	summary.ExitStatus = runExitCode(summary.Failed, summary.Hosts)
+	return summary
+}
+
+// notify: POST summary as JSON to url, any 2xx response is a success.
+func notify(url string, summary runSummary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	return postJSON(url, body)
+}
+
+// postJSON: POST body to url as JSON, failing on anything but a 2xx response.
+func postJSON(url string, body []byte) error {
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s responded %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// slackAPI: the Slack Web API method -slack-token posts with, a var so tests can post elsewhere
+var slackAPI = "https://slack.com/api/chat.postMessage"
+
+// maxSlackFailures: failed hosts beyond this many are only counted in Slack messages
+const maxSlackFailures = 20
+
+// slackMessage: summary as a Slack or Mattermost message in their markdown.
+func slackMessage(summary runSummary) string {
+	var b strings.Builder
+	took := (time.Duration(summary.Duration * float64(time.Second))).Round(time.Millisecond)
+	if summary.Failed == 0 {
+		fmt.Fprintf(&b, ":white_check_mark: `%s` succeeded on %d hosts in %s", summary.Command, summary.Hosts, took)
+	} else {
+		fmt.Fprintf(
+			&b,
+			":x: `%s` failed on %d of %d hosts in %s, %d succeeded",
+			summary.Command,
+			summary.Failed,
+			summary.Hosts,
+			took,
+			summary.Succeeded,
+		)
+	}
+	if summary.Job != "" {
+		fmt.Fprintf(&b, " (job %s)", summary.Job)
+	}
+	for i, failure := range summary.Failures {
+		if i == maxSlackFailures {
+			fmt.Fprintf(&b, "\n• and %d more", len(summary.Failures)-maxSlackFailures)
+			break
+		}
+		fmt.Fprintf(&b, "\n• %s: %s, exit %d", failure.Host, failure.ErrorClass, failure.ExitCode)
+	}
+	return b.String()
+}
+
+// notifySlack: post summary to SlackWebhook, a Slack or Mattermost incoming webhook, or with SlackToken to
+// SlackChannel through the Slack API. summary should list its failures.
+func (c *Config) notifySlack(summary runSummary) error {
+	msg := map[string]string{"text": slackMessage(summary)}
+	if c.SlackChannel != "" {
+		msg["channel"] = c.SlackChannel
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if c.SlackWebhook != "" {
+		return postJSON(c.SlackWebhook, body)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, slackAPI, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+c.SlackToken)
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	// the API answers 200 even when the message was not posted
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result); err != nil {
+		return fmt.Errorf("slack responded %s: %v", resp.Status, err)
+	}
+	if !result.OK {
+		return fmt.Errorf("slack did not post the message: %s", result.Error)
+	}
+	return nil
+}
+
+// sendNotifications: send summary to every notifier that is configured, logging those that fail.
+func (c *Config) sendNotifications(summary runSummary, logArgs ...interface{}) {
+	if c.NotifyURL != "" {
+		generic := summary
+		if !c.NotifyFailures {
+			generic.Failures = nil
+		}
+		if err := notify(c.NotifyURL, generic); err != nil {
+			c.Logger.Warn(fmt.Sprintf("unable to send the run notification: %v", err), logArgs...)
+		}
+	}
+	if c.SlackWebhook != "" || c.SlackToken != "" {
+		if err := c.notifySlack(summary); err != nil {
+			c.Logger.Warn(fmt.Sprintf("unable to post the run summary to slack: %v", err), logArgs...)
+		}
+	}
+}
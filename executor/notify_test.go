@@ -0,0 +1,178 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failWeb2: a command failing on web2 of a localInventory and succeeding everywhere else
+const failWeb2 = `test "$TEST_HOST" != web2`
+
+// receiver: a webhook decoding what is posted to it into a new V, answering with status.
+func receiver[V any](t *testing.T, status int) (*httptest.Server, <-chan V) {
+	t.Helper()
+	posted := make(chan V, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v V
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			t.Errorf("unable to decode notification: %v", err)
+		}
+		posted <- v
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, posted
+}
+
+func TestNotify(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     bool
+		status       int
+		wantFailures []hostFailure
+	}{
+		{name: "summary", status: http.StatusOK},
+		{
+			name:     "with failures",
+			failures: true,
+			status:   http.StatusNoContent,
+			wantFailures: []hostFailure{
+				{Host: "web2", ExitCode: 1, Error: "Process exited with status 1", ErrorClass: "exit-status"},
+			},
+		},
+		// the run's exit status does not depend on the webhook
+		{name: "webhook fails", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, posted := receiver[runSummary](t, tt.status)
+			c := Config{NotifyURL: srv.URL, NotifyFailures: tt.failures, Workers: 1}
+			code, _ := runLocal(t, c, localInventory(t, "web1", "web2"), failWeb2)
+			if code != ExitSomeFailed {
+				t.Errorf("got exit status %d, want %d", code, ExitSomeFailed)
+			}
+			var got runSummary
+			select {
+			case got = <-posted:
+			default:
+				t.Fatal("no notification was sent")
+			}
+			if got.Kind != "run" || got.Command != failWeb2 {
+				t.Errorf("got a notification for a %s of %q, want a run of %q", got.Kind, got.Command, failWeb2)
+			}
+			if got.Hosts != 2 || got.Succeeded != 1 || got.Failed != 1 || got.ExitStatus != ExitSomeFailed {
+				t.Errorf("got %d hosts, %d succeeded, %d failed and exit status %d, want 2, 1, 1 and %d",
+					got.Hosts, got.Succeeded, got.Failed, got.ExitStatus, ExitSomeFailed)
+			}
+			if len(got.Failures) != len(tt.wantFailures) {
+				t.Fatalf("got failures %+v, want %+v", got.Failures, tt.wantFailures)
+			}
+			for i := range tt.wantFailures {
+				if got.Failures[i] != tt.wantFailures[i] {
+					t.Errorf("got failure %+v, want %+v", got.Failures[i], tt.wantFailures[i])
+				}
+			}
+			if len(posted) != 0 {
+				t.Errorf("got %d more notifications, want one", len(posted))
+			}
+		})
+	}
+}
+
+func TestSlackWebhook(t *testing.T) {
+	srv, posted := receiver[map[string]string](t, http.StatusOK)
+	c := Config{SlackWebhook: srv.URL, SlackChannel: "#ops"}
+	if code, _ := runLocal(t, c, localInventory(t, "web1", "web2"), failWeb2); code != ExitSomeFailed {
+		t.Errorf("got exit status %d, want %d", code, ExitSomeFailed)
+	}
+	var msg map[string]string
+	select {
+	case msg = <-posted:
+	default:
+		t.Fatal("nothing was posted to the webhook")
+	}
+	if msg["channel"] != "#ops" {
+		t.Errorf("got channel %q, want #ops", msg["channel"])
+	}
+	// the failures are listed even without -notify-failures
+	wantStart := ":x: `" + failWeb2 + "` failed on 1 of 2 hosts in "
+	wantEnd := ", 1 succeeded\n• web2: exit-status, exit 1"
+	if !strings.HasPrefix(msg["text"], wantStart) || !strings.HasSuffix(msg["text"], wantEnd) {
+		t.Errorf("got message %q, want one starting %q and ending %q", msg["text"], wantStart, wantEnd)
+	}
+}
+
+func TestSlackToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		wantErr  string
+	}{
+		{name: "posted", response: `{"ok":true}`},
+		{name: "not posted", response: `{"ok":false,"error":"channel_not_found"}`, wantErr: "channel_not_found"},
+		{name: "not the slack api", response: `<html>`, wantErr: "slack responded 200 OK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var auth string
+			var msg map[string]string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				auth = r.Header.Get("Authorization")
+				if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+					t.Errorf("unable to decode message: %v", err)
+				}
+				_, _ = w.Write([]byte(tt.response))
+			}))
+			defer srv.Close()
+			defer func(api string) { slackAPI = api }(slackAPI)
+			slackAPI = srv.URL
+
+			c := Config{SlackToken: "xoxb-test", SlackChannel: "C123"}
+			err := c.notifySlack(runSummary{Command: "uptime", Hosts: 2, Succeeded: 2})
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unable to post: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+			if auth != "Bearer xoxb-test" {
+				t.Errorf("got authorization %q, want the token", auth)
+			}
+			if msg["channel"] != "C123" || !strings.HasPrefix(msg["text"], ":white_check_mark: `uptime` succeeded on 2 hosts") {
+				t.Errorf("got message %v", msg)
+			}
+		})
+	}
+}
+
+func TestSlackMessageManyFailures(t *testing.T) {
+	summary := runSummary{Command: "uptime", Job: "42", Duration: 1.5, Hosts: maxSlackFailures + 5}
+	for i := 0; i < summary.Hosts; i++ {
+		summary.Failures = append(summary.Failures, hostFailure{
+			Host:       fmt.Sprintf("web%d", i),
+			ExitCode:   255,
+			ErrorClass: "connect",
+		})
+	}
+	summary.Failed = len(summary.Failures)
+	lines := strings.Split(slackMessage(summary), "\n")
+	want := fmt.Sprintf(":x: `uptime` failed on %d of %d hosts in %s, 0 succeeded (job 42)",
+		summary.Failed, summary.Hosts, 1500*time.Millisecond)
+	if lines[0] != want {
+		t.Errorf("got first line %q, want %q", lines[0], want)
+	}
+	if len(lines) != maxSlackFailures+2 {
+		t.Fatalf("got %d lines, want the summary, %d failures and how many more", len(lines), maxSlackFailures)
+	}
+	if lines[1] != "• web0: connect, exit 255" {
+		t.Errorf("got failure line %q", lines[1])
+	}
+	if last := lines[len(lines)-1]; last != "• and 5 more" {
+		t.Errorf("got last line %q, want the 5 failures left out counted", last)
+	}
+}
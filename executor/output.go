@@ -0,0 +1,375 @@
+package executor
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/utils"
+	"github.com/basilnsage/remote-executor/utils/inventory"
+)
+
+// outputter: renders each result as it completes and the whole run once it is over
+type outputter interface {
+	result(res api.Result)
+	finish(started time.Time, results []api.Result) error
+}
+
+// newOutputter: return the outputter for an --output format. brief text output only reports each host's status and
+// color text output highlights hosts and errors with ANSI colors.
+func newOutputter(format string, logger *utils.SyncLogger, w io.Writer, cmd string, brief, color bool) (outputter, error) {
+	switch format {
+	case "text":
+		return textOutput{logger, brief, color}, nil
+	case "json":
+		return jsonOutput{w, cmd}, nil
+	case "ndjson":
+		return &ndjsonOutput{enc: json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format: %q", format)
+	}
+}
+
+// ANSI escape sequences used by colored text output
+const (
+	ansiReset = "\033[0m"
+	ansiRed   = "\033[31m"
+	ansiGreen = "\033[32m"
+)
+
+// textOutput: log each host's output as it completes, or only its status if brief is set
+type textOutput struct {
+	logger *utils.SyncLogger
+	brief  bool
+	color  bool
+}
+
+// paint: wrap s in an ANSI color when color output is enabled.
+func (o textOutput) paint(color, s string) string {
+	if !o.color {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+func (o textOutput) result(res api.Result) {
+	fields := []interface{}{
+		"host", res.Host,
+		"exit_code", res.ExitCode,
+		"duration_seconds", res.Duration.Seconds(),
+		"error_class", api.Classify(res.Err),
+	}
+	if res.Truncated {
+		fields = append(fields, "truncated", true)
+	}
+	switch {
+	case o.brief && res.Err != nil:
+		o.logger.Error(fmt.Sprintf("%s: %s", o.paint(ansiRed, res.Host), o.paint(ansiRed, res.Err.Error())), fields...)
+	case o.brief:
+		o.logger.Info(fmt.Sprintf("%s: ok", o.paint(ansiGreen, res.Host)), fields...)
+	case res.Err != nil:
+		o.logger.Error(fmt.Sprintf(
+			"%s\n%s\n%s",
+			o.paint(ansiRed, res.Host),
+			o.paint(ansiRed, res.Err.Error()),
+			string(res.Output),
+		), fields...)
+	default:
+		o.logger.Info(fmt.Sprintf("%s\n%s", o.paint(ansiGreen, res.Host), string(res.Output)), fields...)
+	}
+}
+
+func (o textOutput) finish(time.Time, []api.Result) error {
+	return nil
+}
+
+// jsonOutput: write a single JSON document describing the whole run once it is over
+type jsonOutput struct {
+	w   io.Writer
+	cmd string
+}
+
+type jsonResult struct {
+	Host       string  `json:"host"`
+	ExitCode   int     `json:"exit_code"`
+	Stdout     string  `json:"stdout"`
+	Stderr     string  `json:"stderr"`
+	Duration   float64 `json:"duration_seconds"`
+	Error      string  `json:"error,omitempty"`
+	ErrorClass string  `json:"error_class"`
+	// Truncated is set when output beyond -buffer-limit or -max-output-bytes was left out
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type jsonRun struct {
+	Command   string       `json:"command"`
+	Started   time.Time    `json:"started"`
+	Duration  float64      `json:"duration_seconds"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []jsonResult `json:"results"`
+}
+
+func newJSONResult(res api.Result) jsonResult {
+	jr := jsonResult{
+		Host:       res.Host,
+		ExitCode:   res.ExitCode,
+		Stdout:     string(res.Stdout),
+		Stderr:     string(res.Stderr),
+		Duration:   res.Duration.Seconds(),
+		ErrorClass: api.Classify(res.Err),
+		Truncated:  res.Truncated,
+	}
+	if res.Err != nil {
+		jr.Error = res.Err.Error()
+	}
+	return jr
+}
+
+func (o jsonOutput) result(api.Result) {}
+
+func (o jsonOutput) finish(started time.Time, results []api.Result) error {
+	run := jsonRun{
+		Command:  o.cmd,
+		Started:  started,
+		Duration: time.Since(started).Seconds(),
+		Results:  make([]jsonResult, 0, len(results)),
+	}
+	for _, res := range results {
+		if res.Err != nil {
+			run.Failed++
+		} else {
+			run.Succeeded++
+		}
+		run.Results = append(run.Results, newJSONResult(res))
+	}
+	enc := json.NewEncoder(o.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(run)
+}
+
+// ndjsonOutput: write one JSON record per host, on its own line, as soon as the host finishes
+type ndjsonOutput struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+func (o *ndjsonOutput) result(res api.Result) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// keep the first write error to report once the run is over
+	if err := o.enc.Encode(newJSONResult(res)); err != nil && o.err == nil {
+		o.err = err
+	}
+}
+
+func (o *ndjsonOutput) finish(time.Time, []api.Result) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err
+}
+
+// templateFuncs: the functions --format templates can use besides text/template's own
+var templateFuncs = template.FuncMap{
+	"trim":  strings.TrimSpace,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"lines": func(s string) []string { return strings.Split(strings.TrimRight(s, "\n"), "\n") },
+	"join":  func(sep string, elems []string) string { return strings.Join(elems, sep) },
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// templateOutput: write each host's result through a --format template as soon as the host finishes, with the same
+// fields as JSON output, e.g. '{{.Host}} [{{.ExitCode}}] {{.Stdout | trim}}'
+type templateOutput struct {
+	mu   sync.Mutex
+	w    io.Writer
+	tmpl *template.Template
+	err  error
+}
+
+// newTemplateOutput: parse a --format template, checking it against an empty result so a misspelt field is caught
+// before anything runs.
+func newTemplateOutput(w io.Writer, format string) (*templateOutput, error) {
+	tmpl, err := template.New("format").Funcs(templateFuncs).Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, jsonResult{}); err != nil {
+		return nil, err
+	}
+	return &templateOutput{w: w, tmpl: tmpl}, nil
+}
+
+func (o *templateOutput) result(res api.Result) {
+	var b strings.Builder
+	err := o.tmpl.Execute(&b, newJSONResult(res))
+	if err == nil && !strings.HasSuffix(b.String(), "\n") {
+		b.WriteString("\n")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err == nil {
+		_, err = io.WriteString(o.w, b.String())
+	}
+	// keep the first error to report once the run is over
+	if err != nil && o.err == nil {
+		o.err = fmt.Errorf("%s: %v", res.Host, err)
+	}
+}
+
+func (o *templateOutput) finish(time.Time, []api.Result) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err
+}
+
+// sortResults: results ordered by host name, or by their hosts' order in hosts for inventory order, so runs against
+// the same hosts can be diffed.
+func sortResults(results []api.Result, by string, hosts []inventory.Host) []api.Result {
+	sorted := append([]api.Result{}, results...)
+	switch by {
+	case SortHost:
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Host < sorted[j].Host })
+	case SortInventory:
+		index := make(map[string]int, len(hosts))
+		for i, host := range hosts {
+			index[host.Name] = i
+		}
+		sort.SliceStable(sorted, func(i, j int) bool { return index[sorted[i].Host] < index[sorted[j].Host] })
+	}
+	return sorted
+}
+
+// hostFileName: make host safe to use as a file name.
+func hostFileName(host string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(".-_:@[]", r):
+			return r
+		default:
+			return '_'
+		}
+	}, host)
+}
+
+// writeHostFiles: write a host's stdout and stderr to <dir>/<host>.out and <dir>/<host>.err, like pssh's --outdir.
+func writeHostFiles(dir string, res api.Result) error {
+	base := filepath.Join(dir, hostFileName(res.Host))
+	if err := os.WriteFile(base+".out", res.Stdout, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(base+".err", res.Stderr, 0644)
+}
+
+// hostFileSink: an api.OutputSink streaming a host's stdout and stderr to <dir>/<host>.out and <dir>/<host>.err as
+// they arrive, so large outputs do not have to fit in memory to be kept.
+func hostFileSink(dir string) api.OutputSink {
+	return func(target api.Target) (io.WriteCloser, io.WriteCloser, error) {
+		base := filepath.Join(dir, hostFileName(target.Host))
+		stdout, err := os.Create(base + ".out")
+		if err != nil {
+			return nil, nil, err
+		}
+		stderr, err := os.Create(base + ".err")
+		if err != nil {
+			_ = stdout.Close()
+			return nil, nil, err
+		}
+		return stdout, stderr, nil
+	}
+}
+
+// outputGroup: hosts that produced byte-for-byte identical output and exit codes
+type outputGroup struct {
+	hosts    []string
+	output   []byte
+	exitCode int
+}
+
+// groupOutputs: group results by a hash of their output and exit code, largest group first, like dshbak -c.
+func groupOutputs(results []api.Result) []outputGroup {
+	var groups []*outputGroup
+	byHash := make(map[[sha256.Size]byte]*outputGroup)
+	for _, res := range results {
+		sum := sha256.Sum256(append([]byte(fmt.Sprintf("%d\x00", res.ExitCode)), res.Output...))
+		group, ok := byHash[sum]
+		if !ok {
+			group = &outputGroup{output: res.Output, exitCode: res.ExitCode}
+			byHash[sum] = group
+			groups = append(groups, group)
+		}
+		group.hosts = append(group.hosts, res.Host)
+	}
+
+	sorted := make([]outputGroup, 0, len(groups))
+	for _, group := range groups {
+		sort.Strings(group.hosts)
+		sorted = append(sorted, *group)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if len(sorted[i].hosts) != len(sorted[j].hosts) {
+			return len(sorted[i].hosts) > len(sorted[j].hosts)
+		}
+		return sorted[i].hosts[0] < sorted[j].hosts[0]
+	})
+	return sorted
+}
+
+// logGroups: log one copy of each unique output followed by the hosts that produced it.
+func logGroups(logger *utils.SyncLogger, results []api.Result) {
+	for _, group := range groupOutputs(results) {
+		logger.Info(fmt.Sprintf(
+			"%d host(s), exit code %d: %s\n%s",
+			len(group.hosts),
+			group.exitCode,
+			strings.Join(group.hosts, ","),
+			string(group.output),
+		))
+	}
+}
+
+// logOutliers: log the hosts whose output differs from the most common one with a unified diff against it, to spot
+// configuration drift. Hosts whose command never ran are left out.
+func logOutliers(logger *utils.SyncLogger, results []api.Result) {
+	var ran []api.Result
+	for _, res := range results {
+		if res.Err == nil || api.Classify(res.Err) == api.ClassExitStatus {
+			ran = append(ran, res)
+		}
+	}
+	groups := groupOutputs(ran)
+	if len(groups) == 0 {
+		return
+	}
+	common := groups[0]
+	if len(groups) == 1 {
+		logger.Info(fmt.Sprintf("all %d host(s) produced the same output", len(common.hosts)))
+		return
+	}
+	name := fmt.Sprintf("most common output, %d host(s)", len(common.hosts))
+	for _, group := range groups[1:] {
+		hosts := strings.Join(group.hosts, ",")
+		msg := fmt.Sprintf("%d host(s) differ from the most common output: %s", len(group.hosts), hosts)
+		if group.exitCode != common.exitCode {
+			msg += fmt.Sprintf(", exit code %d instead of %d", group.exitCode, common.exitCode)
+		}
+		diff := unifiedDiff(name, hosts, common.output, group.output, 3)
+		logger.Warn(strings.TrimSuffix(msg+"\n"+diff, "\n"))
+	}
+}
@@ -0,0 +1,371 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/utils"
+)
+
+func TestTextOutput(t *testing.T) {
+	ok := api.Result{Host: "web1", Output: []byte("up 3 days\n")}
+	failed := api.Result{Host: "web2", Err: errors.New("Process exited with status 1"), Output: []byte("no such file\n")}
+	tests := []struct {
+		name    string
+		res     api.Result
+		brief   bool
+		color   bool
+		wantMsg string
+	}{
+		{
+			name:    "success",
+			res:     ok,
+			wantMsg: "web1\nup 3 days\n",
+		},
+		{
+			name:    "success in color",
+			res:     ok,
+			color:   true,
+			wantMsg: ansiGreen + "web1" + ansiReset + "\nup 3 days\n",
+		},
+		{
+			name:    "failure",
+			res:     failed,
+			wantMsg: "web2\nProcess exited with status 1\nno such file\n",
+		},
+		{
+			name:  "failure in color",
+			res:   failed,
+			color: true,
+			wantMsg: ansiRed + "web2" + ansiReset + "\n" + ansiRed + "Process exited with status 1" + ansiReset +
+				"\nno such file\n",
+		},
+		{
+			name:    "brief success in color",
+			res:     ok,
+			brief:   true,
+			color:   true,
+			wantMsg: ansiGreen + "web1" + ansiReset + ": ok",
+		},
+		{
+			name:    "brief failure in color",
+			res:     failed,
+			brief:   true,
+			color:   true,
+			wantMsg: ansiRed + "web2" + ansiReset + ": " + ansiRed + "Process exited with status 1" + ansiReset,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := utils.NewLogger(&buf, "", utils.LogJSON, slog.LevelInfo)
+			if err != nil {
+				t.Fatalf("unable to create logger: %v", err)
+			}
+			textOutput{logger: logger, brief: tt.brief, color: tt.color}.result(tt.res)
+			var record struct {
+				Msg  string `json:"msg"`
+				Host string `json:"host"`
+			}
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatalf("unable to decode log record %q: %v", buf.String(), err)
+			}
+			if record.Msg != tt.wantMsg {
+				t.Errorf("got message %q, want %q", record.Msg, tt.wantMsg)
+			}
+			if record.Host != tt.res.Host {
+				t.Errorf("got host field %q, want %q", record.Host, tt.res.Host)
+			}
+		})
+	}
+}
+
+func TestFormatTemplate(t *testing.T) {
+	inv := localInventory(t, "web1", "web2")
+	tests := []struct {
+		name   string
+		format string
+		cmd    string
+		want   string
+	}{
+		{
+			name:   "fields",
+			format: "{{.Host}} [{{.ExitCode}}] {{.Stdout | trim}}",
+			cmd:    `echo "hello from $TEST_HOST"; test "$TEST_HOST" != web2`,
+			want:   "web1 [0] hello from web1\nweb2 [1] hello from web2\n",
+		},
+		{
+			name:   "functions",
+			format: `{{.Host | upper}}: {{join "," (lines .Stdout)}} {{json .ErrorClass}}` + "\n",
+			cmd:    `printf 'a\nb\n'`,
+			want:   "WEB1: a,b \"ok\"\nWEB2: a,b \"ok\"\n",
+		},
+		{
+			name:   "errors",
+			format: "{{.Host}}{{if .Error}} {{.Error}}: {{.Stderr | trim}}{{end}}",
+			cmd:    `test "$TEST_HOST" != web2 || { echo broken >&2; exit 3; }`,
+			want:   "web1\nweb2 Process exited with status 3: broken\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, stdout := runLocal(t, Config{Output: "text", Format: tt.format, SortBy: SortHost}, inv, tt.cmd)
+			if stdout != tt.want {
+				t.Errorf("got output %q, want %q", stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatTemplateInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		format  string
+		wantErr string
+	}{
+		{name: "syntax", output: "text", format: "{{.Host", wantErr: "unable to parse flags: -format: "},
+		{name: "unknown field", output: "text", format: "{{.Hostname}}", wantErr: "can't evaluate field Hostname"},
+		{name: "with another output", output: "json", format: "{{.Host}}", wantErr: "mutually exclusive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			c := Config{
+				HostList:  localInventory(t, "web1"),
+				Args:      []string{"true"},
+				Transport: TransportLocal,
+				Logger:    testLogger(t),
+				Stdout:    &stdout,
+				Output:    tt.output,
+				Format:    tt.format,
+				Workers:   1,
+			}
+			code, err := Execute(context.Background(), &c)
+			if code != ExitSetup || err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got exit status %d and error %v, want %d and one containing %q", code, err, ExitSetup, tt.wantErr)
+			}
+			if stdout.Len() != 0 {
+				t.Errorf("got output %q before the run was set up", stdout.String())
+			}
+		})
+	}
+}
+
+func TestSortResults(t *testing.T) {
+	results := []api.Result{{Host: "web2"}, {Host: "web10"}, {Host: "db1"}, {Host: "web1"}}
+	hosts := testHosts("web1", "web2", "db1", "web10")
+	tests := []struct {
+		name, by, want string
+	}{
+		{name: "unsorted", want: "web2,web10,db1,web1"},
+		{name: "by host", by: SortHost, want: "db1,web1,web10,web2"},
+		{name: "by inventory", by: SortInventory, want: "web1,web2,db1,web10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, res := range sortResults(results, tt.by, hosts) {
+				got = append(got, res.Host)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("got %s, want %s", strings.Join(got, ","), tt.want)
+			}
+		})
+	}
+	if results[0].Host != "web2" {
+		t.Errorf("sorting changed the results it was given")
+	}
+}
+
+// TestSortedOutput: results are reported in the order asked for, not the order the hosts finish in.
+func TestSortedOutput(t *testing.T) {
+	inv := localInventory(t, "web3", "web1", "web2")
+	// web2 finishes first, then web1, then web3
+	cmd := `case "$TEST_HOST" in web1) sleep 0.2;; web3) sleep 0.4;; esac; echo "$TEST_HOST"`
+	tests := []struct {
+		name, by, want string
+	}{
+		{name: "unsorted", want: "web2,web1,web3"},
+		{name: "by host", by: SortHost, want: "web1,web2,web3"},
+		{name: "by inventory", by: SortInventory, want: "web3,web1,web2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, stdout := runLocal(t, Config{Output: "ndjson", SortBy: tt.by}, inv, cmd)
+			var got []string
+			dec := json.NewDecoder(strings.NewReader(stdout))
+			for dec.More() {
+				var res jsonResult
+				if err := dec.Decode(&res); err != nil {
+					t.Fatalf("unable to decode output %q: %v", stdout, err)
+				}
+				got = append(got, res.Host)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("got results for %s, want %s", strings.Join(got, ","), tt.want)
+			}
+		})
+	}
+}
+
+// logRecords: the level and message of each JSON log record in buf.
+func logRecords(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+	var records []string
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var record struct {
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}
+		if err := dec.Decode(&record); err != nil {
+			t.Fatalf("unable to decode log records: %v", err)
+		}
+		records = append(records, record.Level+" "+record.Msg)
+	}
+	return records
+}
+
+func TestGroupOutputs(t *testing.T) {
+	results := []api.Result{
+		{Host: "web3", Output: []byte("v2\n")},
+		{Host: "web1", Output: []byte("v1\n")},
+		{Host: "db1", Output: []byte("v1\n"), ExitCode: 1},
+		{Host: "web2", Output: []byte("v1\n")},
+		{Host: "web4", Output: []byte("v2\n")},
+		{Host: "web5", Output: []byte("v3\n")},
+	}
+	groups := groupOutputs(results)
+	// largest group first, then groups of the same size by their first host, identical output with another exit code
+	// is a group of its own
+	want := []string{"web1,web2 0 v1\n", "web3,web4 0 v2\n", "db1 1 v1\n", "web5 0 v3\n"}
+	var got []string
+	for _, group := range groups {
+		got = append(got, fmt.Sprintf("%s %d %s", strings.Join(group.hosts, ","), group.exitCode, group.output))
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got groups %q, want %q", got, want)
+	}
+	if groups := groupOutputs(nil); len(groups) != 0 {
+		t.Errorf("got groups %+v for no results, want none", groups)
+	}
+}
+
+func TestLogGroups(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := utils.NewLogger(&buf, "", utils.LogJSON, slog.LevelInfo)
+	if err != nil {
+		t.Fatalf("unable to create logger: %v", err)
+	}
+	logGroups(logger, []api.Result{
+		{Host: "web2", Output: []byte("ok\n")},
+		{Host: "web1", Output: []byte("ok\n")},
+		{Host: "web3", Output: []byte("disk full\n"), ExitCode: 2},
+	})
+	want := []string{
+		"INFO 2 host(s), exit code 0: web1,web2\nok\n",
+		"INFO 1 host(s), exit code 2: web3\ndisk full\n",
+	}
+	if got := logRecords(t, &buf); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got log records %q, want %q", got, want)
+	}
+}
+
+func TestLogOutliers(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []api.Result
+		want    []string
+	}{
+		{
+			name:    "no results",
+			results: nil,
+		},
+		{
+			name: "all the same",
+			results: []api.Result{
+				{Host: "web1", Output: []byte("ok\n")},
+				{Host: "web2", Output: []byte("ok\n")},
+			},
+			want: []string{"INFO all 2 host(s) produced the same output"},
+		},
+		{
+			name: "hosts whose command never ran are left out",
+			results: []api.Result{
+				{Host: "web1", Output: []byte("ok\n")},
+				{Host: "web2", Err: fmt.Errorf("%w: connection refused", api.ErrDial), ExitCode: -1},
+			},
+			want: []string{"INFO all 1 host(s) produced the same output"},
+		},
+		{
+			name: "outliers",
+			results: []api.Result{
+				{Host: "web1", Output: []byte("a\nb\n")},
+				{Host: "web2", Output: []byte("a\nb\n")},
+				{Host: "web3", Output: []byte("a\nc\n"), Err: &api.ExitError{Status: 1}, ExitCode: 1},
+			},
+			want: []string{
+				"WARN 1 host(s) differ from the most common output: web3, exit code 1 instead of 0\n" +
+					"--- most common output, 2 host(s)\n+++ web3\n@@ -1,2 +1,2 @@\n a\n-b\n+c",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := utils.NewLogger(&buf, "", utils.LogJSON, slog.LevelInfo)
+			if err != nil {
+				t.Fatalf("unable to create logger: %v", err)
+			}
+			logOutliers(logger, tt.results)
+			if got := logRecords(t, &buf); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got log records %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostFileName(t *testing.T) {
+	for host, want := range map[string]string{
+		"web1":                "web1",
+		"deploy@web1.example": "deploy@web1.example",
+		"[::1]:2222":          "[::1]:2222",
+		"../etc/passwd":       ".._etc_passwd",
+		"local:web 1":         "local:web_1",
+	} {
+		if got := hostFileName(host); got != want {
+			t.Errorf("hostFileName(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+// TestOutDir: each host's stdout and stderr land in files of their own, in a directory created for them.
+func TestOutDir(t *testing.T) {
+	inv := localInventory(t, "web1", "web2")
+	dir := filepath.Join(t.TempDir(), "out", "today")
+	code, _ := runLocal(t, Config{OutDir: dir}, inv, `echo "out $TEST_HOST"; echo "err $TEST_HOST" >&2`)
+	if code != ExitOK {
+		t.Fatalf("got exit status %d, want %d", code, ExitOK)
+	}
+	for _, host := range []string{"web1", "web2"} {
+		for ext, want := range map[string]string{".out": "out " + host + "\n", ".err": "err " + host + "\n"} {
+			data, err := os.ReadFile(filepath.Join(dir, host+ext))
+			if err != nil {
+				t.Fatalf("unable to read output file: %v", err)
+			}
+			if string(data) != want {
+				t.Errorf("got %s%s %q, want %q", host, ext, data, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// progress: a completed/total line with failures so far and an ETA, redrawn in place as hosts finish
+type progress struct {
+	mu       sync.Mutex
+	w        io.Writer
+	inPlace  bool
+	total    int
+	done     int
+	failed   int
+	started  time.Time
+	drawn    bool
+	lastLine time.Time
+}
+
+// newProgress: track a run of total hosts. inPlace redraws a single line, otherwise each update is a new line.
+func newProgress(w io.Writer, total int, inPlace bool) *progress {
+	return &progress{w: w, total: total, inPlace: inPlace, started: time.Now()}
+}
+
+// clear: erase the progress line so other output can be written over it.
+func (p *progress) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inPlace && p.drawn {
+		fmt.Fprint(p.w, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// update: count a finished host and redraw the progress line.
+func (p *progress) update(failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if failed {
+		p.failed++
+	}
+
+	// without a terminal to redraw on, print at most one line a second plus the last one
+	now := time.Now()
+	if !p.inPlace && p.done < p.total && now.Sub(p.lastLine) < time.Second {
+		return
+	}
+	p.lastLine = now
+
+	line := fmt.Sprintf("%d/%d done, %d failed, eta %s", p.done, p.total, p.failed, p.eta(now))
+	if p.inPlace {
+		fmt.Fprintf(p.w, "\r\033[K%s", line)
+		p.drawn = true
+	} else {
+		fmt.Fprintln(p.w, line)
+	}
+}
+
+// finish: move past the progress line once the run is over.
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inPlace && p.drawn {
+		fmt.Fprintln(p.w)
+		p.drawn = false
+	}
+}
+
+// eta: estimate the time left from the average time per finished host so far.
+func (p *progress) eta(now time.Time) string {
+	if p.done == 0 {
+		return "unknown"
+	}
+	if p.done >= p.total {
+		return "0s"
+	}
+	perHost := now.Sub(p.started) / time.Duration(p.done)
+	return (perHost * time.Duration(p.total-p.done)).Round(time.Second).String()
+}
@@ -0,0 +1,74 @@
+package executor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressInPlace(t *testing.T) {
+	var buf bytes.Buffer
+	p := newProgress(&buf, 3, true)
+	p.update(false)
+	p.clear()
+	buf.WriteString("web1 output\n")
+	p.update(true)
+	p.update(false)
+	p.finish()
+
+	got := buf.String()
+	want := "\r\033[K1/3 done, 0 failed, eta 0s" + "\r\033[K" + "web1 output\n" +
+		"\r\033[K2/3 done, 1 failed, eta 0s" + "\r\033[K3/3 done, 1 failed, eta 0s" + "\n"
+	if got != want {
+		t.Errorf("got progress %q, want %q", got, want)
+	}
+}
+
+// TestProgressLines: without a terminal each update is a line of its own, at most one a second but always the last.
+func TestProgressLines(t *testing.T) {
+	var buf bytes.Buffer
+	p := newProgress(&buf, 3, false)
+	p.update(false)
+	p.update(true)
+	p.clear()
+	p.update(false)
+	p.finish()
+
+	want := "1/3 done, 0 failed, eta 0s\n3/3 done, 1 failed, eta 0s\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got progress %q, want %q", got, want)
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		done  int
+		total int
+		want  string
+	}{
+		{name: "nothing done", done: 0, total: 10, want: "unknown"},
+		{name: "all done", done: 10, total: 10, want: "0s"},
+		// 2 hosts in 10s is 5s a host, 8 hosts left
+		{name: "part done", done: 2, total: 10, want: "40s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &progress{total: tt.total, done: tt.done, started: now.Add(-10 * time.Second)}
+			if got := p.eta(now); got != tt.want {
+				t.Errorf("got eta %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestProgressRun: -progress reports to Stderr as hosts finish.
+func TestProgressRun(t *testing.T) {
+	inv := localInventory(t, "web1", "web2")
+	_, out := runLocal(t, Config{Progress: true, Output: "ndjson"}, inv, `test "$TEST_HOST" = web1`)
+	if !strings.Contains(out, "2/2 done, 1 failed, eta 0s\n") {
+		t.Errorf("got output %q, want the final progress line", out)
+	}
+}
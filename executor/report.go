@@ -0,0 +1,138 @@
+package executor
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+)
+
+// Report: a file written once the run is over, in a format other tools understand
+type Report struct {
+	// Kind is junit or csv
+	Kind string
+	Path string
+}
+
+// write: render results to the report's file.
+func (r Report) write(cmd string, started time.Time, results []api.Result) error {
+	f, err := os.Create(r.Path)
+	if err != nil {
+		return err
+	}
+	switch r.Kind {
+	case "junit":
+		err = writeJUnit(f, cmd, started, results)
+	case "csv":
+		err = writeCSV(f, results)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// JUnit XML as understood by Jenkins and GitLab, each host is a test case
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Time      float64     `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// writeJUnit: write a single test suite named after the command. A nonzero exit status is a failure, anything that
+// kept the command from running to completion is an error.
+func writeJUnit(f *os.File, cmd string, started time.Time, results []api.Result) error {
+	suite := junitSuite{
+		Name:      cmd,
+		Tests:     len(results),
+		Time:      time.Since(started).Seconds(),
+		Timestamp: started.Format(time.RFC3339),
+	}
+	for _, res := range results {
+		tc := junitCase{
+			Name:      res.Host,
+			ClassName: "remote-executor",
+			Time:      res.Duration.Seconds(),
+			SystemOut: string(res.Stdout),
+			SystemErr: string(res.Stderr),
+		}
+		if res.Err != nil {
+			class := api.Classify(res.Err)
+			problem := &junitProblem{Message: res.Err.Error(), Type: class, Body: string(res.Output)}
+			if class == api.ClassExitStatus {
+				tc.Failure = problem
+				suite.Failures++
+			} else {
+				tc.Error = problem
+				suite.Errors++
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	if _, err := f.WriteString(xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(f)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitSuites{Suites: []junitSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := f.WriteString("\n")
+	return err
+}
+
+// writeCSV: write one row per host with its status, exit code, duration, and the first line of any error.
+func writeCSV(f *os.File, results []api.Result) error {
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"host", "status", "exit_code", "duration_seconds", "error"}); err != nil {
+		return err
+	}
+	for _, res := range results {
+		var errLine string
+		if res.Err != nil {
+			errLine = strings.SplitN(res.Err.Error(), "\n", 2)[0]
+		}
+		row := []string{
+			res.Host,
+			api.Classify(res.Err),
+			strconv.Itoa(res.ExitCode),
+			strconv.FormatFloat(res.Duration.Seconds(), 'f', 3, 64),
+			errLine,
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,133 @@
+package executor
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+)
+
+func TestJUnitReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.xml")
+	started := time.Now().Add(-2 * time.Second).Truncate(time.Second)
+	cmd := `grep "a<b" /etc/hosts && echo done`
+	results := []api.Result{
+		{Host: "web1", Stdout: []byte("up 3 days\n"), Output: []byte("up 3 days\n"), Duration: 1500 * time.Millisecond},
+		{
+			Host:     "web2",
+			Err:      &api.ExitError{Status: 2},
+			ExitCode: 2,
+			Stderr:   []byte("a < b & \"c\"\n"),
+			Output:   []byte("<fail> & \"quoted\"\n"),
+			Duration: 250 * time.Millisecond,
+		},
+		{Host: "web3", Err: fmt.Errorf("%w: connection refused", api.ErrDial)},
+	}
+	if err := (Report{Kind: "junit", Path: path}).write(cmd, started, results); err != nil {
+		t.Fatalf("unable to write report: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read report: %v", err)
+	}
+	if !strings.HasPrefix(string(data), xml.Header) {
+		t.Errorf("report does not start with an XML header:\n%s", data)
+	}
+	if !strings.Contains(string(data), "&lt;fail&gt; &amp;") {
+		t.Errorf("output was not escaped:\n%s", data)
+	}
+
+	var got junitSuites
+	if err := xml.Unmarshal(data, &got); err != nil {
+		t.Fatalf("unable to parse report: %v\n%s", err, data)
+	}
+	if len(got.Suites) != 1 {
+		t.Fatalf("got %d test suites, want 1", len(got.Suites))
+	}
+	suite := got.Suites[0]
+	if suite.Name != cmd {
+		t.Errorf("got suite name %q, want %q", suite.Name, cmd)
+	}
+	if suite.Tests != 3 || suite.Failures != 1 || suite.Errors != 1 {
+		t.Errorf("got %d tests, %d failures and %d errors, want 3, 1 and 1", suite.Tests, suite.Failures, suite.Errors)
+	}
+	if suite.Time < 2 {
+		t.Errorf("got suite time %v, want at least the 2s since it started", suite.Time)
+	}
+	if want := started.Format(time.RFC3339); suite.Timestamp != want {
+		t.Errorf("got timestamp %q, want %q", suite.Timestamp, want)
+	}
+	if len(suite.Cases) != 3 {
+		t.Fatalf("got %d test cases, want 3", len(suite.Cases))
+	}
+
+	ok, failed, broken := suite.Cases[0], suite.Cases[1], suite.Cases[2]
+	if ok.Name != "web1" || ok.Time != 1.5 || ok.SystemOut != "up 3 days\n" || ok.Failure != nil || ok.Error != nil {
+		t.Errorf("got test case %+v for the host that succeeded", ok)
+	}
+	if failed.Name != "web2" || failed.Time != 0.25 || failed.Error != nil || failed.SystemErr != "a < b & \"c\"\n" {
+		t.Errorf("got test case %+v for the host that exited 2", failed)
+	}
+	wantFailure := junitProblem{
+		Message: "Process exited with status 2",
+		Type:    api.ClassExitStatus,
+		Body:    "<fail> & \"quoted\"\n",
+	}
+	if failed.Failure == nil || *failed.Failure != wantFailure {
+		t.Errorf("got failure %+v, want %+v", failed.Failure, wantFailure)
+	}
+	wantError := junitProblem{Message: "could not dial: connection refused", Type: api.ClassConnect}
+	if broken.Name != "web3" || broken.Failure != nil || broken.Error == nil || *broken.Error != wantError {
+		t.Errorf("got test case %+v with error %+v for the host that was not reached, want error %+v",
+			broken, broken.Error, wantError)
+	}
+}
+
+func TestCSVReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.csv")
+	results := []api.Result{
+		{Host: "web1", Duration: 1500 * time.Millisecond},
+		{
+			Host:     "web2",
+			Err:      fmt.Errorf("%w: lookup \"web2, east\": no such host\nsecond line", api.ErrDial),
+			Duration: 250 * time.Millisecond,
+		},
+		{Host: "db,primary", Err: &api.ExitError{Status: 3}, ExitCode: 3},
+	}
+	if err := (Report{Kind: "csv", Path: path}).write("uptime", time.Now(), results); err != nil {
+		t.Fatalf("unable to write report: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read report: %v", err)
+	}
+	wantRaw := `web2,connect,0,0.250,"could not dial: lookup ""web2, east"": no such host"` + "\n"
+	if !strings.Contains(string(data), wantRaw) {
+		t.Errorf("report does not quote the error line, got:\n%s", data)
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		t.Fatalf("unable to parse report: %v\n%s", err, data)
+	}
+	want := [][]string{
+		{"host", "status", "exit_code", "duration_seconds", "error"},
+		{"web1", "ok", "0", "1.500", ""},
+		{"web2", "connect", "0", "0.250", `could not dial: lookup "web2, east": no such host`},
+		{"db,primary", "exit-status", "3", "0.000", "Process exited with status 3"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d:\n%s", len(rows), len(want), data)
+	}
+	for i := range want {
+		if strings.Join(rows[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("row %d: got %q, want %q", i, rows[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package executor
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/basilnsage/remote-executor/utils"
+)
+
+// prompt: ask a question on the terminal, replaced in tests
+var prompt = utils.Prompt
+
+// batchSize: how many hosts out of total go in each --serial batch, all of them if spec is empty. spec is a host count
+// or a percentage of the hosts, rounded up so every batch has at least one host, e.g. 5 or 25%.
+func batchSize(spec string, total int) (int, error) {
+	if spec == "" {
+		return total, nil
+	}
+	if percent := strings.TrimSuffix(spec, "%"); percent != spec {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return 0, fmt.Errorf("invalid batch size %q, want a percentage between 0 and 100", spec)
+		}
+		// allow for float error, 30% of 10 hosts is 3.0000000000000004
+		size := int(math.Ceil(float64(total)*p/100 - 1e-9))
+		if size < 1 {
+			size = 1
+		}
+		return size, nil
+	}
+	size, err := strconv.Atoi(spec)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid batch size %q, want a number of hosts or a percentage", spec)
+	}
+	return size, nil
+}
+
+// failureLimit: the number of failed hosts out of total at which to stop starting new hosts, the lower of max and pct
+// percent of total rounded up, or 0 for no limit.
+func failureLimit(max int, pct float64, total int) int {
+	limit := max
+	if pct > 0 {
+		byPct := int(math.Ceil(float64(total)*pct/100 - 1e-9))
+		if byPct < 1 {
+			byPct = 1
+		}
+		if limit == 0 || byPct < limit {
+			limit = byPct
+		}
+	}
+	return limit
+}
+
+// confirmCanary: whether to carry on with the remaining hosts once the canary hosts are done and failed of them failed.
+// With auto set every canary must have succeeded, otherwise the user is asked on the terminal.
+func confirmCanary(failed, remaining int, auto bool) (bool, error) {
+	if auto {
+		return failed == 0, nil
+	}
+	answer, err := prompt(fmt.Sprintf("continue with the remaining %d hosts? [y/N] ", remaining), true)
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// confirmRun: ask on the terminal before running command on count hosts, carrying on only if the answer is yes or the
+// number of hosts.
+func confirmRun(command string, count int) (bool, error) {
+	answer, err := prompt(
+		fmt.Sprintf("about to run %q on %d hosts, type yes or %d to continue: ", command, count, count),
+		true,
+	)
+	if err != nil {
+		return false, err
+	}
+	answer = strings.TrimSpace(answer)
+	return strings.EqualFold(answer, "yes") || answer == strconv.Itoa(count), nil
+}
+
+// readFailed: the hosts listed in a --failed-out file, one per line.
+func readFailed(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	failed := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			failed[line] = true
+		}
+	}
+	return failed, nil
+}
+
+// writeFailed: replace the --failed-out file with the failed hosts, one per line, so it can be used as a host list or
+// with --retry-failed. A run without failures leaves it empty.
+func writeFailed(path string, hosts []string) error {
+	sorted := append([]string{}, hosts...)
+	sort.Strings(sorted)
+	var b strings.Builder
+	for _, host := range sorted {
+		b.WriteString(host + "\n")
+	}
+	// write the new list next to the old one first, an interrupted write must not lose the hosts left to retry
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
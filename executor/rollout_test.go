@@ -0,0 +1,444 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+)
+
+// ranHosts: the hosts in the json output of a run, sorted.
+func ranHosts(t *testing.T, stdout string) []string {
+	t.Helper()
+	var run jsonRun
+	if err := json.Unmarshal([]byte(stdout), &run); err != nil {
+		t.Fatalf("unable to decode run output %q: %v", stdout, err)
+	}
+	var hosts []string
+	for _, res := range run.Results {
+		hosts = append(hosts, res.Host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func TestRetryFailed(t *testing.T) {
+	inv := localInventory(t, "web1", "web2", "web3", "web4")
+	failedOut := filepath.Join(t.TempDir(), "failed")
+	steps := []struct {
+		name  string
+		retry bool
+		cmd   string
+		// wantRan are the hosts run on and wantFailed those written to the failed-out file
+		wantRan    string
+		wantFailed string
+		wantCode   int
+	}{
+		{
+			name:       "first run",
+			cmd:        `case "$TEST_HOST" in web2|web4) exit 1;; esac`,
+			wantRan:    "web1,web2,web3,web4",
+			wantFailed: "web2\nweb4\n",
+			wantCode:   ExitSomeFailed,
+		},
+		{
+			name:       "retry",
+			retry:      true,
+			cmd:        `test "$TEST_HOST" != web4`,
+			wantRan:    "web2,web4",
+			wantFailed: "web4\n",
+			wantCode:   ExitSomeFailed,
+		},
+		{
+			name:       "retry again",
+			retry:      true,
+			cmd:        "true",
+			wantRan:    "web4",
+			wantFailed: "",
+			wantCode:   ExitOK,
+		},
+	}
+	for _, step := range steps {
+		c := Config{FailedOut: failedOut, RetryFailed: step.retry}
+		code, stdout := runLocal(t, c, inv, step.cmd)
+		if code != step.wantCode {
+			t.Errorf("%s: got exit status %d, want %d", step.name, code, step.wantCode)
+		}
+		if ran := strings.Join(ranHosts(t, stdout), ","); ran != step.wantRan {
+			t.Errorf("%s: ran on %s, want %s", step.name, ran, step.wantRan)
+		}
+		failed, err := os.ReadFile(failedOut)
+		if err != nil {
+			t.Fatalf("%s: unable to read the failed hosts: %v", step.name, err)
+		}
+		if string(failed) != step.wantFailed {
+			t.Errorf("%s: got failed hosts %q, want %q", step.name, failed, step.wantFailed)
+		}
+	}
+}
+
+func TestRetryFailedNotInHostList(t *testing.T) {
+	failedOut := filepath.Join(t.TempDir(), "failed")
+	if err := os.WriteFile(failedOut, []byte("web2\nold1\n"), 0644); err != nil {
+		t.Fatalf("unable to write the failed hosts: %v", err)
+	}
+	c := Config{FailedOut: failedOut, RetryFailed: true}
+	code, stdout := runLocal(t, c, localInventory(t, "web1", "web2"), "true")
+	if code != ExitOK {
+		t.Errorf("got exit status %d, want %d", code, ExitOK)
+	}
+	if ran := strings.Join(ranHosts(t, stdout), ","); ran != "web2" {
+		t.Errorf("ran on %s, want only web2", ran)
+	}
+}
+
+func TestRetryFailedWithoutFile(t *testing.T) {
+	c := Config{
+		HostList:    localInventory(t, "web1"),
+		Args:        []string{"true"},
+		Transport:   TransportLocal,
+		Logger:      testLogger(t),
+		Output:      "json",
+		Workers:     1,
+		FailedOut:   filepath.Join(t.TempDir(), "failed"),
+		RetryFailed: true,
+	}
+	code, err := Execute(context.Background(), &c)
+	if code != ExitSetup || err == nil || !strings.Contains(err.Error(), "unable to read the failed hosts to retry") {
+		t.Errorf("got exit status %d and error %v, want %d and a missing failed hosts file", code, err, ExitSetup)
+	}
+}
+
+// skippedHosts: the hosts in the json output of a run that were skipped instead of run, sorted.
+func skippedHosts(t *testing.T, stdout string) []string {
+	t.Helper()
+	var run jsonRun
+	if err := json.Unmarshal([]byte(stdout), &run); err != nil {
+		t.Fatalf("unable to decode run output %q: %v", stdout, err)
+	}
+	var hosts []string
+	for _, res := range run.Results {
+		if res.ErrorClass == api.ClassSkipped {
+			hosts = append(hosts, res.Host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func TestBatchSize(t *testing.T) {
+	tests := []struct {
+		spec    string
+		total   int
+		want    int
+		wantErr bool
+	}{
+		{spec: "", total: 7, want: 7},
+		{spec: "3", total: 10, want: 3},
+		{spec: "20", total: 10, want: 20},
+		{spec: "50%", total: 10, want: 5},
+		{spec: "30%", total: 10, want: 3},
+		{spec: "25%", total: 10, want: 3},
+		{spec: "33.3%", total: 3, want: 1},
+		{spec: "1%", total: 10, want: 1},
+		{spec: "100%", total: 10, want: 10},
+		{spec: "0", total: 10, wantErr: true},
+		{spec: "-2", total: 10, wantErr: true},
+		{spec: "two", total: 10, wantErr: true},
+		{spec: "0%", total: 10, wantErr: true},
+		{spec: "101%", total: 10, wantErr: true},
+		{spec: "half%", total: 10, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := batchSize(tt.spec, tt.total)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("batchSize(%q, %d) got error %v, want error %v", tt.spec, tt.total, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("batchSize(%q, %d) = %d, want %d", tt.spec, tt.total, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunnerBatches(t *testing.T) {
+	// every batch must be over before the next one starts, however many workers are free
+	var mu sync.Mutex
+	var running, batch, maxRunning int
+	var ran []string
+	batches := map[string]int{"a": 0, "b": 0, "c": 1, "d": 1, "e": 2}
+	exec := api.ExecutorFunc(func(ctx context.Context, target api.Target, cmd string) (api.Result, error) {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		if batches[target.Host] < batch {
+			t.Errorf("%s of batch %d started after batch %d", target.Host, batches[target.Host], batch)
+		}
+		batch = batches[target.Host]
+		ran = append(ran, target.Host)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return api.Result{}, nil
+	})
+	r := &Runner{Command: "uptime", Workers: 4, BatchSize: 2, Options: []api.Option{api.WithExecutor(exec)}}
+	summary, err := r.Run(context.Background(), testHosts("a", "b", "c", "d", "e"))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(summary.Results) != 5 || len(summary.Failed()) != 0 {
+		t.Errorf("got %d results and failed hosts %v, want 5 results and none failed", len(summary.Results),
+			summary.Failed())
+	}
+	if maxRunning > 2 {
+		t.Errorf("got %d hosts running at once, want at most the batch size of 2", maxRunning)
+	}
+	if len(ran) != 5 {
+		t.Errorf("ran on %v, want every host", ran)
+	}
+}
+
+func TestSerialAbort(t *testing.T) {
+	inv := localInventory(t, "web1", "web2", "web3", "web4", "web5")
+	tests := []struct {
+		name        string
+		cfg         Config
+		cmd         string
+		wantRan     string
+		wantSkipped string
+		wantCode    int
+	}{
+		{
+			name:     "batches without failures",
+			cfg:      Config{Serial: "2", SerialAbort: true},
+			cmd:      "true",
+			wantRan:  "web1,web2,web3,web4,web5",
+			wantCode: ExitOK,
+		},
+		{
+			name:     "failures without serial-abort",
+			cfg:      Config{Serial: "2"},
+			cmd:      `test "$TEST_HOST" != web1`,
+			wantRan:  "web1,web2,web3,web4,web5",
+			wantCode: ExitSomeFailed,
+		},
+		{
+			name:        "failure in the first batch",
+			cfg:         Config{Serial: "40%", SerialAbort: true},
+			cmd:         `test "$TEST_HOST" != web2`,
+			wantRan:     "web1,web2",
+			wantSkipped: "web3,web4,web5",
+			wantCode:    ExitSomeFailed,
+		},
+		{
+			name:        "failure in the second batch",
+			cfg:         Config{Serial: "2", SerialAbort: true},
+			cmd:         `test "$TEST_HOST" != web3`,
+			wantRan:     "web1,web2,web3,web4",
+			wantSkipped: "web5",
+			wantCode:    ExitSomeFailed,
+		},
+		{
+			name:     "failure in the last batch",
+			cfg:      Config{Serial: "2", SerialAbort: true},
+			cmd:      `test "$TEST_HOST" != web5`,
+			wantRan:  "web1,web2,web3,web4,web5",
+			wantCode: ExitSomeFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout := runLocal(t, tt.cfg, inv, tt.cmd)
+			if code != tt.wantCode {
+				t.Errorf("got exit status %d, want %d", code, tt.wantCode)
+			}
+			skipped := strings.Join(skippedHosts(t, stdout), ",")
+			if skipped != tt.wantSkipped {
+				t.Errorf("got skipped hosts %q, want %q", skipped, tt.wantSkipped)
+			}
+			var ran []string
+			for _, host := range ranHosts(t, stdout) {
+				if !strings.Contains(","+skipped+",", ","+host+",") {
+					ran = append(ran, host)
+				}
+			}
+			if got := strings.Join(ran, ","); got != tt.wantRan {
+				t.Errorf("ran on %s, want %s", got, tt.wantRan)
+			}
+		})
+	}
+}
+
+func TestFailureLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		max   int
+		pct   float64
+		total int
+		want  int
+	}{
+		{name: "no limit", total: 10, want: 0},
+		{name: "max only", max: 3, total: 10, want: 3},
+		{name: "max over total", max: 20, total: 10, want: 20},
+		{name: "pct only", pct: 20, total: 10, want: 2},
+		{name: "pct rounds up", pct: 25, total: 10, want: 3},
+		{name: "pct without float error", pct: 30, total: 10, want: 3},
+		{name: "pct at least one host", pct: 1, total: 10, want: 1},
+		{name: "pct of no hosts", pct: 50, total: 0, want: 1},
+		{name: "all hosts", pct: 100, total: 10, want: 10},
+		{name: "max lower than pct", max: 2, pct: 50, total: 10, want: 2},
+		{name: "pct lower than max", max: 6, pct: 50, total: 10, want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureLimit(tt.max, tt.pct, tt.total); got != tt.want {
+				t.Errorf("failureLimit(%d, %v, %d) = %d, want %d", tt.max, tt.pct, tt.total, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxFailures(t *testing.T) {
+	inv := localInventory(t, "web1", "web2", "web3", "web4", "web5", "web6")
+	// one worker runs the hosts in order, web2 and web4 fail
+	cmd := `case "$TEST_HOST" in web2|web4) exit 1;; esac`
+	tests := []struct {
+		name        string
+		cfg         Config
+		wantSkipped string
+	}{
+		{name: "no limit", cfg: Config{}, wantSkipped: ""},
+		{name: "limit not reached", cfg: Config{MaxFailures: 3}, wantSkipped: ""},
+		{name: "max failures", cfg: Config{MaxFailures: 1}, wantSkipped: "web3,web4,web5,web6"},
+		{name: "max failures reached later", cfg: Config{MaxFailures: 2}, wantSkipped: "web5,web6"},
+		{name: "max failure pct", cfg: Config{MaxFailurePct: 30}, wantSkipped: "web5,web6"},
+		{name: "lower of both", cfg: Config{MaxFailures: 1, MaxFailurePct: 50}, wantSkipped: "web3,web4,web5,web6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.cfg
+			c.Workers = 1
+			code, stdout := runLocal(t, c, inv, cmd)
+			if code != ExitSomeFailed {
+				t.Errorf("got exit status %d, want %d", code, ExitSomeFailed)
+			}
+			if skipped := strings.Join(skippedHosts(t, stdout), ","); skipped != tt.wantSkipped {
+				t.Errorf("got skipped hosts %q, want %q", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+// answer: replace prompt with one giving answer, or failing with err, recording the questions asked.
+func answer(t *testing.T, answer string, err error) *[]string {
+	t.Helper()
+	orig := prompt
+	t.Cleanup(func() { prompt = orig })
+	var asked []string
+	prompt = func(question string, echo bool) (string, error) {
+		asked = append(asked, question)
+		return answer, err
+	}
+	return &asked
+}
+
+func TestConfirmRun(t *testing.T) {
+	tests := []struct {
+		answer string
+		want   bool
+	}{
+		{answer: "yes", want: true},
+		{answer: "YES", want: true},
+		{answer: " yes ", want: true},
+		{answer: "3", want: true},
+		{answer: "y", want: false},
+		{answer: "4", want: false},
+		{answer: "no", want: false},
+		{answer: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.answer, func(t *testing.T) {
+			asked := answer(t, tt.answer, nil)
+			got, err := confirmRun("systemctl restart app", 3)
+			if err != nil {
+				t.Fatalf("confirmRun: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got confirmed %v for %q, want %v", got, tt.answer, tt.want)
+			}
+			want := `about to run "systemctl restart app" on 3 hosts, type yes or 3 to continue: `
+			if len(*asked) != 1 || (*asked)[0] != want {
+				t.Errorf("got asked %q, want %q", *asked, want)
+			}
+		})
+	}
+
+	answer(t, "", errors.New("stdin is not a terminal"))
+	if _, err := confirmRun("uptime", 3); err == nil {
+		t.Error("confirmRun did not fail without a terminal")
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	inv := localInventory(t, "web1", "web2")
+	marker := filepath.Join(t.TempDir(), "ran")
+	cmd := "touch " + marker + "-$TEST_HOST"
+	tests := []struct {
+		name      string
+		cfg       Config
+		answer    string
+		err       error
+		wantAsked bool
+		wantRan   bool
+		wantCode  int
+	}{
+		{name: "confirmed", cfg: Config{Confirm: true}, answer: "yes", wantAsked: true, wantRan: true, wantCode: ExitOK},
+		{name: "declined", cfg: Config{Confirm: true}, answer: "no", wantAsked: true, wantCode: ExitSetup},
+		{
+			name:      "no terminal",
+			cfg:       Config{Confirm: true},
+			err:       errors.New("stdin is not a terminal"),
+			wantAsked: true,
+			wantCode:  ExitSetup,
+		},
+		// there is nothing to confirm without hosts to run on
+		{name: "no hosts", cfg: Config{Confirm: true, Limit: []string{"db*"}}, wantCode: ExitOK},
+		{name: "without confirm", cfg: Config{}, wantRan: true, wantCode: ExitOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(marker + "-web1")
+			asked := answer(t, tt.answer, tt.err)
+			c := tt.cfg
+			c.HostList = inv
+			c.Args = []string{cmd}
+			c.Transport = TransportLocal
+			c.Logger = testLogger(t)
+			c.Stdout = &strings.Builder{}
+			c.Output = "json"
+			c.Workers = 1
+			code, err := Execute(context.Background(), &c)
+			if asked := len(*asked) > 0; asked != tt.wantAsked {
+				t.Errorf("got asked %v, want %v", asked, tt.wantAsked)
+			}
+			_, statErr := os.Stat(marker + "-web1")
+			if ran := statErr == nil; ran != tt.wantRan {
+				t.Errorf("got ran %v, want %v", ran, tt.wantRan)
+			}
+			if code != tt.wantCode || (err != nil) != (tt.wantCode == ExitSetup) {
+				t.Errorf("got exit status %d and error %v, want %d", code, err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,466 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/utils/inventory"
+	"golang.org/x/term"
+)
+
+// commandToRun: the remote command from Args, and the input to feed it.
+// With a Script the command feeds the script to bash on stdin, passing the optional argument on as its arguments.
+// With PipeStdin the input is everything read from Stdin, buffered so it can be replayed to each host.
+func (c *Config) commandToRun() (string, []byte, error) {
+	args := c.Args
+	if c.Script == "" {
+		if len(args) != 1 {
+			return "", nil, fmt.Errorf("need 1 positional argument for the command, found: %d", len(args))
+		}
+		if !c.PipeStdin {
+			return args[0], nil, nil
+		}
+		input, err := io.ReadAll(c.Stdin)
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to read stdin: %v", err)
+		}
+		return args[0], input, nil
+	}
+	if c.PipeStdin {
+		return "", nil, fmt.Errorf("unable to parse flags: -script and -stdin are mutually exclusive")
+	}
+	if len(args) > 1 {
+		return "", nil, fmt.Errorf("need at most 1 positional argument for the script's arguments, found: %d", len(args))
+	}
+	script, err := os.ReadFile(c.Script)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to read script: %v", err)
+	}
+	cmd := "bash -s"
+	if len(args) == 1 {
+		cmd += " -- " + args[0]
+	}
+	return cmd, script, nil
+}
+
+// task: the command, or the action of a subcommand, to run on every host, a command-like description of it for output
+// and reports, and the input to feed the command.
+func (c *Config) task() (string, api.Action, []byte, error) {
+	var cmd string
+	var stdin []byte
+	var action api.Action
+	var err error
+	switch c.Subcommand {
+	case SubcommandCopy:
+		cmd, action, err = c.copyAction()
+	case SubcommandFetch:
+		cmd, action, err = c.fetchAction()
+	case SubcommandCheck:
+		cmd, action, err = c.checkAction()
+	case SubcommandCollect:
+		cmd, action, err = c.collectAction()
+	case "":
+		cmd, stdin, err = c.commandToRun()
+		cmd = api.WrapShell(c.Shell, api.InDir(c.Chdir, cmd))
+	default:
+		err = fmt.Errorf("unknown subcommand %q", c.Subcommand)
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+	// only commands' output can be checked
+	if action != nil && (c.Expect.Regex != nil || c.Expect.Exact != "") {
+		return "", nil, nil, errors.New(
+			"unable to parse flags: -expect-regex and -expect-exact only check the output of commands",
+		)
+	}
+	return cmd, action, stdin, nil
+}
+
+// newOutput: the outputter for the Output format or Format template.
+func (c *Config) newOutput(cmd string) (outputter, error) {
+	switch {
+	case c.Format != "" && c.Output != "text":
+		return nil, fmt.Errorf("unable to parse flags: -format and -output %s are mutually exclusive", c.Output)
+	case c.Format != "":
+		out, err := newTemplateOutput(c.Stdout, c.Format)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse flags: -format: %v", err)
+		}
+		return out, nil
+	default:
+		brief := c.OutDir != "" || c.Aggregate || c.Diff || c.Stream
+		out, err := newOutputter(c.Output, c.Logger, c.Stdout, cmd, brief, c.Color)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse flags: %v", err)
+		}
+		return out, nil
+	}
+}
+
+// resume: the hosts still to run when carrying on from the ResumePath state file, seeding breaker with the failures
+// in a row of those that kept failing, and the state file to keep checkpointing to.
+func (c *Config) resume(
+	hosts []inventory.Host,
+	cmd string,
+	breaker *api.CircuitBreaker,
+) ([]inventory.Host, *runState, error) {
+	state, records, err := resumeRunState(c.ResumePath, cmd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to resume the run: %v", err)
+	}
+	remaining := hosts[:0:0]
+	for _, host := range hosts {
+		rec := records[host.Name]
+		if rec.OK {
+			continue
+		}
+		// hosts that kept failing before the run was interrupted stay quarantined
+		if breaker != nil && rec.Failures > 0 {
+			breaker.Seed(host.Name, rec.Failures)
+		}
+		remaining = append(remaining, host)
+	}
+	c.Logger.Info(fmt.Sprintf(
+		"resuming the run, skipping %d hosts that already succeeded, %d left",
+		len(hosts)-len(remaining),
+		len(remaining),
+	))
+	return remaining, state, nil
+}
+
+// skipRecent: hosts without those that succeeded running cmd within SkipRecent, going by the history.
+func (c *Config) skipRecent(hosts []inventory.Host, cmd string) ([]inventory.Host, error) {
+	if c.SkipRecent <= 0 || c.Force {
+		return hosts, nil
+	}
+	succeeded, err := recentSuccesses(c.HistoryPath, c.runKind(), cmd, c.SkipRecent)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up recent runs in the history: %v", err)
+	}
+	remaining := hosts[:0:0]
+	for _, host := range hosts {
+		if !succeeded[host.Name] {
+			remaining = append(remaining, host)
+		}
+	}
+	if len(remaining) < len(hosts) {
+		c.Logger.Info(fmt.Sprintf(
+			"skipping %d hosts that succeeded within %v, %d left, -force runs them all",
+			len(hosts)-len(remaining),
+			c.SkipRecent,
+			len(remaining),
+		))
+	}
+	return remaining, nil
+}
+
+// serveMetrics: serve metrics on MetricsListen for the lifetime of the run.
+func (c *Config) serveMetrics() (*api.Metrics, error) {
+	metrics := api.NewMetrics()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	listener, err := net.Listen("tcp", c.MetricsListen)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for metrics: %v", err)
+	}
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			c.Logger.Error(fmt.Sprintf("metrics server stopped: %v", err))
+		}
+	}()
+	c.Logger.Info(fmt.Sprintf("serving metrics on http://%s/metrics", listener.Addr()))
+	return metrics, nil
+}
+
+// poolOptions: the worker pool options shared by runs and serve jobs.
+func (c *Config) poolOptions() []api.Option {
+	opts := []api.Option{
+		api.WithKeepalive(c.Keepalive, c.KeepaliveCount),
+		api.WithStopSignal(c.StopSignal, c.StopGrace),
+		api.WithIdleTimeout(c.IdleTimeout),
+		api.WithBufferLimit(c.BufferLimit),
+		api.WithMaxOutput(c.MaxOutput, c.AbortOutput),
+		api.WithCleanOutput(c.CleanOutput),
+		api.WithRemoteLock(c.lockOwner()),
+		api.WithExpect(c.Expect),
+		api.WithOKExitCodes(c.OKExitCodes),
+	}
+	if c.ConnectRate > 0 {
+		opts = append(opts, api.WithConnectRate(c.ConnectRate, c.ConnectBurst))
+	}
+	if c.DialJitter > 0 {
+		opts = append(opts, api.WithDialJitter(c.DialJitter))
+	}
+	return opts
+}
+
+// isTerminal: whether w is a terminal.
+func isTerminal(w interface{}) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// run: run the command or subcommand on every selected host, report the results, and record the run.
+func (c *Config) run(ctx context.Context) (int, error) {
+	cmd, action, stdin, err := c.task()
+	if err != nil {
+		return ExitSetup, err
+	}
+	out, err := c.newOutput(cmd)
+	if err != nil {
+		return ExitSetup, err
+	}
+	if c.OutDir != "" {
+		if err := os.MkdirAll(c.OutDir, 0755); err != nil {
+			return ExitSetup, fmt.Errorf("unable to create output directory: %v", err)
+		}
+	}
+	c.Logger.Info("starting new remote executor run")
+
+	resolver, sshConf, err := c.newResolver()
+	if err != nil {
+		return ExitSetup, err
+	}
+	hosts, err := c.selectHosts()
+	if err != nil {
+		return ExitSetup, err
+	}
+	var breaker *api.CircuitBreaker
+	if c.BreakerFailures > 0 {
+		breaker = api.NewCircuitBreaker(c.BreakerFailures, c.BreakerCooldown)
+	}
+	var state *runState
+	switch {
+	case c.ResumePath != "":
+		if hosts, state, err = c.resume(hosts, cmd, breaker); err != nil {
+			return ExitSetup, err
+		}
+	case c.StatePath != "":
+		if state, err = newRunState(c.StatePath, cmd); err != nil {
+			return ExitSetup, fmt.Errorf("unable to create the state file: %v", err)
+		}
+	}
+	if hosts, err = c.skipRecent(hosts, cmd); err != nil {
+		return ExitSetup, err
+	}
+	size, err := batchSize(c.Serial, len(hosts))
+	if err != nil {
+		return ExitSetup, fmt.Errorf("unable to parse flags: %v", err)
+	}
+	canaries := 0
+	if c.Canary != "" {
+		if canaries, err = batchSize(c.Canary, len(hosts)); err != nil {
+			return ExitSetup, fmt.Errorf("unable to parse flags: %v", err)
+		}
+		if canaries > len(hosts) {
+			canaries = len(hosts)
+		}
+	}
+	// a check changes nothing on the hosts, so there is nothing to confirm
+	if c.Confirm && len(hosts) > 0 && c.Subcommand != SubcommandCheck {
+		ok, err := confirmRun(cmd, len(hosts))
+		if err != nil {
+			return ExitSetup, fmt.Errorf("unable to confirm the run: %v", err)
+		}
+		if !ok {
+			return ExitSetup, errors.New("the run was not confirmed, nothing was run")
+		}
+	}
+
+	var metrics *api.Metrics
+	if c.MetricsListen != "" {
+		if metrics, err = c.serveMetrics(); err != nil {
+			return ExitSetup, err
+		}
+	}
+
+	var hops []api.Hop
+	if c.Jump != "" {
+		if hops, err = resolver.jumpChain(c.Jump); err != nil {
+			return ExitSetup, fmt.Errorf("unable to parse flags: %v", err)
+		}
+	}
+	opts := append(c.poolOptions(),
+		api.WithJumpChain(hops),
+		api.WithTimeout(c.Timeout),
+		api.WithLogger(c.Logger),
+		api.WithMetrics(metrics),
+		api.WithEnv(c.Env),
+		api.WithStdin(stdin),
+		api.WithAction(action),
+		api.WithCircuitBreaker(breaker),
+	)
+	// command output is streamed to -outdir as it arrives, action output is only known once the action is over
+	if c.OutDir != "" && action == nil {
+		opts = append(opts, api.WithOutputSink(hostFileSink(c.OutDir)))
+	}
+	var streamer *lineStreamer
+	if c.Stream {
+		streamer = newLineStreamer(c.Stdout, c.Stderr)
+		opts = append(opts, api.WithOutputTap(streamer.tap))
+	}
+
+	var prog *progress
+	if c.Progress {
+		prog = newProgress(c.Stderr, len(hosts), isTerminal(c.Stderr))
+	}
+
+	var audit *auditLog
+	var auditStarted auditEntry
+	if c.AuditPath != "" {
+		names := make([]string, 0, len(hosts))
+		for _, host := range hosts {
+			names = append(names, host.Name)
+		}
+		audit = newAuditLog(c.AuditPath)
+		auditStarted = newAuditEntry(auditStart, c.runKind(), cmd, c.User, names)
+		if err := audit.append(auditStarted); err != nil {
+			return ExitSetup, fmt.Errorf("%v, nothing was run", err)
+		}
+	}
+
+	runner := &Runner{
+		Command:    cmd,
+		Config:     sshConf,
+		Workers:    c.Workers,
+		MaxWorkers: c.MaxWorkers,
+		Options:    opts,
+		Resolve:    resolver.resolve,
+		BatchSize:  size,
+		Canaries:   canaries,
+		ContinueAfterCanaries: func(failed, canaries, remaining int) (bool, error) {
+			if prog != nil {
+				prog.clear()
+			}
+			c.Logger.Info(fmt.Sprintf("%d of %d canary hosts failed", failed, canaries))
+			return confirmCanary(failed, remaining, c.CanaryAuto)
+		},
+		StopOnBatchFailure: c.SerialAbort,
+		MaxFailures:        failureLimit(c.MaxFailures, c.MaxFailurePct, len(hosts)),
+		MaxRuntime:         c.MaxRuntime,
+		Logger:             c.Logger,
+		OnResult: func(res api.Result) {
+			if streamer != nil {
+				streamer.flush(res.Host)
+			}
+			if prog != nil {
+				prog.clear()
+				defer prog.update(res.Err != nil)
+			}
+			if state != nil {
+				if err := state.record(res, breaker.Failures(res.Host)); err != nil {
+					c.Logger.Error(fmt.Sprintf("unable to checkpoint %s: %v", res.Host, err))
+				}
+			}
+			if c.OutDir != "" && action != nil {
+				if err := writeHostFiles(c.OutDir, res); err != nil {
+					c.Logger.Error(fmt.Sprintf("unable to write output files for %s: %v", res.Host, err))
+				}
+			}
+			if c.SortBy == "" {
+				out.result(res)
+			}
+		},
+	}
+	summary, err := runner.Run(ctx, hosts)
+	if summary == nil {
+		return ExitSetup, fmt.Errorf("unable to parse flags: %v", err)
+	}
+	if err != nil {
+		c.Logger.Error(err.Error())
+	}
+	if prog != nil {
+		prog.finish()
+	}
+	if state != nil {
+		if err := state.Close(); err != nil {
+			c.Logger.Error(fmt.Sprintf("unable to close the state file: %v", err))
+		}
+	}
+	return c.report(cmd, hosts, summary, out, audit, auditStarted), nil
+}
+
+// report: report a finished run's results everywhere the config asks for, returning the exit status describing it.
+func (c *Config) report(
+	cmd string,
+	hosts []inventory.Host,
+	summary *Summary,
+	out outputter,
+	audit *auditLog,
+	auditStarted auditEntry,
+) int {
+	started, results := summary.Started, summary.Results
+	if c.SortBy != "" {
+		results = sortResults(results, c.SortBy, hosts)
+		for _, res := range results {
+			out.result(res)
+		}
+	}
+	if err := out.finish(started, results); err != nil {
+		c.Logger.Error(fmt.Sprintf("unable to write results: %v", err))
+	}
+
+	for _, r := range c.Reports {
+		if err := r.write(cmd, started, results); err != nil {
+			c.Logger.Error(fmt.Sprintf("unable to write %s report: %v", r.Kind, err))
+		}
+	}
+
+	failed := summary.Failed()
+	if audit != nil {
+		finished := auditStarted.finished(len(results)-len(failed), len(failed))
+		if err := audit.append(finished); err != nil {
+			c.Logger.Error(err.Error())
+		}
+	}
+	if c.FailedOut != "" {
+		if err := writeFailed(c.FailedOut, failed); err != nil {
+			c.Logger.Error(fmt.Sprintf("unable to write the failed hosts: %v", err))
+		} else if len(failed) > 0 {
+			c.Logger.Info(fmt.Sprintf(
+				"wrote %d failed hosts to %s, retry them with -retry-failed", len(failed), c.FailedOut,
+			))
+		}
+	}
+	c.sendNotifications(newRunSummary(c.runKind(), cmd, started, results))
+	if c.HistoryPath != "" {
+		id, err := recordHistory(c.HistoryPath, c.runKind(), cmd, started, results)
+		if err != nil {
+			c.Logger.Warn(fmt.Sprintf("unable to record the run in the history: %v", err))
+		} else {
+			c.Logger.Debug(fmt.Sprintf("recorded as run %d in %s", id, c.HistoryPath))
+		}
+	}
+
+	if c.Aggregate {
+		logGroups(c.Logger, results)
+	}
+	if c.Diff {
+		logOutliers(c.Logger, results)
+	}
+
+	if c.Summarize && len(failed) > 0 {
+		c.Logger.Info(fmt.Sprintf("failed hosts:\n%s", strings.Join(failed, "\n")))
+	}
+	return runExitCode(len(failed), len(results))
+}
+
+// runExitCode: the exit status describing a run where failed out of total hosts failed.
+func runExitCode(failed, total int) int {
+	switch {
+	case failed == 0:
+		return ExitOK
+	case failed == total:
+		return ExitAllFailed
+	default:
+		return ExitSomeFailed
+	}
+}
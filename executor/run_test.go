@@ -0,0 +1,189 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+)
+
+func TestSkipRecent(t *testing.T) {
+	needHistory(t)
+	inv := localInventory(t, "web1", "web2", "web3")
+	history := filepath.Join(t.TempDir(), "history.db")
+	// web1 ran the deploy long ago, so it is not skipped however the last run went
+	longAgo := []api.Result{{Host: "web1"}}
+	if _, err := recordHistory(history, "run", failWeb2, time.Now().Add(-2*time.Hour), longAgo); err != nil {
+		t.Fatalf("unable to record the old run: %v", err)
+	}
+	if _, err := recordHistory(history, "run", "true", time.Now().Add(-2*time.Hour), longAgo); err != nil {
+		t.Fatalf("unable to record the old run: %v", err)
+	}
+	// a copy is not the same as running a command, even one that looks like it
+	copied := []api.Result{{Host: "web1"}, {Host: "web2"}, {Host: "web3"}}
+	if _, err := recordHistory(history, SubcommandCopy, "echo copied", time.Now(), copied); err != nil {
+		t.Fatalf("unable to record the copy: %v", err)
+	}
+
+	steps := []struct {
+		name    string
+		c       Config
+		cmd     string
+		wantRan string
+	}{
+		{
+			name:    "nothing recent",
+			c:       Config{SkipRecent: time.Hour},
+			cmd:     failWeb2,
+			wantRan: "web1,web2,web3",
+		},
+		{
+			name:    "skip the hosts that succeeded",
+			c:       Config{SkipRecent: time.Hour},
+			cmd:     failWeb2,
+			wantRan: "web2",
+		},
+		{
+			name:    "window too short",
+			c:       Config{SkipRecent: time.Nanosecond},
+			cmd:     failWeb2,
+			wantRan: "web1,web2,web3",
+		},
+		{
+			name:    "force",
+			c:       Config{SkipRecent: time.Hour, Force: true},
+			cmd:     failWeb2,
+			wantRan: "web1,web2,web3",
+		},
+		{
+			name:    "another command",
+			c:       Config{SkipRecent: time.Hour},
+			cmd:     "true",
+			wantRan: "web1,web2,web3",
+		},
+		{
+			name:    "another kind",
+			c:       Config{SkipRecent: time.Hour},
+			cmd:     "echo copied",
+			wantRan: "web1,web2,web3",
+		},
+	}
+	for _, step := range steps {
+		c := step.c
+		c.HistoryPath = history
+		_, stdout := runLocal(t, c, inv, step.cmd)
+		ran := ranHosts(t, stdout)
+		if got := strings.Join(ran, ","); got != step.wantRan {
+			t.Errorf("%s: ran on %s, want %s", step.name, got, step.wantRan)
+		}
+	}
+}
+
+func TestExecuteExitCodes(t *testing.T) {
+	inv := localInventory(t, "web1", "web2", "web3")
+	tests := []struct {
+		name string
+		cmd  string
+		want int
+	}{
+		{name: "all succeeded", cmd: "true", want: ExitOK},
+		{name: "some failed", cmd: `test "$TEST_HOST" != web2`, want: ExitSomeFailed},
+		{name: "all failed", cmd: "false", want: ExitAllFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, _ := runLocal(t, Config{}, inv, tt.cmd); code != tt.want {
+				t.Errorf("got exit status %d, want %d", code, tt.want)
+			}
+		})
+	}
+
+	// nothing runs when the run cannot be set up
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "bad output", cfg: Config{HostList: inv, Output: "bogus"}},
+		{name: "missing host list", cfg: Config{HostList: filepath.Join(t.TempDir(), "missing.yaml")}},
+		{name: "bad batch size", cfg: Config{HostList: inv, Serial: "0"}},
+		{name: "unknown transport", cfg: Config{HostList: inv, Transport: "telnet"}},
+	} {
+		c := tt.cfg
+		c.Args = []string{"true"}
+		c.Logger = testLogger(t)
+		c.Workers = 1
+		if c.Transport == "" {
+			c.Transport = TransportLocal
+		}
+		if code, err := Execute(context.Background(), &c); code != ExitSetup || err == nil {
+			t.Errorf("%s: got exit status %d and error %v, want %d and an error", tt.name, code, err, ExitSetup)
+		}
+	}
+}
+
+func TestPipeStdin(t *testing.T) {
+	inv := localInventory(t, "web1", "web2", "web3")
+	// every host gets all of stdin, not whatever part of it is left
+	c := Config{PipeStdin: true, Stdin: strings.NewReader("line one\nline two\n")}
+	code, stdout := runLocal(t, c, inv, `echo "$TEST_HOST"; cat`)
+	if code != ExitOK {
+		t.Fatalf("got exit status %d, want %d", code, ExitOK)
+	}
+	var run jsonRun
+	if err := json.Unmarshal([]byte(stdout), &run); err != nil {
+		t.Fatalf("unable to decode run output %q: %v", stdout, err)
+	}
+	if len(run.Results) != 3 {
+		t.Fatalf("got %d results, want 3", len(run.Results))
+	}
+	for _, res := range run.Results {
+		if want := res.Host + "\nline one\nline two\n"; res.Stdout != want {
+			t.Errorf("%s: got output %q, want %q", res.Host, res.Stdout, want)
+		}
+	}
+
+	// without -stdin the command's stdin is left alone
+	c = Config{Stdin: strings.NewReader("unread\n")}
+	if _, stdout = runLocal(t, c, inv, "cat"); strings.Contains(stdout, "unread") {
+		t.Errorf("got stdin passed on without -stdin: %s", stdout)
+	}
+}
+
+func TestPipeStdinErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{
+			name:    "unreadable stdin",
+			cfg:     Config{Args: []string{"cat"}, Stdin: iotest.ErrReader(errors.New("broken pipe"))},
+			wantErr: "unable to read stdin: broken pipe",
+		},
+		{
+			name:    "with a script",
+			cfg:     Config{Script: "deploy.sh", Stdin: strings.NewReader("")},
+			wantErr: "-script and -stdin are mutually exclusive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.cfg
+			c.PipeStdin = true
+			c.HostList = localInventory(t, "web1")
+			c.Transport = TransportLocal
+			c.Logger = testLogger(t)
+			c.Workers = 1
+			code, err := Execute(context.Background(), &c)
+			if code != ExitSetup || err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got exit status %d and error %v, want %d and %q", code, err, ExitSetup, tt.wantErr)
+			}
+		})
+	}
+}
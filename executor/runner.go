@@ -0,0 +1,298 @@
+// Package executor runs a command across a fleet the way the remote-executor CLI does, so it can be embedded in other
+// programs instead of running the binary. The CLI turns its flags into a Runner and hosts into an inventory, and
+// renders the results, everything in between happens here.
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/utils/inventory"
+	"golang.org/x/crypto/ssh"
+)
+
+// Logger: receives progress messages about a run, *utils.SyncLogger is one
+type Logger interface {
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// nopLogger: the default Logger, discards everything
+type nopLogger struct{}
+
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// Runner: runs Command on every host of a run on a worker pool. Hosts can be rolled out in batches, after a set of
+// canary hosts, and stop being started once too many fail. Only Workers needs to be set.
+type Runner struct {
+	// Command is run on every host
+	Command string
+	// Config is the SSH client config used for hosts Resolve gives no config of their own
+	Config ssh.ClientConfig
+	// Workers is the number of hosts run at once, and MaxWorkers the number the pool may grow to when every worker
+	// is busy, zero to never grow
+	Workers    int
+	MaxWorkers int
+	// Options configure the worker pool, see api.CreatePool
+	Options []api.Option
+	// Resolve turns a host into the target to run against, nil runs against the host's address, or else its name, with
+	// its timeouts
+	Resolve func(host inventory.Host) (api.Target, error)
+	// BatchSize splits the hosts into batches started one after another, zero starts them all at once
+	BatchSize int
+	// Canaries is the number of hosts run on their own first, before the rest are started
+	Canaries int
+	// ContinueAfterCanaries decides whether to start the remaining hosts once the canary hosts are done, given how many
+	// of them failed, nil only carries on if none failed
+	ContinueAfterCanaries func(failed, canaries, remaining int) (bool, error)
+	// StopOnBatchFailure skips the remaining batches once a batch had a failed host
+	StopOnBatchFailure bool
+	// MaxFailures stops starting hosts once this many have failed, zero for no limit
+	MaxFailures int
+	// MaxRuntime cancels the hosts still running after this long, zero for no limit
+	MaxRuntime time.Duration
+	// Logger gets messages about batches, canaries, and limits being reached, nil discards them
+	Logger Logger
+	// OnResult is called with each host's result as soon as it is known, possibly from several goroutines at once
+	OnResult func(res api.Result)
+}
+
+// Summary: the outcome of a run
+type Summary struct {
+	Started time.Time
+	// Results has a result for every host, in the order they finished. Hosts that were not run have an
+	// api.ErrSkipped error.
+	Results []api.Result
+	// TimedOut is set if MaxRuntime was reached and unfinished hosts were cancelled
+	TimedOut bool
+}
+
+// Failed: the hosts whose result has an error.
+func (s *Summary) Failed() []string {
+	var hosts []string
+	for _, res := range s.Results {
+		if res.Err != nil {
+			hosts = append(hosts, res.Host)
+		}
+	}
+	return hosts
+}
+
+// run: the state of one call to Runner.Run
+type run struct {
+	*Runner
+	ctx  context.Context
+	pool *api.WorkerPool
+	log  Logger
+
+	mu      sync.Mutex
+	results []api.Result
+	failed  int
+
+	// stopReason is set once hosts still to be started are skipped
+	stopReason error
+	// slots holds a token for each host queued on the pool
+	slots chan struct{}
+}
+
+// Run: run the command on hosts, returning once every host has a result. The error is only set if the Runner is not
+// usable or the pool could not be shut down cleanly, failed hosts are reported in the Summary.
+func (r *Runner) Run(ctx context.Context, hosts []inventory.Host) (*Summary, error) {
+	if r.Workers <= 0 {
+		return nil, fmt.Errorf("invalid number of workers %d", r.Workers)
+	}
+	if r.MaxWorkers != 0 && r.MaxWorkers < r.Workers {
+		return nil, fmt.Errorf("max workers %d is below the %d workers", r.MaxWorkers, r.Workers)
+	}
+	if r.BatchSize < 0 || r.Canaries < 0 || r.MaxFailures < 0 {
+		return nil, errors.New("the batch size, canaries, and max failures must not be negative")
+	}
+
+	summary := &Summary{Started: time.Now()}
+	if r.MaxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.MaxRuntime)
+		defer cancel()
+	}
+	opts := append(append([]api.Option{}, r.Options...), api.WithMaxWorkers(r.MaxWorkers))
+	pool := api.CreatePool(r.Workers, r.Command, r.Config, opts...)
+	pool.ScheduleWorkers()
+
+	ru := &run{
+		Runner: r,
+		ctx:    ctx,
+		pool:   pool,
+		log:    r.Logger,
+		// queue no more hosts than there are workers so a failure limit stops hosts before they start
+		slots: make(chan struct{}, max(r.Workers, r.MaxWorkers)),
+	}
+	if ru.log == nil {
+		ru.log = nopLogger{}
+	}
+	ru.rollOut(hosts)
+
+	if ctx.Err() != nil && r.MaxRuntime > 0 {
+		summary.TimedOut = true
+		ru.log.Warn(fmt.Sprintf("max runtime of %s reached, unfinished hosts were cancelled", r.MaxRuntime))
+	}
+	summary.Results = ru.results
+	if err := pool.Shutdown(); err != nil {
+		return summary, fmt.Errorf("unable to shut down the worker pool: %v", err)
+	}
+	return summary, nil
+}
+
+// rollOut: run the hosts batch by batch, starting with the canaries.
+func (ru *run) rollOut(hosts []inventory.Host) {
+	canaries := min(ru.Canaries, len(hosts))
+	size := ru.BatchSize
+	if size == 0 {
+		size = len(hosts)
+	}
+	split := batches(hosts[canaries:], size)
+	if canaries > 0 {
+		split = append([][]inventory.Host{hosts[:canaries]}, split...)
+	}
+
+	for i, batch := range split {
+		if ru.stopReason != nil {
+			for _, host := range batch {
+				ru.record(api.Result{Host: host.Name, ExitCode: -1, Err: ru.stopReason})
+			}
+			continue
+		}
+		switch {
+		case i == 0 && canaries > 0:
+			ru.log.Info(fmt.Sprintf("starting with %d canary hosts", len(batch)))
+		case len(split) > 1:
+			ru.log.Info(fmt.Sprintf("starting batch %d of %d with %d hosts", i+1, len(split), len(batch)))
+		}
+		failedBefore := ru.failures()
+		ru.runBatch(batch)
+		if ru.stopReason != nil {
+			continue
+		}
+		failed := ru.failures() - failedBefore
+		if i == 0 && canaries > 0 && len(split) > 1 {
+			if !ru.continueAfterCanaries(failed, len(batch), len(hosts)-canaries) {
+				ru.stopReason = fmt.Errorf("%w: the canary hosts were not confirmed", api.ErrSkipped)
+				ru.log.Warn("not continuing past the canary hosts")
+				continue
+			}
+		}
+		if ru.StopOnBatchFailure && failed > 0 && i < len(split)-1 {
+			ru.stopReason = fmt.Errorf("%w: a host in batch %d failed", api.ErrSkipped, i+1)
+			ru.log.Warn(fmt.Sprintf("batch %d had failures, skipping the remaining batches", i+1))
+		}
+	}
+}
+
+// continueAfterCanaries: whether to start the remaining hosts.
+func (ru *run) continueAfterCanaries(failed, canaries, remaining int) bool {
+	if ru.ContinueAfterCanaries == nil {
+		return failed == 0
+	}
+	carryOn, err := ru.ContinueAfterCanaries(failed, canaries, remaining)
+	if err != nil {
+		ru.log.Error(fmt.Sprintf("unable to confirm the canary hosts: %v", err))
+		return false
+	}
+	return carryOn
+}
+
+// runBatch: run batch on the pool, returning once every host in it has a result.
+func (ru *run) runBatch(batch []inventory.Host) {
+	var wg sync.WaitGroup
+	for _, host := range batch {
+		ru.slots <- struct{}{}
+		if ru.stopReason == nil {
+			ru.stopReason = ru.checkFailures()
+		}
+		if ru.stopReason != nil {
+			<-ru.slots
+			ru.record(api.Result{Host: host.Name, ExitCode: -1, Err: ru.stopReason})
+			continue
+		}
+		target, err := ru.resolve(host)
+		if err != nil {
+			<-ru.slots
+			ru.record(api.Result{Host: host.Name, ExitCode: -1, Err: fmt.Errorf("unable to resolve host: %v", err)})
+			continue
+		}
+		wg.Add(1)
+		go func(t api.Target) {
+			defer wg.Done()
+			defer func() { <-ru.slots }()
+			res, err := ru.pool.RunTarget(ru.ctx, t)
+			if err != nil {
+				// the job never finished, most likely because the run was cancelled
+				res = api.Result{Host: t.Host, ExitCode: -1, Err: err}
+			}
+			ru.record(res)
+		}(target)
+	}
+	wg.Wait()
+}
+
+// resolve: the target for host.
+func (ru *run) resolve(host inventory.Host) (api.Target, error) {
+	if ru.Resolve != nil {
+		return ru.Resolve(host)
+	}
+	target := api.Target{Host: host.Name, Addr: host.Address, Env: host.Env, Timeout: host.Timeout}
+	if host.ConnectTimeout > 0 {
+		conf := ru.Config
+		conf.Timeout = host.ConnectTimeout
+		target.Config = &conf
+	}
+	return target, nil
+}
+
+// checkFailures: the reason to stop starting hosts once MaxFailures hosts have failed, nil until then.
+func (ru *run) checkFailures() error {
+	if failed := ru.failures(); ru.MaxFailures > 0 && failed >= ru.MaxFailures {
+		ru.log.Warn(fmt.Sprintf("%d hosts failed, not starting the remaining hosts", failed))
+		return fmt.Errorf("%w: %d hosts had already failed", api.ErrSkipped, failed)
+	}
+	return nil
+}
+
+// record: keep a host's result and hand it to OnResult.
+func (ru *run) record(res api.Result) {
+	ru.mu.Lock()
+	ru.results = append(ru.results, res)
+	if res.Err != nil {
+		ru.failed++
+	}
+	ru.mu.Unlock()
+	if ru.OnResult != nil {
+		ru.OnResult(res)
+	}
+}
+
+// failures: the number of hosts that failed so far.
+func (ru *run) failures() int {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+	return ru.failed
+}
+
+// batches: split hosts into consecutive batches of size hosts, the last may be smaller.
+func batches(hosts []inventory.Host, size int) [][]inventory.Host {
+	var split [][]inventory.Host
+	for size > 0 && len(hosts) > 0 {
+		if size > len(hosts) {
+			size = len(hosts)
+		}
+		split = append(split, hosts[:size])
+		hosts = hosts[size:]
+	}
+	return split
+}
@@ -0,0 +1,608 @@
+package executor
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/utils"
+	"github.com/basilnsage/remote-executor/utils/inventory"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxJobs: finished jobs beyond this many are forgotten, oldest first
+const maxJobs = 1000
+
+// maxJobRequest: the largest POST /jobs body accepted
+const maxJobRequest = 1 << 20
+
+// maxLiveOutput: how much of the latest output of each running host is kept for the dashboard to tail
+const maxLiveOutput = 16 * 1024
+
+// jobRequest: the body of POST /jobs
+type jobRequest struct {
+	// Hosts are host list entries, expanded like -H
+	Hosts   []string `json:"hosts"`
+	Command string   `json:"command"`
+	// Timeout is a duration like 30s, the -timeout flag applies if it is empty
+	Timeout string `json:"timeout"`
+	// Concurrency defaults to the -concurrency flag and may not exceed -concurrency or -max-concurrency
+	Concurrency int               `json:"concurrency"`
+	Env         map[string]string `json:"env"`
+}
+
+// Job states reported by the API
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCancelled = "cancelled"
+)
+
+// job: a command submitted to the daemon and the results of the hosts that have finished
+type job struct {
+	id      string
+	command string
+	hosts   int
+	names   []string
+	started time.Time
+	cancel  context.CancelFunc
+	// audit is the job's start entry in the audit log
+	audit auditEntry
+
+	mu      sync.Mutex
+	results []api.Result
+	// live is the latest output of each host still running
+	live      map[string][]byte
+	state     string
+	finished  time.Time
+	cancelled bool
+	// updated is closed and replaced whenever a result arrives or the job finishes
+	updated chan struct{}
+}
+
+// jobStatus: a job as the API reports it
+type jobStatus struct {
+	ID        string       `json:"id"`
+	Command   string       `json:"command"`
+	State     string       `json:"state"`
+	Hosts     int          `json:"hosts"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Started   time.Time    `json:"started"`
+	Finished  *time.Time   `json:"finished,omitempty"`
+	Results   []jsonResult `json:"results,omitempty"`
+	// Pending are the hosts without a result yet
+	Pending []string `json:"pending,omitempty"`
+}
+
+func (j *job) record(res api.Result) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.results = append(j.results, res)
+	delete(j.live, res.Host)
+	close(j.updated)
+	j.updated = make(chan struct{})
+}
+
+func (j *job) finish() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.state = jobDone
+	if j.cancelled {
+		j.state = jobCancelled
+	}
+	j.finished = time.Now()
+	close(j.updated)
+	j.updated = make(chan struct{})
+}
+
+// tap: keep the latest output of a running host, an api.OutputTap.
+func (j *job) tap(host string, _ bool, data []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	out := append(j.live[host], data...)
+	if len(out) > maxLiveOutput {
+		out = append([]byte{}, out[len(out)-maxLiveOutput:]...)
+	}
+	j.live[host] = out
+}
+
+// liveOutput: the latest output of every host still running.
+func (j *job) liveOutput() map[string]string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	live := make(map[string]string, len(j.live))
+	for host, out := range j.live {
+		live[host] = string(out)
+	}
+	return live
+}
+
+// stop: cancel the job, its state becomes cancelled once the hosts still running are interrupted.
+func (j *job) stop() {
+	j.mu.Lock()
+	j.cancelled = true
+	j.mu.Unlock()
+	j.cancel()
+}
+
+// status: the job's progress, with every result so far if withResults is set.
+func (j *job) status(withResults bool) jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st := jobStatus{ID: j.id, Command: j.command, State: j.state, Hosts: j.hosts, Started: j.started}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		st.Finished = &finished
+	}
+	done := make(map[string]bool, len(j.results))
+	for _, res := range j.results {
+		done[res.Host] = true
+		if res.Err != nil {
+			st.Failed++
+		} else {
+			st.Succeeded++
+		}
+		if withResults {
+			st.Results = append(st.Results, newJSONResult(res))
+		}
+	}
+	if withResults {
+		for _, name := range j.names {
+			if !done[name] {
+				st.Pending = append(st.Pending, name)
+			}
+		}
+	}
+	return st
+}
+
+// since: the results after the first n, whether the job is over, and a channel closed when there is more to see.
+func (j *job) since(n int) ([]api.Result, bool, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]api.Result{}, j.results[n:]...), j.state != jobRunning, j.updated
+}
+
+// jobServer: runs submitted jobs with the daemon's SSH settings and serves their status
+type jobServer struct {
+	cfg      *Config
+	logger   *utils.SyncLogger
+	resolver *targetResolver
+	sshConf  ssh.ClientConfig
+	hops     []api.Hop
+	opts     []api.Option
+	// history records finished jobs if it is set
+	history *history
+	// audit logs every job if it is set
+	audit *auditLog
+
+	mu    sync.Mutex
+	jobs  map[string]*job
+	order []string
+	next  int
+}
+
+func newJobServer(
+	c *Config,
+	resolver *targetResolver,
+	sshConf ssh.ClientConfig,
+	hops []api.Hop,
+	opts []api.Option,
+	h *history,
+	audit *auditLog,
+) *jobServer {
+	return &jobServer{
+		cfg:      c,
+		logger:   c.Logger,
+		resolver: resolver,
+		sshConf:  sshConf,
+		hops:     hops,
+		opts:     opts,
+		history:  h,
+		audit:    audit,
+		jobs:     make(map[string]*job),
+	}
+}
+
+// ServeHTTP: route the job API.
+//
+//	POST   /jobs               submit a job, returns its status
+//	GET    /jobs               every job's status
+//	GET    /jobs/ID            a job's status and results so far
+//	GET    /jobs/ID/results    stream a job's results as newline delimited JSON until it is over
+//	GET    /jobs/ID/output     the latest output of each host still running
+//	DELETE /jobs/ID            cancel a job
+func (s *jobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.authorize(w, r) {
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "jobs" && r.Method == http.MethodPost:
+		s.submit(w, r)
+	case path == "jobs" && r.Method == http.MethodGet:
+		s.list(w)
+	case len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodGet:
+		s.withJob(w, parts[1], func(j *job) { writeJSON(w, http.StatusOK, j.status(true)) })
+	case len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodDelete:
+		s.withJob(w, parts[1], func(j *job) {
+			j.stop()
+			writeJSON(w, http.StatusAccepted, j.status(false))
+		})
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "results" && r.Method == http.MethodGet:
+		s.withJob(w, parts[1], func(j *job) { s.stream(w, r, j) })
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "output" && r.Method == http.MethodGet:
+		s.withJob(w, parts[1], func(j *job) { writeJSON(w, http.StatusOK, j.liveOutput()) })
+	case path == "jobs" || (len(parts) >= 2 && parts[0] == "jobs"):
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed on /%s", r.Method, path))
+	default:
+		httpError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: /%s", path))
+	}
+}
+
+// authorize: whether r carries the Token bearer token, answering 401 if it does not. Every request is authorized when
+// there is no token.
+func (c *Config) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if c.Token == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) != 1 {
+		httpError(w, http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+		return false
+	}
+	return true
+}
+
+// requireToken: h, serving only requests that carry the Token bearer token.
+func (c *Config) requireToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.authorize(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (s *jobServer) withJob(w http.ResponseWriter, id string, f func(*job)) {
+	j, ok := s.lookup(id)
+	if !ok {
+		httpError(w, http.StatusNotFound, fmt.Errorf("no such job: %s", id))
+		return
+	}
+	f(j)
+}
+
+// submit: start running the job in the request body.
+func (s *jobServer) submit(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJobRequest))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("invalid job: larger than %d bytes", tooLarge.Limit))
+			return
+		}
+		httpError(w, http.StatusBadRequest, fmt.Errorf("invalid job: %v", err))
+		return
+	}
+	j, err := s.start(req)
+	if errors.Is(err, errAudit) {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+j.id)
+	writeJSON(w, http.StatusAccepted, j.status(false))
+}
+
+// start: validate a job request and start running it.
+func (s *jobServer) start(req jobRequest) (*job, error) {
+	if strings.TrimSpace(req.Command) == "" {
+		return nil, errors.New("invalid job: no command")
+	}
+	timeout := s.cfg.Timeout
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(req.Timeout); err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid job: bad timeout %q", req.Timeout)
+		}
+	}
+	concurrency := req.Concurrency
+	if concurrency == 0 {
+		concurrency = s.cfg.Workers
+	}
+	if concurrency < 0 {
+		return nil, fmt.Errorf("invalid job: bad concurrency %d", concurrency)
+	}
+	if limit := s.maxConcurrency(); concurrency > limit {
+		return nil, fmt.Errorf("invalid job: concurrency %d is over the limit of %d", concurrency, limit)
+	}
+	entries, err := s.cfg.expandEntries(req.Hosts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid job: %v", err)
+	}
+	inv, dropped := inventory.FromNames(entries).Validate(s.cfg.DefaultPort)
+	if len(dropped) > 0 {
+		return nil, fmt.Errorf("invalid job: host %q: %s", dropped[0].Host, dropped[0].Reason)
+	}
+	if len(inv.Hosts) == 0 {
+		return nil, errors.New("invalid job: no hosts")
+	}
+
+	env := make(map[string]string)
+	for name, value := range s.cfg.Env {
+		env[name] = value
+	}
+	for name, value := range req.Env {
+		env[name] = value
+	}
+	cmd := api.WrapShell(s.cfg.Shell, api.InDir(s.cfg.Chdir, req.Command))
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		command: req.Command,
+		hosts:   len(inv.Hosts),
+		started: time.Now(),
+		cancel:  cancel,
+		live:    make(map[string][]byte),
+		state:   jobRunning,
+		updated: make(chan struct{}),
+	}
+	for _, host := range inv.Hosts {
+		j.names = append(j.names, host.Name)
+	}
+	opts := append([]api.Option{
+		api.WithJumpChain(s.hops),
+		api.WithTimeout(timeout),
+		api.WithLogger(s.logger),
+		api.WithEnv(env),
+		api.WithOutputTap(j.tap),
+	}, s.opts...)
+	pool := api.CreatePool(concurrency, cmd, s.sshConf, opts...)
+	j.id = s.newID()
+	if s.audit != nil {
+		j.audit = newAuditEntry(auditStart, SubcommandServe, j.command, s.cfg.User, j.names)
+		j.audit.Job = j.id
+		if err := s.audit.append(j.audit); err != nil {
+			cancel()
+			s.logger.Error(fmt.Sprintf("job %s: %v, not running it", j.id, err), "job", j.id)
+			return nil, err
+		}
+	}
+	s.add(j)
+	s.logger.Info(fmt.Sprintf("job %s: running %q on %d hosts", j.id, j.command, j.hosts), "job", j.id)
+	go s.run(ctx, j, pool, inv.Hosts)
+	return j, nil
+}
+
+// maxConcurrency: the most workers a job may ask for, the -max-concurrency the pools may grow to or else
+// -concurrency.
+func (s *jobServer) maxConcurrency() int {
+	if s.cfg.MaxWorkers > s.cfg.Workers {
+		return s.cfg.MaxWorkers
+	}
+	return s.cfg.Workers
+}
+
+// lookup: the job with id, if it is still remembered.
+func (s *jobServer) lookup(id string) (*job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+// all: every remembered job, oldest first.
+func (s *jobServer) all() []*job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]*job, 0, len(s.order))
+	for _, id := range s.order {
+		jobs = append(jobs, s.jobs[id])
+	}
+	return jobs
+}
+
+// newID: the id of the next job.
+func (s *jobServer) newID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	return strconv.Itoa(s.next)
+}
+
+// add: keep j, forgetting the oldest finished jobs once there are too many.
+func (s *jobServer) add(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.id] = j
+	s.order = append(s.order, j.id)
+	for i := 0; len(s.order) > maxJobs && i < len(s.order); {
+		old := s.jobs[s.order[i]]
+		if old.status(false).State == jobRunning {
+			i++
+			continue
+		}
+		delete(s.jobs, old.id)
+		s.order = append(s.order[:i], s.order[i+1:]...)
+	}
+}
+
+// run: run the job's command on every host, then stop its pool.
+func (s *jobServer) run(ctx context.Context, j *job, pool *api.WorkerPool, hosts []inventory.Host) {
+	defer j.cancel()
+	pool.ScheduleWorkers()
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		target, err := s.resolver.resolve(host)
+		if err != nil {
+			j.record(api.Result{Host: host.Name, ExitCode: -1, Err: fmt.Errorf("unable to resolve host: %v", err)})
+			continue
+		}
+		wg.Add(1)
+		go func(t api.Target) {
+			defer wg.Done()
+			res, err := pool.RunTarget(ctx, t)
+			if err != nil {
+				res = api.Result{Host: t.Host, ExitCode: -1, Err: err}
+			}
+			j.record(res)
+		}(target)
+	}
+	wg.Wait()
+	j.finish()
+	st := j.status(false)
+	s.logger.Info(
+		fmt.Sprintf("job %s %s: %d succeeded, %d failed", j.id, st.State, st.Succeeded, st.Failed),
+		"job", j.id,
+	)
+	if s.audit != nil {
+		if err := s.audit.append(j.audit.finished(st.Succeeded, st.Failed)); err != nil {
+			s.logger.Error(fmt.Sprintf("job %s: %v", j.id, err), "job", j.id)
+		}
+	}
+	results, _, _ := j.since(0)
+	summary := newRunSummary(SubcommandServe, j.command, j.started, results)
+	summary.Job = j.id
+	s.cfg.sendNotifications(summary, "job", j.id)
+	if s.history != nil {
+		if id, err := s.history.record(SubcommandServe, j.command, j.started, results); err != nil {
+			s.logger.Warn(fmt.Sprintf("job %s: unable to record the job in the history: %v", j.id, err), "job", j.id)
+		} else {
+			s.logger.Debug(fmt.Sprintf("job %s: recorded as run %d", j.id, id), "job", j.id)
+		}
+	}
+	// workers of a cancelled job may still be stuck connecting, the job is over either way
+	if err := pool.Shutdown(); err != nil {
+		s.logger.Warn(fmt.Sprintf("job %s: unable to close connections: %v", j.id, err), "job", j.id)
+	}
+}
+
+// list: every job's status, oldest first.
+func (s *jobServer) list(w http.ResponseWriter) {
+	jobs := s.all()
+	statuses := make([]jobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		statuses = append(statuses, j.status(false))
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// stream: write each of the job's results as a JSON line as soon as it is in, until the job is over or the client
+// goes away.
+func (s *jobServer) stream(w http.ResponseWriter, r *http.Request, j *job) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	seen := 0
+	for {
+		results, over, updated := j.since(seen)
+		for _, res := range results {
+			if err := enc.Encode(newJSONResult(res)); err != nil {
+				return
+			}
+		}
+		seen += len(results)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if over {
+			return
+		}
+		select {
+		case <-updated:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// serveMux: the routes of the HTTP job API, every one of them behind the bearer token.
+func (c *Config) serveMux(jobs *jobServer, metrics *api.Metrics) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/jobs", jobs)
+	mux.Handle("/jobs/", jobs)
+	mux.Handle("/metrics", c.requireToken(metrics))
+	mux.Handle("/", c.requireToken(http.HandlerFunc(serveDashboard)))
+	return mux
+}
+
+// serve: the serve subcommand, run the job API until a listener fails.
+func (c *Config) serve() error {
+	if len(c.Args) > 0 {
+		return fmt.Errorf("unable to parse flags: serve takes jobs over HTTP, not a command, got %q", c.Args)
+	}
+	resolver, sshConf, err := c.newResolver()
+	if err != nil {
+		return err
+	}
+	var hops []api.Hop
+	if c.Jump != "" {
+		if hops, err = resolver.jumpChain(c.Jump); err != nil {
+			return fmt.Errorf("unable to parse flags: %v", err)
+		}
+	}
+	metrics := api.NewMetrics()
+	opts := append(c.poolOptions(), api.WithMetrics(metrics), api.WithMaxWorkers(c.MaxWorkers))
+	if c.BreakerFailures > 0 {
+		// shared by every job, so a host that keeps failing is quarantined across them
+		opts = append(opts, api.WithCircuitBreaker(api.NewCircuitBreaker(c.BreakerFailures, c.BreakerCooldown)))
+	}
+	if c.ReuseConnections {
+		// shared by every job, so later jobs against a host run on the connection an earlier one opened
+		conns := api.NewConnectionCache()
+		defer func() { _ = conns.Close() }()
+		opts = append(opts, api.WithConnectionCache(conns))
+	}
+
+	var h *history
+	if c.HistoryPath != "" {
+		if h, err = openHistory(c.HistoryPath); err != nil {
+			c.Logger.Warn(fmt.Sprintf("unable to open the history, jobs will not be recorded: %v", err))
+		}
+	}
+
+	var audit *auditLog
+	if c.AuditPath != "" {
+		audit = newAuditLog(c.AuditPath)
+	}
+	jobs := newJobServer(c, resolver, sshConf, hops, opts, h, audit)
+	mux := c.serveMux(jobs, metrics)
+	errc := make(chan error, 2)
+	if c.GRPCListen != "" {
+		go func() {
+			c.Logger.Info(fmt.Sprintf("serving the gRPC job API on %s", c.GRPCListen))
+			errc <- fmt.Errorf("gRPC job API stopped: %v", serveGRPC(c.GRPCListen, jobs))
+		}()
+	}
+	go func() {
+		c.Logger.Info(fmt.Sprintf("serving the job API on http://%s/jobs and the dashboard on http://%[1]s/", c.Listen))
+		errc <- fmt.Errorf("job API stopped: %v", http.ListenAndServe(c.Listen, mux))
+	}()
+	return <-errc
+}
@@ -0,0 +1,386 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestJobServer: a job server for c running its jobs over ssh, with a quiet logger if c has none.
+func newTestJobServer(t *testing.T, c *Config) *jobServer {
+	t.Helper()
+	if c.Logger == nil {
+		c.Logger = testLogger(t)
+	}
+	if c.Transport == "" {
+		c.Transport = TransportSSH
+	}
+	if c.DefaultPort == 0 {
+		c.DefaultPort = 22
+	}
+	if c.Workers == 0 {
+		c.Workers = 4
+	}
+	sshConf := ssh.ClientConfig{
+		User:            "root",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         time.Second,
+	}
+	resolver := newTargetResolver(c, &utils.SSHConfigFile{}, utils.AuthConfig{}, sshConf)
+	return newJobServer(c, resolver, sshConf, nil, c.poolOptions(), nil, nil)
+}
+
+// submitJob: POST req to the job API at url, returning the submitted job's status.
+func submitJob(t *testing.T, url, token string, req jobRequest) (int, jobStatus) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Errorf("unable to encode job: %v", err)
+		return 0, jobStatus{}
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, url+"/jobs", bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("unable to build request: %v", err)
+		return 0, jobStatus{}
+	}
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Errorf("unable to submit job: %v", err)
+		return 0, jobStatus{}
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var st jobStatus
+	_ = json.NewDecoder(resp.Body).Decode(&st)
+	return resp.StatusCode, st
+}
+
+// waitJob: wait until the job with id is over, returning the results streamed for it.
+func waitJob(t *testing.T, url, id string) []jsonResult {
+	resp, err := http.Get(url + "/jobs/" + id + "/results")
+	if err != nil {
+		t.Errorf("unable to stream results of job %s: %v", id, err)
+		return nil
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var results []jsonResult
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var res jsonResult
+		if err := dec.Decode(&res); err == io.EOF {
+			return results
+		} else if err != nil {
+			t.Errorf("unable to decode result of job %s: %v", id, err)
+			return results
+		}
+		results = append(results, res)
+	}
+}
+
+// TestJobServerConcurrentJobs: jobs submitted at the same time resolve their hosts at the same time, which must not
+// race on the resolver's cached client configs. Run with -race.
+func TestJobServerConcurrentJobs(t *testing.T) {
+	srv := httptest.NewServer(newTestJobServer(t, &Config{}))
+	defer srv.Close()
+
+	const jobs, hosts = 2, 20
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// per-host users make the resolver build and cache a client config for each host, nothing listens on
+			// port 1 so every host fails straight away
+			var names []string
+			for j := 0; j < hosts; j++ {
+				names = append(names, fmt.Sprintf("user%d-%d@127.0.0.1:1", i, j))
+			}
+			code, st := submitJob(t, srv.URL, "", jobRequest{Hosts: names, Command: "true"})
+			if code != http.StatusAccepted {
+				t.Errorf("job %d: got status %d, want %d", i, code, http.StatusAccepted)
+				return
+			}
+			if results := waitJob(t, srv.URL, st.ID); len(results) != hosts {
+				t.Errorf("job %d: got %d results, want %d", i, len(results), hosts)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// request: send a request without a body to url, returning the response's status and body.
+func request(t *testing.T, method, url, token string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("unable to build request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to send request: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response: %v", err)
+	}
+	return resp.StatusCode, body
+}
+
+// jobState: the status of the job with id.
+func jobState(t *testing.T, url, token, id string) jobStatus {
+	t.Helper()
+	code, body := request(t, http.MethodGet, url+"/jobs/"+id, token)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d for job %s: %s", code, id, body)
+	}
+	var st jobStatus
+	if err := json.Unmarshal(body, &st); err != nil {
+		t.Fatalf("unable to decode job %s: %v", id, err)
+	}
+	return st
+}
+
+func TestJobServerRun(t *testing.T) {
+	srv := httptest.NewServer(newTestJobServer(t, &Config{Transport: TransportLocal}))
+	defer srv.Close()
+
+	code, st := submitJob(t, srv.URL, "", jobRequest{
+		Hosts:   []string{"web1", "web2"},
+		Command: `echo "$GREETING"; test "$GREETING" = hello`,
+		Env:     map[string]string{"GREETING": "hello"},
+	})
+	if code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", code, http.StatusAccepted)
+	}
+	if st.ID == "" || st.State != jobRunning || st.Hosts != 2 {
+		t.Errorf("got submitted job %+v, want a running job on 2 hosts", st)
+	}
+	results := waitJob(t, srv.URL, st.ID)
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, res := range results {
+		if res.ErrorClass != "ok" || res.Stdout != "hello\n" {
+			t.Errorf("got result %+v, want hello", res)
+		}
+	}
+
+	st = jobState(t, srv.URL, "", st.ID)
+	if st.State != jobDone || st.Succeeded != 2 || st.Failed != 0 || st.Finished == nil {
+		t.Errorf("got job %+v once its results were streamed, want it done with 2 hosts succeeded", st)
+	}
+	if len(st.Results) != 2 || len(st.Pending) != 0 {
+		t.Errorf("got %d results and pending hosts %v, want 2 results and none pending", len(st.Results), st.Pending)
+	}
+
+	code, body := request(t, http.MethodGet, srv.URL+"/jobs", "")
+	var jobs []jobStatus
+	if err := json.Unmarshal(body, &jobs); code != http.StatusOK || err != nil {
+		t.Fatalf("got status %d and %q listing jobs", code, body)
+	}
+	if len(jobs) != 1 || jobs[0].ID != st.ID {
+		t.Errorf("got jobs %+v, want only job %s", jobs, st.ID)
+	}
+}
+
+func TestJobServerCancel(t *testing.T) {
+	srv := httptest.NewServer(newTestJobServer(t, &Config{Transport: TransportLocal}))
+	defer srv.Close()
+
+	code, st := submitJob(t, srv.URL, "", jobRequest{Hosts: []string{"web1"}, Command: "sleep 30"})
+	if code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", code, http.StatusAccepted)
+	}
+	if code, body := request(t, http.MethodDelete, srv.URL+"/jobs/"+st.ID, ""); code != http.StatusAccepted {
+		t.Fatalf("got status %d cancelling the job: %s", code, body)
+	}
+	start := time.Now()
+	results := waitJob(t, srv.URL, st.ID)
+	if took := time.Since(start); took > 10*time.Second {
+		t.Errorf("the job took %v to stop", took)
+	}
+	if len(results) != 1 || results[0].ErrorClass != "cancelled" {
+		t.Errorf("got results %+v, want web1 cancelled", results)
+	}
+	if st = jobState(t, srv.URL, "", st.ID); st.State != jobCancelled {
+		t.Errorf("got state %q, want %q", st.State, jobCancelled)
+	}
+}
+
+func TestJobServerBadRequests(t *testing.T) {
+	srv := httptest.NewServer(newTestJobServer(t, &Config{Transport: TransportLocal}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name string
+		body string
+	}{
+		{name: "not json", body: "uptime"},
+		{name: "unknown field", body: `{"hosts":["web1"],"command":"uptime","user":"root"}`},
+		{name: "no command", body: `{"hosts":["web1"],"command":" "}`},
+		{name: "no hosts", body: `{"command":"uptime"}`},
+		{name: "bad timeout", body: `{"hosts":["web1"],"command":"uptime","timeout":"soon"}`},
+		{name: "bad concurrency", body: `{"hosts":["web1"],"command":"uptime","concurrency":-1}`},
+		{name: "concurrency over the limit", body: `{"hosts":["web1"],"command":"uptime","concurrency":5}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(srv.URL+"/jobs", "application/json", bytes.NewReader([]byte(tt.body)))
+			if err != nil {
+				t.Fatalf("unable to submit job: %v", err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+
+	tooLarge := `{"hosts":["web1"],"command":"` + strings.Repeat("x", maxJobRequest) + `"}`
+	resp, err := http.Post(srv.URL+"/jobs", "application/json", strings.NewReader(tooLarge))
+	if err != nil {
+		t.Fatalf("unable to submit job: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d for a body over the limit, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/jobs/42", http.StatusNotFound},
+		{http.MethodDelete, "/jobs/42", http.StatusNotFound},
+		{http.MethodGet, "/jobs/42/results", http.StatusNotFound},
+		{http.MethodPut, "/jobs", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/jobs/42", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/nothing", http.StatusNotFound},
+	} {
+		if code, _ := request(t, tt.method, srv.URL+tt.path, ""); code != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, code, tt.want)
+		}
+	}
+}
+
+func TestJobServerToken(t *testing.T) {
+	srv := httptest.NewServer(newTestJobServer(t, &Config{Transport: TransportLocal, Token: "s3cret"}))
+	defer srv.Close()
+
+	for _, token := range []string{"", "wrong", "s3cret-and-more"} {
+		code, _ := submitJob(t, srv.URL, token, jobRequest{Hosts: []string{"web1"}, Command: "true"})
+		if code != http.StatusUnauthorized {
+			t.Errorf("submitting with token %q: got status %d, want %d", token, code, http.StatusUnauthorized)
+		}
+		if code, _ := request(t, http.MethodGet, srv.URL+"/jobs", token); code != http.StatusUnauthorized {
+			t.Errorf("listing with token %q: got status %d, want %d", token, code, http.StatusUnauthorized)
+		}
+	}
+
+	code, st := submitJob(t, srv.URL, "s3cret", jobRequest{Hosts: []string{"web1"}, Command: "true"})
+	if code != http.StatusAccepted {
+		t.Fatalf("got status %d with the right token, want %d", code, http.StatusAccepted)
+	}
+	code, body := request(t, http.MethodGet, srv.URL+"/jobs", "s3cret")
+	var jobs []jobStatus
+	if err := json.Unmarshal(body, &jobs); code != http.StatusOK || err != nil {
+		t.Fatalf("got status %d and %q listing jobs", code, body)
+	}
+	if len(jobs) != 1 || jobs[0].ID != st.ID {
+		t.Errorf("got jobs %+v, want only the job submitted with the right token", jobs)
+	}
+}
+
+// TestJobServerMaxConcurrency: jobs may ask for up to -max-concurrency workers when it is above -concurrency.
+func TestJobServerMaxConcurrency(t *testing.T) {
+	srv := httptest.NewServer(newTestJobServer(t, &Config{Transport: TransportLocal, Workers: 2, MaxWorkers: 8}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		concurrency int
+		want        int
+	}{
+		{concurrency: 8, want: http.StatusAccepted},
+		{concurrency: 9, want: http.StatusBadRequest},
+	} {
+		req := jobRequest{Hosts: []string{"web1"}, Command: "true", Concurrency: tt.concurrency}
+		code, st := submitJob(t, srv.URL, "", req)
+		if code != tt.want {
+			t.Errorf("concurrency %d: got status %d, want %d", tt.concurrency, code, tt.want)
+		}
+		if code == http.StatusAccepted {
+			waitJob(t, srv.URL, st.ID)
+		}
+	}
+}
+
+// TestJobServerCommandOptions: jobs run their command with the daemon's -chdir, -shell, -ok-exit-codes, and -expect-*
+// flags, like a run does.
+func TestJobServerCommandOptions(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name      string
+		cfg       Config
+		command   string
+		wantClass string
+		wantOut   string
+	}{
+		{name: "chdir", cfg: Config{Chdir: dir}, command: "pwd", wantClass: "ok", wantOut: dir + "\n"},
+		{name: "shell", cfg: Config{Shell: "sh -c"}, command: "echo $0", wantClass: "ok", wantOut: "sh\n"},
+		{name: "ok exit codes", cfg: Config{OKExitCodes: []int{0, 3}}, command: "exit 3", wantClass: "ok"},
+		{
+			name:      "expect exact",
+			cfg:       Config{Expect: api.Expectation{Exact: "ready"}},
+			command:   "echo starting",
+			wantClass: "unexpected-output",
+			wantOut:   "starting\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Transport = TransportLocal
+			srv := httptest.NewServer(newTestJobServer(t, &cfg))
+			defer srv.Close()
+
+			code, st := submitJob(t, srv.URL, "", jobRequest{Hosts: []string{"web1"}, Command: tt.command})
+			if code != http.StatusAccepted {
+				t.Fatalf("got status %d, want %d", code, http.StatusAccepted)
+			}
+			results := waitJob(t, srv.URL, st.ID)
+			if len(results) != 1 || results[0].ErrorClass != tt.wantClass || results[0].Stdout != tt.wantOut {
+				t.Errorf("got results %+v, want %s with output %q", results, tt.wantClass, tt.wantOut)
+			}
+		})
+	}
+}
+
+// TestServeMuxToken: the dashboard and metrics need the bearer token just like the job API.
+func TestServeMuxToken(t *testing.T) {
+	c := &Config{Transport: TransportLocal, Token: "s3cret"}
+	srv := httptest.NewServer(c.serveMux(newTestJobServer(t, c), api.NewMetrics()))
+	defer srv.Close()
+
+	for _, path := range []string{"/", "/metrics", "/jobs"} {
+		if code, _ := request(t, http.MethodGet, srv.URL+path, ""); code != http.StatusUnauthorized {
+			t.Errorf("GET %s without the token: got status %d, want %d", path, code, http.StatusUnauthorized)
+		}
+		if code, _ := request(t, http.MethodGet, srv.URL+path, "s3cret"); code != http.StatusOK {
+			t.Errorf("GET %s with the token: got status %d, want %d", path, code, http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build cgo
+
+package executor
+
+import _ "github.com/mattn/go-sqlite3"
+
+// HistorySupported: whether this build can keep the SQLite history, the driver needs cgo.
+const HistorySupported = true
@@ -0,0 +1,6 @@
+//go:build !cgo
+
+package executor
+
+// HistorySupported: whether this build can keep the SQLite history, the driver needs cgo.
+const HistorySupported = false
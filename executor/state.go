@@ -0,0 +1,137 @@
+package executor
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/basilnsage/remote-executor/api"
+)
+
+// stateHeader: the first line of a --state file, naming the run it checkpoints
+type stateHeader struct {
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+}
+
+// stateRecord: a line of a --state file for each host once it is done
+type stateRecord struct {
+	Host     string `json:"host"`
+	OK       bool   `json:"ok"`
+	ExitCode int    `json:"exit_code"`
+	Failures int    `json:"failures,omitempty"`
+}
+
+// runState: the --state file hosts are checkpointed to as they finish, so an interrupted run can be resumed
+type runState struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// newRunState: start a new --state file at path for a run of command, replacing any earlier one.
+func newRunState(path, command string) (*runState, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &runState{f: f}
+	if err := s.write(stateHeader{Command: command, Started: time.Now()}); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// resumeRunState: reopen the --state file at path to carry on checkpointing to it, along with the last record of
+// every host already done. The file must checkpoint a run of the same command.
+func resumeRunState(path, command string) (*runState, map[string]stateRecord, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, err := readRunState(f, command)
+	if err == nil {
+		err = endLine(f)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &runState{f: f}, records, nil
+}
+
+// endLine: terminate a broken last line of f, so records appended to it start on a line of their own.
+func endLine(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		_, err = f.Write([]byte{'\n'})
+	}
+	return err
+}
+
+// readRunState: the last record of every host in a state file.
+func readRunState(f *os.File, command string) (map[string]stateRecord, error) {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("not a state file, it is empty")
+	}
+	var header stateHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, fmt.Errorf("not a state file: %v", err)
+	}
+	if header.Command != command {
+		return nil, fmt.Errorf("checkpoints a run of %q, not %q", header.Command, command)
+	}
+
+	records := make(map[string]stateRecord)
+	for scanner.Scan() {
+		var rec stateRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// a broken line is from a run killed halfway through writing it, its host is simply run again
+			continue
+		}
+		records[rec.Host] = rec
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// record: checkpoint res, along with the host's failures in a row so far for -breaker-failures, synced to disk so it
+// survives a crash or power loss.
+func (s *runState) record(res api.Result, failures int) error {
+	return s.write(stateRecord{Host: res.Host, OK: res.Err == nil, ExitCode: res.ExitCode, Failures: failures})
+}
+
+func (s *runState) write(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *runState) Close() error {
+	return s.f.Close()
+}
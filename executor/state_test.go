@@ -0,0 +1,138 @@
+package executor
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/utils"
+)
+
+// testLogger: a logger that drops everything below errors.
+func testLogger(t *testing.T) *utils.SyncLogger {
+	t.Helper()
+	logger, err := utils.NewLogger(io.Discard, "", utils.LogText, slog.LevelError)
+	if err != nil {
+		t.Fatalf("unable to create logger: %v", err)
+	}
+	return logger
+}
+
+// writeState: a state file with contents, returning its path.
+func writeState(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "state")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("unable to write state file: %v", err)
+	}
+	return path
+}
+
+func TestResumeRunStateErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{
+			name:     "empty file",
+			contents: "",
+			wantErr:  "not a state file, it is empty",
+		},
+		{
+			name:     "not json",
+			contents: "uptime\n",
+			wantErr:  "not a state file",
+		},
+		{
+			name:     "other command",
+			contents: `{"command":"reboot","started":"2024-01-01T00:00:00Z"}` + "\n",
+			wantErr:  `checkpoints a run of "reboot", not "uptime"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeState(t, tt.contents)
+			state, _, err := resumeRunState(path, "uptime")
+			if err == nil {
+				_ = state.Close()
+				t.Fatalf("resumed a bad state file, want error %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %q, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResumeRunStateLastRecordWins(t *testing.T) {
+	path := writeState(t, `{"command":"uptime","started":"2024-01-01T00:00:00Z"}
+{"host":"web1","ok":false,"exit_code":1,"failures":1}
+{"host":"web2","ok":true,"exit_code":0}
+{"host":"web1","ok":true,"exit_code":0}
+{"host":"web2","ok":false,"exit_code":2,"failures":1}
+`)
+	state, records, err := resumeRunState(path, "uptime")
+	if err != nil {
+		t.Fatalf("unable to resume: %v", err)
+	}
+	defer func() { _ = state.Close() }()
+	want := map[string]stateRecord{
+		"web1": {Host: "web1", OK: true},
+		"web2": {Host: "web2", ExitCode: 2, Failures: 1},
+	}
+	if len(records) != len(want) {
+		t.Errorf("got %d records, want %d", len(records), len(want))
+	}
+	for host, rec := range want {
+		if records[host] != rec {
+			t.Errorf("%s: got record %+v, want %+v", host, records[host], rec)
+		}
+	}
+}
+
+// TestResumeBrokenLastLine: a run killed halfway through checkpointing a host leaves a broken last line. That host is
+// run again, and the records of the resumed run start on a line of their own.
+func TestResumeBrokenLastLine(t *testing.T) {
+	path := writeState(t, `{"command":"uptime","started":"2024-01-01T00:00:00Z"}
+{"host":"web1","ok":true,"exit_code":0}
+{"host":"web2","ok":tr`)
+	c := &Config{Logger: testLogger(t), ResumePath: path}
+	remaining, state, err := c.resume(testHosts("web1", "web2", "web3"), "uptime", nil)
+	if err != nil {
+		t.Fatalf("unable to resume: %v", err)
+	}
+	var names []string
+	for _, host := range remaining {
+		names = append(names, host.Name)
+	}
+	if got := strings.Join(names, ","); got != "web2,web3" {
+		t.Errorf("got hosts %s left to run, want web2,web3", got)
+	}
+
+	if err := state.record(api.Result{Host: "web2"}, 0); err != nil {
+		t.Fatalf("unable to record web2: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("unable to close state file: %v", err)
+	}
+	state, records, err := resumeRunState(path, "uptime")
+	if err != nil {
+		t.Fatalf("unable to resume again: %v", err)
+	}
+	defer func() { _ = state.Close() }()
+	if !records["web2"].OK {
+		t.Errorf("web2's record after the broken line was lost, got records %+v", records)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read state file: %v", err)
+	}
+	if !strings.HasSuffix(string(data), "\"ok\":tr\n{\"host\":\"web2\",\"ok\":true,\"exit_code\":0}\n") {
+		t.Errorf("record was not appended on a new line, got state file:\n%s", data)
+	}
+}
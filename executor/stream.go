@@ -0,0 +1,70 @@
+package executor
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// lineStreamer: print each line of the hosts' output as soon as it is complete, prefixed with the host it came from,
+// like pssh -P. Stdout lines go to stdout and stderr lines to stderr, and lines from different hosts never interleave.
+type lineStreamer struct {
+	mu     sync.Mutex
+	stdout io.Writer
+	stderr io.Writer
+	// partial holds the start of each host's last line until the rest of it arrives
+	partial map[streamKey][]byte
+}
+
+// streamKey: one of a host's output streams
+type streamKey struct {
+	host   string
+	stderr bool
+}
+
+func newLineStreamer(stdout, stderr io.Writer) *lineStreamer {
+	return &lineStreamer{stdout: stdout, stderr: stderr, partial: make(map[streamKey][]byte)}
+}
+
+// tap: an api.OutputTap printing every complete line in data.
+func (s *lineStreamer) tap(host string, stderr bool, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := streamKey{host, stderr}
+	buf := append(s.partial[key], data...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		s.write(key, buf[:i])
+		buf = buf[i+1:]
+	}
+	if len(buf) == 0 {
+		delete(s.partial, key)
+		return
+	}
+	s.partial[key] = append([]byte{}, buf...)
+}
+
+// flush: print what is left of host's output once it is done, for output not ending in a newline.
+func (s *lineStreamer) flush(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range []streamKey{{host, false}, {host, true}} {
+		if buf, ok := s.partial[key]; ok {
+			s.write(key, buf)
+			delete(s.partial, key)
+		}
+	}
+}
+
+// write: print a line of key's output. Must be called with s.mu held.
+func (s *lineStreamer) write(key streamKey, line []byte) {
+	w := s.stdout
+	if key.stderr {
+		w = s.stderr
+	}
+	// a failed write to the terminal is not worth failing the host over
+	_, _ = w.Write(append(append([]byte(key.host+": "), bytes.TrimSuffix(line, []byte("\r"))...), '\n'))
+}
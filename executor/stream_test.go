@@ -0,0 +1,100 @@
+package executor
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLineStreamer(t *testing.T) {
+	type chunk struct {
+		host   string
+		stderr bool
+		data   string
+	}
+	tests := []struct {
+		name   string
+		chunks []chunk
+		// flush lists the hosts finishing after the chunks
+		flush      []string
+		wantStdout string
+		wantStderr string
+	}{
+		{
+			name:       "whole lines",
+			chunks:     []chunk{{"web1", false, "one\ntwo\n"}},
+			wantStdout: "web1: one\nweb1: two\n",
+		},
+		{
+			name:       "lines split across writes",
+			chunks:     []chunk{{"web1", false, "o"}, {"web1", false, "ne\ntw"}, {"web1", false, "o\n"}},
+			wantStdout: "web1: one\nweb1: two\n",
+		},
+		{
+			name:       "stderr",
+			chunks:     []chunk{{"web1", true, "oops\n"}, {"web1", false, "fine\n"}},
+			wantStdout: "web1: fine\n",
+			wantStderr: "web1: oops\n",
+		},
+		{
+			name:       "carriage returns",
+			chunks:     []chunk{{"web1", false, "one\r\ntwo\r\n"}},
+			wantStdout: "web1: one\nweb1: two\n",
+		},
+		{
+			name: "hosts writing at the same time",
+			chunks: []chunk{
+				{"web1", false, "from "},
+				{"web2", false, "from "},
+				{"web2", false, "web2\n"},
+				{"web1", false, "web1\n"},
+			},
+			wantStdout: "web2: from web2\nweb1: from web1\n",
+		},
+		{
+			name:       "unfinished last line",
+			chunks:     []chunk{{"web1", false, "done\nno newline"}, {"web1", true, "warn"}, {"web2", false, "more"}},
+			flush:      []string{"web1"},
+			wantStdout: "web1: done\nweb1: no newline\n",
+			wantStderr: "web1: warn\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			s := newLineStreamer(&stdout, &stderr)
+			for _, c := range tt.chunks {
+				s.tap(c.host, c.stderr, []byte(c.data))
+			}
+			for _, host := range tt.flush {
+				s.flush(host)
+			}
+			if stdout.String() != tt.wantStdout {
+				t.Errorf("got stdout %q, want %q", stdout.String(), tt.wantStdout)
+			}
+			if stderr.String() != tt.wantStderr {
+				t.Errorf("got stderr %q, want %q", stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+}
+
+func TestStreamedRun(t *testing.T) {
+	inv := localInventory(t, "web1", "web2")
+	cmd := `echo "hello from $TEST_HOST"; echo oops >&2; printf 'no newline'`
+	_, stdout := runLocal(t, Config{Output: "text", Stream: true}, inv, cmd)
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	sort.Strings(lines)
+	want := []string{
+		"web1: hello from web1",
+		"web1: no newline",
+		"web1: oops",
+		"web2: hello from web2",
+		"web2: no newline",
+		"web2: oops",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got streamed lines %q, want %q", lines, want)
+	}
+}
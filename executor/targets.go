@@ -0,0 +1,552 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/utils"
+	"github.com/basilnsage/remote-executor/utils/inventory"
+	"golang.org/x/crypto/ssh"
+)
+
+// targetResolver: turn host list entries into api.Targets, applying any per-host settings from the ssh config file.
+// Settings given explicitly on the command line win over the ssh config, like they do for OpenSSH.
+type targetResolver struct {
+	cfg       *Config
+	sshConfig *utils.SSHConfigFile
+	authConf  utils.AuthConfig
+	baseConf  ssh.ClientConfig
+	// configs caches the client configs built for per-host users and identity files, guarded by mu since serve jobs
+	// resolve their hosts concurrently
+	mu      sync.Mutex
+	configs map[string]*ssh.ClientConfig
+	// sshErr is why ssh could not be set up, hosts run over ssh fail with it
+	sshErr error
+	// vault hands out a one-time password for each host with --vault-ssh, nil unless it is used
+	vault *utils.VaultClient
+	// creds are the --credentials file's entries
+	creds []credential
+	// passwords are the creds' passwords by entry, each fetched once, guarded by mu
+	passwords map[*credential]string
+}
+
+func newTargetResolver(
+	c *Config,
+	sshConfig *utils.SSHConfigFile,
+	authConf utils.AuthConfig,
+	baseConf ssh.ClientConfig,
+) *targetResolver {
+	return &targetResolver{
+		cfg:       c,
+		sshConfig: sshConfig,
+		authConf:  authConf,
+		baseConf:  baseConf,
+		configs:   make(map[string]*ssh.ClientConfig),
+		passwords: make(map[*credential]string),
+	}
+}
+
+// transportPrefixes: the transports flat host list entries can pick with a prefix
+var transportPrefixes = []string{TransportLocal, TransportDocker, TransportKubectl, TransportSSM}
+
+// splitTransport: split the transport prefix from a flat host list entry, returning an empty transport if there is
+// none.
+func splitTransport(entry string) (string, string) {
+	for _, transport := range transportPrefixes {
+		if rest := strings.TrimPrefix(entry, transport+":"); rest != entry {
+			return transport, rest
+		}
+	}
+	return "", entry
+}
+
+// markTransports: set the transport of hosts from flat host list entries with a transport prefix, which stays part of
+// their name unless they have an alias.
+func markTransports(inv *inventory.Inventory) *inventory.Inventory {
+	for i := range inv.Hosts {
+		host := &inv.Hosts[i]
+		if host.Address != "" {
+			host.Transport, host.Address = splitTransport(host.Address)
+			continue
+		}
+		host.Transport, _ = splitTransport(host.Name)
+	}
+	return inv
+}
+
+// hostTransport: the transport host is run with, its own if it has one, otherwise Transport.
+func (c *Config) hostTransport(host inventory.Host) (string, error) {
+	transport := host.Transport
+	if transport == "" {
+		transport = c.Transport
+	}
+	switch transport {
+	case TransportSSH, TransportLocal, TransportDocker, TransportKubectl, TransportSSM:
+		return transport, nil
+	default:
+		return "", fmt.Errorf("unknown transport: %q", transport)
+	}
+}
+
+// resolve: build the target for an inventory host. Flat host list entries are named in host:port form, inventory
+// overrides win over the ssh config and command line flags.
+func (r *targetResolver) resolve(host inventory.Host) (api.Target, error) {
+	target := api.Target{Host: host.Name, Env: host.Env, Timeout: host.Timeout}
+	transport, err := r.cfg.hostTransport(host)
+	if err != nil {
+		return target, err
+	}
+	switch transport {
+	case TransportLocal:
+		target.Executor = api.LocalExecutor{}
+		return target, nil
+	case TransportDocker:
+		target.Addr = transportAddr(host)
+		target.Executor = api.DockerExecutor{CLI: r.cfg.DockerCLI, User: r.containerUser(host)}
+		return target, nil
+	case TransportKubectl:
+		target.Addr = transportAddr(host)
+		target.Executor = api.KubectlExecutor{
+			Context:   host.Vars["kubectl_context"],
+			Namespace: host.Vars["kubectl_namespace"],
+			Container: host.Vars["kubectl_container"],
+		}
+		return target, nil
+	case TransportSSM:
+		target.Addr = transportAddr(host)
+		target.Executor = api.SSMExecutor{Region: host.Vars["aws_region"]}
+		return target, nil
+	}
+	if r.sshErr != nil {
+		return target, r.sshErr
+	}
+	alias, port, settings, err := r.settings(host)
+	if err != nil {
+		return target, err
+	}
+
+	target.Addr = r.addr(alias, port, settings)
+	cred := credentialFor(r.creds, host, alias)
+	if conf, err := r.config(settings, r.user(settings, hostUser(host, cred)), cred); err != nil {
+		return target, err
+	} else if conf != nil {
+		target.Config = conf
+	}
+	if r.vault != nil {
+		conf := r.baseConf
+		if target.Config != nil {
+			conf = *target.Config
+		}
+		if target.Config, err = r.otpConfig(conf, target.Addr); err != nil {
+			return target, err
+		}
+	}
+	if host.ConnectTimeout > 0 {
+		conf := r.baseConf
+		if target.Config != nil {
+			conf = *target.Config
+		}
+		conf.Timeout = host.ConnectTimeout
+		target.Config = &conf
+	}
+	if settings.ProxyJump != "" && r.cfg.Jump == "" {
+		if target.Jump, err = r.jumpChain(settings.ProxyJump); err != nil {
+			return target, fmt.Errorf("ProxyJump for %s: %v", alias, err)
+		}
+	}
+	return target, nil
+}
+
+// transportAddr: the container, pod, or instance a host using the docker, kubectl, or ssm transport runs on, its
+// address if it has one, otherwise its name without a transport prefix.
+func transportAddr(host inventory.Host) string {
+	if host.Address != "" {
+		return host.Address
+	}
+	_, name := splitTransport(host.Name)
+	return name
+}
+
+// containerUser: the user to run as in a host's container, its own or an explicitly picked User, otherwise the
+// container's.
+func (r *targetResolver) containerUser(host inventory.Host) string {
+	if host.User != "" || !r.cfg.UserSet {
+		return host.User
+	}
+	return r.baseConf.User
+}
+
+// otpConfig: conf authenticating with a one-time password from Vault for the host at addr, which Vault knows by IP.
+func (r *targetResolver) otpConfig(conf ssh.ClientConfig, addr string) (*ssh.ClientConfig, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupHost(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	otp, err := r.vault.OTP(context.Background(), r.cfg.VaultSSH, ips[0], conf.User)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get a one-time password from vault: %v", err)
+	}
+	answer := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range answers {
+			answers[i] = otp
+		}
+		return answers, nil
+	}
+	conf.Auth = []ssh.AuthMethod{ssh.Password(otp), ssh.KeyboardInteractive(answer)}
+	return &conf, nil
+}
+
+// hostUser: the user a host asks for itself, in the inventory or else the credentials file.
+func hostUser(host inventory.Host, cred *credential) string {
+	if host.User == "" && cred != nil {
+		return cred.User
+	}
+	return host.User
+}
+
+// settings: the ssh config alias and port for an inventory host, and its ssh config settings with the inventory's key
+// files tried first, then the credentials file's.
+func (r *targetResolver) settings(host inventory.Host) (string, string, utils.SSHHostSettings, error) {
+	alias, port := splitHostPort(host.Name)
+	if host.Address != "" {
+		alias, port = splitHostPort(host.Address)
+	}
+	if host.Port != 0 {
+		port = strconv.Itoa(host.Port)
+	}
+	settings, err := r.sshConfig.Lookup(alias)
+	if err != nil {
+		return alias, port, settings, err
+	}
+	keyFiles := append([]string{}, host.KeyFiles...)
+	if cred := credentialFor(r.creds, host, alias); cred != nil {
+		keyFiles = append(keyFiles, cred.KeyFiles...)
+	}
+	settings.IdentityFiles = append(keyFiles, settings.IdentityFiles...)
+	return alias, port, settings, nil
+}
+
+// addr: the address to dial for alias, the ssh config port is only used if the host list did not pick a port other than
+// the DefaultPort.
+func (r *targetResolver) addr(alias, port string, settings utils.SSHHostSettings) string {
+	hostName := alias
+	if settings.HostName != "" {
+		hostName = settings.HostName
+	}
+	if (port == "" || port == strconv.Itoa(r.cfg.DefaultPort)) && settings.Port != "" {
+		port = settings.Port
+	}
+	if port == "" {
+		port = strconv.Itoa(r.cfg.DefaultPort)
+	}
+	return net.JoinHostPort(hostName, port)
+}
+
+// user: the remote user for a host, an override wins over an explicitly picked User, which wins over the ssh config.
+func (r *targetResolver) user(settings utils.SSHHostSettings, override string) string {
+	switch {
+	case override != "":
+		return override
+	case settings.User != "" && !r.cfg.UserSet:
+		return settings.User
+	default:
+		return r.baseConf.User
+	}
+}
+
+// config: return the client config for user on a host with the given settings and credentials file entry, nil if the
+// base config applies unchanged.
+func (r *targetResolver) config(
+	settings utils.SSHHostSettings,
+	user string,
+	cred *credential,
+) (*ssh.ClientConfig, error) {
+	var password string
+	if cred != nil {
+		password = cred.Password
+	}
+	if user == r.baseConf.User && len(settings.IdentityFiles) == 0 && password == "" {
+		return nil, nil
+	}
+
+	key := user + "\x00" + password + "\x00" + strings.Join(settings.IdentityFiles, "\x00")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conf, ok := r.configs[key]; ok {
+		return conf, nil
+	}
+
+	conf := r.baseConf
+	if len(settings.IdentityFiles) > 0 || password != "" {
+		// per-host identities are tried before the PrivateKeys, which newResolver has loaded already
+		authConf := r.authConf
+		authConf.KeyFiles = append(append([]string{}, settings.IdentityFiles...), r.authConf.KeyFiles...)
+		if password != "" {
+			pass, ok := r.passwords[cred]
+			if !ok {
+				var err error
+				if pass, err = cred.password(); err != nil {
+					return nil, fmt.Errorf("unable to read the credentials file password: %v", err)
+				}
+				r.passwords[cred] = pass
+			}
+			credentialPassword(&authConf, pass, r.cfg.totpSecret())
+		}
+		var err error
+		conf, err = utils.NewSSHConfig(
+			r.cfg.HostKeyPolicy, r.cfg.KnownHosts, user, r.cfg.ConnectTimeout, authConf, r.cfg.SSHOptions...,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conf.User = user
+	r.configs[key] = &conf
+	return &conf, nil
+}
+
+// jumpChain: parse a comma separated jump host chain. Each hop is looked up in the ssh config and authenticated like
+// the remote hosts.
+func (r *targetResolver) jumpChain(spec string) ([]api.Hop, error) {
+	var hops []api.Hop
+	for _, hopSpec := range strings.Split(spec, ",") {
+		user, addr, err := utils.ParseJumpHost(strings.TrimSpace(hopSpec), "")
+		if err != nil {
+			return nil, err
+		}
+		alias, port := splitHostPort(addr)
+		settings, err := r.sshConfig.Lookup(alias)
+		if err != nil {
+			return nil, err
+		}
+		// jump hosts use the credentials file entries matching them too
+		cred := credentialFor(r.creds, inventory.Host{}, alias)
+		if cred != nil {
+			settings.IdentityFiles = append(append([]string{}, cred.KeyFiles...), settings.IdentityFiles...)
+		}
+		conf, err := r.config(settings, r.user(settings, hostUser(inventory.Host{User: user}, cred)), cred)
+		if err != nil {
+			return nil, err
+		}
+		if conf == nil {
+			conf = &r.baseConf
+		}
+		hops = append(hops, api.Hop{Addr: r.addr(alias, port, settings), Config: *conf})
+	}
+	return hops, nil
+}
+
+// loadInventory: read the hosts to run against. Sources like srv:_ssh._tcp.example.com, aws:tag:Role=web,
+// ssm:tag:Role=web, gce:label:role=web, k8s:node-role.kubernetes.io/worker, pods:app=web, or docker:label=role=web
+// are discovered, anything else is a file path. The yaml, json, and ini formats are picked by file extension unless
+// format says otherwise, anything else is a flat host list parsed with Parser.
+func (c *Config) loadInventory(path, format string) (*inventory.Inventory, error) {
+	if name := strings.TrimPrefix(path, "srv:"); name != path {
+		return inventory.LookupSRV(name)
+	}
+	if spec := strings.TrimPrefix(path, "aws:"); spec != path {
+		return inventory.EC2(spec)
+	}
+	if spec := strings.TrimPrefix(path, "ssm:"); spec != path {
+		return inventory.SSM(spec)
+	}
+	if spec := strings.TrimPrefix(path, "gce:"); spec != path {
+		return inventory.GCE(spec)
+	}
+	if spec := strings.TrimPrefix(path, "k8s:"); spec != path {
+		return inventory.K8sNodes(spec)
+	}
+	if spec := strings.TrimPrefix(path, "pods:"); spec != path {
+		return inventory.K8sPods(spec)
+	}
+	if spec := strings.TrimPrefix(path, "docker:"); spec != path {
+		return inventory.DockerContainers(c.DockerCLI, spec)
+	}
+	if format == "auto" || format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+			format = "yaml"
+		case ".ini":
+			format = "ini"
+		default:
+			format = "flat"
+		}
+	}
+	switch format {
+	case "yaml", "json":
+		return inventory.Load(path)
+	case "ini":
+		return inventory.LoadINI(path)
+	case "flat":
+		entries, err := utils.ParseHostsList(path, c.Parser, func(entry string) string { return entry })
+		if err != nil {
+			return nil, err
+		}
+		hosts, err := c.expandEntries(entries)
+		if err != nil {
+			return nil, err
+		}
+		return markTransports(inventory.FromNames(hosts)), nil
+	default:
+		return nil, fmt.Errorf("unknown inventory format: %q", format)
+	}
+}
+
+// selectHosts: load the hosts to run against from HostList, or InlineHosts, and narrow them down with the group and
+// limit fields. Hosts that cannot be connected to are dropped with a warning.
+func (c *Config) selectHosts() ([]inventory.Host, error) {
+	var inv *inventory.Inventory
+	var err error
+	if c.InlineHosts != "" {
+		inv, err = c.inlineInventory(c.InlineHosts)
+	} else {
+		inv, err = c.loadInventory(c.HostList, c.InventoryFormat)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse host list: %v", err)
+	}
+	if inv, err = inv.SelectGroups(c.Groups, c.NotGroups); err != nil {
+		return nil, fmt.Errorf("unable to select hosts: %v", err)
+	}
+	if inv, err = inv.Limit(c.Limit, c.Exclude); err != nil {
+		return nil, fmt.Errorf("unable to select hosts: %v", err)
+	}
+	if c.RetryFailed {
+		failed, err := readFailed(c.FailedOut)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the failed hosts to retry: %v", err)
+		}
+		inv = inv.Filter(func(host inventory.Host) bool {
+			if failed[host.Name] {
+				delete(failed, host.Name)
+				return true
+			}
+			return false
+		})
+		for host := range failed {
+			c.Logger.Warn(fmt.Sprintf("not retrying host %q, it is not in the host list", host), "host", host)
+		}
+	}
+	inv, dropped := inv.Validate(c.DefaultPort)
+	for _, d := range dropped {
+		c.Logger.Warn(fmt.Sprintf("skipping host %q: %s", d.Host, d.Reason), "host", d.Host)
+	}
+	if len(inv.Hosts) == 0 {
+		c.Logger.Warn("no hosts to run against")
+	}
+	return inv.Hosts, nil
+}
+
+// inlineInventory: an inventory of the comma separated hosts in list, expanded like host list entries.
+// Commas inside [] and {} patterns do not separate hosts.
+func (c *Config) inlineInventory(list string) (*inventory.Inventory, error) {
+	var entries []string
+	depth, start := 0, 0
+	for i, r := range list + "," {
+		switch r {
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case ',':
+			if depth > 0 {
+				continue
+			}
+			if entry := strings.TrimSpace(list[start:i]); entry != "" {
+				entries = append(entries, entry)
+			}
+			start = i + 1
+		}
+	}
+	hosts, err := c.expandEntries(entries)
+	if err != nil {
+		return nil, err
+	}
+	return markTransports(inventory.FromNames(hosts)), nil
+}
+
+// expandEntries: expand host list entries into [user@]host:port names, see utils.ExpandHostPattern and
+// utils.ExpandCIDR. Entries with a transport prefix, e.g. local:build-[1-2], keep it and get no port, as do all
+// entries when Transport is not ssh. Entries in alias=entry form keep their alias and must name a single host.
+func (c *Config) expandEntries(entries []string) ([]string, error) {
+	var hosts []string
+	for _, entry := range entries {
+		alias, entry, aliased := strings.Cut(entry, "=")
+		if !aliased {
+			entry = alias
+		}
+		expanded, err := c.expandEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		if aliased {
+			if alias == "" || len(expanded) != 1 {
+				return nil, fmt.Errorf("alias %q must name a single host, not %d", alias, len(expanded))
+			}
+			expanded[0] = alias + "=" + expanded[0]
+		}
+		hosts = append(hosts, expanded...)
+	}
+	return hosts, nil
+}
+
+// expandEntry: expand a single host list entry without an alias.
+func (c *Config) expandEntry(entry string) ([]string, error) {
+	var hosts []string
+	if transport, name := splitTransport(entry); transport != "" || c.Transport != TransportSSH {
+		prefix := ""
+		if transport != "" {
+			prefix = transport + ":"
+		}
+		patterns, err := utils.ExpandHostPattern(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, pattern := range patterns {
+			hosts = append(hosts, prefix+pattern)
+		}
+		return hosts, nil
+	}
+	// keep the user out of the way of pattern and port handling
+	user, entry, ok := strings.Cut(entry, "@")
+	if !ok {
+		user, entry = "", user
+	} else {
+		user += "@"
+	}
+	patterns, err := utils.ExpandHostPattern(entry)
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range patterns {
+		expanded, err := utils.ExpandCIDR(pattern, c.CIDRHostsOnly)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range expanded {
+			hosts = append(hosts, user+utils.WithDefaultPort(c.DefaultPort)(host))
+		}
+	}
+	return hosts, nil
+}
+
+// splitHostPort: split host:port, returning an empty port if there is none. Bare and bracketed IPv6 literals without a
+// port are returned without brackets.
+func splitHostPort(hostPort string) (string, string) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return strings.TrimSuffix(strings.TrimPrefix(hostPort, "["), "]"), ""
+	}
+	return host, port
+}
@@ -0,0 +1,84 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/basilnsage/remote-executor/api"
+)
+
+// copyAction: the upload described by the source and destination positional arguments left after the host list, and
+// a command-like description of it for output and reports.
+func (c *Config) copyAction() (string, api.Action, error) {
+	args := c.Args
+	if len(args) != 2 {
+		return "", nil, fmt.Errorf("need 2 positional arguments for the source and destination, found: %d", len(args))
+	}
+	if c.Script != "" || c.PipeStdin {
+		return "", nil, fmt.Errorf("unable to parse flags: -script and -stdin cannot be used with %s", SubcommandCopy)
+	}
+	opts := api.UploadOptions{Owner: c.FileOwner, Filter: c.transferFilter(), Verify: c.VerifyCopy}
+	if c.FileMode != "" {
+		mode, err := strconv.ParseUint(c.FileMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return "", nil, fmt.Errorf("unable to parse flags: invalid mode %q", c.FileMode)
+		}
+		opts.Mode = os.FileMode(mode)
+	}
+	action, err := api.Upload(args[0], args[1], opts)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to copy: %v", err)
+	}
+	return fmt.Sprintf("copy %s %s", args[0], args[1]), action, nil
+}
+
+// fetchAction: the download described by the remote source and local directory positional arguments left after the
+// host list, and a command-like description of it. Each host's copy goes to <dir>/<host>/<src>.
+func (c *Config) fetchAction() (string, api.Action, error) {
+	args := c.Args
+	if len(args) != 2 {
+		return "", nil, fmt.Errorf("need 2 positional arguments for the source and local directory, found: %d", len(args))
+	}
+	if c.Script != "" || c.PipeStdin {
+		return "", nil, fmt.Errorf("unable to parse flags: -script and -stdin cannot be used with %s", SubcommandFetch)
+	}
+	src, dir := args[0], args[1]
+	dest := func(target api.Target) string {
+		// rooting src keeps .. from escaping the host's directory
+		return filepath.Join(dir, hostFileName(target.Host), filepath.Clean("/"+src))
+	}
+	action, err := api.Download(src, dest, c.transferFilter())
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to fetch: %v", err)
+	}
+	return fmt.Sprintf("fetch %s %s", src, dir), action, nil
+}
+
+// collectAction: the archiving of the remote paths following the local directory in the positional arguments left
+// after the host list, and a command-like description of it. Each host's archive goes to <dir>/<host>.tar.gz.
+func (c *Config) collectAction() (string, api.Action, error) {
+	args := c.Args
+	if len(args) < 2 {
+		return "", nil, fmt.Errorf("need a local directory and at least 1 remote path to collect, found: %d", len(args))
+	}
+	if c.Script != "" || c.PipeStdin {
+		return "", nil, fmt.Errorf("unable to parse flags: -script and -stdin cannot be used with %s", SubcommandCollect)
+	}
+	dir, paths := args[0], args[1:]
+	dest := func(target api.Target) string {
+		return filepath.Join(dir, hostFileName(target.Host)+".tar.gz")
+	}
+	action, err := api.Collect(paths, dest)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to collect: %v", err)
+	}
+	return fmt.Sprintf("collect %s %s", dir, strings.Join(paths, " ")), action, nil
+}
+
+// transferFilter: the files picked by IncludeFiles and ExcludeFiles.
+func (c *Config) transferFilter() api.Filter {
+	return api.Filter{Include: c.IncludeFiles, Exclude: c.ExcludeFiles}
+}
@@ -1,9 +1,24 @@
 module github.com/basilnsage/remote-executor
 
-go 1.15
+go 1.21
 
 require (
-	github.com/google/go-cmp v0.5.4
-	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
-	golang.org/x/sys v0.0.0-20210105210732-16f7687f5001 // indirect
+	github.com/google/go-cmp v0.6.0
+	github.com/kevinburke/ssh_config v1.2.0
+	github.com/mattn/go-sqlite3 v1.14.24
+	github.com/pkg/sftp v1.13.7
+	golang.org/x/crypto v0.31.0
+	golang.org/x/term v0.27.0
+	golang.org/x/time v0.8.0
+	google.golang.org/grpc v1.65.0
+	google.golang.org/protobuf v1.34.2
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/net v0.25.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157 // indirect
 )
@@ -0,0 +1,4 @@
+// Package jobspb: the protobuf messages and gRPC service of the serve subcommand's job API, generated from jobs.proto.
+package jobspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative jobs.proto
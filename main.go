@@ -2,46 +2,221 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/basilnsage/remote-executor/api"
+	"github.com/basilnsage/remote-executor/executor"
 	"github.com/basilnsage/remote-executor/utils"
+	"golang.org/x/term"
 )
 
 var (
-	numWorkers     int
-	checkHostKey   bool
-	regexExpr      string
-	remoteUser     string
-	privateKeyPath string
-	knownHostsPath string
-	summarize      bool
+	numWorkers      int
+	maxWorkers      int
+	checkHostKey    bool
+	hostKeyPolicy   string
+	ciphers         string
+	kexAlgorithms   string
+	macs            string
+	hostKeyAlgos    string
+	configPath      string
+	historyPath     string
+	auditPath       string
+	notifyURL       string
+	notifyFailures  bool
+	slackWebhook    string
+	slackToken      string
+	slackChannel    string
+	failedOut       string
+	retryFailed     bool
+	statePath       string
+	resumePath      string
+	profile         string
+	regexExpr       string
+	remoteUser      string
+	privateKeyPath  string
+	knownHostsPath  string
+	summarize       bool
+	useAgent        bool
+	passphrase      string
+	passwordAuth    bool
+	passwordFD      int
+	passwordSecret  string
+	authOrder       string
+	totpSecret      string
+	vaultSSH        string
+	jumpSpec        string
+	transportFlag   string
+	dockerCLI       string
+	sshConfigPath   string
+	credsPath       string
+	jobTimeout      time.Duration
+	dialTimeout     time.Duration
+	maxRuntime      time.Duration
+	outputFormat    string
+	formatTmpl      string
+	sortBy          string
+	outDir          string
+	bufferLimit     int
+	maxOutput       int64
+	abortOutput     bool
+	cleanOutput     bool
+	expectRegex     string
+	expectExact     string
+	okExitCodes     string
+	wrapShell       string
+	chdir           string
+	remoteLock      string
+	lockTTL         time.Duration
+	skipRecent      time.Duration
+	breakerFailures int
+	breakerCooldown time.Duration
+	force           bool
+	aggregate       bool
+	showOutliers    bool
+	stream          bool
+	showProgress    bool
+	noColor         bool
+	verbose         bool
+	quiet           bool
+	logFormat       string
+	metricsListen   string
+	reports         reportFlag
+	inventoryFmt    string
+	cidrHostsOnly   bool
+	hostSource      string
+	inlineHosts     string
+	groups          string
+	notGroups       string
+	limitHosts      string
+	excludeHosts    string
+	defaultPort     int
+	remoteEnv       envFlag
+	scriptPath      string
+	pipeStdin       bool
+	serial          string
+	serialAbort     bool
+	canary          string
+	canaryAuto      bool
+	confirm         bool
+	maxFailures     int
+	maxFailurePct   float64
+	connectRate     string
+	dialJitter      time.Duration
+	keepalive       time.Duration
+	keepaliveCount  int
+	stopSignal      string
+	stopGrace       time.Duration
+	idleTimeout     time.Duration
+
+	// history subcommand flags
+	historyRunID int64
+	historyHost  string
+	historySince time.Duration
+	historyLimit int
+
+	// copy and fetch subcommand flags
+	fileMode     string
+	fileOwner    string
+	includeFiles string
+	excludeFiles string
+	verifyCopy   bool
+
+	// serve subcommand flags
+	listenAddr       string
+	serveToken       string
+	grpcListenAddr   string
+	reuseConnections bool
 )
 
 func init() {
 	homeDir, _ := os.LookupEnv("HOME")
 	userName, _ := os.LookupEnv("USER")
 
+	flag.StringVar(
+		&configPath,
+		"config",
+		fmt.Sprintf("%s/.remote-executor.yaml", homeDir),
+		"config file holding the profiles picked with -profile",
+	)
+	flag.StringVar(&profile, "profile", "", "apply the flags of this profile from the -config file, e.g. prod")
+	// builds without cgo cannot open the history, so they only keep one when asked to
+	defaultHistory := ""
+	if executor.HistorySupported {
+		defaultHistory = fmt.Sprintf("%s/.remote-executor-history.db", homeDir)
+	}
+	flag.StringVar(
+		&historyPath,
+		"history-db",
+		defaultHistory,
+		"SQLite database every run is recorded in, empty to not record runs",
+	)
+	flag.StringVar(
+		&auditPath,
+		"audit-log",
+		"",
+		"append who ran what on which hosts, and the outcome, to this hash-chained log; runs fail if it cannot be written",
+	)
+	flag.StringVar(&notifyURL, "notify-url", "", "POST a JSON summary of each run to this webhook once it is over")
+	flag.BoolVar(
+		&notifyFailures,
+		"notify-failures",
+		false,
+		"list every failed host and its error in -notify-url summaries",
+	)
+	flag.StringVar(
+		&slackWebhook,
+		"slack-webhook",
+		"",
+		"post a summary of each run to this Slack or Mattermost incoming webhook once it is over",
+	)
+	flag.StringVar(
+		&slackToken,
+		"slack-token",
+		"",
+		"post run summaries to -slack-channel with this Slack bot token (prefer $REMOTE_EXECUTOR_SLACK_TOKEN)",
+	)
+	flag.StringVar(&slackChannel, "slack-channel", "", "channel to post run summaries to, e.g. #deploys")
 	flag.IntVar(&numWorkers, "concurrency", 100, "size of worker pool")
-	flag.BoolVar(&checkHostKey, "check-hostkey", false, "check remote host key")
+	flag.IntVar(
+		&maxWorkers,
+		"max-concurrency",
+		0,
+		"let the worker pool grow up to this many workers while hosts are waiting (default the fixed -concurrency)",
+	)
+	flag.BoolVar(&checkHostKey, "check-hostkey", false, "check remote host key, short for -hostkey strict")
+	flag.StringVar(
+		&hostKeyPolicy,
+		"hostkey",
+		"",
+		"host key checking: ignore, strict (only hosts in -known-hosts), or tofu (add unknown hosts, reject changed keys)",
+	)
 	flag.StringVar(
 		&regexExpr,
 		"parser",
-		`^([^\s]*)\b`,
+		`^(\S+)`,
 		"regex used to parse host list",
 	)
+	flag.StringVar(&ciphers, "ciphers", "", "comma separated ciphers to offer, in order (default the ssh package's)")
+	flag.StringVar(&kexAlgorithms, "kex", "", "comma separated key exchange algorithms to offer, in order")
+	flag.StringVar(&macs, "macs", "", "comma separated MAC algorithms to offer, in order")
+	flag.StringVar(&hostKeyAlgos, "hostkey-algorithms", "", "comma separated host key algorithms to accept, in order")
 	flag.StringVar(&remoteUser, "user", userName, "remote user")
+	flag.IntVar(&defaultPort, "port", 22, "ssh port for hosts that do not specify one")
 	flag.StringVar(
 		&privateKeyPath,
 		"private-key",
 		fmt.Sprintf("%s/.ssh/id_rsa", homeDir),
-		"ssh private key to use",
+		"comma separated list of ssh private keys to try, in order, as paths or aws-sm:// or aws-ssm:// secrets",
 	)
 	flag.StringVar(
 		&knownHostsPath,
@@ -49,89 +224,787 @@ func init() {
 		fmt.Sprintf("%s/.ssh/known_hosts", homeDir),
 		"path to known hosts file",
 	)
+	flag.StringVar(
+		&passphrase,
+		"passphrase",
+		"",
+		"passphrase for an encrypted private key (prefer $REMOTE_EXECUTOR_PASSPHRASE or the prompt)",
+	)
+	flag.StringVar(
+		&authOrder,
+		"auth",
+		"",
+		"comma separated auth methods to try in order: agent, key, password, keyboard-interactive "+
+			"(default derived from other flags)",
+	)
+	flag.StringVar(
+		&totpSecret,
+		"totp-secret",
+		"",
+		"base32 TOTP secret used to answer one-time password prompts (prefer $REMOTE_EXECUTOR_TOTP_SECRET)",
+	)
+	flag.StringVar(
+		&vaultSSH,
+		"vault-ssh",
+		"",
+		"fetch credentials from Vault's SSH secrets engine at run start: <mount>/sign/<role> for a signed "+
+			"certificate, <mount>/creds/<role> for one-time passwords",
+	)
+	flag.BoolVar(&passwordAuth, "password-auth", false, "also offer password authentication")
+	flag.IntVar(&passwordFD, "password-fd", -1, "read the password from this file descriptor instead of prompting")
+	flag.StringVar(
+		&passwordSecret,
+		"password-secret",
+		"",
+		"read the password from this aws-sm://<secret> or aws-ssm://<parameter> reference instead of prompting",
+	)
+	flag.StringVar(
+		&jumpSpec,
+		"jump",
+		"",
+		"connect to hosts through these comma separated jump hosts, in order: [user@]host[:port][,...]",
+	)
+	flag.StringVar(
+		&transportFlag,
+		"transport",
+		executor.TransportSSH,
+		"run commands over ssh, on this machine with local, in containers with docker or kubectl, or with aws ssm",
+	)
+	flag.StringVar(
+		&dockerCLI,
+		"docker-cli",
+		"docker",
+		"the CLI containers are listed and run in with, for the docker transport, e.g. nerdctl for containerd",
+	)
+	flag.StringVar(
+		&sshConfigPath,
+		"ssh-config",
+		fmt.Sprintf("%s/.ssh/config", homeDir),
+		"OpenSSH client config to read per-host settings from, empty to disable",
+	)
+	flag.StringVar(
+		&credsPath,
+		"credentials",
+		"",
+		"YAML file giving the user, keys, and password for hosts matching name patterns or in inventory groups",
+	)
+	flag.DurationVar(&jobTimeout, "timeout", 0, "give up on a host after this long, e.g. 30s or 5m (0 means no limit)")
+	flag.DurationVar(
+		&dialTimeout,
+		"connect-timeout",
+		0,
+		"give up connecting to a host after this long, e.g. 10s (0 means the OS default)",
+	)
+	flag.DurationVar(
+		&keepalive,
+		"keepalive",
+		0,
+		"check a host is still answering this often while its command runs, e.g. 15s (0 means never)",
+	)
+	flag.IntVar(&keepaliveCount, "keepalive-count", 3, "fail a host once it misses this many keepalives in a row")
+	flag.DurationVar(
+		&maxRuntime,
+		"max-runtime",
+		0,
+		"cancel the whole run after this long, unfinished hosts are reported as failed (0 means no limit)",
+	)
+	flag.StringVar(
+		&stopSignal,
+		"stop-signal",
+		"TERM",
+		"signal sent to a command that timed out or was cancelled before its session is closed, e.g. TERM or INT",
+	)
+	flag.DurationVar(
+		&stopGrace,
+		"stop-grace",
+		5*time.Second,
+		"how long a command sent -stop-signal gets to exit before its session is closed (0 closes it straight away)",
+	)
+	flag.DurationVar(
+		&idleTimeout,
+		"idle-timeout",
+		0,
+		"stop a host's command once it has printed nothing for this long, even within -timeout (0 for no limit)",
+	)
+	flag.StringVar(&outputFormat, "output", "text", "how to report results: text, json, or ndjson")
+	flag.StringVar(
+		&sortBy,
+		"sort",
+		"",
+		"report results once the run is over, sorted by host name or in inventory order: host or inventory",
+	)
+	flag.StringVar(
+		&formatTmpl,
+		"format",
+		"",
+		"Go template printed for each host instead of -output, e.g. '{{.Host}} [{{.ExitCode}}] {{.Stdout | trim}}'",
+	)
+	flag.StringVar(&outDir, "outdir", "", "write each host's stdout and stderr to <dir>/<host>.out and <dir>/<host>.err")
+	flag.IntVar(
+		&bufferLimit,
+		"buffer-limit",
+		0,
+		"keep at most this many bytes of each host's output in memory, -outdir still gets all of it (0 means no limit)",
+	)
+	flag.Int64Var(
+		&maxOutput,
+		"max-output-bytes",
+		0,
+		"drop each host's output past this many bytes of stdout and stderr, everywhere, after a marker (0 means no limit)",
+	)
+	flag.BoolVar(
+		&abortOutput,
+		"max-output-abort",
+		false,
+		"stop a host's command and fail it once it prints more than -max-output-bytes, instead of dropping the rest",
+	)
+	flag.BoolVar(
+		&cleanOutput,
+		"clean-output",
+		false,
+		"strip terminal colors and other escape sequences from each host's output and replace invalid UTF-8",
+	)
+	flag.StringVar(
+		&expectRegex,
+		"expect-regex",
+		"",
+		"fail hosts whose command exits 0 but whose stdout does not match this regex, e.g. 'nginx/1\\.24\\.'",
+	)
+	flag.StringVar(
+		&expectExact,
+		"expect-exact",
+		"",
+		"fail hosts whose command exits 0 but whose stdout, trimmed of surrounding whitespace, is not exactly this",
+	)
+	flag.StringVar(
+		&okExitCodes,
+		"ok-exit-codes",
+		"0",
+		"comma separated exit codes counted as success, any other fails the host, e.g. 0,1 for grep",
+	)
+	flag.BoolVar(
+		&aggregate,
+		"aggregate",
+		false,
+		"print each unique output once, followed by the hosts that produced it, at the end of the run",
+	)
+	flag.BoolVar(
+		&showOutliers,
+		"diff",
+		false,
+		"at the end of the run, print a unified diff against the most common output for every host whose output differs",
+	)
+	flag.BoolVar(
+		&stream,
+		"stream",
+		false,
+		"print each line of output as it arrives, prefixed with its host, text output then only reports each host's status",
+	)
+	flag.BoolVar(
+		&showProgress,
+		"progress",
+		false,
+		"show hosts done, failures so far, and an estimated time left on stderr as hosts finish",
+	)
+	flag.BoolVar(&noColor, "no-color", false, "never color text output, even on a terminal")
+	flag.BoolVar(&verbose, "v", false, "also log debug messages, including SSH handshakes and worker scheduling")
+	flag.BoolVar(&quiet, "q", false, "only log warnings and errors, successful hosts are not reported")
+	flag.StringVar(&logFormat, "log-format", utils.LogText, "how to write log messages: text, logfmt, or json")
+	flag.StringVar(
+		&metricsListen,
+		"metrics-listen",
+		"",
+		"serve Prometheus metrics on this address, e.g. :9090, at /metrics",
+	)
+	flag.Var(&reports, "report", "write a report once the run is over, as kind=FILE, may be repeated (kinds: junit, csv)")
+	flag.StringVar(
+		&hostSource,
+		"hosts",
+		"",
+		"read hosts from this file or source, e.g. srv:_ssh._tcp.example.com, instead of the first positional argument",
+	)
+	flag.StringVar(
+		&scriptPath,
+		"script",
+		"",
+		"run this local script on each host with bash, the command argument becomes optional arguments for the script",
+	)
+	flag.BoolVar(&pipeStdin, "stdin", false, "read all of stdin and feed a copy of it to the command on every host")
+	flag.StringVar(
+		&wrapShell,
+		"shell",
+		"",
+		"run the command as the quoted last argument of this shell on every host, e.g. 'bash -lc' or 'sh -c'",
+	)
+	flag.StringVar(
+		&remoteLock,
+		"remote-lock",
+		"",
+		"take this lock directory on every host before running anything, hosts another run holds it on fail",
+	)
+	flag.DurationVar(
+		&lockTTL,
+		"lock-ttl",
+		time.Hour,
+		"how long a -remote-lock is held at most, a lock left behind is taken over once it is up",
+	)
+	flag.StringVar(
+		&chdir,
+		"chdir",
+		"",
+		"run the command in this directory on every host, failing hosts where it does not exist (~/ is the home directory)",
+	)
+	flag.Var(&remoteEnv, "env", "set this KEY=VALUE environment variable for the remote command, may be repeated")
+	flag.StringVar(
+		&inlineHosts,
+		"H",
+		"",
+		"run against these comma separated hosts, e.g. web1,deploy@web2:2222, instead of reading a host list",
+	)
+	flag.StringVar(
+		&serial,
+		"serial",
+		"",
+		"run against hosts in batches of this many or this percent of hosts, e.g. 5 or 25%, one batch at a time",
+	)
+	flag.BoolVar(&serialAbort, "serial-abort", false, "with -serial, skip the remaining batches once a host fails")
+	flag.StringVar(&failedOut, "failed-out", "", "write the hosts that failed to this file once the run is over")
+	flag.BoolVar(&retryFailed, "retry-failed", false, "only run against the hosts in the -failed-out file of the last run")
+	flag.StringVar(&statePath, "state", "", "checkpoint each host to this file as it finishes, for -resume")
+	flag.StringVar(
+		&resumePath,
+		"resume",
+		"",
+		"carry on an interrupted run from its -state file, skipping the hosts that already succeeded",
+	)
+	flag.DurationVar(
+		&skipRecent,
+		"skip-recent",
+		0,
+		"skip hosts that succeeded running the same command within this long, going by -history-db (0 runs them all)",
+	)
+	flag.BoolVar(&force, "force", false, "run against every host, even those -skip-recent would skip")
+	flag.IntVar(
+		&breakerFailures,
+		"breaker-failures",
+		0,
+		"quarantine hosts that could not be connected to or run on this many times in a row, failing them at once (0 never)",
+	)
+	flag.DurationVar(
+		&breakerCooldown,
+		"breaker-cooldown",
+		5*time.Minute,
+		"how long a host is quarantined by -breaker-failures before it is tried again (0 for good)",
+	)
+	flag.StringVar(
+		&canary,
+		"canary",
+		"",
+		"run against this many or this percent of hosts first, then ask before continuing with the rest",
+	)
+	flag.BoolVar(&canaryAuto, "canary-auto", false, "with -canary, continue without asking only if every canary succeeded")
+	flag.BoolVar(&confirm, "confirm", false, "show the host count and command and ask for yes before running anything")
+	flag.IntVar(&maxFailures, "max-failures", 0, "stop starting new hosts once this many have failed (0 means no limit)")
+	flag.Float64Var(
+		&maxFailurePct,
+		"max-failure-pct",
+		0,
+		"stop starting new hosts once this percent of hosts have failed (0 means no limit)",
+	)
+	flag.StringVar(
+		&connectRate,
+		"connect-rate",
+		"",
+		"open at most this many new connections per second, minute, or hour, e.g. 50/s or 600/m (default no limit)",
+	)
+	flag.DurationVar(&dialJitter, "dial-jitter", 0, "wait a random time of up to this long before each new connection")
+	flag.StringVar(&groups, "group", "", "only run against hosts in these comma separated inventory groups")
+	flag.StringVar(&notGroups, "not-group", "", "skip hosts in these comma separated inventory groups")
+	flag.StringVar(
+		&limitHosts,
+		"limit",
+		"",
+		"only run against hosts matching these comma separated globs, or regular expressions starting with ~",
+	)
+	flag.StringVar(&excludeHosts, "exclude", "", "skip hosts matching these comma separated globs or ~regular expressions")
+	flag.StringVar(
+		&inventoryFmt,
+		"inventory-format",
+		"auto",
+		"format of the host list: flat, yaml, json, ini, or auto to pick by file extension",
+	)
+	flag.BoolVar(
+		&cidrHostsOnly,
+		"cidr-hosts-only",
+		false,
+		"skip the network and broadcast addresses when expanding IPv4 CIDR ranges in the host list",
+	)
 	flag.BoolVar(&summarize, "summarize", false, "report a list of failed hosts")
+	flag.BoolVar(&useAgent, "use-agent", false, "authenticate with keys held by ssh-agent")
 }
 
-type failedHosts struct {
-	failed []string
-	mu     sync.Mutex
+// historyFlags: register the flags only the history subcommand takes.
+func historyFlags() {
+	flag.Int64Var(&historyRunID, "run", 0, "show the results of every host in this run")
+	flag.StringVar(&historyHost, "host", "", "only show runs that included this host, and its results in them")
+	flag.DurationVar(&historySince, "since", 0, "only show runs started within this long, e.g. 168h for the last week")
+	flag.IntVar(&historyLimit, "last", 20, "show at most this many runs, latest first, 0 for all of them")
 }
 
-func newFailedHosts() *failedHosts {
-	var hosts []string
-	return &failedHosts{failed: hosts}
+// transferFlags: register the flags understood by the copy and fetch subcommands.
+func transferFlags() {
+	flag.StringVar(
+		&includeFiles,
+		"include-files",
+		"",
+		"only transfer files in a directory tree matching these comma separated globs, e.g. *.conf",
+	)
+	flag.StringVar(
+		&excludeFiles,
+		"exclude-files",
+		"",
+		"skip files and directories in a directory tree matching these comma separated globs, e.g. *.tmp,cache",
+	)
 }
 
-func (fh *failedHosts) append(host string) {
-	fh.mu.Lock()
-	defer fh.mu.Unlock()
-	fh.failed = append(fh.failed, host)
+// copyFlags: register the flags only understood by the copy subcommand.
+func copyFlags() {
+	flag.StringVar(&fileMode, "mode", "", "octal permissions for copied files, e.g. 0644, instead of the local ones")
+	flag.StringVar(&fileOwner, "owner", "", "chown everything copied to this owner, e.g. www-data or root:root")
+	flag.BoolVar(
+		&verifyCopy,
+		"verify",
+		false,
+		"compare a SHA-256 of each copied file, from sha256sum on the host, to the local file",
+	)
 }
 
-func main() {
-	syncLogger := utils.SyncLogger{
-		Logger: log.New(os.Stdout, "remote-executor: ", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile),
+// serveFlags: register the flags only the serve subcommand takes.
+func serveFlags() {
+	flag.StringVar(&listenAddr, "listen", "localhost:8080", "address to serve the job API on")
+	flag.StringVar(
+		&serveToken,
+		"token",
+		"",
+		"require this bearer token on every API request (prefer $REMOTE_EXECUTOR_TOKEN)",
+	)
+	flag.StringVar(&grpcListenAddr, "grpc-listen", "", "also serve the job API over gRPC on this address")
+	flag.BoolVar(
+		&reuseConnections,
+		"reuse-connections",
+		false,
+		"keep each host's connection open between jobs and run later jobs against it as new sessions",
+	)
+}
+
+// splitList: split a comma separated flag value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	syncLogger.Info("starting new remote executor run")
+	return items
+}
 
-	// parse flags and check positional arguments
-	flag.Parse()
-	args := flag.Args()
-	if len(args) != 2 {
-		syncLogger.Fatal(fmt.Sprintf("need 2 positional arguments, found: %d", len(args)))
+// parseExitCodes: the exit codes in a comma separated list.
+func parseExitCodes(value string) ([]int, error) {
+	var codes []int
+	for _, item := range splitList(value) {
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 0 || code > 255 {
+			return nil, fmt.Errorf("invalid exit code %q", item)
+		}
+		codes = append(codes, code)
+	}
+	if len(codes) == 0 {
+		return nil, errors.New("need at least one exit code")
+	}
+	return codes, nil
+}
+
+// parseRate: parse a --connect-rate spec like 50/s, 600/m, or 10/500ms into connections per second, 0 if spec is
+// empty. The burst allows up to one period's worth of connections at once, at least one.
+func parseRate(spec string) (float64, int, error) {
+	if spec == "" {
+		return 0, 0, nil
+	}
+	count, per, _ := strings.Cut(spec, "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("invalid connect rate %q, want a number of connections like 50/s", spec)
+	}
+	var period time.Duration
+	switch per {
+	case "", "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		if period, err = time.ParseDuration(per); err != nil || period <= 0 {
+			return 0, 0, fmt.Errorf("invalid connect rate %q, want a period of s, m, h, or a duration", spec)
+		}
+	}
+	burst := int(n)
+	if burst < 1 {
+		burst = 1
+	}
+	return n / period.Seconds(), burst, nil
+}
+
+// envFlag: the repeatable --env KEY=VALUE flag
+type envFlag map[string]string
+
+func (ef *envFlag) String() string {
+	var vars []string
+	for name, value := range *ef {
+		vars = append(vars, name+"="+value)
+	}
+	sort.Strings(vars)
+	return strings.Join(vars, ",")
+}
+
+func (ef *envFlag) Set(spec string) error {
+	name, value, ok := strings.Cut(spec, "=")
+	if !ok || name == "" || strings.ContainsAny(name, "= \t") {
+		return fmt.Errorf("env must be KEY=VALUE, got %q", spec)
+	}
+	if *ef == nil {
+		*ef = make(envFlag)
+	}
+	(*ef)[name] = value
+	return nil
+}
+
+// reportFlag: the repeatable --report kind=FILE flag
+type reportFlag []executor.Report
+
+func (rf *reportFlag) String() string {
+	var specs []string
+	for _, r := range *rf {
+		specs = append(specs, r.Kind+"="+r.Path)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (rf *reportFlag) Set(spec string) error {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("report must be kind=FILE, got %q", spec)
+	}
+	switch parts[0] {
+	case "junit", "csv":
+	default:
+		return fmt.Errorf("unknown report kind: %q", parts[0])
+	}
+	*rf = append(*rf, executor.Report{Kind: parts[0], Path: parts[1]})
+	return nil
+}
+
+// expectation: what -expect-regex and -expect-exact ask of each host's stdout.
+func expectation() (api.Expectation, error) {
+	expect := api.Expectation{Exact: expectExact}
+	if expectRegex != "" {
+		re, err := regexp.Compile(expectRegex)
+		if err != nil {
+			return expect, fmt.Errorf("-expect-regex: %v", err)
+		}
+		expect.Regex = re
 	}
-	hostList := args[0]
-	remoteCommand := args[1]
+	return expect, nil
+}
 
-	// create ssh client config
+// userSet: whether -user was passed explicitly, so it wins over the ssh config.
+func userSet() bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "user" {
+			set = true
+		}
+	})
+	return set
+}
+
+func main() {
+	// parse flags and check positional arguments
+	subcommand, argv := "", os.Args[1:]
+	if len(argv) > 0 {
+		for _, name := range executor.Subcommands {
+			if argv[0] == name {
+				subcommand, argv = argv[0], argv[1:]
+				break
+			}
+		}
+	}
+	if subcommand == executor.SubcommandCopy || subcommand == executor.SubcommandFetch {
+		transferFlags()
+	}
+	if subcommand == executor.SubcommandCopy {
+		copyFlags()
+	}
+	if subcommand == executor.SubcommandServe {
+		serveFlags()
+	}
+	if subcommand == executor.SubcommandHistory {
+		historyFlags()
+	}
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(argv); err == flag.ErrHelp {
+		os.Exit(executor.ExitOK)
+	} else if err != nil {
+		os.Exit(executor.ExitSetup)
+	}
+	// flags win over the environment, which wins over the profile
+	if err := applyEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "remote-executor: unable to parse flags: %v\n", err)
+		os.Exit(executor.ExitSetup)
+	}
+	if profile != "" {
+		if err := applyProfile(configPath, profile); err != nil {
+			fmt.Fprintf(os.Stderr, "remote-executor: unable to load profile: %v\n", err)
+			os.Exit(executor.ExitSetup)
+		}
+	}
 
-	sshConf, err := utils.NewSSHConfig(checkHostKey, knownHostsPath, privateKeyPath, remoteUser)
+	level := slog.LevelInfo
+	switch {
+	case verbose:
+		level = slog.LevelDebug
+	case quiet:
+		level = slog.LevelWarn
+	}
+	// keep stdout clean for machine-readable output
+	logOut := os.Stdout
+	if outputFormat != "text" || formatTmpl != "" {
+		logOut = os.Stderr
+	}
+	syncLogger, err := utils.NewLogger(logOut, "remote-executor: ", logFormat, level)
+	if err != nil {
+		syncLogger, _ = utils.NewLogger(os.Stderr, "remote-executor: ", utils.LogText, level)
+		syncLogger.FatalExitCode = executor.ExitSetup
+		syncLogger.Fatal(fmt.Sprintf("unable to parse flags: %v", err))
+	}
+	syncLogger.FatalExitCode = executor.ExitSetup
+	if verbose && quiet {
+		syncLogger.Fatal("unable to parse flags: -v and -q are mutually exclusive")
+	}
+	if defaultPort <= 0 || defaultPort > 65535 {
+		syncLogger.Fatal(fmt.Sprintf("unable to parse flags: invalid port %d", defaultPort))
+	}
+	if numWorkers <= 0 {
+		syncLogger.Fatal(fmt.Sprintf("unable to parse flags: invalid concurrency %d", numWorkers))
+	}
+	if hostKeyPolicy == "" {
+		hostKeyPolicy = utils.HostKeyIgnore
+		if checkHostKey {
+			hostKeyPolicy = utils.HostKeyStrict
+		}
+	}
+	if skipRecent < 0 || (skipRecent > 0 && historyPath == "") {
+		syncLogger.Fatal("unable to parse flags: -skip-recent must be positive and needs -history-db")
+	}
+	if breakerFailures < 0 {
+		syncLogger.Fatal("unable to parse flags: -breaker-failures must be positive")
+	}
+	if lockTTL <= 0 {
+		syncLogger.Fatal("unable to parse flags: -lock-ttl must be positive")
+	}
+	if maxOutput < 0 {
+		syncLogger.Fatal("unable to parse flags: -max-output-bytes must be positive")
+	}
+	if keepalive < 0 || keepaliveCount < 1 {
+		syncLogger.Fatal("unable to parse flags: -keepalive must be positive and -keepalive-count at least 1")
+	}
+	sig, err := api.ParseSignal(stopSignal)
+	if err != nil || stopGrace < 0 {
+		syncLogger.Fatal("unable to parse flags: -stop-signal must be a signal like TERM and -stop-grace positive")
+	}
+	if idleTimeout < 0 {
+		syncLogger.Fatal("unable to parse flags: -idle-timeout must be positive")
+	}
+	if sortBy != "" && sortBy != executor.SortHost && sortBy != executor.SortInventory {
+		syncLogger.Fatal(fmt.Sprintf("unable to parse flags: unknown -sort order %q, want host or inventory", sortBy))
+	}
+	if maxWorkers != 0 && maxWorkers < numWorkers {
+		syncLogger.Fatal(fmt.Sprintf("unable to parse flags: -max-concurrency %d is below -concurrency", maxWorkers))
+	}
+	if maxFailures < 0 || maxFailurePct < 0 || maxFailurePct > 100 {
+		syncLogger.Fatal("unable to parse flags: -max-failures and -max-failure-pct must be positive, at most 100 percent")
+	}
+	if resumePath != "" && statePath != "" && resumePath != statePath {
+		syncLogger.Fatal("unable to parse flags: -resume checkpoints to the file it resumes from, drop -state")
+	}
+	if retryFailed && failedOut == "" {
+		syncLogger.Fatal("unable to parse flags: -retry-failed needs -failed-out")
+	}
+	if slackToken != "" && slackChannel == "" && slackWebhook == "" {
+		syncLogger.Fatal("unable to parse flags: -slack-token needs -slack-channel")
+	}
+	perSecond, burst, err := parseRate(connectRate)
+	if err != nil {
+		syncLogger.Fatal(fmt.Sprintf("unable to parse flags: %v", err))
+	}
+	expect, err := expectation()
 	if err != nil {
 		syncLogger.Fatal(fmt.Sprintf("unable to parse flags: %v", err))
 	}
+	okCodes, err := parseExitCodes(okExitCodes)
+	if err != nil {
+		syncLogger.Fatal(fmt.Sprintf("unable to parse flags: -ok-exit-codes: %v", err))
+	}
 
+	args := flag.Args()
+	hostList := hostSource
+	switch subcommand {
+	case executor.SubcommandHistory, executor.SubcommandVerifyAudit, executor.SubcommandServe:
+	default:
+		if hostList != "" && inlineHosts != "" {
+			syncLogger.Fatal("unable to parse flags: -hosts and -H are mutually exclusive")
+		}
+		if hostList == "" && inlineHosts == "" {
+			if len(args) == 0 {
+				syncLogger.Fatal("need a host list as the first positional argument, or --hosts or -H")
+			}
+			hostList, args = args[0], args[1:]
+		}
+	}
 	// compile re
 	re, err := regexp.Compile(regexExpr)
 	if err != nil {
 		syncLogger.Fatal(fmt.Sprintf("unable to compile regex: %v", err))
 	}
 
-	// parse the host list
-	hosts, err := utils.ParseHostsList(hostList, re, utils.Append22)
-	if err != nil {
-		syncLogger.Fatal(fmt.Sprintf("unable to parse host list: %v", err))
-	}
-
-	// create worker pool
-	pool := api.CreatePool(numWorkers, remoteCommand, sshConf)
-
-	// schedule workers
-	pool.ScheduleWorkers()
-
-	fh := newFailedHosts()
-
-	var wg sync.WaitGroup
-	for _, host := range hosts {
-		wg.Add(1)
-		go func(h string) {
-			ctx := context.Background()
-			res, err := pool.RunJob(ctx, h)
-			if err != nil {
-				syncLogger.Error(fmt.Sprintf("error running command against host: %s, error: %v", h, err))
-				fh.append(h)
-			} else if res.Err != nil {
-				syncLogger.Error(fmt.Sprintf("%s\n%s\n%s", res.Host, res.Err.Error(), string(res.Output)))
-				fh.append(h)
-			} else {
-				syncLogger.Info(string(res.Output))
-			}
-			wg.Done()
-		}(host)
-	}
-	wg.Wait()
+	// color only when writing to a terminal, and never if asked not to, see https://no-color.org
+	_, noColorEnv := os.LookupEnv("NO_COLOR")
+	color := !noColor && !noColorEnv && logFormat == utils.LogText && term.IsTerminal(int(os.Stdout.Fd()))
+
+	status, err := executor.Execute(context.Background(), &executor.Config{
+		Subcommand: subcommand,
+		HostList:   hostList,
+		Args:       args,
+		Logger:     syncLogger,
+
+		InlineHosts:     inlineHosts,
+		InventoryFormat: inventoryFmt,
+		Parser:          re,
+		Groups:          splitList(groups),
+		NotGroups:       splitList(notGroups),
+		Limit:           splitList(limitHosts),
+		Exclude:         splitList(excludeHosts),
+		DefaultPort:     defaultPort,
+		CIDRHostsOnly:   cidrHostsOnly,
+		FailedOut:       failedOut,
+		RetryFailed:     retryFailed,
+
+		User:           remoteUser,
+		UserSet:        userSet(),
+		AuthOrder:      authOrder,
+		UseAgent:       useAgent,
+		PasswordAuth:   passwordAuth,
+		PrivateKeys:    splitList(privateKeyPath),
+		Passphrase:     passphrase,
+		PasswordFD:     passwordFD,
+		PasswordSecret: passwordSecret,
+		TOTPSecret:     totpSecret,
+		VaultSSH:       vaultSSH,
+		HostKeyPolicy:  hostKeyPolicy,
+		KnownHosts:     knownHostsPath,
+		ConnectTimeout: dialTimeout,
+		SSHOptions: []utils.SSHOption{utils.WithAlgorithms(utils.Algorithms{
+			Ciphers:           splitList(ciphers),
+			KeyExchanges:      splitList(kexAlgorithms),
+			MACs:              splitList(macs),
+			HostKeyAlgorithms: splitList(hostKeyAlgos),
+		})},
+		SSHConfigPath: sshConfigPath,
+		Credentials:   credsPath,
+		Jump:          jumpSpec,
+		Transport:     transportFlag,
+		DockerCLI:     dockerCLI,
+
+		Script:       scriptPath,
+		PipeStdin:    pipeStdin,
+		Shell:        wrapShell,
+		Chdir:        chdir,
+		Env:          remoteEnv,
+		FileMode:     fileMode,
+		FileOwner:    fileOwner,
+		VerifyCopy:   verifyCopy,
+		IncludeFiles: splitList(includeFiles),
+		ExcludeFiles: splitList(excludeFiles),
+
+		Workers:         numWorkers,
+		MaxWorkers:      maxWorkers,
+		Timeout:         jobTimeout,
+		MaxRuntime:      maxRuntime,
+		Keepalive:       keepalive,
+		KeepaliveCount:  keepaliveCount,
+		StopSignal:      sig,
+		StopGrace:       stopGrace,
+		IdleTimeout:     idleTimeout,
+		BufferLimit:     bufferLimit,
+		MaxOutput:       maxOutput,
+		AbortOutput:     abortOutput,
+		CleanOutput:     cleanOutput,
+		Expect:          expect,
+		OKExitCodes:     okCodes,
+		RemoteLock:      remoteLock,
+		LockTTL:         lockTTL,
+		BreakerFailures: breakerFailures,
+		BreakerCooldown: breakerCooldown,
+		ConnectRate:     perSecond,
+		ConnectBurst:    burst,
+		DialJitter:      dialJitter,
 
-	if summarize && len(fh.failed) > 0 {
-		logMsg := fmt.Sprintf("failed hosts:\n%s", strings.Join(fh.failed, "\n"))
-		syncLogger.Info(logMsg)
+		Serial:        serial,
+		SerialAbort:   serialAbort,
+		Canary:        canary,
+		CanaryAuto:    canaryAuto,
+		Confirm:       confirm,
+		MaxFailures:   maxFailures,
+		MaxFailurePct: maxFailurePct,
+
+		Output:        outputFormat,
+		Format:        formatTmpl,
+		SortBy:        sortBy,
+		OutDir:        outDir,
+		Aggregate:     aggregate,
+		Diff:          showOutliers,
+		Stream:        stream,
+		Progress:      showProgress,
+		Color:         color,
+		Summarize:     summarize,
+		Reports:       reports,
+		MetricsListen: metricsListen,
+
+		StatePath:   statePath,
+		ResumePath:  resumePath,
+		SkipRecent:  skipRecent,
+		Force:       force,
+		HistoryPath: historyPath,
+		AuditPath:   auditPath,
+
+		NotifyURL:      notifyURL,
+		NotifyFailures: notifyFailures,
+		SlackWebhook:   slackWebhook,
+		SlackToken:     slackToken,
+		SlackChannel:   slackChannel,
+
+		HistoryRun:   historyRunID,
+		HistoryHost:  historyHost,
+		HistorySince: historySince,
+		HistoryLast:  historyLimit,
+
+		Listen:           listenAddr,
+		GRPCListen:       grpcListenAddr,
+		Token:            serveToken,
+		ReuseConnections: reuseConnections,
+	})
+	if err != nil {
+		syncLogger.Fatal(err.Error())
 	}
+	os.Exit(status)
 }
@@ -0,0 +1,107 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ec2Reservations: the parts of `aws ec2 describe-instances` output used to build an inventory
+type ec2Reservations struct {
+	Reservations []struct {
+		Instances []struct {
+			InstanceID       string `json:"InstanceId"`
+			PrivateIPAddress string `json:"PrivateIpAddress"`
+			PublicIPAddress  string `json:"PublicIpAddress"`
+			Placement        struct {
+				AvailabilityZone string `json:"AvailabilityZone"`
+			} `json:"Placement"`
+			Tags []struct {
+				Key   string `json:"Key"`
+				Value string `json:"Value"`
+			} `json:"Tags"`
+		} `json:"Instances"`
+	} `json:"Reservations"`
+}
+
+// EC2: build an inventory from running EC2 instances using the aws CLI and its usual credentials and config.
+// spec is a comma separated list of tag:Key=Value filters, region=..., and ip=private or ip=public to pick the address
+// to connect to, private by default, e.g. tag:Role=web,region=us-west-2,ip=public.
+// Hosts are named by instance ID, tags become tag_<Key> vars, and each host belongs to its availability zone group.
+func EC2(spec string) (*Inventory, error) {
+	return ec2Instances(spec, false)
+}
+
+// SSM: build an inventory of running EC2 instances to reach through AWS Systems Manager, selected like EC2 but without
+// ip=. Hosts are named by instance ID, use the ssm transport instead of an address, and have the region in the
+// aws_region var if one was given.
+func SSM(spec string) (*Inventory, error) {
+	return ec2Instances(spec, true)
+}
+
+// ec2Instances: list the running EC2 instances matching spec, see EC2, as ssh or ssm hosts.
+func ec2Instances(spec string, ssm bool) (*Inventory, error) {
+	args := []string{"ec2", "describe-instances", "--output", "json"}
+	region := ""
+	filters := []string{"Name=instance-state-name,Values=running"}
+	public := false
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		key, value, ok := strings.Cut(part, "=")
+		switch {
+		case part == "":
+		case !ok || value == "":
+			return nil, fmt.Errorf("invalid EC2 selector %q, want key=value", part)
+		case strings.HasPrefix(key, "tag:"):
+			filters = append(filters, fmt.Sprintf("Name=%s,Values=%s", key, value))
+		case key == "region":
+			args = append(args, "--region", value)
+			region = value
+		case key == "ip" && !ssm && (value == "private" || value == "public"):
+			public = value == "public"
+		default:
+			return nil, fmt.Errorf("unknown EC2 selector %q", part)
+		}
+	}
+	args = append(append(args, "--filters"), filters...)
+
+	out, err := runCLI("aws", args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list EC2 instances: %v", err)
+	}
+	var resp ec2Reservations
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("unable to parse EC2 instances: %v", err)
+	}
+
+	inv := &Inventory{Groups: make(map[string][]string)}
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			host := Host{Name: instance.InstanceID, Vars: make(map[string]string)}
+			switch {
+			case ssm:
+				host.Transport = "ssm"
+				if region != "" {
+					host.Vars["aws_region"] = region
+				}
+			case public:
+				host.Address = instance.PublicIPAddress
+			default:
+				host.Address = instance.PrivateIPAddress
+			}
+			if host.Address == "" && !ssm {
+				// e.g. no public IP, there is no way to reach the instance
+				continue
+			}
+			for _, tag := range instance.Tags {
+				host.Vars["tag_"+tag.Key] = tag.Value
+			}
+			if zone := instance.Placement.AvailabilityZone; zone != "" {
+				host.Groups = []string{zone}
+				inv.Groups[zone] = append(inv.Groups[zone], host.Name)
+			}
+			inv.Hosts = append(inv.Hosts, host)
+		}
+	}
+	return inv, nil
+}
@@ -0,0 +1,70 @@
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// composeServiceLabel: the label compose puts on the containers of each service
+const composeServiceLabel = "com.docker.compose.service"
+
+// dockerContainer: the parts of a line of `docker ps --format '{{json .}}'` output used to build an inventory
+type dockerContainer struct {
+	Names  string `json:"Names"`
+	Image  string `json:"Image"`
+	Labels string `json:"Labels"`
+}
+
+// DockerContainers: build an inventory from the running containers listed by cli, docker or a CLI that takes the same
+// arguments like nerdctl. spec is a comma separated list of `docker ps` filters, e.g. label=role=web or name=api, a
+// bare word being a name filter. Hosts are named by container and use the docker transport, labels become
+// label_<key> vars and the image the image var, and containers started by compose belong to their service's group.
+func DockerContainers(cli, spec string) (*Inventory, error) {
+	args := []string{"ps", "--format", "{{json .}}"}
+	for _, filter := range strings.Split(spec, ",") {
+		filter = strings.TrimSpace(filter)
+		switch {
+		case filter == "":
+		case !strings.Contains(filter, "="):
+			args = append(args, "--filter", "name="+filter)
+		default:
+			args = append(args, "--filter", filter)
+		}
+	}
+
+	out, err := runCLI(cli, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list containers: %v", err)
+	}
+	inv := &Inventory{Groups: make(map[string][]string)}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var container dockerContainer
+		if err := json.Unmarshal(scanner.Bytes(), &container); err != nil {
+			return nil, fmt.Errorf("unable to parse containers: %v", err)
+		}
+		// containers with several names are reached by the first
+		name, _, _ := strings.Cut(container.Names, ",")
+		host := Host{Name: name, Transport: "docker", Vars: map[string]string{"image": container.Image}}
+		for _, label := range strings.Split(container.Labels, ",") {
+			if key, value, ok := strings.Cut(label, "="); ok {
+				host.Vars["label_"+key] = value
+			}
+		}
+		if service := host.Vars["label_"+composeServiceLabel]; service != "" {
+			host.Groups = []string{service}
+			inv.Groups[service] = append(inv.Groups[service], host.Name)
+		}
+		inv.Hosts = append(inv.Hosts, host)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to parse containers: %v", err)
+	}
+	return inv, nil
+}
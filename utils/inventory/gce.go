@@ -0,0 +1,96 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// gceInstance: the parts of `gcloud compute instances list` output used to build an inventory
+type gceInstance struct {
+	Name              string            `json:"name"`
+	Zone              string            `json:"zone"`
+	Labels            map[string]string `json:"labels"`
+	NetworkInterfaces []struct {
+		NetworkIP     string `json:"networkIP"`
+		AccessConfigs []struct {
+			NatIP string `json:"natIP"`
+		} `json:"accessConfigs"`
+	} `json:"networkInterfaces"`
+}
+
+// GCE: build an inventory from running Compute Engine instances using the gcloud CLI and its usual credentials and
+// config. spec is a comma separated list of project=..., zone=... (may be repeated), label:key=value selectors, and
+// ip=internal or ip=external to pick the address to connect to, internal by default, e.g.
+// project=prod,zone=us-central1-a,label:role=web. Hosts are named by instance name, labels become label_<key> vars,
+// and each host belongs to its zone group.
+func GCE(spec string) (*Inventory, error) {
+	args := []string{"compute", "instances", "list", "--format=json"}
+	filters := []string{"status=RUNNING"}
+	var zones []string
+	external := false
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		key, value, ok := strings.Cut(part, "=")
+		switch {
+		case part == "":
+		case !ok || value == "":
+			return nil, fmt.Errorf("invalid GCE selector %q, want key=value", part)
+		case strings.HasPrefix(key, "label:"):
+			filters = append(filters, fmt.Sprintf("labels.%s=%q", strings.TrimPrefix(key, "label:"), value))
+		case key == "project":
+			args = append(args, "--project="+value)
+		case key == "zone":
+			zones = append(zones, value)
+		case key == "ip" && (value == "internal" || value == "external"):
+			external = value == "external"
+		default:
+			return nil, fmt.Errorf("unknown GCE selector %q", part)
+		}
+	}
+	if len(zones) > 0 {
+		args = append(args, "--zones="+strings.Join(zones, ","))
+	}
+	args = append(args, "--filter="+strings.Join(filters, " AND "))
+
+	out, err := runCLI("gcloud", args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list GCE instances: %v", err)
+	}
+	var instances []gceInstance
+	if err := json.Unmarshal(out, &instances); err != nil {
+		return nil, fmt.Errorf("unable to parse GCE instances: %v", err)
+	}
+
+	inv := &Inventory{Groups: make(map[string][]string)}
+	for _, instance := range instances {
+		var addr string
+		if len(instance.NetworkInterfaces) > 0 {
+			nic := instance.NetworkInterfaces[0]
+			addr = nic.NetworkIP
+			if external {
+				addr = ""
+				if len(nic.AccessConfigs) > 0 {
+					addr = nic.AccessConfigs[0].NatIP
+				}
+			}
+		}
+		if addr == "" {
+			// e.g. no external IP, there is no way to reach the instance
+			continue
+		}
+		host := Host{Name: instance.Name, Address: addr, Vars: make(map[string]string)}
+		for key, value := range instance.Labels {
+			host.Vars["label_"+key] = value
+		}
+		if instance.Zone != "" {
+			// zones are reported as URLs ending in the zone name
+			zone := path.Base(instance.Zone)
+			host.Groups = []string{zone}
+			inv.Groups[zone] = append(inv.Groups[zone], host.Name)
+		}
+		inv.Hosts = append(inv.Hosts, host)
+	}
+	return inv, nil
+}
@@ -0,0 +1,347 @@
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadINI: read and parse the Ansible INI inventory at path.
+func LoadINI(path string) (*Inventory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read inventory: %v", err)
+	}
+	inv, err := ParseINI(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse inventory %s: %v", path, err)
+	}
+	return inv, nil
+}
+
+// iniHost: a host line's connection settings and variables, in Ansible's terms
+type iniHost struct {
+	spec hostSpec
+	line int
+}
+
+// ParseINI: parse an Ansible style INI inventory. Hosts before any section belong to the ungrouped group, [group]
+// sections list hosts with optional key=value variables, [group:vars] sections set group variables, and
+// [group:children] sections nest groups. ansible_host, ansible_port, ansible_user, ansible_ssh_private_key_file,
+// ansible_connection, and ansible_timeout, the connect timeout in seconds, become connection overrides, other
+// variables are kept as Vars. Host names may use ranges like www[01:50].example.com.
+func ParseINI(data []byte) (*Inventory, error) {
+	inv := &Inventory{Groups: make(map[string][]string)}
+	specs := make(map[string]*iniHost)
+	children := make(map[string][]string)
+	groupVars := make(map[string]map[string]string)
+	var groupOrder []string
+	addGroup := func(name string) {
+		if _, ok := inv.Groups[name]; !ok {
+			inv.Groups[name] = nil
+			groupOrder = append(groupOrder, name)
+		}
+	}
+
+	group, kind := "ungrouped", ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated section header", lineNum)
+			}
+			group, kind = line[1:len(line)-1], ""
+			if i := strings.LastIndex(group, ":"); i >= 0 {
+				group, kind = group[:i], group[i+1:]
+			}
+			if group == "" {
+				return nil, fmt.Errorf("line %d: empty group name", lineNum)
+			}
+			switch kind {
+			case "", "children":
+				addGroup(group)
+			case "vars":
+				if group != "all" {
+					addGroup(group)
+				}
+			default:
+				return nil, fmt.Errorf("line %d: unknown section type %q", lineNum, kind)
+			}
+			continue
+		}
+
+		switch kind {
+		case "vars":
+			key, value, err := iniVar(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			if groupVars[group] == nil {
+				groupVars[group] = make(map[string]string)
+			}
+			groupVars[group][key] = value
+		case "children":
+			children[group] = append(children[group], line)
+		default:
+			fields := strings.Fields(line)
+			names, err := expandRange(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			var spec hostSpec
+			for _, field := range fields[1:] {
+				key, value, err := iniVar(field)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNum, err)
+				}
+				if err := spec.setAnsibleVar(key, value); err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNum, err)
+				}
+			}
+			addGroup(group)
+			for _, name := range names {
+				host, ok := specs[name]
+				if !ok {
+					host = &iniHost{line: lineNum}
+					specs[name] = host
+					inv.Hosts = append(inv.Hosts, Host{Name: name})
+				}
+				host.spec.merge(spec)
+				inv.Groups[group] = appendUnique(inv.Groups[group], name)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// expand children into their parents, detecting cycles
+	var expand func(group string, seen map[string]bool) ([]string, error)
+	expand = func(group string, seen map[string]bool) ([]string, error) {
+		if seen[group] {
+			return nil, fmt.Errorf("group %s contains itself", group)
+		}
+		seen[group] = true
+		defer delete(seen, group)
+		hosts := append([]string{}, inv.Groups[group]...)
+		for _, child := range children[group] {
+			if _, ok := inv.Groups[child]; !ok {
+				return nil, fmt.Errorf("group %s has unknown child group %s", group, child)
+			}
+			childHosts, err := expand(child, seen)
+			if err != nil {
+				return nil, err
+			}
+			for _, host := range childHosts {
+				hosts = appendUnique(hosts, host)
+			}
+		}
+		return hosts, nil
+	}
+	expanded := make(map[string][]string)
+	for _, group := range groupOrder {
+		hosts, err := expand(group, make(map[string]bool))
+		if err != nil {
+			return nil, err
+		}
+		expanded[group] = hosts
+	}
+	inv.Groups = expanded
+
+	for i := range inv.Hosts {
+		host := &inv.Hosts[i]
+		spec := specs[host.Name].spec
+		host.Address = spec.Address
+		host.Port = spec.Port
+		host.User = spec.User
+		host.Transport = spec.Transport
+		host.ConnectTimeout = spec.ConnectTimeout
+		for _, keyFile := range spec.KeyFiles {
+			host.KeyFiles = append(host.KeyFiles, expandHome(keyFile))
+		}
+
+		vars := make(map[string]string)
+		merge(vars, groupVars["all"])
+		for _, group := range groupOrder {
+			if contains(inv.Groups[group], host.Name) {
+				host.Groups = append(host.Groups, group)
+				merge(vars, groupVars[group])
+			}
+		}
+		merge(vars, spec.Vars)
+		host.Vars = vars
+		if host.Transport == "" {
+			// set for a whole group in a :vars section
+			host.Transport = ansibleTransport(vars["ansible_connection"])
+		}
+		if timeout, ok := vars["ansible_timeout"]; ok && host.ConnectTimeout == 0 {
+			// set for a whole group in a :vars section
+			connectTimeout, err := ansibleTimeout(timeout)
+			if err != nil {
+				return nil, fmt.Errorf("host %s: %v", host.Name, err)
+			}
+			host.ConnectTimeout = connectTimeout
+		}
+	}
+	return inv, nil
+}
+
+// setAnsibleVar: apply a host variable, mapping Ansible's connection variables onto overrides.
+func (spec *hostSpec) setAnsibleVar(key, value string) error {
+	switch key {
+	case "ansible_host", "ansible_ssh_host":
+		spec.Address = value
+	case "ansible_port", "ansible_ssh_port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid %s: %q", key, value)
+		}
+		spec.Port = port
+	case "ansible_user", "ansible_ssh_user":
+		spec.User = value
+	case "ansible_ssh_private_key_file", "ansible_private_key_file":
+		spec.KeyFiles = []string{value}
+	case "ansible_connection":
+		spec.Transport = ansibleTransport(value)
+	case "ansible_timeout":
+		timeout, err := ansibleTimeout(value)
+		if err != nil {
+			return err
+		}
+		spec.ConnectTimeout = timeout
+	default:
+		if spec.Vars == nil {
+			spec.Vars = make(map[string]string)
+		}
+		spec.Vars[key] = value
+	}
+	return nil
+}
+
+// merge: apply the settings in other, for a host listed more than once.
+func (spec *hostSpec) merge(other hostSpec) {
+	if other.Address != "" {
+		spec.Address = other.Address
+	}
+	if other.Port != 0 {
+		spec.Port = other.Port
+	}
+	if other.User != "" {
+		spec.User = other.User
+	}
+	if len(other.KeyFiles) > 0 {
+		spec.KeyFiles = other.KeyFiles
+	}
+	if other.Transport != "" {
+		spec.Transport = other.Transport
+	}
+	if other.ConnectTimeout != 0 {
+		spec.ConnectTimeout = other.ConnectTimeout
+	}
+	if len(other.Vars) > 0 && spec.Vars == nil {
+		spec.Vars = make(map[string]string)
+	}
+	merge(spec.Vars, other.Vars)
+}
+
+// ansibleTransport: the transport for an ansible_connection, Ansible's ways of connecting over SSH are all the default.
+func ansibleTransport(connection string) string {
+	switch connection {
+	case "ssh", "paramiko", "smart":
+		return ""
+	default:
+		return connection
+	}
+}
+
+// ansibleTimeout: an ansible_timeout, a whole number of seconds.
+func ansibleTimeout(value string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("invalid ansible_timeout: %q", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// iniVar: split key=value, removing quotes around the value.
+func iniVar(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	key := strings.TrimSpace(parts[0])
+	if len(parts) != 2 || key == "" {
+		return "", "", fmt.Errorf("expected key=value, got %q", s)
+	}
+	value := strings.TrimSpace(parts[1])
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return key, value, nil
+}
+
+// ansibleRange: a [start:end] or [start:end:stride] range in a host pattern
+var ansibleRange = regexp.MustCompile(`\[([0-9a-zA-Z]+):([0-9a-zA-Z]+)(?::([0-9]+))?\]`)
+
+// expandRange: expand the first Ansible range in pattern, recursively, e.g. db-[a:c]-[01:02].
+// Numeric ranges keep the zero padding of their start.
+func expandRange(pattern string) ([]string, error) {
+	loc := ansibleRange.FindStringSubmatchIndex(pattern)
+	if loc == nil {
+		return []string{pattern}, nil
+	}
+	start, end := pattern[loc[2]:loc[3]], pattern[loc[4]:loc[5]]
+	stride := 1
+	if loc[6] >= 0 {
+		stride, _ = strconv.Atoi(pattern[loc[6]:loc[7]])
+		if stride <= 0 {
+			return nil, fmt.Errorf("invalid stride in %q", pattern)
+		}
+	}
+
+	var items []string
+	if lo, err := strconv.Atoi(start); err == nil {
+		hi, err := strconv.Atoi(end)
+		if err != nil || hi < lo {
+			return nil, fmt.Errorf("invalid range in %q", pattern)
+		}
+		width := 0
+		if len(start) > 1 && start[0] == '0' {
+			width = len(start)
+		}
+		for i := lo; i <= hi; i += stride {
+			items = append(items, fmt.Sprintf("%0*d", width, i))
+		}
+	} else {
+		if len(start) != 1 || len(end) != 1 || end[0] < start[0] {
+			return nil, fmt.Errorf("invalid range in %q", pattern)
+		}
+		for c := int(start[0]); c <= int(end[0]); c += stride {
+			items = append(items, string(rune(c)))
+		}
+	}
+
+	var names []string
+	for _, item := range items {
+		rest, err := expandRange(pattern[:loc[0]] + item + pattern[loc[1]:])
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, rest...)
+	}
+	return names, nil
+}
+
+func appendUnique(list []string, s string) []string {
+	if contains(list, s) {
+		return list
+	}
+	return append(list, s)
+}
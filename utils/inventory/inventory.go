@@ -0,0 +1,483 @@
+// Package inventory: structured host inventories with groups, per-host connection overrides, and variables.
+//
+// Inventories are YAML, or JSON since it is a subset of YAML:
+//
+//	vars:
+//	  env: prod
+//	hosts:
+//	  web1.example.com:
+//	    port: 2222
+//	    user: deploy
+//	    key_files: [~/.ssh/deploy]
+//	    vars:
+//	      role: web
+//	    env:
+//	      APP_ENV: prod
+//	  db1:
+//	    address: 10.0.0.5
+//	groups:
+//	  web:
+//	    hosts: [web1.example.com, web2.example.com]
+//	    vars:
+//	      tier: frontend
+//
+// Hosts only named by a group are added with no overrides. Variables are merged with host vars winning over group
+// vars, which win over top-level vars. env sets environment variables for the remote command and is merged the same
+// way. Ansible INI inventories are read by ParseINI.
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Host: an inventory entry. Name identifies the host in output, Address is dialled instead of Name if set.
+// A zero Port or empty User leaves the choice to the ssh config and command line flags, and an empty Transport to
+// the --transport flag. A zero Timeout or ConnectTimeout leaves it to the --timeout and --connect-timeout flags, for
+// hosts that need longer than the rest, e.g. behind slow satellite links.
+type Host struct {
+	Name           string
+	Address        string
+	Port           int
+	User           string
+	KeyFiles       []string
+	Transport      string
+	Timeout        time.Duration
+	ConnectTimeout time.Duration
+	Vars           map[string]string
+	Env            map[string]string
+	Groups         []string
+}
+
+// Inventory: every host in file order, and the host names belonging to each group
+type Inventory struct {
+	Hosts  []Host
+	Groups map[string][]string
+}
+
+// hostSpec: a host as written in the file
+type hostSpec struct {
+	Address        string            `yaml:"address"`
+	Port           int               `yaml:"port"`
+	User           string            `yaml:"user"`
+	KeyFiles       []string          `yaml:"key_files"`
+	Transport      string            `yaml:"transport"`
+	Timeout        time.Duration     `yaml:"timeout"`
+	ConnectTimeout time.Duration     `yaml:"connect_timeout"`
+	Vars           map[string]string `yaml:"vars"`
+	Env            map[string]string `yaml:"env"`
+}
+
+// groupSpec: a group as written in the file
+type groupSpec struct {
+	Hosts []string          `yaml:"hosts"`
+	Vars  map[string]string `yaml:"vars"`
+	Env   map[string]string `yaml:"env"`
+}
+
+// fileSpec: the top level of the file, hosts and groups are decoded later to keep their order
+type fileSpec struct {
+	Vars   map[string]string `yaml:"vars"`
+	Env    map[string]string `yaml:"env"`
+	Hosts  yaml.Node         `yaml:"hosts"`
+	Groups yaml.Node         `yaml:"groups"`
+}
+
+// Load: read and parse the inventory file at path.
+func Load(path string) (*Inventory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read inventory: %v", err)
+	}
+	inv, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse inventory %s: %v", path, err)
+	}
+	return inv, nil
+}
+
+// Parse: parse a YAML or JSON inventory.
+func Parse(data []byte) (*Inventory, error) {
+	var file fileSpec
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	inv := &Inventory{Groups: make(map[string][]string)}
+	index := make(map[string]int)
+	specs := make(map[string]hostSpec)
+	add := func(name string, spec hostSpec) error {
+		if name == "" {
+			return fmt.Errorf("host with an empty name")
+		}
+		if _, ok := index[name]; ok {
+			return fmt.Errorf("host %s is defined twice", name)
+		}
+		index[name] = len(inv.Hosts)
+		specs[name] = spec
+		inv.Hosts = append(inv.Hosts, Host{Name: name})
+		return nil
+	}
+
+	err := eachPair(&file.Hosts, func(name string, value *yaml.Node) error {
+		var spec hostSpec
+		if err := value.Decode(&spec); err != nil {
+			return fmt.Errorf("host %s: %v", name, err)
+		}
+		return add(name, spec)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groupVars := make(map[string]map[string]string)
+	groupEnv := make(map[string]map[string]string)
+	var groupOrder []string
+	err = eachPair(&file.Groups, func(name string, value *yaml.Node) error {
+		var spec groupSpec
+		if err := value.Decode(&spec); err != nil {
+			return fmt.Errorf("group %s: %v", name, err)
+		}
+		if _, ok := inv.Groups[name]; ok {
+			return fmt.Errorf("group %s is defined twice", name)
+		}
+		inv.Groups[name] = spec.Hosts
+		groupVars[name] = spec.Vars
+		groupEnv[name] = spec.Env
+		groupOrder = append(groupOrder, name)
+		for _, host := range spec.Hosts {
+			if _, ok := index[host]; !ok {
+				if err := add(host, hostSpec{}); err != nil {
+					return fmt.Errorf("group %s: %v", name, err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range inv.Hosts {
+		host := &inv.Hosts[i]
+		spec := specs[host.Name]
+		host.Address = spec.Address
+		host.Port = spec.Port
+		host.User = spec.User
+		host.Transport = spec.Transport
+		host.Timeout = spec.Timeout
+		host.ConnectTimeout = spec.ConnectTimeout
+		for _, keyFile := range spec.KeyFiles {
+			host.KeyFiles = append(host.KeyFiles, expandHome(keyFile))
+		}
+		if host.Port < 0 || host.Port > 65535 {
+			return nil, fmt.Errorf("host %s: invalid port %d", host.Name, host.Port)
+		}
+		if host.Timeout < 0 || host.ConnectTimeout < 0 {
+			return nil, fmt.Errorf("host %s: timeouts must not be negative", host.Name)
+		}
+
+		vars, env := make(map[string]string), make(map[string]string)
+		merge(vars, file.Vars)
+		merge(env, file.Env)
+		for _, group := range groupOrder {
+			if contains(inv.Groups[group], host.Name) {
+				host.Groups = append(host.Groups, group)
+				merge(vars, groupVars[group])
+				merge(env, groupEnv[group])
+			}
+		}
+		merge(vars, spec.Vars)
+		merge(env, spec.Env)
+		host.Vars = vars
+		if len(env) > 0 {
+			host.Env = env
+		}
+	}
+	return inv, nil
+}
+
+// FromNames: an inventory of hosts with no overrides, e.g. from a flat host list. Names in user@host form connect
+// to host as user, and names in alias=host or alias=user@host form are known as alias in output and connect to host,
+// e.g. cache-eu-1=10.3.4.5:2222.
+func FromNames(names []string) *Inventory {
+	inv := &Inventory{Groups: make(map[string][]string)}
+	for _, name := range names {
+		host := Host{Name: name, Vars: map[string]string{}}
+		conn := name
+		if alias, addr, ok := strings.Cut(name, "="); ok {
+			host.Name, host.Address, conn = alias, addr, addr
+		}
+		if user, addr, ok := strings.Cut(conn, "@"); ok {
+			host.User, host.Address = user, addr
+		}
+		inv.Hosts = append(inv.Hosts, host)
+	}
+	return inv
+}
+
+// SelectGroups: the hosts belonging to any of the include groups, or every host if there are none, minus the hosts
+// belonging to any of the exclude groups. The all group contains every host. Unknown group names are an error so a
+// typo cannot silently widen or narrow a run.
+func (inv *Inventory) SelectGroups(include, exclude []string) (*Inventory, error) {
+	for _, group := range append(append([]string{}, include...), exclude...) {
+		if _, ok := inv.Groups[group]; !ok && group != "all" {
+			return nil, fmt.Errorf("unknown group: %s", group)
+		}
+	}
+	inGroups := func(host Host, groups []string) bool {
+		for _, group := range groups {
+			if group == "all" || contains(host.Groups, group) {
+				return true
+			}
+		}
+		return false
+	}
+	return inv.Filter(func(host Host) bool {
+		return (len(include) == 0 || inGroups(host, include)) && !inGroups(host, exclude)
+	}), nil
+}
+
+// Limit: the hosts matching any of the limit patterns, or every host if there are none, minus the hosts matching
+// any of the exclude patterns. Patterns are globs like web-1*, or regular expressions if they start with ~, and are
+// matched against the host name with and without its port.
+func (inv *Inventory) Limit(limit, exclude []string) (*Inventory, error) {
+	limitRe, err := compilePatterns(limit)
+	if err != nil {
+		return nil, err
+	}
+	excludeRe, err := compilePatterns(exclude)
+	if err != nil {
+		return nil, err
+	}
+	matches := func(host Host, patterns []*regexp.Regexp) bool {
+		names := []string{host.Name}
+		if host.Address != "" {
+			names = append(names, host.Address)
+		}
+		for _, name := range names {
+			if name, _, err := net.SplitHostPort(name); err == nil {
+				names = append(names, name)
+			}
+		}
+		for _, re := range patterns {
+			for _, name := range names {
+				if re.MatchString(name) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return inv.Filter(func(host Host) bool {
+		return (len(limitRe) == 0 || matches(host, limitRe)) && !matches(host, excludeRe)
+	}), nil
+}
+
+// compilePatterns: compile host patterns, ~ prefixed regular expressions are unanchored and globs match the whole name.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		expr := strings.TrimPrefix(pattern, "~")
+		if expr == pattern {
+			expr = globToRegexp(pattern)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %v", pattern, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// globToRegexp: translate a glob with *, ?, and [...] classes into an anchored regular expression.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			if end := strings.IndexByte(glob[i+1:], ']'); end > 0 {
+				class := glob[i+1 : i+1+end]
+				if class[0] == '!' {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + class + "]")
+				i += end + 1
+				continue
+			}
+			b.WriteString(regexp.QuoteMeta("["))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// Dropped: a host removed by Validate and why
+type Dropped struct {
+	Host   string
+	Reason string
+}
+
+// Validate: remove hosts that cannot be connected to, i.e. empty names, names or addresses containing whitespace, and
+// bad ports, and hosts that would connect to the same address and port as the same user as an earlier host, assuming
+// defaultPort for hosts without one. Hosts with a Transport other than ssh are not connected to and only need a unique
+// name. The removed hosts are returned with the reason for dropping them.
+func (inv *Inventory) Validate(defaultPort int) (*Inventory, []Dropped) {
+	var dropped []Dropped
+	seen := make(map[string]string)
+	res := inv.Filter(func(host Host) bool {
+		key, reason := dialKey(host, defaultPort)
+		if reason == "" {
+			if first, ok := seen[key]; ok {
+				reason = fmt.Sprintf("duplicate of %s", first)
+			}
+		}
+		if reason != "" {
+			dropped = append(dropped, Dropped{Host: host.Name, Reason: reason})
+			return false
+		}
+		seen[key] = host.Name
+		return true
+	})
+	return res, dropped
+}
+
+// dialKey: the user, address, and port a host will be dialled with, or the reason it cannot be.
+func dialKey(host Host, defaultPort int) (string, string) {
+	if host.Transport != "" && host.Transport != "ssh" {
+		if strings.TrimSpace(host.Name) == "" {
+			return "", "empty host"
+		}
+		return host.Transport + ":" + host.Name, ""
+	}
+	addr := host.Address
+	if addr == "" {
+		addr = host.Name
+	}
+	if strings.TrimSpace(addr) == "" {
+		return "", "empty host"
+	}
+	if strings.Contains(addr, "@") {
+		return "", "invalid user@host"
+	}
+	if strings.ContainsAny(host.Name+addr, " \t\r\n") {
+		return "", "contains whitespace"
+	}
+
+	name, port := addr, ""
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		// a bracketed IPv6 literal without a port
+		name = addr[1 : len(addr)-1]
+	} else if strings.Contains(addr, ":") && net.ParseIP(addr) == nil {
+		var err error
+		if name, port, err = net.SplitHostPort(addr); err != nil {
+			return "", fmt.Sprintf("invalid host:port: %v", err)
+		}
+		if name == "" {
+			return "", "empty host"
+		}
+	}
+	if host.Port != 0 {
+		port = strconv.Itoa(host.Port)
+	}
+	if port == "" {
+		port = strconv.Itoa(defaultPort)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Sprintf("invalid port %q", port)
+	}
+	return host.User + "@" + net.JoinHostPort(strings.ToLower(name), port), ""
+}
+
+// Filter: the hosts for which keep returns true, with groups limited to those hosts.
+func (inv *Inventory) Filter(keep func(Host) bool) *Inventory {
+	res := &Inventory{Groups: make(map[string][]string)}
+	kept := make(map[string]bool)
+	for _, host := range inv.Hosts {
+		if keep(host) {
+			res.Hosts = append(res.Hosts, host)
+			kept[host.Name] = true
+		}
+	}
+	for group, hosts := range inv.Groups {
+		var members []string
+		for _, host := range hosts {
+			if kept[host] {
+				members = append(members, host)
+			}
+		}
+		res.Groups[group] = members
+	}
+	return res
+}
+
+// eachPair: call fn for each key and value of a mapping node, in file order. A missing or null node is empty.
+func eachPair(node *yaml.Node, fn func(key string, value *yaml.Node) error) error {
+	if node.Kind == 0 || node.Tag == "!!null" {
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping", node.Line)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if err := fn(node.Content[i].Value, node.Content[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func merge(dst, src map[string]string) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// runCLI: run a cloud provider CLI and return its stdout, replaced in tests
+var runCLI = func(name string, args ...string) ([]byte, error) {
+	out, err := exec.Command(name, args...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return nil, fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return out, nil
+}
+
+// expandHome: replace a leading ~ with the user's home directory.
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, _ := os.LookupEnv("HOME")
+		return home + path[1:]
+	}
+	return path
+}
@@ -0,0 +1,736 @@
+package inventory
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testYAML = `
+vars:
+  env: prod
+  tier: none
+env:
+  LANG: C
+hosts:
+  web1:
+    port: 2222
+    user: deploy
+    key_files: [~/.ssh/deploy]
+    vars:
+      role: web
+    env:
+      APP_ENV: prod
+  db1:
+    address: 10.0.0.5
+    timeout: 10m
+    connect_timeout: 1m30s
+  build:
+    transport: local
+groups:
+  web:
+    hosts: [web1, web2]
+    vars:
+      tier: frontend
+      role: unknown
+    env:
+      APP_ENV: unknown
+      TIER: frontend
+`
+
+func TestParse(t *testing.T) {
+	t.Setenv("HOME", "/home/test")
+	inv, err := Parse([]byte(testYAML))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := &Inventory{
+		Hosts: []Host{
+			{
+				Name:     "web1",
+				Port:     2222,
+				User:     "deploy",
+				KeyFiles: []string{"/home/test/.ssh/deploy"},
+				Vars:     map[string]string{"env": "prod", "tier": "frontend", "role": "web"},
+				Env:      map[string]string{"LANG": "C", "APP_ENV": "prod", "TIER": "frontend"},
+				Groups:   []string{"web"},
+			},
+			{
+				Name:           "db1",
+				Address:        "10.0.0.5",
+				Timeout:        10 * time.Minute,
+				ConnectTimeout: 90 * time.Second,
+				Vars:           map[string]string{"env": "prod", "tier": "none"},
+				Env:            map[string]string{"LANG": "C"},
+			},
+			{
+				Name:      "build",
+				Transport: "local",
+				Vars:      map[string]string{"env": "prod", "tier": "none"},
+				Env:       map[string]string{"LANG": "C"},
+			},
+			{
+				Name:   "web2",
+				Vars:   map[string]string{"env": "prod", "tier": "frontend", "role": "unknown"},
+				Env:    map[string]string{"LANG": "C", "APP_ENV": "unknown", "TIER": "frontend"},
+				Groups: []string{"web"},
+			},
+		},
+		Groups: map[string][]string{"web": {"web1", "web2"}},
+	}
+	if diff := cmp.Diff(want, inv); diff != "" {
+		t.Errorf("Parse mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSelectGroups(t *testing.T) {
+	inv, err := ParseINI([]byte(testINI))
+	if err != nil {
+		t.Fatalf("ParseINI: %v", err)
+	}
+	names := func(inv *Inventory) []string {
+		var names []string
+		for _, host := range inv.Hosts {
+			names = append(names, host.Name)
+		}
+		return names
+	}
+
+	tests := map[string]struct {
+		include, exclude []string
+		want             []string
+	}{
+		"everything": {nil, nil, []string{
+			"bastion", "web01.example.com", "web02.example.com", "web03.example.com", "db-a", "db-b",
+		}},
+		"one group":     {[]string{"db"}, nil, []string{"db-a", "db-b"}},
+		"two groups":    {[]string{"db", "ungrouped"}, nil, []string{"bastion", "db-a", "db-b"}},
+		"children":      {[]string{"prod"}, []string{"web"}, []string{"db-a", "db-b"}},
+		"exclude only":  {nil, []string{"prod"}, []string{"bastion"}},
+		"all minus web": {[]string{"all"}, []string{"web", "db"}, []string{"bastion"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := inv.SelectGroups(tc.include, tc.exclude)
+			if err != nil {
+				t.Fatalf("SelectGroups: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, names(got)); diff != "" {
+				t.Errorf("SelectGroups mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	got, _ := inv.SelectGroups([]string{"prod"}, []string{"db"})
+	if diff := cmp.Diff([]string(nil), got.Groups["db"]); diff != "" {
+		t.Errorf("excluded hosts are still in their group (-want +got):\n%s", diff)
+	}
+	if _, err := inv.SelectGroups([]string{"wbe"}, nil); err == nil {
+		t.Error("SelectGroups accepted an unknown group")
+	}
+	if _, err := inv.SelectGroups(nil, []string{"canry"}); err == nil {
+		t.Error("SelectGroups accepted an unknown excluded group")
+	}
+}
+
+func TestLimit(t *testing.T) {
+	inv := FromNames([]string{"web-1:22", "web-12:22", "web-13:22", "web-2:22", "db-1:2222", "root@db-2:22"})
+	tests := map[string]struct {
+		limit, exclude []string
+		want           []string
+	}{
+		"everything": {nil, nil, []string{
+			"web-1:22", "web-12:22", "web-13:22", "web-2:22", "db-1:2222", "root@db-2:22",
+		}},
+		"glob":         {[]string{"web-1*"}, nil, []string{"web-1:22", "web-12:22", "web-13:22"}},
+		"with port":    {[]string{"*:2222"}, nil, []string{"db-1:2222"}},
+		"with user":    {[]string{"db-2"}, nil, []string{"root@db-2:22"}},
+		"exclude":      {[]string{"web-1*"}, []string{"web-13", "web-12"}, []string{"web-1:22"}},
+		"regex":        {[]string{"~^web-[0-9]$"}, nil, []string{"web-1:22", "web-2:22"}},
+		"class":        {[]string{"web-[!1]"}, nil, []string{"web-2:22"}},
+		"exclude only": {nil, []string{"web-*"}, []string{"db-1:2222", "root@db-2:22"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := inv.Limit(tc.limit, tc.exclude)
+			if err != nil {
+				t.Fatalf("Limit: %v", err)
+			}
+			var names []string
+			for _, host := range got.Hosts {
+				names = append(names, host.Name)
+			}
+			if diff := cmp.Diff(tc.want, names); diff != "" {
+				t.Errorf("Limit mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if _, err := inv.Limit([]string{"~web-("}, nil); err == nil {
+		t.Error("Limit accepted an invalid regular expression")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	inv := FromNames([]string{
+		"web1:22", "web1", "WEB1:22", "web2:22", "", "web 3:22", "web4:99999", "web5:ssh", "localhost:1:22", ":22",
+		"::1", "[::1]:22", "[::1]:2222", "[::1]", "deploy@web1:22", "deploy@WEB1:22", "a@b@web1:22", "deploy@",
+	})
+	inv.Hosts = append(inv.Hosts, Host{Name: "db", Address: "10.0.0.1", Port: 2222}, Host{Name: "db-2", Address: "10.0.0.1:2222"})
+	local := Host{Name: "local:build", Transport: "local"}
+	inv.Hosts = append(inv.Hosts, local, local)
+
+	got, dropped := inv.Validate(22)
+	var names []string
+	for _, host := range got.Hosts {
+		names = append(names, host.Name)
+	}
+	want := []string{"web1:22", "web2:22", "::1", "[::1]:2222", "deploy@web1:22", "db", "local:build"}
+	if diff := cmp.Diff(want, names); diff != "" {
+		t.Errorf("Validate kept the wrong hosts (-want +got):\n%s", diff)
+	}
+
+	var reasons []string
+	for _, d := range dropped {
+		reasons = append(reasons, d.Host+": "+d.Reason)
+	}
+	wantReasons := []string{
+		"web1: duplicate of web1:22",
+		"WEB1:22: duplicate of web1:22",
+		": empty host",
+		"web 3:22: contains whitespace",
+		`web4:99999: invalid port "99999"`,
+		`web5:ssh: invalid port "ssh"`,
+		"localhost:1:22: invalid host:port: address localhost:1:22: too many colons in address",
+		":22: empty host",
+		"[::1]:22: duplicate of ::1",
+		"[::1]: duplicate of ::1",
+		"deploy@WEB1:22: duplicate of deploy@web1:22",
+		"a@b@web1:22: invalid user@host",
+		"deploy@: invalid user@host",
+		"db-2: duplicate of db",
+		"local:build: duplicate of local:build",
+	}
+	if diff := cmp.Diff(wantReasons, reasons); diff != "" {
+		t.Errorf("Validate dropped the wrong hosts (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	inv, err := Parse([]byte(`{"hosts": {"a": {"port": 22}, "b": null}, "groups": {"g": {"hosts": ["b"]}}}`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := &Inventory{
+		Hosts: []Host{
+			{Name: "a", Port: 22, Vars: map[string]string{}},
+			{Name: "b", Vars: map[string]string{}, Groups: []string{"g"}},
+		},
+		Groups: map[string][]string{"g": {"b"}},
+	}
+	if diff := cmp.Diff(want, inv); diff != "" {
+		t.Errorf("Parse mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"bad yaml":        "hosts: [",
+		"hosts not map":   "hosts: [a, b]",
+		"bad port":        "hosts: {a: {port: 70000}}",
+		"port not number": "hosts: {a: {port: nope}}",
+		"duplicate host":  "hosts: {a: {}, a: {}}",
+		"bad timeout":     "hosts: {a: {timeout: soon}}",
+		"negative":        "hosts: {a: {connect_timeout: -1s}}",
+		"groups not map":  "groups: [a]",
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse([]byte(data)); err == nil {
+				t.Errorf("Parse(%q) succeeded, want an error", data)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts.yaml")
+	if err := ioutil.WriteFile(path, []byte("hosts: {a: {}}"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile: %v", err)
+	}
+	inv, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(inv.Hosts) != 1 || inv.Hosts[0].Name != "a" {
+		t.Errorf("Load returned %+v, want a single host a", inv.Hosts)
+	}
+	if _, err := Load(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("Load succeeded for a missing file")
+	}
+}
+
+const testINI = `
+# comment
+bastion ansible_host=10.0.0.1
+
+[web]
+web[01:02].example.com ansible_user=deploy role=web
+web03.example.com ansible_port=2222 ansible_ssh_private_key_file=~/.ssh/web
+
+[db]
+db-[a:b] ansible_user='dba'
+
+[prod:children]
+web
+db
+
+[all:vars]
+env=prod
+
+[web:vars]
+tier = "frontend"
+ansible_connection = ssh
+`
+
+func TestParseINI(t *testing.T) {
+	t.Setenv("HOME", "/home/test")
+	inv, err := ParseINI([]byte(testINI))
+	if err != nil {
+		t.Fatalf("ParseINI: %v", err)
+	}
+	webVars := map[string]string{"env": "prod", "tier": "frontend", "role": "web", "ansible_connection": "ssh"}
+	want := &Inventory{
+		Hosts: []Host{
+			{Name: "bastion", Address: "10.0.0.1", Vars: map[string]string{"env": "prod"}, Groups: []string{"ungrouped"}},
+			{Name: "web01.example.com", User: "deploy", Vars: webVars, Groups: []string{"web", "prod"}},
+			{Name: "web02.example.com", User: "deploy", Vars: webVars, Groups: []string{"web", "prod"}},
+			{
+				Name:     "web03.example.com",
+				Port:     2222,
+				KeyFiles: []string{"/home/test/.ssh/web"},
+				Vars:     map[string]string{"env": "prod", "tier": "frontend", "ansible_connection": "ssh"},
+				Groups:   []string{"web", "prod"},
+			},
+			{Name: "db-a", User: "dba", Vars: map[string]string{"env": "prod"}, Groups: []string{"db", "prod"}},
+			{Name: "db-b", User: "dba", Vars: map[string]string{"env": "prod"}, Groups: []string{"db", "prod"}},
+		},
+		Groups: map[string][]string{
+			"ungrouped": {"bastion"},
+			"web":       {"web01.example.com", "web02.example.com", "web03.example.com"},
+			"db":        {"db-a", "db-b"},
+			"prod":      {"web01.example.com", "web02.example.com", "web03.example.com", "db-a", "db-b"},
+		},
+	}
+	if diff := cmp.Diff(want, inv); diff != "" {
+		t.Errorf("ParseINI mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseINIConnection(t *testing.T) {
+	inv, err := ParseINI([]byte(`
+localhost ansible_connection=local
+web1
+[builders]
+ci[1:2]
+ci3 ansible_timeout=5
+[builders:vars]
+ansible_connection=local
+ansible_timeout=60
+`))
+	if err != nil {
+		t.Fatalf("ParseINI: %v", err)
+	}
+	want := map[string]string{"localhost": "local", "web1": "", "ci1": "local", "ci2": "local", "ci3": "local"}
+	timeouts := map[string]time.Duration{"ci1": time.Minute, "ci2": time.Minute, "ci3": 5 * time.Second}
+	for _, host := range inv.Hosts {
+		if host.Transport != want[host.Name] {
+			t.Errorf("%s has transport %q, want %q", host.Name, host.Transport, want[host.Name])
+		}
+		if host.ConnectTimeout != timeouts[host.Name] {
+			t.Errorf("%s has connect timeout %v, want %v", host.Name, host.ConnectTimeout, timeouts[host.Name])
+		}
+	}
+}
+
+func TestParseINIErrors(t *testing.T) {
+	tests := map[string]string{
+		"unterminated section": "[web",
+		"unknown section type": "[web:hosts]",
+		"bad port":             "a ansible_port=nope",
+		"bad timeout":          "a ansible_timeout=1m",
+		"bad variable":         "a role",
+		"bad range":            "web[05:01]",
+		"unknown child":        "[prod:children]\nweb",
+		"cycle":                "[a:children]\nb\n[b:children]\na",
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseINI([]byte(data)); err == nil {
+				t.Errorf("ParseINI(%q) succeeded, want an error", data)
+			}
+		})
+	}
+}
+
+func TestExpandRange(t *testing.T) {
+	tests := map[string][]string{
+		"plain":       {"plain"},
+		"w[1:3]":      {"w1", "w2", "w3"},
+		"w[08:10]":    {"w08", "w09", "w10"},
+		"w[0:4:2]":    {"w0", "w2", "w4"},
+		"[a:b]-[1:2]": {"a-1", "a-2", "b-1", "b-2"},
+	}
+	for pattern, want := range tests {
+		got, err := expandRange(pattern)
+		if err != nil {
+			t.Errorf("expandRange(%q): %v", pattern, err)
+			continue
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("expandRange(%q) mismatch (-want +got):\n%s", pattern, diff)
+		}
+	}
+}
+
+func TestLookupSRV(t *testing.T) {
+	defer func(orig func(string, string, string) (string, []*net.SRV, error)) { lookupSRV = orig }(lookupSRV)
+
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_ssh._tcp.fleet.example.com" {
+			return "", nil, errors.New("no such host")
+		}
+		return name, []*net.SRV{
+			{Target: "a.example.com.", Port: 22},
+			{Target: "b.example.com.", Port: 2222},
+		}, nil
+	}
+	inv, err := LookupSRV("_ssh._tcp.fleet.example.com")
+	if err != nil {
+		t.Fatalf("LookupSRV: %v", err)
+	}
+	want := FromNames([]string{"a.example.com:22", "b.example.com:2222"})
+	if diff := cmp.Diff(want, inv); diff != "" {
+		t.Errorf("LookupSRV mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := LookupSRV("_ssh._tcp.missing.example.com"); err == nil {
+		t.Error("LookupSRV succeeded for a missing record")
+	}
+	lookupSRV = func(string, string, string) (string, []*net.SRV, error) {
+		return "", []*net.SRV{{Target: ".", Port: 0}}, nil
+	}
+	if _, err := LookupSRV("_ssh._tcp.fleet.example.com"); err == nil {
+		t.Error("LookupSRV succeeded for a record with no targets")
+	}
+}
+
+const testEC2 = `{"Reservations": [{"Instances": [
+	{"InstanceId": "i-1", "PrivateIpAddress": "10.0.0.1", "PublicIpAddress": "54.0.0.1",
+	 "Placement": {"AvailabilityZone": "us-west-2a"}, "Tags": [{"Key": "Role", "Value": "web"}]},
+	{"InstanceId": "i-2", "PrivateIpAddress": "10.0.0.2", "Placement": {"AvailabilityZone": "us-west-2b"}}
+]}]}`
+
+func TestEC2(t *testing.T) {
+	defer func(orig func(string, ...string) ([]byte, error)) { runCLI = orig }(runCLI)
+
+	var gotArgs string
+	runCLI = func(name string, args ...string) ([]byte, error) {
+		gotArgs = name + " " + strings.Join(args, " ")
+		return []byte(testEC2), nil
+	}
+
+	inv, err := EC2("tag:Role=web,region=us-west-2")
+	if err != nil {
+		t.Fatalf("EC2: %v", err)
+	}
+	wantArgs := "aws ec2 describe-instances --output json --region us-west-2 --filters " +
+		"Name=instance-state-name,Values=running Name=tag:Role,Values=web"
+	if gotArgs != wantArgs {
+		t.Errorf("ran %q, want %q", gotArgs, wantArgs)
+	}
+	want := &Inventory{
+		Hosts: []Host{
+			{Name: "i-1", Address: "10.0.0.1", Vars: map[string]string{"tag_Role": "web"}, Groups: []string{"us-west-2a"}},
+			{Name: "i-2", Address: "10.0.0.2", Vars: map[string]string{}, Groups: []string{"us-west-2b"}},
+		},
+		Groups: map[string][]string{"us-west-2a": {"i-1"}, "us-west-2b": {"i-2"}},
+	}
+	if diff := cmp.Diff(want, inv); diff != "" {
+		t.Errorf("EC2 mismatch (-want +got):\n%s", diff)
+	}
+
+	// i-2 has no public IP and is skipped
+	inv, err = EC2("ip=public")
+	if err != nil {
+		t.Fatalf("EC2: %v", err)
+	}
+	if len(inv.Hosts) != 1 || inv.Hosts[0].Address != "54.0.0.1" {
+		t.Errorf("EC2 with ip=public returned %+v, want only i-1 at 54.0.0.1", inv.Hosts)
+	}
+
+	for _, spec := range []string{"Role=web", "ip=elastic", "tag:Role"} {
+		if _, err := EC2(spec); err == nil {
+			t.Errorf("EC2(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestSSM(t *testing.T) {
+	defer func(orig func(string, ...string) ([]byte, error)) { runCLI = orig }(runCLI)
+
+	runCLI = func(name string, args ...string) ([]byte, error) {
+		return []byte(testEC2), nil
+	}
+	inv, err := SSM("tag:Role=web,region=us-west-2")
+	if err != nil {
+		t.Fatalf("SSM: %v", err)
+	}
+	region := map[string]string{"aws_region": "us-west-2"}
+	want := &Inventory{
+		Hosts: []Host{
+			{
+				Name:      "i-1",
+				Transport: "ssm",
+				Vars:      map[string]string{"aws_region": "us-west-2", "tag_Role": "web"},
+				Groups:    []string{"us-west-2a"},
+			},
+			{Name: "i-2", Transport: "ssm", Vars: region, Groups: []string{"us-west-2b"}},
+		},
+		Groups: map[string][]string{"us-west-2a": {"i-1"}, "us-west-2b": {"i-2"}},
+	}
+	if diff := cmp.Diff(want, inv); diff != "" {
+		t.Errorf("SSM mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := SSM("ip=public"); err == nil {
+		t.Error("SSM accepted an address type")
+	}
+}
+
+const testGCE = `[
+	{"name": "web-1", "zone": "https://www.googleapis.com/compute/v1/projects/prod/zones/us-central1-a",
+	 "labels": {"role": "web"},
+	 "networkInterfaces": [{"networkIP": "10.128.0.2", "accessConfigs": [{"natIP": "34.1.1.1"}]}]},
+	{"name": "web-2", "zone": "https://www.googleapis.com/compute/v1/projects/prod/zones/us-central1-b",
+	 "networkInterfaces": [{"networkIP": "10.128.0.3"}]}
+]`
+
+func TestGCE(t *testing.T) {
+	defer func(orig func(string, ...string) ([]byte, error)) { runCLI = orig }(runCLI)
+
+	var gotArgs []string
+	runCLI = func(name string, args ...string) ([]byte, error) {
+		gotArgs = append([]string{name}, args...)
+		return []byte(testGCE), nil
+	}
+
+	inv, err := GCE("project=prod,zone=us-central1-a,zone=us-central1-b,label:role=web")
+	if err != nil {
+		t.Fatalf("GCE: %v", err)
+	}
+	wantArgs := []string{
+		"gcloud", "compute", "instances", "list", "--format=json", "--project=prod",
+		"--zones=us-central1-a,us-central1-b", `--filter=status=RUNNING AND labels.role="web"`,
+	}
+	if diff := cmp.Diff(wantArgs, gotArgs); diff != "" {
+		t.Errorf("gcloud arguments mismatch (-want +got):\n%s", diff)
+	}
+	want := &Inventory{
+		Hosts: []Host{
+			{Name: "web-1", Address: "10.128.0.2", Vars: map[string]string{"label_role": "web"}, Groups: []string{"us-central1-a"}},
+			{Name: "web-2", Address: "10.128.0.3", Vars: map[string]string{}, Groups: []string{"us-central1-b"}},
+		},
+		Groups: map[string][]string{"us-central1-a": {"web-1"}, "us-central1-b": {"web-2"}},
+	}
+	if diff := cmp.Diff(want, inv); diff != "" {
+		t.Errorf("GCE mismatch (-want +got):\n%s", diff)
+	}
+
+	// web-2 has no external IP and is skipped
+	inv, err = GCE("ip=external")
+	if err != nil {
+		t.Fatalf("GCE: %v", err)
+	}
+	if len(inv.Hosts) != 1 || inv.Hosts[0].Address != "34.1.1.1" {
+		t.Errorf("GCE with ip=external returned %+v, want only web-1 at 34.1.1.1", inv.Hosts)
+	}
+
+	for _, spec := range []string{"role=web", "ip=public", "project"} {
+		if _, err := GCE(spec); err == nil {
+			t.Errorf("GCE(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+const testK8s = `{"items": [
+	{"metadata": {"name": "node-1", "labels": {"topology.kubernetes.io/zone": "z1"}},
+	 "status": {"addresses": [{"type": "Hostname", "address": "node-1"}, {"type": "InternalIP", "address": "10.0.0.1"}]}},
+	{"metadata": {"name": "node-2"},
+	 "status": {"addresses": [{"type": "InternalIP", "address": "10.0.0.2"}, {"type": "ExternalIP", "address": "35.0.0.2"}]}}
+]}`
+
+func TestK8sNodes(t *testing.T) {
+	defer func(orig func(string, ...string) ([]byte, error)) { runCLI = orig }(runCLI)
+
+	var gotArgs []string
+	runCLI = func(name string, args ...string) ([]byte, error) {
+		gotArgs = append([]string{name}, args...)
+		return []byte(testK8s), nil
+	}
+
+	inv, err := K8sNodes("node-role.kubernetes.io/worker,context=prod,pool=a")
+	if err != nil {
+		t.Fatalf("K8sNodes: %v", err)
+	}
+	wantArgs := []string{
+		"kubectl", "get", "nodes", "-o", "json", "--context", "prod", "-l", "node-role.kubernetes.io/worker,pool=a",
+	}
+	if diff := cmp.Diff(wantArgs, gotArgs); diff != "" {
+		t.Errorf("kubectl arguments mismatch (-want +got):\n%s", diff)
+	}
+	want := &Inventory{
+		Hosts: []Host{
+			{
+				Name:    "node-1",
+				Address: "10.0.0.1",
+				Vars:    map[string]string{"label_topology.kubernetes.io/zone": "z1"},
+				Groups:  []string{"z1"},
+			},
+			{Name: "node-2", Address: "10.0.0.2", Vars: map[string]string{}},
+		},
+		Groups: map[string][]string{"z1": {"node-1"}},
+	}
+	if diff := cmp.Diff(want, inv); diff != "" {
+		t.Errorf("K8sNodes mismatch (-want +got):\n%s", diff)
+	}
+
+	// node-1 has no external IP and is skipped
+	inv, err = K8sNodes("ip=external")
+	if err != nil {
+		t.Fatalf("K8sNodes: %v", err)
+	}
+	if len(inv.Hosts) != 1 || inv.Hosts[0].Address != "35.0.0.2" {
+		t.Errorf("K8sNodes with ip=external returned %+v, want only node-2 at 35.0.0.2", inv.Hosts)
+	}
+
+	if _, err := K8sNodes("ip=public"); err == nil {
+		t.Error("K8sNodes accepted an unknown address type")
+	}
+}
+
+const testPods = `{"items": [
+	{"metadata": {"name": "web-0", "namespace": "shop", "labels": {"app": "web"}}},
+	{"metadata": {"name": "web-0", "namespace": "staging"}}
+]}`
+
+func TestK8sPods(t *testing.T) {
+	defer func(orig func(string, ...string) ([]byte, error)) { runCLI = orig }(runCLI)
+
+	var gotArgs []string
+	runCLI = func(name string, args ...string) ([]byte, error) {
+		gotArgs = append([]string{name}, args...)
+		return []byte(testPods), nil
+	}
+
+	inv, err := K8sPods("app=web,context=prod,namespace=*,container=app")
+	if err != nil {
+		t.Fatalf("K8sPods: %v", err)
+	}
+	wantArgs := []string{
+		"kubectl", "get", "pods", "-o", "json", "--field-selector", "status.phase=Running", "--context", "prod",
+		"--all-namespaces", "-l", "app=web",
+	}
+	if diff := cmp.Diff(wantArgs, gotArgs); diff != "" {
+		t.Errorf("kubectl arguments mismatch (-want +got):\n%s", diff)
+	}
+	vars := map[string]string{"kubectl_context": "prod", "kubectl_container": "app"}
+	want := &Inventory{
+		Hosts: []Host{
+			{
+				Name:      "shop/web-0",
+				Transport: "kubectl",
+				Vars:      map[string]string{"kubectl_context": "prod", "kubectl_container": "app", "label_app": "web"},
+				Groups:    []string{"shop"},
+			},
+			{Name: "staging/web-0", Transport: "kubectl", Vars: vars, Groups: []string{"staging"}},
+		},
+		Groups: map[string][]string{"shop": {"shop/web-0"}, "staging": {"staging/web-0"}},
+	}
+	if diff := cmp.Diff(want, inv); diff != "" {
+		t.Errorf("K8sPods mismatch (-want +got):\n%s", diff)
+	}
+}
+
+const testDocker = `{"ID":"a1","Image":"nginx","Names":"shop-web-1","Labels":"com.docker.compose.service=web,tier=front"}
+{"ID":"b2","Image":"redis:7","Names":"cache,cache-alias","Labels":""}
+`
+
+func TestDockerContainers(t *testing.T) {
+	defer func(orig func(string, ...string) ([]byte, error)) { runCLI = orig }(runCLI)
+
+	var gotArgs []string
+	runCLI = func(name string, args ...string) ([]byte, error) {
+		gotArgs = append([]string{name}, args...)
+		return []byte(testDocker), nil
+	}
+
+	inv, err := DockerContainers("nerdctl", "label=tier=front, shop")
+	if err != nil {
+		t.Fatalf("DockerContainers: %v", err)
+	}
+	wantArgs := []string{
+		"nerdctl", "ps", "--format", "{{json .}}", "--filter", "label=tier=front", "--filter", "name=shop",
+	}
+	if diff := cmp.Diff(wantArgs, gotArgs); diff != "" {
+		t.Errorf("nerdctl arguments mismatch (-want +got):\n%s", diff)
+	}
+	want := &Inventory{
+		Hosts: []Host{
+			{
+				Name:      "shop-web-1",
+				Transport: "docker",
+				Vars: map[string]string{
+					"image":                            "nginx",
+					"label_com.docker.compose.service": "web",
+					"label_tier":                       "front",
+				},
+				Groups: []string{"web"},
+			},
+			{Name: "cache", Transport: "docker", Vars: map[string]string{"image": "redis:7"}},
+		},
+		Groups: map[string][]string{"web": {"shop-web-1"}},
+	}
+	if diff := cmp.Diff(want, inv); diff != "" {
+		t.Errorf("DockerContainers mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestFromNames(t *testing.T) {
+	want := &Inventory{
+		Hosts: []Host{
+			{Name: "web-1:22", Vars: map[string]string{}},
+			{Name: "deploy@web-2:22", Address: "web-2:22", User: "deploy", Vars: map[string]string{}},
+			{Name: "cache-eu-1", Address: "10.3.4.5:2222", Vars: map[string]string{}},
+			{Name: "cache-eu-2", Address: "10.3.4.6:22", User: "redis", Vars: map[string]string{}},
+		},
+		Groups: map[string][]string{},
+	}
+	names := []string{"web-1:22", "deploy@web-2:22", "cache-eu-1=10.3.4.5:2222", "cache-eu-2=redis@10.3.4.6:22"}
+	if diff := cmp.Diff(want, FromNames(names)); diff != "" {
+		t.Errorf("FromNames mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,161 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// zoneLabel: the well known node label holding its zone
+const zoneLabel = "topology.kubernetes.io/zone"
+
+// k8sNodes: the parts of `kubectl get nodes -o json` output used to build an inventory
+type k8sNodes struct {
+	Items []struct {
+		Metadata struct {
+			Name   string            `json:"name"`
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Status struct {
+			Addresses []struct {
+				Type    string `json:"type"`
+				Address string `json:"address"`
+			} `json:"addresses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// K8sNodes: build an inventory from the nodes of a Kubernetes cluster using kubectl and the current kubeconfig.
+// spec is a comma separated label selector, plus context=... to pick a kubeconfig context and ip=internal or
+// ip=external to pick the address to connect to, internal by default, e.g. node-role.kubernetes.io/worker,context=prod.
+// Hosts are named by node name, labels become label_<key> vars, and each host belongs to its zone group if it has one.
+func K8sNodes(spec string) (*Inventory, error) {
+	args := []string{"get", "nodes", "-o", "json"}
+	var selector []string
+	addrType := "InternalIP"
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		key, value, _ := strings.Cut(part, "=")
+		switch {
+		case part == "":
+		case key == "context" && value != "":
+			args = append(args, "--context", value)
+		case key == "ip" && value == "internal":
+			addrType = "InternalIP"
+		case key == "ip" && value == "external":
+			addrType = "ExternalIP"
+		case key == "ip":
+			return nil, fmt.Errorf("invalid node address type %q, want internal or external", value)
+		default:
+			selector = append(selector, part)
+		}
+	}
+	if len(selector) > 0 {
+		args = append(args, "-l", strings.Join(selector, ","))
+	}
+
+	out, err := runCLI("kubectl", args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list Kubernetes nodes: %v", err)
+	}
+	var nodes k8sNodes
+	if err := json.Unmarshal(out, &nodes); err != nil {
+		return nil, fmt.Errorf("unable to parse Kubernetes nodes: %v", err)
+	}
+
+	inv := &Inventory{Groups: make(map[string][]string)}
+	for _, node := range nodes.Items {
+		var addr string
+		for _, address := range node.Status.Addresses {
+			if address.Type == addrType {
+				addr = address.Address
+				break
+			}
+		}
+		if addr == "" {
+			continue
+		}
+		host := Host{Name: node.Metadata.Name, Address: addr, Vars: make(map[string]string)}
+		for key, value := range node.Metadata.Labels {
+			host.Vars["label_"+key] = value
+		}
+		if zone := node.Metadata.Labels[zoneLabel]; zone != "" {
+			host.Groups = []string{zone}
+			inv.Groups[zone] = append(inv.Groups[zone], host.Name)
+		}
+		inv.Hosts = append(inv.Hosts, host)
+	}
+	return inv, nil
+}
+
+// k8sPods: the parts of `kubectl get pods -o json` output used to build an inventory
+type k8sPods struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+	} `json:"items"`
+}
+
+// K8sPods: build an inventory from the running pods of a Kubernetes cluster using kubectl and the current kubeconfig.
+// spec is a comma separated label selector, plus context=... to pick a kubeconfig context, namespace=... to list
+// another namespace than the context's, or namespace=* for all of them, and container=... to run in a container other
+// than each pod's default, e.g. app=web,namespace=shop. Hosts are named namespace/pod and use the kubectl transport,
+// with the context and container in the kubectl_context and kubectl_container vars. Labels become label_<key> vars,
+// and each host belongs to its namespace's group.
+func K8sPods(spec string) (*Inventory, error) {
+	args := []string{"get", "pods", "-o", "json", "--field-selector", "status.phase=Running"}
+	var selector []string
+	vars := make(map[string]string)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		key, value, _ := strings.Cut(part, "=")
+		switch {
+		case part == "":
+		case key == "context" && value != "":
+			args = append(args, "--context", value)
+			vars["kubectl_context"] = value
+		case key == "namespace" && value == "*":
+			args = append(args, "--all-namespaces")
+		case key == "namespace" && value != "":
+			args = append(args, "--namespace", value)
+		case key == "container" && value != "":
+			vars["kubectl_container"] = value
+		default:
+			selector = append(selector, part)
+		}
+	}
+	if len(selector) > 0 {
+		args = append(args, "-l", strings.Join(selector, ","))
+	}
+
+	out, err := runCLI("kubectl", args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list Kubernetes pods: %v", err)
+	}
+	var pods k8sPods
+	if err := json.Unmarshal(out, &pods); err != nil {
+		return nil, fmt.Errorf("unable to parse Kubernetes pods: %v", err)
+	}
+
+	inv := &Inventory{Groups: make(map[string][]string)}
+	for _, pod := range pods.Items {
+		host := Host{
+			Name:      pod.Metadata.Namespace + "/" + pod.Metadata.Name,
+			Transport: "kubectl",
+			Vars:      make(map[string]string),
+			Groups:    []string{pod.Metadata.Namespace},
+		}
+		for key, value := range vars {
+			host.Vars[key] = value
+		}
+		for key, value := range pod.Metadata.Labels {
+			host.Vars["label_"+key] = value
+		}
+		inv.Groups[pod.Metadata.Namespace] = append(inv.Groups[pod.Metadata.Namespace], host.Name)
+		inv.Hosts = append(inv.Hosts, host)
+	}
+	return inv, nil
+}
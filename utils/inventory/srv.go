@@ -0,0 +1,34 @@
+package inventory
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// lookupSRV: resolve SRV records, replaced in tests
+var lookupSRV = net.LookupSRV
+
+// LookupSRV: build an inventory from the targets of an SRV record such as _ssh._tcp.fleet.example.com, in the order
+// the resolver returns them, i.e. by priority then randomized by weight. Each host is named host:port.
+func LookupSRV(name string) (*Inventory, error) {
+	_, records, err := lookupSRV("", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve SRV record %s: %v", name, err)
+	}
+
+	var names []string
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		if target == "" {
+			// a target of "." means the service is decidedly not available
+			continue
+		}
+		names = append(names, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("SRV record %s has no targets", name)
+	}
+	return FromNames(names), nil
+}
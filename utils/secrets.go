@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Cloud secret references
+
+// Secret reference schemes accepted by FetchSecret
+const (
+	// SecretAWSSecretsManager names an AWS Secrets Manager secret by name or ARN, e.g. aws-sm://prod/ssh-key
+	SecretAWSSecretsManager = "aws-sm://"
+	// SecretAWSParameterStore names an SSM Parameter Store parameter, e.g. aws-ssm:///prod/ssh-key
+	SecretAWSParameterStore = "aws-ssm://"
+)
+
+// IsSecretRef: report whether s is a cloud secret reference rather than a local path.
+func IsSecretRef(s string) bool {
+	return strings.HasPrefix(s, SecretAWSSecretsManager) || strings.HasPrefix(s, SecretAWSParameterStore)
+}
+
+// FetchSecret: the value of a cloud secret reference, read with the aws CLI and its usual credentials and config, so
+// secrets can be used where there is no home directory to keep them in, e.g. CI jobs.
+func FetchSecret(ref string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(ref, SecretAWSSecretsManager):
+		id := strings.TrimPrefix(ref, SecretAWSSecretsManager)
+		out, err := awsCLI("secretsmanager", "get-secret-value", "--secret-id", id, "--output", "json")
+		if err != nil {
+			return nil, fmt.Errorf("unable to read secret %s: %v", id, err)
+		}
+		var secret struct {
+			SecretString *string `json:"SecretString"`
+			SecretBinary string  `json:"SecretBinary"`
+		}
+		if err := json.Unmarshal(out, &secret); err != nil {
+			return nil, fmt.Errorf("unable to parse secret %s: %v", id, err)
+		}
+		if secret.SecretString != nil {
+			return []byte(*secret.SecretString), nil
+		}
+		return base64.StdEncoding.DecodeString(secret.SecretBinary)
+	case strings.HasPrefix(ref, SecretAWSParameterStore):
+		name := strings.TrimPrefix(ref, SecretAWSParameterStore)
+		out, err := awsCLI("ssm", "get-parameter", "--name", name, "--with-decryption", "--output", "json")
+		if err != nil {
+			return nil, fmt.Errorf("unable to read parameter %s: %v", name, err)
+		}
+		var param struct {
+			Parameter struct {
+				Value string `json:"Value"`
+			} `json:"Parameter"`
+		}
+		if err := json.Unmarshal(out, &param); err != nil {
+			return nil, fmt.Errorf("unable to parse parameter %s: %v", name, err)
+		}
+		return []byte(param.Parameter.Value), nil
+	default:
+		return nil, fmt.Errorf("unknown secret reference %q, want %s<secret> or %s<parameter>", ref,
+			SecretAWSSecretsManager, SecretAWSParameterStore)
+	}
+}
+
+// awsCLI: run the aws CLI, returning its output.
+func awsCLI(args ...string) ([]byte, error) {
+	out, err := exec.Command("aws", args...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return out, err
+}
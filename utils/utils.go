@@ -2,49 +2,660 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/kevinburke/ssh_config"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
 )
 
 // SSH utilities
 
+// Auth method names accepted in AuthConfig.Order
+const (
+	AuthAgent               = "agent"
+	AuthKey                 = "key"
+	AuthPassword            = "password"
+	AuthKeyboardInteractive = "keyboard-interactive"
+)
+
+// AuthConfig: the ordered list of auth methods to offer and the credentials backing them.
+// Methods are offered to each host in Order. Agent and key signers are merged into a single public key method, placed at
+// the position of the first of them, since the ssh client only attempts each method type once per connection.
+type AuthConfig struct {
+	Order []string
+	// KeyFiles are tried in order; files that do not exist are skipped. Secret references, see IsSecretRef, are fetched
+	// instead of read.
+	KeyFiles []string
+	// Passphrase is only called for encrypted key files and may be nil if no passphrase is available
+	Passphrase func(keyFile string) ([]byte, error)
+	// Password is called once, when the password method is in Order
+	Password func() (string, error)
+	// Challenge answers the server's questions, when the keyboard-interactive method is in Order
+	Challenge ssh.KeyboardInteractiveChallenge
+	// Signers, e.g. short-lived certificates from Vault, are offered before the agent and key file ones whatever the
+	// Order
+	Signers []ssh.Signer
+	// KeySigners are offered after the KeyFiles ones by the key method, see Preload
+	KeySigners []ssh.Signer
+	// AgentSigners lists the agent's signers for the agent method instead of connecting to SSH_AUTH_SOCK, see Preload
+	AgentSigners func() ([]ssh.Signer, error)
+}
+
+// Preload: ac with its key files read, fetched, and decrypted into KeySigners and the agent connected, so the configs
+// built from it, e.g. one per host with extra KeyFiles, do not ask for passphrases or fetch secrets again.
+func (ac AuthConfig) Preload() (AuthConfig, error) {
+	for _, method := range ac.Order {
+		switch method {
+		case AuthAgent:
+			if ac.AgentSigners != nil {
+				continue
+			}
+			signers, err := agentSigners()
+			if err != nil {
+				return ac, err
+			}
+			ac.AgentSigners = signers
+		case AuthKey:
+			signers, err := keyFileSigners(ac.KeyFiles, ac.Passphrase)
+			if err != nil {
+				return ac, err
+			}
+			ac.KeySigners = append(signers, ac.KeySigners...)
+			ac.KeyFiles = nil
+		}
+	}
+	return ac, nil
+}
+
+// Host key policies accepted by NewSSHConfig
+const (
+	// HostKeyIgnore accepts any host key
+	HostKeyIgnore = "ignore"
+	// HostKeyStrict only accepts host keys already in the known hosts file
+	HostKeyStrict = "strict"
+	// HostKeyTOFU trusts on first use: unknown hosts are accepted and added to the known hosts file, hosts already
+	// there must present the key recorded for them
+	HostKeyTOFU = "tofu"
+)
+
 // NewSSHConfig: take in some common arguments and return an already-populated ssh.ClientConfig
-func NewSSHConfig(checkHostKey bool, knownHostsFile, privateKeyFile, remoteUser string) (ssh.ClientConfig, error) {
+// dialTimeout bounds how long establishing the TCP connection may take, zero means the OS default.
+func NewSSHConfig(
+	hostKeys string,
+	knownHostsFile, remoteUser string,
+	dialTimeout time.Duration,
+	authConf AuthConfig,
+	opts ...SSHOption,
+) (ssh.ClientConfig, error) {
 	var conf ssh.ClientConfig
 	var callback ssh.HostKeyCallback
 
-	if checkHostKey {
+	switch hostKeys {
+	case HostKeyIgnore, "":
+		callback = ssh.InsecureIgnoreHostKey()
+	case HostKeyStrict:
 		if cb, err := knownhosts.New(knownHostsFile); err != nil {
 			return conf, fmt.Errorf("knowhosts.New: %v", err)
 		} else {
 			callback = cb
 		}
-	} else {
-		callback = ssh.InsecureIgnoreHostKey()
+	case HostKeyTOFU:
+		cb, err := trustOnFirstUse(knownHostsFile)
+		if err != nil {
+			return conf, err
+		}
+		callback = cb
+	default:
+		return conf, fmt.Errorf("unknown host key policy %q, want %s, %s, or %s", hostKeys, HostKeyIgnore,
+			HostKeyStrict, HostKeyTOFU)
+	}
+
+	auth, err := authConf.authMethods()
+	if err != nil {
+		return conf, err
+	}
+
+	conf = ssh.ClientConfig{
+		User:            remoteUser,
+		Auth:            auth,
+		HostKeyCallback: callback,
+		Timeout:         dialTimeout,
+	}
+	for _, opt := range opts {
+		if err := opt(&conf); err != nil {
+			return ssh.ClientConfig{}, err
+		}
+	}
+	return conf, nil
+}
+
+// SSHOption: changes NewSSHConfig makes to the client config it builds
+type SSHOption func(*ssh.ClientConfig) error
+
+// Algorithms: the algorithms to offer hosts, in order of preference. An empty list keeps the ssh package's defaults.
+type Algorithms struct {
+	Ciphers           []string
+	KeyExchanges      []string
+	MACs              []string
+	HostKeyAlgorithms []string
+}
+
+// supportedAlgorithms: every algorithm golang.org/x/crypto/ssh implements, including legacy ones it does not offer by
+// default, which old network devices may still need
+var supportedAlgorithms = map[string][]string{
+	"cipher": {
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour",
+	},
+	"key exchange": {
+		"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384",
+		"ecdh-sha2-nistp521", "diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1", "diffie-hellman-group-exchange-sha256",
+		"diffie-hellman-group-exchange-sha1",
+	},
+	"MAC": {
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
+		"hmac-sha1-96",
+	},
+	"host key algorithm": {
+		ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoRSASHA512,
+		ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.CertAlgoED25519v01, ssh.CertAlgoECDSA256v01,
+		ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+		ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01,
+	},
+}
+
+// Validate: check every algorithm is one the ssh package implements, so a typo fails up front rather than on every
+// host.
+func (a Algorithms) Validate() error {
+	for _, list := range []struct {
+		kind  string
+		names []string
+	}{
+		{"cipher", a.Ciphers},
+		{"key exchange", a.KeyExchanges},
+		{"MAC", a.MACs},
+		{"host key algorithm", a.HostKeyAlgorithms},
+	} {
+		for _, name := range list.names {
+			if !contains(supportedAlgorithms[list.kind], name) {
+				return fmt.Errorf("unsupported %s %q, want one of %s", list.kind, name,
+					strings.Join(supportedAlgorithms[list.kind], ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// WithAlgorithms: offer only these algorithms, to reach legacy devices or to restrict hardened fleets to modern ones.
+func WithAlgorithms(a Algorithms) SSHOption {
+	return func(conf *ssh.ClientConfig) error {
+		if err := a.Validate(); err != nil {
+			return err
+		}
+		conf.Ciphers = a.Ciphers
+		conf.KeyExchanges = a.KeyExchanges
+		conf.MACs = a.MACs
+		conf.HostKeyAlgorithms = a.HostKeyAlgorithms
+		return nil
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// tofuStore: the known hosts file used for trust on first use, shared by every client config reading the same file so
+// hosts seen for the first time are only added once
+type tofuStore struct {
+	path  string
+	mu    sync.Mutex
+	check ssh.HostKeyCallback
+	// added holds the keys accepted during this run, which check has not seen
+	added map[string]ssh.PublicKey
+}
+
+var (
+	tofuStoresMu sync.Mutex
+	tofuStores   = make(map[string]*tofuStore)
+)
+
+// trustOnFirstUse: a host key callback that accepts and records the key of hosts missing from knownHostsFile, and
+// rejects hosts presenting a different key from the one recorded. The file is created if it does not exist.
+func trustOnFirstUse(knownHostsFile string) (ssh.HostKeyCallback, error) {
+	tofuStoresMu.Lock()
+	defer tofuStoresMu.Unlock()
+	if store, ok := tofuStores[knownHostsFile]; ok {
+		return store.verify, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(knownHostsFile), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create known hosts directory: %v", err)
+	}
+	f, err := os.OpenFile(knownHostsFile, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create known hosts file: %v", err)
+	}
+	_ = f.Close()
+	check, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("knowhosts.New: %v", err)
+	}
+	store := &tofuStore{path: knownHostsFile, check: check, added: make(map[string]ssh.PublicKey)}
+	tofuStores[knownHostsFile] = store
+	return store.verify, nil
+}
+
+// verify: check key against the known hosts, recording it if hostname has never been seen.
+func (s *tofuStore) verify(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := knownhosts.Normalize(hostname)
+	if added, ok := s.added[name]; ok {
+		if !bytes.Equal(added.Marshal(), key.Marshal()) {
+			return fmt.Errorf("knownhosts: key mismatch, %s presented a different host key than earlier in this run", name)
+		}
+		return nil
 	}
 
-	pkey, err := ioutil.ReadFile(privateKeyFile)
+	err := s.check(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+		// known, or known with a different key
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
 	if err != nil {
-		return conf, fmt.Errorf("ioutil.ReadFile: %v", err)
+		return fmt.Errorf("unable to record host key for %s: %v", name, err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{name}, key)); err != nil {
+		return fmt.Errorf("unable to record host key for %s: %v", name, err)
+	}
+	s.added[name] = key
+	return nil
+}
+
+// ParseAuthOrder: split a comma separated list of auth method names and validate each of them.
+func ParseAuthOrder(order string) ([]string, error) {
+	var methods []string
+	seen := make(map[string]bool)
+	for _, method := range strings.Split(order, ",") {
+		method = strings.TrimSpace(method)
+		switch method {
+		case "":
+			continue
+		case AuthAgent, AuthKey, AuthPassword, AuthKeyboardInteractive:
+		default:
+			return nil, fmt.Errorf("unknown auth method: %q", method)
+		}
+		if seen[method] {
+			return nil, fmt.Errorf("auth method listed more than once: %q", method)
+		}
+		seen[method] = true
+		methods = append(methods, method)
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no auth methods specified")
+	}
+	return methods, nil
+}
+
+// authMethods: build the ssh.AuthMethod list described by the AuthConfig.
+func (ac AuthConfig) authMethods() ([]ssh.AuthMethod, error) {
+	var auth []ssh.AuthMethod
+	var signers []func() ([]ssh.Signer, error)
+	publicKeyIdx := -1
+	if len(ac.Signers) > 0 {
+		signers = append(signers, func() ([]ssh.Signer, error) { return ac.Signers, nil })
+		publicKeyIdx = 0
+		auth = append(auth, nil)
+	}
+
+	for _, method := range ac.Order {
+		switch method {
+		case AuthAgent:
+			listAgent := ac.AgentSigners
+			if listAgent == nil {
+				var err error
+				if listAgent, err = agentSigners(); err != nil {
+					return nil, err
+				}
+			}
+			signers = append(signers, listAgent)
+		case AuthKey:
+			keySigners, err := keyFileSigners(ac.KeyFiles, ac.Passphrase)
+			if err != nil {
+				return nil, err
+			}
+			keySigners = append(keySigners, ac.KeySigners...)
+			if len(keySigners) == 0 {
+				continue
+			}
+			signers = append(signers, func() ([]ssh.Signer, error) { return keySigners, nil })
+		case AuthPassword:
+			if ac.Password == nil {
+				return nil, fmt.Errorf("password auth requested but no password source configured")
+			}
+			pass, err := ac.Password()
+			if err != nil {
+				return nil, fmt.Errorf("unable to read password: %v", err)
+			}
+			auth = append(auth, ssh.Password(pass))
+			continue
+		case AuthKeyboardInteractive:
+			if ac.Challenge == nil {
+				return nil, fmt.Errorf("keyboard-interactive auth requested but no challenge responder configured")
+			}
+			auth = append(auth, ssh.KeyboardInteractive(ac.Challenge))
+			continue
+		default:
+			return nil, fmt.Errorf("unknown auth method: %q", method)
+		}
+		if publicKeyIdx < 0 {
+			publicKeyIdx = len(auth)
+			auth = append(auth, nil)
+		}
+	}
+
+	if publicKeyIdx >= 0 {
+		auth[publicKeyIdx] = ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			var res []ssh.Signer
+			for _, cb := range signers {
+				s, err := cb()
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, s...)
+			}
+			return res, nil
+		})
+	}
+
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no usable auth methods, checked: %s", strings.Join(ac.Order, ","))
+	}
+	return auth, nil
+}
+
+// keyFileSigners: load a signer for each of the key files that exist.
+func keyFileSigners(paths []string, passphrase func(string) ([]byte, error)) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) && !IsSecretRef(path) {
+			continue
+		}
+		signer, err := keyFileSigner(path, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// keyFileSigner: read and parse a private key file, or fetch it if path is a secret reference, decrypting it with
+// passphrase if the key is encrypted.
+func keyFileSigner(path string, passphrase func(string) ([]byte, error)) (ssh.Signer, error) {
+	var pkey []byte
+	var err error
+	if IsSecretRef(path) {
+		if pkey, err = FetchSecret(path); err != nil {
+			return nil, err
+		}
+	} else if pkey, err = os.ReadFile(path); err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %v", err)
 	}
 	signer, err := ssh.ParsePrivateKey(pkey)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok && passphrase != nil {
+		pass, err := passphrase(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read passphrase: %v", err)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pkey, pass)
+		if err != nil {
+			return nil, fmt.Errorf("ssh.ParsePrivateKeyWithPassphrase: %v", err)
+		}
+		return signer, nil
+	}
 	if err != nil {
-		return conf, fmt.Errorf("ssh.ParsePrivateKey: %v", err)
+		return nil, fmt.Errorf("ssh.ParsePrivateKey: %v", err)
 	}
+	return signer, nil
+}
 
-	return ssh.ClientConfig{
-		User:            remoteUser,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: callback,
-	}, nil
+// agentSigners: connect to the ssh-agent listening on SSH_AUTH_SOCK and return a callback listing its signers.
+// The agent connection is held open for the life of the program so signing requests can be made on every dial.
+func agentSigners() (func() ([]ssh.Signer, error), error) {
+	sock, ok := os.LookupEnv("SSH_AUTH_SOCK")
+	if !ok || sock == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set, is ssh-agent running?")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to ssh-agent: %v", err)
+	}
+	return agent.NewClient(conn).Signers, nil
+}
+
+// ParseJumpHost: split a [user@]host[:port] jump host spec into the user and the address to dial.
+// defaultUser is returned if the spec has no user, and port 22 is used if the spec has no port.
+func ParseJumpHost(spec, defaultUser string) (string, string, error) {
+	user := defaultUser
+	addr := spec
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		user, addr = spec[:i], spec[i+1:]
+		if user == "" {
+			return "", "", fmt.Errorf("invalid jump host: %q", spec)
+		}
+	}
+	if addr == "" {
+		return "", "", fmt.Errorf("invalid jump host: %q", spec)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "22")
+	}
+	return user, addr, nil
+}
+
+// SSHHostSettings: the per-host settings read from an OpenSSH client config file.
+// Fields are empty when the config does not set them.
+type SSHHostSettings struct {
+	HostName      string
+	User          string
+	Port          string
+	IdentityFiles []string
+	ProxyJump     string
+}
+
+// SSHConfigFile: a parsed OpenSSH client config, e.g. ~/.ssh/config
+type SSHConfigFile struct {
+	cfg *ssh_config.Config
+}
+
+// LoadSSHConfig: parse the OpenSSH client config at path. A missing file is treated as an empty config.
+func LoadSSHConfig(path string) (*SSHConfigFile, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &SSHConfigFile{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to open ssh config: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	cfg, err := ssh_config.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse ssh config %s: %v", path, err)
+	}
+	return &SSHConfigFile{cfg: cfg}, nil
+}
+
+// Lookup: return the settings that apply to alias, the host name as it appears in the host list.
+func (c *SSHConfigFile) Lookup(alias string) (SSHHostSettings, error) {
+	var settings SSHHostSettings
+	if c.cfg == nil {
+		return settings, nil
+	}
+
+	var err error
+	get := func(key string) string {
+		if err != nil {
+			return ""
+		}
+		var val string
+		val, err = c.cfg.Get(alias, key)
+		return val
+	}
+	settings.HostName = get("HostName")
+	settings.User = get("User")
+	settings.Port = get("Port")
+	settings.ProxyJump = get("ProxyJump")
+	if err != nil {
+		return settings, fmt.Errorf("ssh config lookup for %s: %v", alias, err)
+	}
+	if strings.EqualFold(settings.ProxyJump, "none") {
+		settings.ProxyJump = ""
+	}
+
+	identityFiles, err := c.cfg.GetAll(alias, "IdentityFile")
+	if err != nil {
+		return settings, fmt.Errorf("ssh config lookup for %s: %v", alias, err)
+	}
+	for _, identityFile := range identityFiles {
+		settings.IdentityFiles = append(settings.IdentityFiles, expandSSHPath(identityFile, alias, settings.User))
+	}
+	return settings, nil
+}
+
+// expandSSHPath: expand the leading ~ and the %d, %h, %r and %% tokens OpenSSH allows in IdentityFile.
+func expandSSHPath(path, alias, user string) string {
+	home, _ := os.LookupEnv("HOME")
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = home + path[1:]
+	}
+	return strings.NewReplacer("%d", home, "%h", alias, "%r", user, "%%", "%").Replace(path)
+}
+
+// NewChallengeResponder: answer keyboard-interactive questions, e.g. from PAM 2FA modules.
+// Questions that look like one-time password prompts are answered with a TOTP code when totpSecret is set, questions
+// that look like password prompts are answered with password, and anything else is passed to prompt. Calls to prompt
+// are serialized so concurrent connections do not interleave on the terminal.
+func NewChallengeResponder(
+	password func() (string, error),
+	totpSecret string,
+	prompt func(question string, echo bool) (string, error),
+) ssh.KeyboardInteractiveChallenge {
+	var mu sync.Mutex
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			lower := strings.ToLower(question)
+			var err error
+			switch {
+			case totpSecret != "" && isOTPQuestion(lower):
+				answers[i], err = TOTP(totpSecret, time.Now())
+			case password != nil && strings.Contains(lower, "password"):
+				answers[i], err = password()
+			default:
+				mu.Lock()
+				if instruction != "" {
+					fmt.Fprintln(os.Stderr, instruction)
+				}
+				answers[i], err = prompt(fmt.Sprintf("(%s) %s", user, question), echos[i])
+				mu.Unlock()
+			}
+			if err != nil {
+				return nil, fmt.Errorf("unable to answer %q: %v", question, err)
+			}
+		}
+		return answers, nil
+	}
+}
+
+// isOTPQuestion: report whether a lowercased keyboard-interactive question asks for a one-time password.
+func isOTPQuestion(question string) bool {
+	for _, word := range []string{"passcode", "verification code", "one-time", "otp", "token", "2fa"} {
+		if strings.Contains(question, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// TOTP: return the 6 digit RFC 6238 code for the base32 encoded secret at time t.
+func TOTP(secret string, t time.Time) (string, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %v", err)
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
+
+// Prompt: print question to stderr and read a line from the terminal on stdin, echoing it only if echo is set.
+func Prompt(question string, echo bool) (string, error) {
+	if !echo {
+		answer, err := ReadSecret(question)
+		return string(answer), err
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("stdin is not a terminal, cannot prompt for %q", question)
+	}
+	fmt.Fprint(os.Stderr, question)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// ReadSecret: print prompt to stderr and read a line from the terminal on stdin without echoing it.
+func ReadSecret(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("stdin is not a terminal, cannot prompt for %q", prompt)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	return term.ReadPassword(fd)
 }
 
 // Hosts parsing utilities
@@ -72,46 +683,248 @@ func ParseHostsList(path string, re *regexp.Regexp, formatter func(string) strin
 	return hosts, nil
 }
 
-// Append22: return the host string with `:22` appended if not already present.
-func Append22(host string) string {
-	parts := strings.Split(host, ":")
-	res := host
-	if len(parts) == 1 && parts[0] != "" {
-		res = fmt.Sprintf("%s:%d", host, 22)
-	} else if len(parts) > 1 {
-		last := parts[len(parts)-1]
+// maxCIDRHosts: refuse to expand ranges larger than this, a typo like /8 would otherwise produce millions of hosts
+const maxCIDRHosts = 1 << 16
+
+// ExpandCIDR: expand a host list entry in CIDR notation, optionally followed by :port, into one entry per address.
+// With hostsOnly the network and broadcast addresses of IPv4 prefixes shorter than /31 are skipped. Entries that are
+// not CIDR ranges are returned unchanged.
+func ExpandCIDR(entry string, hostsOnly bool) ([]string, error) {
+	slash := strings.Index(entry, "/")
+	if slash < 0 {
+		return []string{entry}, nil
+	}
+	bits, port := entry[slash+1:], ""
+	if colon := strings.Index(bits, ":"); colon >= 0 {
+		bits, port = bits[:colon], bits[colon+1:]
+	}
+	prefix, err := netip.ParsePrefix(entry[:slash] + "/" + bits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR range %q: %v", entry, err)
+	}
+	prefix = prefix.Masked()
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits > 16 {
+		return nil, fmt.Errorf("CIDR range %q has more than %d addresses", entry, maxCIDRHosts)
+	}
+	skipEdges := hostsOnly && prefix.Addr().Is4() && hostBits > 1
+
+	var hosts []string
+	for addr, i := prefix.Addr(), 0; i < 1<<hostBits; addr, i = addr.Next(), i+1 {
+		if skipEdges && (i == 0 || i == 1<<hostBits-1) {
+			continue
+		}
+		if port != "" {
+			hosts = append(hosts, net.JoinHostPort(addr.String(), port))
+		} else {
+			hosts = append(hosts, addr.String())
+		}
+	}
+	return hosts, nil
+}
+
+// hostPattern: a pdsh style numeric range like [01-20] or [1-3,7], or a brace list like {a,b,c}
+var hostPattern = regexp.MustCompile(`\[([0-9]+(?:-[0-9]+)?(?:,[0-9]+(?:-[0-9]+)?)*)\]|\{([^{}]*,[^{}]*)\}`)
+
+// ExpandHostPattern: expand numeric ranges and brace lists in a host list entry, like clustershell and pdsh, e.g.
+// web[01-20].example.com or db{1,3,5}.example.com. Numeric ranges keep the zero padding of their start. IPv6 literals in
+// brackets are left alone since they always contain a colon.
+func ExpandHostPattern(entry string) ([]string, error) {
+	loc := hostPattern.FindStringSubmatchIndex(entry)
+	if loc == nil {
+		return []string{entry}, nil
+	}
+
+	var items []string
+	if loc[2] >= 0 {
+		for _, part := range strings.Split(entry[loc[2]:loc[3]], ",") {
+			bounds := strings.SplitN(part, "-", 2)
+			lo, _ := strconv.Atoi(bounds[0])
+			hi := lo
+			if len(bounds) == 2 {
+				hi, _ = strconv.Atoi(bounds[1])
+			}
+			if hi < lo || hi-lo >= maxCIDRHosts {
+				return nil, fmt.Errorf("invalid range %q in %q", part, entry)
+			}
+			width := 0
+			if len(bounds[0]) > 1 && bounds[0][0] == '0' {
+				width = len(bounds[0])
+			}
+			for i := lo; i <= hi; i++ {
+				items = append(items, fmt.Sprintf("%0*d", width, i))
+			}
+		}
+	} else {
+		items = strings.Split(entry[loc[4]:loc[5]], ",")
+	}
+
+	var hosts []string
+	for _, item := range items {
+		expanded, err := ExpandHostPattern(entry[:loc[0]] + item + entry[loc[1]:])
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, expanded...)
+	}
+	if len(hosts) > maxCIDRHosts {
+		return nil, fmt.Errorf("%q expands to more than %d hosts", entry, maxCIDRHosts)
+	}
+	return hosts, nil
+}
+
+// WithDefaultPort: return a host list formatter that appends :port to entries without one, keeping any port given.
+// IPv6 literals may be bare, 2001:db8::1, or bracketed, [2001:db8::1] or [2001:db8::1]:2222.
+func WithDefaultPort(port int) func(string) string {
+	return func(host string) string {
+		if addr, err := netip.ParseAddr(host); err == nil && addr.Is6() {
+			return net.JoinHostPort(host, strconv.Itoa(port))
+		}
 		switch {
-		case last == "":
-			res = fmt.Sprintf("%s%d", host, 22)
-		case last != "22":
-			res = fmt.Sprintf("%s:%d", host, 22)
-		default:
+		case host == "":
+			return host
+		case strings.HasSuffix(host, ":"):
+			return fmt.Sprintf("%s%d", host, port)
+		}
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			if _, err := strconv.Atoi(host[i+1:]); err == nil {
+				return host
+			}
 		}
+		return fmt.Sprintf("%s:%d", host, port)
 	}
-	return res
+}
+
+// Append22: return the host string with `:22` appended if it has no port.
+func Append22(host string) string {
+	return WithDefaultPort(22)(host)
 }
 
 // Logging utilities
 
+// log formats accepted by NewLogger
+const (
+	LogText   = "text"
+	LogLogfmt = "logfmt"
+	LogJSON   = "json"
+)
+
+// SyncLogger: a structured logger safe for concurrent use. Key/value pairs passed to each method become fields.
 type SyncLogger struct {
-	Logger *log.Logger
-	mu     sync.Mutex
+	Logger *slog.Logger
+	// FatalExitCode: the exit status used by Fatal, 1 if unset
+	FatalExitCode int
+}
+
+// NewLogger: create a logger writing to w at or above level. The text format is the classic human readable
+// "prefix date time file:line: LEVEL: msg" line, logfmt and json write every field for log collectors to parse.
+func NewLogger(w io.Writer, prefix, format string, level slog.Leveler) (*SyncLogger, error) {
+	opts := &slog.HandlerOptions{AddSource: true, Level: level}
+	var handler slog.Handler
+	switch format {
+	case LogText:
+		handler = &classicHandler{w: w, mu: &sync.Mutex{}, prefix: prefix, level: level}
+	case LogLogfmt:
+		handler = slog.NewTextHandler(w, opts)
+	case LogJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format: %q", format)
+	}
+	return &SyncLogger{Logger: slog.New(handler)}, nil
+}
+
+// log: emit a record attributed to the caller of the level method rather than to SyncLogger itself.
+func (l *SyncLogger) log(level slog.Level, msg string, args []interface{}) {
+	ctx := context.Background()
+	if !l.Logger.Enabled(ctx, level) {
+		return
+	}
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+	record := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	record.Add(args...)
+	_ = l.Logger.Handler().Handle(ctx, record)
 }
 
-func (l *SyncLogger) Info(msg string) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	l.Logger.Printf("INFO: %s", msg)
+func (l *SyncLogger) Debug(msg string, args ...interface{}) {
+	l.log(slog.LevelDebug, msg, args)
+}
+
+func (l *SyncLogger) Info(msg string, args ...interface{}) {
+	l.log(slog.LevelInfo, msg, args)
+}
+
+func (l *SyncLogger) Warn(msg string, args ...interface{}) {
+	l.log(slog.LevelWarn, msg, args)
+}
+
+func (l *SyncLogger) Error(msg string, args ...interface{}) {
+	l.log(slog.LevelError, msg, args)
+}
+
+// Fatal: log msg regardless of level and exit with FatalExitCode.
+func (l *SyncLogger) Fatal(msg string, args ...interface{}) {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+	record := slog.NewRecord(time.Now(), levelFatal, msg, pcs[0])
+	record.Add(args...)
+	_ = l.Logger.Handler().Handle(context.Background(), record)
+	if l.FatalExitCode != 0 {
+		os.Exit(l.FatalExitCode)
+	}
+	os.Exit(1)
+}
+
+// levelFatal: above every level a logger can be configured with, so fatal messages are always written
+const levelFatal = slog.Level(12)
+
+// classicHandler: render records as single log lines in the format used before structured logging.
+// Fields are left out, the message is expected to be self-explanatory.
+type classicHandler struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix string
+	level  slog.Leveler
+}
+
+func (h *classicHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *classicHandler) Handle(_ context.Context, record slog.Record) error {
+	level := record.Level.String()
+	if record.Level >= levelFatal {
+		level = "FATAL"
+	}
+	source := "???:0"
+	if record.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{record.PC}).Next()
+		source = fmt.Sprintf("%s:%d", filepath.Base(frame.File), frame.Line)
+	}
+	line := fmt.Sprintf(
+		"%s%s %s: %s: %s",
+		h.prefix,
+		record.Time.Format("2006/01/02 15:04:05.000000"),
+		source,
+		level,
+		record.Message,
+	)
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line)
+	return err
 }
 
-func (l *SyncLogger) Error(msg string) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	l.Logger.Printf("ERROR: %s", msg)
+func (h *classicHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
 }
 
-func (l *SyncLogger) Fatal(msg string) {
-	// no need to Unlock since logger.Fatalf will call os.Exit(1) and terminate the program
-	l.mu.Lock()
-	l.Logger.Fatalf("FATAL: %s", msg)
+func (h *classicHandler) WithGroup(string) slog.Handler {
+	return h
 }
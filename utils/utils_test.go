@@ -1,17 +1,32 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func TestNewSSHConfig(t *testing.T) {
@@ -26,13 +41,17 @@ func TestNewSSHConfig(t *testing.T) {
 	}
 	_ = ioutil.WriteFile(tempKey, pem.EncodeToMemory(&pkeyPEM), 0600)
 
-	conf, err := NewSSHConfig(false, "/dev/null", tempKey, "foobar")
+	authConf := AuthConfig{Order: []string{AuthKey}, KeyFiles: []string{tempKey}}
+	conf, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 10*time.Second, authConf)
 	if err != nil {
 		t.Fatalf("NewSSHConfig: %v", err)
 	}
 	if got, want := conf.User, "foobar"; got != want {
 		t.Errorf("bad user: %v, want %v", got, want)
 	}
+	if got, want := conf.Timeout, 10*time.Second; got != want {
+		t.Errorf("bad timeout: %v, want %v", got, want)
+	}
 	//pkeySigner, _ := ssh.ParsePrivateKey(pem.EncodeToMemory(&pkeyPEM))
 	//if got, want := conf.Auth[0], ssh.PublicKeys(pkeySigner); got != want {
 	//if diff := cmp.Diff(conf.Auth[0], ssh.PublicKeys(pkeySigner)); diff != "" {
@@ -47,6 +66,464 @@ func TestNewSSHConfig(t *testing.T) {
 	}
 }
 
+func TestNewSSHConfigPassphrase(t *testing.T) {
+	// create temp encrypted private key file
+	tempKey := fmt.Sprintf("%s/temp-encrypted-key.pem", os.TempDir())
+	pkey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pkeyPEM, err := ssh.MarshalPrivateKeyWithPassphrase(pkey, "", []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("ssh.MarshalPrivateKeyWithPassphrase: %v", err)
+	}
+	_ = ioutil.WriteFile(tempKey, pem.EncodeToMemory(pkeyPEM), 0600)
+	defer func() { _ = os.Remove(tempKey) }()
+
+	authConf := func(pass string) AuthConfig {
+		return AuthConfig{
+			Order:      []string{AuthKey},
+			KeyFiles:   []string{tempKey},
+			Passphrase: func(string) ([]byte, error) { return []byte(pass), nil },
+		}
+	}
+
+	if _, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 0, authConf("hunter2")); err != nil {
+		t.Errorf("NewSSHConfig with correct passphrase: %v", err)
+	}
+	if _, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 0, authConf("wrong")); err == nil {
+		t.Errorf("NewSSHConfig should fail with the wrong passphrase")
+	}
+	noPassphrase := AuthConfig{Order: []string{AuthKey}, KeyFiles: []string{tempKey}}
+	if _, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 0, noPassphrase); err == nil {
+		t.Errorf("NewSSHConfig should fail without a passphrase")
+	}
+}
+
+func TestAuthConfigPreload(t *testing.T) {
+	tempKey := filepath.Join(t.TempDir(), "encrypted-key.pem")
+	pkey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pkeyPEM, err := ssh.MarshalPrivateKeyWithPassphrase(pkey, "", []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("ssh.MarshalPrivateKeyWithPassphrase: %v", err)
+	}
+	if err := ioutil.WriteFile(tempKey, pem.EncodeToMemory(pkeyPEM), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	asked := 0
+	authConf := AuthConfig{
+		Order:    []string{AuthKey},
+		KeyFiles: []string{tempKey},
+		Passphrase: func(string) ([]byte, error) {
+			asked++
+			return []byte("hunter2"), nil
+		},
+	}
+	loaded, err := authConf.Preload()
+	if err != nil {
+		t.Fatalf("Preload: %v", err)
+	}
+	if len(loaded.KeyFiles) != 0 || len(loaded.KeySigners) != 1 {
+		t.Fatalf("got key files %v and %d key signers, want the key file loaded", loaded.KeyFiles, len(loaded.KeySigners))
+	}
+	// configs built from the preloaded auth neither read the key file nor ask for its passphrase again
+	if err := os.Remove(tempKey); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		conf, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 0, loaded)
+		if err != nil {
+			t.Fatalf("NewSSHConfig: %v", err)
+		}
+		if len(conf.Auth) != 1 {
+			t.Errorf("got %d auth methods, want 1", len(conf.Auth))
+		}
+	}
+	if asked != 1 {
+		t.Errorf("asked for the passphrase %d times, want once", asked)
+	}
+}
+
+func TestNewSSHConfigPassword(t *testing.T) {
+	authConf := AuthConfig{
+		Order:    []string{AuthKey, AuthPassword},
+		KeyFiles: []string{"/does/not/exist"},
+		Password: func() (string, error) { return "hunter2", nil },
+	}
+	conf, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 0, authConf)
+	if err != nil {
+		t.Fatalf("NewSSHConfig: %v", err)
+	}
+	if got, want := len(conf.Auth), 1; got != want {
+		t.Errorf("bad number of auth methods: %v, want %v", got, want)
+	}
+
+	authConf.Password = func() (string, error) { return "", errors.New("no tty") }
+	if _, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 0, authConf); err == nil {
+		t.Errorf("NewSSHConfig should fail when the password cannot be read")
+	}
+}
+
+func TestNewSSHConfigAgent(t *testing.T) {
+	// serve an in-memory keyring on a temp unix socket
+	pkey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: pkey}); err != nil {
+		t.Fatalf("keyring.Add: %v", err)
+	}
+	sock := fmt.Sprintf("%s/test-agent.sock", os.TempDir())
+	_ = os.Remove(sock)
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = agent.ServeAgent(keyring, conn) }()
+		}
+	}()
+
+	oldSock, hadSock := os.LookupEnv("SSH_AUTH_SOCK")
+	defer func() {
+		if hadSock {
+			_ = os.Setenv("SSH_AUTH_SOCK", oldSock)
+		} else {
+			_ = os.Unsetenv("SSH_AUTH_SOCK")
+		}
+	}()
+
+	authConf := AuthConfig{Order: []string{AuthAgent}}
+	_ = os.Setenv("SSH_AUTH_SOCK", sock)
+	conf, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 0, authConf)
+	if err != nil {
+		t.Fatalf("NewSSHConfig: %v", err)
+	}
+	if got, want := len(conf.Auth), 1; got != want {
+		t.Errorf("bad number of auth methods: %v, want %v", got, want)
+	}
+
+	_ = os.Unsetenv("SSH_AUTH_SOCK")
+	if _, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 0, authConf); err == nil {
+		t.Errorf("NewSSHConfig should fail without SSH_AUTH_SOCK")
+	}
+}
+
+func TestNewSSHConfigOrder(t *testing.T) {
+	// create temp private key files
+	var keyFiles []string
+	for i := 0; i < 2; i++ {
+		tempKey := fmt.Sprintf("%s/temp-key-%d.pem", os.TempDir(), i)
+		pkey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		pkeyPEM := pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pkey)}
+		_ = ioutil.WriteFile(tempKey, pem.EncodeToMemory(&pkeyPEM), 0600)
+		defer func() { _ = os.Remove(tempKey) }()
+		keyFiles = append(keyFiles, tempKey)
+	}
+	keyFiles = append(keyFiles, "/does/not/exist")
+	password := func() (string, error) { return "hunter2", nil }
+
+	for name, test := range map[string]struct {
+		order    []string
+		keyFiles []string
+		want     int
+		wantErr  bool
+	}{
+		"keys only":               {[]string{AuthKey}, keyFiles, 1, false},
+		"password then keys":      {[]string{AuthPassword, AuthKey}, keyFiles, 2, false},
+		"keys then password":      {[]string{AuthKey, AuthPassword}, keyFiles, 2, false},
+		"missing keys":            {[]string{AuthKey}, []string{"/does/not/exist"}, 0, true},
+		"missing keys + password": {[]string{AuthKey, AuthPassword}, []string{"/does/not/exist"}, 1, false},
+		"unknown method":          {[]string{"telepathy"}, keyFiles, 0, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			authConf := AuthConfig{Order: test.order, KeyFiles: test.keyFiles, Password: password}
+			conf, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 0, authConf)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("NewSSHConfig should fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewSSHConfig: %v", err)
+			}
+			if got := len(conf.Auth); got != test.want {
+				t.Errorf("bad number of auth methods: %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewSSHConfigTOFU(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+	authConf := AuthConfig{
+		Order:    []string{AuthPassword},
+		Password: func() (string, error) { return "hunter2", nil },
+	}
+	conf, err := NewSSHConfig(HostKeyTOFU, knownHosts, "foobar", 0, authConf)
+	if err != nil {
+		t.Fatalf("NewSSHConfig: %v", err)
+	}
+	newKey := func() ssh.PublicKey {
+		pkey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		pub, err := ssh.NewPublicKey(&pkey.PublicKey)
+		if err != nil {
+			t.Fatalf("ssh.NewPublicKey: %v", err)
+		}
+		return pub
+	}
+	key, other := newKey(), newKey()
+	remote := fakeAddr{network: "tcp", host: "192.0.2.1:2222"}
+
+	// the first key seen is accepted and recorded, later connections must present it
+	if err := conf.HostKeyCallback("web1:2222", remote, key); err != nil {
+		t.Fatalf("unknown host rejected: %v", err)
+	}
+	if err := conf.HostKeyCallback("web1:2222", remote, key); err != nil {
+		t.Errorf("recorded key rejected: %v", err)
+	}
+	if err := conf.HostKeyCallback("web1:2222", remote, other); err == nil {
+		t.Errorf("changed key accepted")
+	}
+
+	// keys recorded by an earlier run are checked too
+	contents, err := os.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if diff := cmp.Diff(knownhosts.Line([]string{"[web1]:2222"}, key)+"\n", string(contents)); diff != "" {
+		t.Errorf("unexpected known hosts file (-want +got):\n%s", diff)
+	}
+	strict, err := NewSSHConfig(HostKeyStrict, knownHosts, "foobar", 0, authConf)
+	if err != nil {
+		t.Fatalf("NewSSHConfig: %v", err)
+	}
+	if err := strict.HostKeyCallback("web1:2222", remote, key); err != nil {
+		t.Errorf("key recorded on first use rejected by strict checking: %v", err)
+	}
+	if err := strict.HostKeyCallback("web1:2222", remote, other); err == nil {
+		t.Errorf("changed key accepted by strict checking")
+	}
+
+	if _, err := NewSSHConfig("maybe", knownHosts, "foobar", 0, authConf); err == nil {
+		t.Errorf("NewSSHConfig should fail with an unknown host key policy")
+	}
+}
+
+func TestNewSSHConfigAlgorithms(t *testing.T) {
+	authConf := AuthConfig{
+		Order:    []string{AuthPassword},
+		Password: func() (string, error) { return "hunter2", nil },
+	}
+	tests := map[string]struct {
+		algorithms Algorithms
+		wantErr    bool
+	}{
+		"defaults": {},
+		"legacy": {
+			algorithms: Algorithms{
+				Ciphers:           []string{"aes128-cbc", "3des-cbc"},
+				KeyExchanges:      []string{"diffie-hellman-group1-sha1"},
+				MACs:              []string{"hmac-sha1"},
+				HostKeyAlgorithms: []string{ssh.KeyAlgoRSA},
+			},
+		},
+		"modern": {
+			algorithms: Algorithms{
+				Ciphers:      []string{"chacha20-poly1305@openssh.com"},
+				KeyExchanges: []string{"curve25519-sha256"},
+			},
+		},
+		"unknown cipher": {
+			algorithms: Algorithms{Ciphers: []string{"aes128-ctr", "rot13"}},
+			wantErr:    true,
+		},
+		"mac as a cipher": {
+			algorithms: Algorithms{Ciphers: []string{"hmac-sha1"}},
+			wantErr:    true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			conf, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 0, authConf, WithAlgorithms(test.algorithms))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("NewSSHConfig should fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewSSHConfig: %v", err)
+			}
+			got := Algorithms{
+				Ciphers:           conf.Ciphers,
+				KeyExchanges:      conf.KeyExchanges,
+				MACs:              conf.MACs,
+				HostKeyAlgorithms: conf.HostKeyAlgorithms,
+			}
+			if diff := cmp.Diff(test.algorithms, got); diff != "" {
+				t.Errorf("unexpected algorithms (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseAuthOrder(t *testing.T) {
+	got, err := ParseAuthOrder("agent, key,password")
+	if err != nil {
+		t.Fatalf("ParseAuthOrder: %v", err)
+	}
+	if diff := cmp.Diff(got, []string{AuthAgent, AuthKey, AuthPassword}); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+	for _, bad := range []string{"", "agent,agent", "agent,telepathy"} {
+		if _, err := ParseAuthOrder(bad); err == nil {
+			t.Errorf("ParseAuthOrder(%q) should fail", bad)
+		}
+	}
+}
+
+func TestParseJumpHost(t *testing.T) {
+	for spec, want := range map[string][2]string{
+		"bastion":                {"me", "bastion:22"},
+		"bastion:2222":           {"me", "bastion:2222"},
+		"admin@bastion":          {"admin", "bastion:22"},
+		"admin@bastion:2222":     {"admin", "bastion:2222"},
+		"admin@[2001:db8::1]:22": {"admin", "[2001:db8::1]:22"},
+		"[2001:db8::1]":          {"me", "[2001:db8::1]:22"},
+	} {
+		user, addr, err := ParseJumpHost(spec, "me")
+		if err != nil {
+			t.Errorf("ParseJumpHost(%q): %v", spec, err)
+			continue
+		}
+		if diff := cmp.Diff([2]string{user, addr}, want); diff != "" {
+			t.Errorf("ParseJumpHost(%q) diff: %v", spec, diff)
+		}
+	}
+	for _, spec := range []string{"", "admin@", "@bastion"} {
+		if _, _, err := ParseJumpHost(spec, "me"); err == nil {
+			t.Errorf("ParseJumpHost(%q) should fail", spec)
+		}
+	}
+}
+
+func TestLoadSSHConfig(t *testing.T) {
+	config := `
+Host web-*
+  User deploy
+  Port 2222
+  IdentityFile ~/.ssh/web_%h
+  ProxyJump bastion
+
+Host db1
+  HostName 10.0.0.5
+  IdentityFile /keys/db
+  IdentityFile /keys/fallback
+  ProxyJump none
+
+Host *
+  User fallback
+`
+	tempFile := fmt.Sprintf("%s/test-ssh-config", os.TempDir())
+	if err := ioutil.WriteFile(tempFile, []byte(config), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile: %v", err)
+	}
+	defer func() { _ = os.Remove(tempFile) }()
+
+	sshConfig, err := LoadSSHConfig(tempFile)
+	if err != nil {
+		t.Fatalf("LoadSSHConfig: %v", err)
+	}
+	home, _ := os.LookupEnv("HOME")
+	for alias, want := range map[string]SSHHostSettings{
+		"web-1": {
+			User:          "deploy",
+			Port:          "2222",
+			IdentityFiles: []string{home + "/.ssh/web_web-1"},
+			ProxyJump:     "bastion",
+		},
+		"db1": {
+			HostName:      "10.0.0.5",
+			User:          "fallback",
+			IdentityFiles: []string{"/keys/db", "/keys/fallback"},
+		},
+		"other": {User: "fallback"},
+	} {
+		got, err := sshConfig.Lookup(alias)
+		if err != nil {
+			t.Fatalf("Lookup(%s): %v", alias, err)
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("Lookup(%s) diff: %v", alias, diff)
+		}
+	}
+
+	missing, err := LoadSSHConfig("/does/not/exist")
+	if err != nil {
+		t.Fatalf("LoadSSHConfig should ignore a missing file: %v", err)
+	}
+	if got, err := missing.Lookup("web-1"); err != nil || !cmp.Equal(got, SSHHostSettings{}) {
+		t.Errorf("Lookup on a missing config: %v, %v", got, err)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 SHA1 test vectors, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		got, err := TOTP(secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("TOTP: %v", err)
+		}
+		if got != want {
+			t.Errorf("TOTP at %d: %v, want %v", unix, got, want)
+		}
+	}
+	if _, err := TOTP("not base32!", time.Now()); err == nil {
+		t.Errorf("TOTP should fail with an invalid secret")
+	}
+}
+
+func TestChallengeResponder(t *testing.T) {
+	password := func() (string, error) { return "hunter2", nil }
+	var prompted []string
+	prompt := func(question string, echo bool) (string, error) {
+		prompted = append(prompted, question)
+		return "1", nil
+	}
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	challenge := NewChallengeResponder(password, secret, prompt)
+
+	answers, err := challenge("foobar", "", []string{"Password: ", "Passcode or option (1-3): "}, []bool{false, true})
+	if err != nil {
+		t.Fatalf("challenge: %v", err)
+	}
+	code, _ := TOTP(secret, time.Now())
+	if diff := cmp.Diff(answers, []string{"hunter2", code}); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+
+	answers, err = challenge("foobar", "", []string{"Favourite colour? "}, []bool{true})
+	if err != nil {
+		t.Fatalf("challenge: %v", err)
+	}
+	if diff := cmp.Diff(answers, []string{"1"}); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+	if diff := cmp.Diff(prompted, []string{"(foobar) Favourite colour? "}); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+}
+
 func TestParseHostsList(t *testing.T) {
 	// create temp host file
 	hosts := `
@@ -75,6 +552,70 @@ foo bar baz
 	}
 }
 
+func TestExpandCIDR(t *testing.T) {
+	tests := map[string]struct {
+		entry     string
+		hostsOnly bool
+		want      []string
+	}{
+		"not cidr":   {"foo:22", false, []string{"foo:22"}},
+		"slash 30":   {"10.0.0.0/30", false, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		"hosts only": {"10.0.0.0/30", true, []string{"10.0.0.1", "10.0.0.2"}},
+		"slash 31":   {"10.0.0.0/31", true, []string{"10.0.0.0", "10.0.0.1"}},
+		"slash 32":   {"10.0.0.7/32", true, []string{"10.0.0.7"}},
+		"unmasked":   {"10.0.0.5/31", false, []string{"10.0.0.4", "10.0.0.5"}},
+		"port":       {"10.0.0.0/31:2222", false, []string{"10.0.0.0:2222", "10.0.0.1:2222"}},
+		"ipv6":       {"fd00::/127", true, []string{"fd00::", "fd00::1"}},
+		"ipv6 port":  {"fd00::/128:2222", false, []string{"[fd00::]:2222"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ExpandCIDR(tc.entry, tc.hostsOnly)
+			if err != nil {
+				t.Fatalf("ExpandCIDR(%q): %v", tc.entry, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ExpandCIDR(%q) mismatch (-want +got):\n%s", tc.entry, diff)
+			}
+		})
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "foo/24", "10.0.0.0/8"} {
+		if _, err := ExpandCIDR(entry, false); err == nil {
+			t.Errorf("ExpandCIDR(%q) succeeded, want an error", entry)
+		}
+	}
+}
+
+func TestExpandHostPattern(t *testing.T) {
+	tests := map[string][]string{
+		"plain:22":              {"plain:22"},
+		"web[1-3]":              {"web1", "web2", "web3"},
+		"web[08-10].example":    {"web08.example", "web09.example", "web10.example"},
+		"web[1-2,7]":            {"web1", "web2", "web7"},
+		"db{1,3,5}.example.com": {"db1.example.com", "db3.example.com", "db5.example.com"},
+		"{a,b}[1-2]":            {"a1", "a2", "b1", "b2"},
+		"[::1]:22":              {"[::1]:22"},
+		"[fd00::5]":             {"[fd00::5]"},
+	}
+	for entry, want := range tests {
+		got, err := ExpandHostPattern(entry)
+		if err != nil {
+			t.Errorf("ExpandHostPattern(%q): %v", entry, err)
+			continue
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("ExpandHostPattern(%q) mismatch (-want +got):\n%s", entry, diff)
+		}
+	}
+
+	for _, entry := range []string{"web[5-1]", "web[0-99999]", "w[0-999][0-999]"} {
+		if _, err := ExpandHostPattern(entry); err == nil {
+			t.Errorf("ExpandHostPattern(%q) succeeded, want an error", entry)
+		}
+	}
+}
+
 func TestAppend22(t *testing.T) {
 	if got, want := Append22("foo"), "foo:22"; got != want {
 		t.Errorf("got: %v, want %v", got, want)
@@ -91,6 +632,33 @@ func TestAppend22(t *testing.T) {
 	if got, want := Append22(""), ""; got != want {
 		t.Errorf("got: %v, want %v", got, want)
 	}
+	if got, want := Append22("foo:2222"), "foo:2222"; got != want {
+		t.Errorf("got: %v, want %v", got, want)
+	}
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	formatter := WithDefaultPort(2200)
+	tests := map[string]string{
+		"foo":      "foo:2200",
+		"foo:":     "foo:2200",
+		"foo:22":   "foo:22",
+		"foo:2222": "foo:2222",
+		"":         "",
+
+		"2001:db8::1":          "[2001:db8::1]:2200",
+		"fe80::1%eth0":         "[fe80::1%eth0]:2200",
+		"[2001:db8::1]":        "[2001:db8::1]:2200",
+		"[2001:db8::1]:22":     "[2001:db8::1]:22",
+		"[2001:db8::1]:":       "[2001:db8::1]:2200",
+		"::ffff:10.0.0.1":      "[::ffff:10.0.0.1]:2200",
+		"[::ffff:10.0.0.1]:22": "[::ffff:10.0.0.1]:22",
+	}
+	for host, want := range tests {
+		if got := formatter(host); got != want {
+			t.Errorf("WithDefaultPort(2200)(%q) = %q, want %q", host, got, want)
+		}
+	}
 }
 
 type fakeAddr struct {
@@ -105,3 +673,219 @@ func (f fakeAddr) Network() string {
 func (f fakeAddr) String() string {
 	return f.host
 }
+
+func TestSyncLoggerLevels(t *testing.T) {
+	tests := map[string]struct {
+		level slog.Level
+		want  []string
+	}{
+		"debug": {slog.LevelDebug, []string{"DEBUG: d", "INFO: i", "WARN: w", "ERROR: e"}},
+		"info":  {slog.LevelInfo, []string{"INFO: i", "WARN: w", "ERROR: e"}},
+		"warn":  {slog.LevelWarn, []string{"WARN: w", "ERROR: e"}},
+		"error": {slog.LevelError, []string{"ERROR: e"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := NewLogger(&buf, "test: ", LogText, tc.level)
+			if err != nil {
+				t.Fatalf("NewLogger: %v", err)
+			}
+			logger.Debug("d")
+			logger.Info("i")
+			logger.Warn("w")
+			logger.Error("e", "host", "ignored")
+
+			line := regexp.MustCompile(`^test: \S+ \S+ utils_test\.go:\d+: (\w+: \w+)$`)
+			var got []string
+			for _, l := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+				m := line.FindStringSubmatch(l)
+				if m == nil {
+					t.Fatalf("unexpected log line: %q", l)
+				}
+				got = append(got, m[1])
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("SyncLogger output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSyncLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "", LogJSON, slog.LevelInfo)
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	logger.Error("failed", "host", "a:22", "exit_code", 1)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+	delete(record, "time")
+	source, _ := record["source"].(map[string]interface{})
+	if file, _ := source["file"].(string); !strings.HasSuffix(file, "utils_test.go") {
+		t.Errorf("source file = %q, want the caller", file)
+	}
+	delete(record, "source")
+	want := map[string]interface{}{"level": "ERROR", "msg": "failed", "host": "a:22", "exit_code": float64(1)}
+	if diff := cmp.Diff(want, record); diff != "" {
+		t.Errorf("JSON record mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := NewLogger(&buf, "", "xml", slog.LevelInfo); err == nil {
+		t.Error("NewLogger accepted an unknown format")
+	}
+}
+
+func TestVaultClient(t *testing.T) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatalf("ssh.NewSignerFromKey: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+			return
+		}
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("bad request body: %v", err)
+		}
+		switch r.URL.Path {
+		case "/v1/ssh/sign/ops":
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(body["public_key"]))
+			if err != nil {
+				t.Errorf("bad public key: %v", err)
+			}
+			cert := &ssh.Certificate{
+				Key:             pub,
+				CertType:        ssh.UserCert,
+				ValidPrincipals: strings.Split(body["valid_principals"], ","),
+				ValidBefore:     ssh.CertTimeInfinity,
+			}
+			if err := cert.SignCert(rand.Reader, ca); err != nil {
+				t.Errorf("SignCert: %v", err)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"signed_key": string(ssh.MarshalAuthorizedKey(cert))},
+			})
+		case "/v1/ssh/creds/otp":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"key": body["username"] + "@" + body["ip"]},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprint(w, `{"errors": []}`)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("VAULT_ADDR", server.URL+"/")
+	t.Setenv("VAULT_TOKEN", "s.token")
+	client, err := NewVaultClient()
+	if err != nil {
+		t.Fatalf("NewVaultClient: %v", err)
+	}
+
+	signer, err := client.SignKey(context.Background(), "ssh/sign/ops", []string{"deploy"})
+	if err != nil {
+		t.Fatalf("SignKey: %v", err)
+	}
+	cert, ok := signer.PublicKey().(*ssh.Certificate)
+	if !ok {
+		t.Fatalf("SignKey returned a %T signer, want a certificate", signer.PublicKey())
+	}
+	if diff := cmp.Diff([]string{"deploy"}, cert.ValidPrincipals); diff != "" {
+		t.Errorf("principals mismatch (-want +got):\n%s", diff)
+	}
+	conf, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "deploy", 0, AuthConfig{
+		Order:    []string{AuthKey},
+		KeyFiles: []string{"/does/not/exist"},
+		Signers:  []ssh.Signer{signer},
+	})
+	if err != nil {
+		t.Fatalf("NewSSHConfig: %v", err)
+	}
+	if got, want := len(conf.Auth), 1; got != want {
+		t.Errorf("bad number of auth methods: %v, want %v", got, want)
+	}
+
+	otp, err := client.OTP(context.Background(), "ssh/creds/otp", "10.0.0.1", "deploy")
+	if err != nil {
+		t.Fatalf("OTP: %v", err)
+	}
+	if want := "deploy@10.0.0.1"; otp != want {
+		t.Errorf("got one-time password %q, want %q", otp, want)
+	}
+
+	if _, err := client.OTP(context.Background(), "ssh/creds/missing", "10.0.0.1", "deploy"); err == nil {
+		t.Error("OTP succeeded for a missing role")
+	}
+	client.Token = "wrong"
+	if _, err := client.SignKey(context.Background(), "ssh/sign/ops", nil); err == nil ||
+		!strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("SignKey with a bad token returned %v, want permission denied", err)
+	}
+}
+
+func TestFetchSecret(t *testing.T) {
+	// an aws CLI that answers with a canned response for each service
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"$@\" >> \"$(dirname \"$0\")/log\"\ncat \"$(dirname \"$0\")/$1.json\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "aws"), []byte(script), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	pkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	pkeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pkey)})
+	secret, _ := json.Marshal(map[string]string{"SecretString": string(pkeyPEM)})
+	param, _ := json.Marshal(map[string]map[string]string{"Parameter": {"Value": "hunter2"}})
+	for name, b := range map[string][]byte{"secretsmanager": secret, "ssm": param} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".json"), b, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	authConf := AuthConfig{Order: []string{AuthKey}, KeyFiles: []string{"aws-sm://prod/ssh-key"}}
+	conf, err := NewSSHConfig(HostKeyIgnore, "/dev/null", "foobar", 0, authConf)
+	if err != nil {
+		t.Fatalf("NewSSHConfig: %v", err)
+	}
+	if got, want := len(conf.Auth), 1; got != want {
+		t.Errorf("bad number of auth methods: %v, want %v", got, want)
+	}
+
+	got, err := FetchSecret("aws-ssm:///prod/ssh-password")
+	if err != nil {
+		t.Fatalf("FetchSecret: %v", err)
+	}
+	if want := "hunter2"; string(got) != want {
+		t.Errorf("got parameter %q, want %q", got, want)
+	}
+
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	wantLog := "secretsmanager get-secret-value --secret-id prod/ssh-key --output json\n" +
+		"ssm get-parameter --name /prod/ssh-password --with-decryption --output json\n"
+	if diff := cmp.Diff(wantLog, string(log)); diff != "" {
+		t.Errorf("aws arguments mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := FetchSecret("gcp-sm://prod/ssh-key"); err == nil {
+		t.Error("FetchSecret accepted an unknown secret reference")
+	}
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Vault SSH secrets engine utilities
+
+// vaultTimeout: how long a single request to Vault may take
+const vaultTimeout = 30 * time.Second
+
+// VaultClient: a minimal client for the parts of the Vault HTTP API used to fetch short-lived SSH credentials
+type VaultClient struct {
+	Addr      string
+	Token     string
+	Namespace string
+	HTTP      *http.Client
+}
+
+// NewVaultClient: a Vault client configured like the vault CLI, from $VAULT_ADDR, $VAULT_TOKEN or ~/.vault-token, and
+// $VAULT_NAMESPACE.
+func NewVaultClient() (*VaultClient, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		home, _ := os.UserHomeDir()
+		b, err := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+		if err != nil {
+			return nil, fmt.Errorf("VAULT_TOKEN is not set and ~/.vault-token cannot be read: %v", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	return &VaultClient{
+		Addr:      strings.TrimSuffix(addr, "/"),
+		Token:     token,
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+		HTTP:      &http.Client{Timeout: vaultTimeout},
+	}, nil
+}
+
+// write: send body to the Vault API path, e.g. ssh/sign/ops, and decode the data of the response into data.
+func (c *VaultClient) write(ctx context.Context, path string, body, data interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := c.Addr + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", c.Token)
+	if c.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.Namespace)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var reply struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&reply); err != nil {
+		return fmt.Errorf("vault %s: %s", path, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(reply.Errors) > 0 {
+			return fmt.Errorf("vault %s: %s: %s", path, resp.Status, strings.Join(reply.Errors, "; "))
+		}
+		return fmt.Errorf("vault %s: %s", path, resp.Status)
+	}
+	return json.Unmarshal(reply.Data, data)
+}
+
+// SignKey: generate a throwaway key and have the SSH secrets engine sign it at path, e.g. ssh-client-signer/sign/ops,
+// returning a signer presenting the certificate. The key only ever exists in memory. principals may be empty to
+// get the role's default user.
+func (c *VaultClient) SignKey(ctx context.Context, path string, principals []string) (ssh.Signer, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]string{"public_key": string(ssh.MarshalAuthorizedKey(sshPub)), "cert_type": "user"}
+	if len(principals) > 0 {
+		body["valid_principals"] = strings.Join(principals, ",")
+	}
+	var data struct {
+		SignedKey string `json:"signed_key"`
+	}
+	if err := c.write(ctx, path, body, &data); err != nil {
+		return nil, err
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(data.SignedKey))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the signed key: %v", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("vault %s did not return a certificate", path)
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// OTP: a one-time password from the SSH secrets engine at path, e.g. ssh/creds/otp, for user on the host at ip.
+func (c *VaultClient) OTP(ctx context.Context, path, ip, user string) (string, error) {
+	var data struct {
+		Key string `json:"key"`
+	}
+	if err := c.write(ctx, path, map[string]string{"ip": ip, "username": user}, &data); err != nil {
+		return "", err
+	}
+	if data.Key == "" {
+		return "", fmt.Errorf("vault %s did not return a one-time password", path)
+	}
+	return data.Key, nil
+}